@@ -67,7 +67,7 @@ A simple UI interface is available to display network data.`,
 				return err
 			}
 
-			return api.API(ctx, c.String("listen"), 5*time.Second, 20*time.Second, e, bwc, c.Bool("debug"))
+			return api.API(ctx, c.String("listen"), 5*time.Second, 20*time.Second, e, bwc, nil, c.Bool("debug"))
 		},
 	}
 }
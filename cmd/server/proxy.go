@@ -85,7 +85,7 @@ func Proxy() cli.Command {
 				return err
 			}
 
-			return api.API(ctx, c.String("listen"), 5*time.Second, 20*time.Second, e, bwc, c.Bool("debug"))
+			return api.API(ctx, c.String("listen"), 5*time.Second, 20*time.Second, e, bwc, nil, c.Bool("debug"))
 		},
 	}
 }
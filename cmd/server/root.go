@@ -33,7 +33,9 @@ import (
 	"github.com/libp2p/go-libp2p-core/network"
 
 	"github.com/bhojpur/vpn/pkg/api"
+	nodeConfig "github.com/bhojpur/vpn/pkg/config"
 	vpn "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/logger"
 	"github.com/bhojpur/vpn/pkg/node"
 	bvpn "github.com/bhojpur/vpn/pkg/node"
 	"github.com/bhojpur/vpn/pkg/services"
@@ -99,6 +101,21 @@ func MainFlags() []cli.Flag {
 			EnvVar: "ADDRESS",
 			Value:  "10.1.0.1/24",
 		},
+		&cli.StringFlag{
+			Name:   "address6",
+			Usage:  "VPN virtual IPv6 address. Empty to derive an unique local address from the network",
+			EnvVar: "ADDRESS6",
+		},
+		&cli.BoolFlag{
+			Name:   "disable-ipv6",
+			Usage:  "Disables IPv6 addressing on the VPN interface",
+			EnvVar: "DISABLEIPV6",
+		},
+		&cli.BoolFlag{
+			Name:   "disable-relay",
+			Usage:  "Stops relaying the traffic between the peers which can not reach each other directly",
+			EnvVar: "DISABLERELAY",
+		},
 		&cli.StringFlag{
 			Name:   "dns",
 			Usage:  "DNS listening address. Empty to disable dns server",
@@ -135,13 +152,13 @@ func MainFlags() []cli.Flag {
 		},
 		&cli.IntFlag{
 			Name:   "aliveness-healthcheck-scrub-interval",
-			Usage:  "Healthcheck scrub interval",
+			Usage:  "Healthcheck expiry. Time after which the healthcheck of a node not renewing it is dropped from the ledger",
 			EnvVar: "HEALTHCHECKSCRUBINTERVAL",
 			Value:  600,
 		},
 		&cli.IntFlag{
 			Name:   "aliveness-healthcheck-max-interval",
-			Usage:  "Healthcheck max interval. Threshold after a node is determined offline",
+			Usage:  "Healthcheck max interval. Threshold after a node is determined offline, its healthcheck expiring then if the scrub interval is longer",
 			EnvVar: "HEALTHCHECKMAXINTERVAL",
 			Value:  900,
 		},
@@ -153,14 +170,116 @@ func MainFlags() []cli.Flag {
 		},
 		&cli.StringFlag{
 			Name:   "router",
-			Usage:  "Sends all packets to this node",
+			Usage:  "Sends all packets to networks outside of the VPN to this node (deprecated, use exit-node)",
 			EnvVar: "ROUTER",
 		},
+		&cli.BoolFlag{
+			Name:   "host-routes",
+			Usage:  "Routes the networks advertised by the peers and the ones of the exit nodes to the interface, and removes the routes on shutdown. Needs bootstrap-iface",
+			EnvVar: "HOSTROUTES",
+		},
+		&cli.IntFlag{
+			Name:   "route-table",
+			Usage:  "Routing table the host routes are added to, the main one if 0. The default networks of the exit nodes are routed only with a dedicated table",
+			EnvVar: "ROUTETABLE",
+		},
+		&cli.StringFlag{
+			Name:   "route-rule",
+			Usage:  "Routing rule looking up the route table, e.g. priority=1000,from=192.168.1.0/24 or priority=1000,not,fwmark=0x51. No rule is added if empty",
+			EnvVar: "ROUTERULE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "exit-node",
+			Usage:  "Exit node the packets to networks outside of the VPN are routed through, e.g. address=10.1.0.5,priority=10,network=0.0.0.0/0. Among the healthy exit nodes of a network, the one with the lowest priority is used",
+			EnvVar: "EXITNODES",
+		},
+		&cli.IntFlag{
+			Name:   "exit-node-timeout",
+			Usage:  "Time (in seconds) after which an exit node which did not send any healthcheck is considered down",
+			Value:  300,
+			EnvVar: "EXITNODETIMEOUT",
+		},
+		&cli.IntFlag{
+			Name:   "limit-in",
+			Usage:  "Bandwidth limit (in kbit/s) of the packets received from the peers, 0 for no limit",
+			EnvVar: "LIMITIN",
+		},
+		&cli.IntFlag{
+			Name:   "limit-out",
+			Usage:  "Bandwidth limit (in kbit/s) of the packets sent to the peers, 0 for no limit",
+			EnvVar: "LIMITOUT",
+		},
+		&cli.StringSliceFlag{
+			Name:   "peer-limit",
+			Usage:  "Bandwidth limit (in kbit/s) of the packets exchanged with a peer, e.g. peer=12D3KooW...,in=1000,out=500",
+			EnvVar: "PEERLIMITS",
+		},
+		&cli.StringSliceFlag{
+			Name:   "traffic-class",
+			Usage:  "Priority class of the packets of a protocol and port, e.g. class=bulk,protocol=tcp,ports=873. When a limit is reached, the bulk packets leave the bandwidth to the interactive ones, the default",
+			EnvVar: "TRAFFICCLASSES",
+		},
+		&cli.StringSliceFlag{
+			Name:   "advertise-route",
+			Usage:  "List of networks reachable through this node to advertise to the peers, e.g. 192.168.1.0/24",
+			EnvVar: "ADVERTISEROUTES",
+		},
+		&cli.BoolFlag{
+			Name:   "userspace",
+			Usage:  "Runs the VPN over an userspace network stack. Does not require a TUN device nor privileges",
+			EnvVar: "USERSPACE",
+		},
+		&cli.StringFlag{
+			Name:   "userspace-proxy",
+			Usage:  "HTTP proxy listening address to reach the VPN in userspace mode, e.g. 127.0.0.1:8118. Empty to disable",
+			EnvVar: "USERSPACEPROXY",
+		},
+		&cli.IntFlag{
+			Name:   "capture-size",
+			Usage:  "Captures the last packets sent and received through the VPN from startup, downloadable from the API. 0 to disable, at most 65536",
+			EnvVar: "CAPTURESIZE",
+		},
+		&cli.StringFlag{
+			Name:   "compression",
+			Usage:  "Compresses the packets sent to the peers supporting it with the given codec: zstd or snappy. Incompressible packets are sent as is. Disabled if empty",
+			EnvVar: "COMPRESSION",
+		},
+		&cli.StringFlag{
+			Name:   "transport",
+			Usage:  "Carries the packets to the peers with 'stream' or 'datagram' (UDP, falling back to streams for the peers not reachable with it). Defaults to the transport of the network token, written into it with -g",
+			EnvVar: "TRANSPORT",
+		},
+		&cli.StringFlag{
+			Name:   "datagram-address",
+			Usage:  "UDP listening address of the datagram transport, e.g. :5350. A random port if empty",
+			EnvVar: "DATAGRAMADDRESS",
+		},
+		&cli.StringFlag{
+			Name:   "multicast",
+			Usage:  "Replicates the broadcast and multicast packets to the peers: 'all' to send them to all the online peers, 'igmp' to send the multicast ones only to the peers which joined the group. Disabled if empty",
+			EnvVar: "MULTICAST",
+		},
+		&cli.IntFlag{
+			Name:   "multicast-rate",
+			Usage:  "Maximum number of broadcast and multicast packets replicated per second, 0 for no limit",
+			Value:  100,
+			EnvVar: "MULTICASTRATE",
+		},
+		&cli.BoolFlag{
+			Name:   "tap",
+			Usage:  "Creates a TAP interface and bridges the Ethernet frames with the peers in TAP mode, instead of routing IP packets",
+			EnvVar: "TAP",
+		},
 		&cli.StringFlag{
 			Name:   "interface",
 			Usage:  "Interface name",
 			Value:  "bhojpurvpn0",
 			EnvVar: "IFACE",
+		},
+		&cli.StringSliceFlag{
+			Name:   "network",
+			Usage:  "Joins one more network, e.g. name=prod,token=...,address=10.2.0.1/24,interface=bhojpurvpn1. The keys are name, token, config, address, address6, interface and datagram-address, the other settings are shared. When set, the token and config flags are ignored and the DNS server resolves the names of the first network",
+			EnvVar: "NETWORKS",
 		}}, CommonFlags...)
 }
 
@@ -169,6 +288,10 @@ func Main() func(c *cli.Context) error {
 		if c.Bool("g") {
 			// Generates a new config and exit
 			newData := bvpn.GenerateNewConnectionData(c.Int("key-otp-interval"))
+			if err := vpn.ValidateTransport(c.String("transport")); err != nil {
+				return err
+			}
+			newData.Transport = c.String("transport")
 			if c.Bool("b") {
 				fmt.Print(newData.Base64())
 			} else {
@@ -177,69 +300,131 @@ func Main() func(c *cli.Context) error {
 
 			os.Exit(0)
 		}
-		o, vpnOpts, ll := cliToOpts(c)
+		nc, ll := cliToConfig(c)
 
-		// Egress and DHCP needs the Alive service
-		// DHCP needs alive services enabled to all nodes, also those with a static IP.
-		o = append(o,
-			services.Alive(
-				time.Duration(c.Int("aliveness-healthcheck-interval"))*time.Second,
-				time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
-				time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)...)
-
-		if c.Bool("dhcp") {
-			// Adds DHCP server
-			address, _, err := net.ParseCIDR(c.String("address"))
+		networks := []nodeConfig.Network{}
+		for _, n := range c.StringSlice("network") {
+			network, err := nodeConfig.ParseNetwork(n)
 			if err != nil {
 				return err
 			}
-			nodeOpts, vO := vpn.DHCP(ll, 15*time.Minute, c.String("lease-dir"), address.String())
-			o = append(o, nodeOpts...)
-			vpnOpts = append(vpnOpts, vO...)
+			networks = append(networks, network)
+		}
+		if err := nodeConfig.ValidateNetworks(networks); err != nil {
+			return err
 		}
 
-		if c.Bool("egress") {
-			o = append(o, services.Egress(time.Duration(c.Int("egress-announce-time"))*time.Second)...)
+		bwc := metrics.NewBandwidthCounter()
+
+		displayStart(ll)
+
+		ctx := context.Background()
+
+		if c.Bool("transient-conn") {
+			ctx = network.WithUseTransient(ctx, "accept")
 		}
 
-		dns := c.String("dns")
-		if dns != "" {
-			// Adds DNS Server
-			o = append(o,
-				services.DNS(ll, dns,
-					c.Bool("dns-forwarder"),
-					c.StringSlice("dns-forward-server"),
-					c.Int("dns-cache-size"),
-				)...)
+		if len(networks) == 0 {
+			e, ctrl, err := newNetwork(c, nc, ll, c.String("lease-dir"), true, bwc)
+			if err != nil {
+				return err
+			}
+
+			if c.Bool("api") {
+				go api.API(ctx, c.String("api-listen"), 5*time.Second, 20*time.Second, e, bwc, ctrl, c.Bool("debug"))
+			}
+
+			return e.Start(ctx)
+		}
+
+		// Each network has its own node, with its own libp2p host, ledger and message hub:
+		// the stream protocols, the peer ID and the connection gater of a host can't be shared
+		// among networks
+		apiNetworks := []api.Network{}
+		for i, n := range networks {
+			e, ctrl, err := newNetwork(c, n.Apply(nc), ll, filepath.Join(c.String("lease-dir"), n.Name), i == 0, bwc)
+			if err != nil {
+				return fmt.Errorf("network '%s': %w", n.Name, err)
+			}
+			apiNetworks = append(apiNetworks, api.Network{Name: n.Name, Node: e, VPN: ctrl})
 		}
 
-		bwc := metrics.NewBandwidthCounter()
 		if c.Bool("api") {
-			o = append(o, node.WithLibp2pAdditionalOptions(libp2p.BandwidthReporter(bwc)))
+			go api.Networks(ctx, c.String("api-listen"), 5*time.Second, 20*time.Second, bwc, c.Bool("debug"), apiNetworks...)
 		}
 
-		opts, err := vpn.Register(vpnOpts...)
-		if err != nil {
-			return err
+		// The process stops as soon as one of the networks stops
+		errs := make(chan error, len(apiNetworks))
+		for _, n := range apiNetworks {
+			go func(n api.Network) {
+				if err := n.Node.Start(ctx); err != nil {
+					errs <- fmt.Errorf("network '%s': %w", n.Name, err)
+					return
+				}
+				errs <- nil
+			}(n)
 		}
+		return <-errs
+	}
+}
+
+// newNetwork returns the node of a network and the controller of its VPN
+func newNetwork(c *cli.Context, nc nodeConfig.Config, ll *logger.Logger, leaseDir string, dns bool, bwc metrics.Reporter) (*node.Node, *vpn.Controller, error) {
+	o, vpnOpts, err := nc.ToOpts(ll)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		e, err := bvpn.New(append(o, opts...)...)
+	// Egress and DHCP needs the Alive service
+	// DHCP needs alive services enabled to all nodes, also those with a static IP.
+	o = append(o,
+		services.Alive(
+			time.Duration(c.Int("aliveness-healthcheck-interval"))*time.Second,
+			time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
+			time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)...)
+
+	if c.Bool("dhcp") {
+		// Adds DHCP server
+		address, _, err := net.ParseCIDR(nc.Address)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		nodeOpts, vO := vpn.DHCP(ll, 15*time.Minute, leaseDir, address.String())
+		o = append(o, nodeOpts...)
+		vpnOpts = append(vpnOpts, vO...)
+	}
 
-		displayStart(ll)
+	if c.Bool("egress") {
+		o = append(o, services.Egress(time.Duration(c.Int("egress-announce-time"))*time.Second)...)
+	}
 
-		ctx := context.Background()
+	listen := c.String("dns")
+	if dns && listen != "" {
+		// Adds DNS Server
+		o = append(o,
+			services.DNS(ll, listen,
+				c.Bool("dns-forwarder"),
+				c.StringSlice("dns-forward-server"),
+				c.Int("dns-cache-size"),
+			)...)
+	}
 
-		if c.Bool("transient-conn") {
-			ctx = network.WithUseTransient(ctx, "accept")
-		}
+	if c.Bool("api") {
+		o = append(o, node.WithLibp2pAdditionalOptions(libp2p.BandwidthReporter(bwc)))
+	}
 
-		if c.Bool("api") {
-			go api.API(ctx, c.String("api-listen"), 5*time.Second, 20*time.Second, e, bwc, c.Bool("debug"))
-		}
+	ctrl := vpn.NewController()
+	vpnOpts = append(vpnOpts, vpn.WithController(ctrl))
 
-		return e.Start(ctx)
+	opts, err := vpn.Register(vpnOpts...)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	e, err := bvpn.New(append(o, opts...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return e, ctrl, nil
 }
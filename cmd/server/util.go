@@ -67,7 +67,7 @@ var CommonFlags []cli.Flag = []cli.Flag{
 	},
 	&cli.IntFlag{
 		Name:   "channel-buffer-size",
-		Usage:  "Specify a channel buffer size",
+		Usage:  "Specify the size of the queue of each worker, the packets are dropped while it is full (0 for 256)",
 		EnvVar: "BHOJPUR_VPN_CHANNEL_BUFFERSIZE",
 		Value:  0,
 	},
@@ -129,6 +129,11 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage:  "Specify a ledger state directory",
 		EnvVar: "BHOJPUR_VPN_LEDGERSTATE",
 	},
+	&cli.BoolFlag{
+		Name:   "ledger-accept-unsigned",
+		Usage:  "Accept the writes to the ledger of the nodes which don't sign them (older versions), while upgrading a network",
+		EnvVar: "BHOJPUR_VPN_LEDGERACCEPTUNSIGNED",
+	},
 	&cli.BoolTFlag{
 		Name:   "mdns",
 		Usage:  "Enable mDNS for peer discovery",
@@ -355,6 +360,18 @@ func displayStart(ll *logger.Logger) {
 }
 
 func cliToOpts(c *cli.Context) ([]node.Option, []vpn.Option, *logger.Logger) {
+	nc, llger := cliToConfig(c)
+
+	nodeOpts, vpnOpts, err := nc.ToOpts(llger)
+	if err != nil {
+		llger.Fatal(err.Error())
+	}
+
+	return nodeOpts, vpnOpts, llger
+}
+
+// cliToConfig returns the configuration of the node from the flags
+func cliToConfig(c *cli.Context) (nodeConfig.Config, *logger.Logger) {
 
 	var limitConfig *node.NetLimitConfig
 
@@ -389,6 +406,18 @@ func cliToOpts(c *cli.Context) ([]node.Option, []vpn.Option, *logger.Logger) {
 		NetworkConfig:     c.String("config"),
 		NetworkToken:      c.String("token"),
 		Address:           c.String("address"),
+		Address6:          c.String("address6"),
+		DisableIPv6:       c.Bool("disable-ipv6"),
+		DisableRelay:      c.Bool("disable-relay"),
+		Userspace:         c.Bool("userspace"),
+		UserspaceProxy:    c.String("userspace-proxy"),
+		CaptureSize:       c.Int("capture-size"),
+		Multicast:         c.String("multicast"),
+		Compression:       c.String("compression"),
+		Transport:         c.String("transport"),
+		DatagramAddress:   c.String("datagram-address"),
+		MulticastRate:     c.Int("multicast-rate"),
+		TAP:               c.Bool("tap"),
 		Router:            c.String("router"),
 		Interface:         c.String("interface"),
 		Libp2pLogLevel:    c.String("libp2p-log-level"),
@@ -396,16 +425,27 @@ func cliToOpts(c *cli.Context) ([]node.Option, []vpn.Option, *logger.Logger) {
 		LowProfile:        c.Bool("low-profile"),
 		VPNLowProfile:     c.Bool("low-profile-vpn"),
 		Blacklist:         c.StringSlice("blacklist"),
+		Routes:            c.StringSlice("advertise-route"),
+		ExitNodes:         c.StringSlice("exit-node"),
+		LimitIn:           c.Int("limit-in"),
+		LimitOut:          c.Int("limit-out"),
+		PeerLimits:        c.StringSlice("peer-limit"),
+		TrafficClasses:    c.StringSlice("traffic-class"),
+		ExitNodeTimeout:   time.Duration(c.Int("exit-node-timeout")) * time.Second,
 		Concurrency:       c.Int("concurrency"),
 		FrameTimeout:      c.String("timeout"),
 		ChannelBufferSize: c.Int("channel-buffer-size"),
 		InterfaceMTU:      c.Int("mtu"),
 		PacketMTU:         c.Int("packet-mtu"),
 		BootstrapIface:    c.Bool("bootstrap-iface"),
+		HostRoutes:        c.Bool("host-routes"),
+		RouteTable:        c.Int("route-table"),
+		RoutingRule:       c.String("route-rule"),
 		Ledger: config.Ledger{
 			StateDir:         c.String("ledger-state"),
 			AnnounceInterval: time.Duration(c.Int("ledger-announce-interval")) * time.Second,
 			SyncInterval:     time.Duration(c.Int("ledger-syncronization-interval")) * time.Second,
+			AcceptUnsigned:   c.Bool("ledger-accept-unsigned"),
 		},
 		NAT: config.NAT{
 			Service:           c.Bool("natservice"),
@@ -454,10 +494,5 @@ func cliToOpts(c *cli.Context) ([]node.Option, []vpn.Option, *logger.Logger) {
 	}
 	llger := logger.New(lvl)
 
-	nodeOpts, vpnOpts, err := nc.ToOpts(llger)
-	if err != nil {
-		llger.Fatal(err.Error())
-	}
-
-	return nodeOpts, vpnOpts, llger
+	return nc, llger
 }
@@ -3,12 +3,16 @@ package api
 import (
 	"context"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +24,8 @@ import (
 	apiTypes "github.com/bhojpur/vpn/pkg/api/types"
 	"github.com/miekg/dns"
 
+	"github.com/bhojpur/vpn/pkg/crypto"
+	"github.com/bhojpur/vpn/pkg/engine"
 	"github.com/bhojpur/vpn/pkg/node"
 	"github.com/bhojpur/vpn/pkg/protocol"
 	"github.com/bhojpur/vpn/pkg/services"
@@ -50,13 +56,43 @@ const (
 	NodesURL      = "/api/nodes"
 	DNSURL        = "/api/dns"
 	MetricsURL    = "/api/metrics"
+	VPNMetricsURL = "/api/metrics/vpn"
 	PeerstoreURL  = "/api/peerstore"
 	PeerGateURL   = "/api/peergate"
+	RoutesURL     = "/api/routes"
+	ACLURL        = "/api/acl"
+	CaptureURL    = "/api/capture"
+	PathsURL      = "/api/paths"
+	ExitNodesURL  = "/api/exitnodes"
+	ShapingURL    = "/api/shaping"
+	InterfaceURL  = "/api/interface"
+	NetworksURL   = "/api/networks"
+	BridgeURL     = "/api/bridge"
+	ProvenanceURL = "/api/provenance"
+	EventsURL     = "/api/events"
 )
 
-func API(ctx context.Context, l string, defaultInterval, timeout time.Duration, e *node.Node, bwc metrics.Reporter, debugMode bool) error {
+// DefaultNetwork is the name of the network served by API
+const DefaultNetwork = "default"
 
-	ledger, _ := e.Ledger()
+// Network is one of the networks joined by the process
+type Network struct {
+	Name string
+	Node *node.Node
+	VPN  *engine.Controller
+}
+
+func API(ctx context.Context, l string, defaultInterval, timeout time.Duration, e *node.Node, bwc metrics.Reporter, vpn *engine.Controller, debugMode bool) error {
+	return Networks(ctx, l, defaultInterval, timeout, bwc, debugMode, Network{Name: DefaultNetwork, Node: e, VPN: vpn})
+}
+
+// Networks serves the API of several networks. The routes of each network are
+// under /api/networks/<name>, and the ones of the first network are also served
+// under /api as when joining a single network
+func Networks(ctx context.Context, l string, defaultInterval, timeout time.Duration, bwc metrics.Reporter, debugMode bool, networks ...Network) error {
+	if len(networks) == 0 {
+		return errors.New("no network to serve")
+	}
 
 	ec := echo.New()
 
@@ -90,6 +126,215 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 			return c.JSON(http.StatusOK, bwc.GetBandwidthForProtocol(p2pprotocol.ID(c.Param("protocol"))))
 		})
 	}
+	ec.GET(NetworksURL, func(c echo.Context) error {
+		list := []apiTypes.Network{}
+		for _, n := range networks {
+			network := apiTypes.Network{Name: n.Name}
+			if h := n.Node.Host(); h != nil {
+				network.NodeID = h.ID().String()
+			}
+			if n.VPN != nil {
+				network.Interface = n.VPN.InterfaceName()
+				network.Address = n.VPN.Interface().Address
+			}
+			list = append(list, network)
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	for _, n := range networks {
+		networkRoutes(&prefixRouter{ec, fmt.Sprintf("%s/%s", NetworksURL, n.Name)}, n, defaultInterval, timeout)
+	}
+	networkRoutes(ec, networks[0], defaultInterval, timeout)
+
+	ec.GET("/*", echo.WrapHandler(http.StripPrefix("/", assetHandler)))
+
+	ec.HideBanner = true
+
+	if err := ec.Start(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ct, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ec.Shutdown(ct)
+		cancel()
+	}()
+
+	return nil
+}
+
+// router is implemented by echo, and by prefixRouter for the routes of each network
+type router interface {
+	GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	PUT(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	DELETE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
+// prefixRouter replaces the /api prefix of the routes
+type prefixRouter struct {
+	ec     *echo.Echo
+	prefix string
+}
+
+func (r *prefixRouter) path(p string) string {
+	return r.prefix + strings.TrimPrefix(p, "/api")
+}
+
+func (r *prefixRouter) GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return r.ec.GET(r.path(path), h, m...)
+}
+
+func (r *prefixRouter) PUT(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return r.ec.PUT(r.path(path), h, m...)
+}
+
+func (r *prefixRouter) POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return r.ec.POST(r.path(path), h, m...)
+}
+
+func (r *prefixRouter) DELETE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
+	return r.ec.DELETE(r.path(path), h, m...)
+}
+
+// networkRoutes registers the routes which read or change the state of a network
+func networkRoutes(ec router, n Network, defaultInterval, timeout time.Duration) {
+	e, vpn := n.Node, n.VPN
+	ledger, _ := e.Ledger()
+
+	if vpn != nil {
+		ec.GET(VPNMetricsURL, func(c echo.Context) error {
+			return c.JSON(http.StatusOK, vpn.Metrics())
+		})
+		ec.GET(filepath.Join(VPNMetricsURL, "peer", ":peer"), func(c echo.Context) error {
+			m, found := vpn.PeerMetrics(c.Param("peer"))
+			if !found {
+				return echo.NewHTTPError(http.StatusNotFound, "no traffic from or to the peer")
+			}
+			return c.JSON(http.StatusOK, m)
+		})
+		ec.GET(filepath.Join(VPNMetricsURL, "scheduler"), func(c echo.Context) error {
+			return c.JSON(http.StatusOK, vpn.SchedulerStats())
+		})
+
+		// The path used to reach each peer, directly or through a relay
+		ec.GET(PathsURL, func(c echo.Context) error {
+			return c.JSON(http.StatusOK, vpn.Paths())
+		})
+
+		// The MAC addresses learned in TAP mode, and the peers they are behind
+		ec.GET(BridgeURL, func(c echo.Context) error {
+			return c.JSON(http.StatusOK, vpn.Bridge())
+		})
+
+		// The exit nodes of each network, and the ones in use
+		ec.GET(ExitNodesURL, func(c echo.Context) error {
+			return c.JSON(http.StatusOK, vpn.ExitNodes())
+		})
+
+		// The addresses, MTU and advertised routes of the interface, changed without restarting
+		ec.GET(InterfaceURL, func(c echo.Context) error {
+			return c.JSON(http.StatusOK, vpn.Interface())
+		})
+		ec.PUT(InterfaceURL, func(c echo.Context) error {
+			cfg := engine.InterfaceConfig{}
+			if err := c.Bind(&cfg); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if err := vpn.Reconfigure(cfg); err != nil {
+				if errors.Is(err, engine.ErrNotRunning) {
+					return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+				}
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			return c.JSON(http.StatusOK, vpn.Interface())
+		})
+
+		// Bandwidth limits, global and per peer
+		ec.GET(ShapingURL, func(c echo.Context) error {
+			return c.JSON(http.StatusOK, vpn.Shaping())
+		})
+		ec.PUT(ShapingURL, func(c echo.Context) error {
+			s := engine.Shaping{}
+			if err := c.Bind(&s); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if err := vpn.SetShaping(s); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			return c.JSON(http.StatusOK, vpn.Shaping())
+		})
+		ec.PUT(fmt.Sprintf("%s/peers/:peer", ShapingURL), func(c echo.Context) error {
+			l := engine.Limit{}
+			for _, r := range []struct {
+				param string
+				rate  *int
+			}{{"in", &l.In}, {"out", &l.Out}} {
+				if v := c.QueryParam(r.param); v != "" {
+					i, err := strconv.Atoi(v)
+					if err != nil || i < 0 {
+						return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s limit", r.param))
+					}
+					*r.rate = i
+				}
+			}
+			if err := vpn.SetPeerLimit(c.Param("peer"), l); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			return c.JSON(http.StatusOK, vpn.Shaping())
+		})
+		ec.DELETE(fmt.Sprintf("%s/peers/:peer", ShapingURL), func(c echo.Context) error {
+			if err := vpn.SetPeerLimit(c.Param("peer"), engine.Limit{}); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			return c.JSON(http.StatusOK, vpn.Shaping())
+		})
+
+		// Packet capture. The captured packets are downloaded in the pcapng format, and can be selected
+		// with a time window (since and until, either RFC3339 times or durations ago) and a filter
+		ec.GET(CaptureURL, func(c echo.Context) error {
+			f, err := engine.ParseCaptureFilter(c.QueryParam("filter"))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if f.Since, err = parseTime(c.QueryParam("since")); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if f.Until, err = parseTime(c.QueryParam("until")); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if !vpn.Capturing() {
+				return echo.NewHTTPError(http.StatusNotFound, engine.ErrNoCapture.Error())
+			}
+
+			c.Response().Header().Set(echo.HeaderContentType, "application/x-pcapng")
+			c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=capture.pcapng")
+			c.Response().WriteHeader(http.StatusOK)
+			return vpn.WriteCapture(c.Response(), f)
+		})
+		ec.PUT(CaptureURL, func(c echo.Context) error {
+			size := engine.DefaultCaptureSize
+			if s := c.QueryParam("size"); s != "" {
+				i, err := strconv.Atoi(s)
+				if err != nil || i < 1 {
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid size")
+				}
+				if i > engine.MaxCaptureSize {
+					return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("size above the maximum of %d packets", engine.MaxCaptureSize))
+				}
+				size = i
+			}
+			vpn.StartCapture(size)
+			return c.JSON(http.StatusOK, vpn.Capturing())
+		})
+		ec.DELETE(CaptureURL, func(c echo.Context) error {
+			vpn.StopCapture()
+			return c.JSON(http.StatusOK, vpn.Capturing())
+		})
+	}
+
 	// Get data from ledger
 	ec.GET(FileURL, func(c echo.Context) error {
 		list := []*types.File{}
@@ -134,6 +379,18 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 
 		blockchain := ledger.Index()
 
+		vpnSummary := types.VPNSummary{}
+		if vpn != nil {
+			m := vpn.Metrics()
+			vpnSummary = types.VPNSummary{
+				PacketsIn:  m.PacketsIn,
+				PacketsOut: m.PacketsOut,
+				BytesIn:    m.BytesIn,
+				BytesOut:   m.BytesOut,
+				Dropped:    m.Dropped,
+			}
+		}
+
 		return c.JSON(http.StatusOK, types.Summary{
 			Files:        files,
 			Machines:     machines,
@@ -143,6 +400,7 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 			OnChainNodes: onChainNodes,
 			Peers:        p2pPeers,
 			NodeID:       nodeID,
+			VPN:          vpnSummary,
 		})
 	})
 
@@ -216,6 +474,32 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		return c.JSON(http.StatusOK, list)
 	})
 
+	ec.GET(RoutesURL, func(c echo.Context) error {
+		list := []*types.Route{}
+		for _, v := range ledger.CurrentData()[protocol.RoutesLedgerKey] {
+			r := &types.Route{}
+			v.Unmarshal(r)
+			list = append(list, r)
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	ec.GET(ACLURL, func(c echo.Context) error {
+		list := []*types.ACLRule{}
+		for _, v := range ledger.CurrentData()[protocol.ACLLedgerKey] {
+			r := &types.ACLRule{}
+			v.Unmarshal(r)
+			list = append(list, r)
+		}
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Priority != list[j].Priority {
+				return list[i].Priority < list[j].Priority
+			}
+			return list[i].ID < list[j].ID
+		})
+		return c.JSON(http.StatusOK, list)
+	})
+
 	ec.GET(UsersURL, func(c echo.Context) error {
 		user := []*types.User{}
 		for _, v := range ledger.CurrentData()[protocol.UsersLedgerKey] {
@@ -236,8 +520,6 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		return c.JSON(http.StatusOK, list)
 	})
 
-	ec.GET("/*", echo.WrapHandler(http.StripPrefix("/", assetHandler)))
-
 	ec.GET(BlockchainURL, func(c echo.Context) error {
 		return c.JSON(http.StatusOK, ledger.LastBlock())
 	})
@@ -257,6 +539,56 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		return c.JSON(http.StatusOK, ledger.CurrentData()[bucket])
 	})
 
+	// The peer which last wrote (or deleted) each key, as signed in the ledger
+	ec.GET(fmt.Sprintf("%s/:bucket", ProvenanceURL), func(c echo.Context) error {
+		return c.JSON(http.StatusOK, ledger.Provenance(c.Param("bucket")))
+	})
+
+	ec.GET(fmt.Sprintf("%s/:bucket/:key", ProvenanceURL), func(c echo.Context) error {
+		p, exists := ledger.Provenance(c.Param("bucket"))[c.Param("key")]
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "key not found")
+		}
+		return c.JSON(http.StatusOK, p)
+	})
+
+	// The changes of the ledger as server-sent events, of a bucket and of a key if given.
+	// The keys in the ledger are sent first
+	ec.GET(EventsURL, func(c echo.Context) error {
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+		events := ledger.Watch(ctx, c.QueryParam("bucket"), c.QueryParam("key"))
+
+		w := c.Response()
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		w.Header().Set(echo.HeaderCacheControl, "no-cache")
+		w.WriteHeader(http.StatusOK)
+		w.Flush()
+
+		keepalive := time.NewTicker(defaultInterval)
+		defer keepalive.Stop()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return nil
+				}
+				dat, err := json.Marshal(ev)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, dat); err != nil {
+					return nil
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return nil
+				}
+			}
+			w.Flush()
+		}
+	})
+
 	announcing := struct{ State string }{"Announcing"}
 
 	// Store arbitrary data
@@ -304,6 +636,28 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		return c.JSON(http.StatusOK, announcing)
 	})
 
+	// Announce an ACL rule, replacing the one with the same ID
+	ec.POST(ACLURL, func(c echo.Context) error {
+		r := new(types.ACLRule)
+		if err := c.Bind(r); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := engine.ValidateACLRule(*r); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if r.ID == "" {
+			r.ID = crypto.MD5(fmt.Sprintf("%d/%s/%s/%s/%s/%s", r.Priority, r.Action, r.Source, r.Destination, r.Protocol, r.Ports))
+		}
+
+		ledger.Persist(context.Background(), defaultInterval, timeout, protocol.ACLLedgerKey, r.ID, r)
+		return c.JSON(http.StatusOK, announcing)
+	})
+
+	ec.DELETE(fmt.Sprintf("%s/:id", ACLURL), func(c echo.Context) error {
+		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, protocol.ACLLedgerKey, c.Param("id"))
+		return c.JSON(http.StatusOK, announcing)
+	})
+
 	// Delete data from ledger
 	ec.DELETE(fmt.Sprintf("%s/:bucket", LedgerURL), func(c echo.Context) error {
 		bucket := c.Param("bucket")
@@ -319,19 +673,20 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 		ledger.AnnounceDeleteBucketKey(context.Background(), defaultInterval, timeout, bucket, key)
 		return c.JSON(http.StatusOK, announcing)
 	})
+}
 
-	ec.HideBanner = true
-
-	if err := ec.Start(l); err != nil && err != http.ErrServerClosed {
-		return err
+// parseTime parses either a RFC3339 time, or a duration which is subtracted from the current time.
+// An empty string is parsed as the zero time
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
 	}
-
-	go func() {
-		<-ctx.Done()
-		ct, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		ec.Shutdown(ct)
-		cancel()
-	}()
-
-	return nil
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time '%s'", s)
+	}
+	return t, nil
 }
@@ -31,6 +31,7 @@ import (
 	. "github.com/bhojpur/vpn/pkg/api"
 	client "github.com/bhojpur/vpn/pkg/api/client"
 	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/engine"
 	"github.com/bhojpur/vpn/pkg/logger"
 	"github.com/bhojpur/vpn/pkg/node"
 	"github.com/ipfs/go-log"
@@ -62,7 +63,7 @@ var _ = Describe("API", func() {
 			e2.Start(ctx)
 
 			go func() {
-				err := API(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, e, nil, false)
+				err := API(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, e, nil, nil, false)
 				Expect(err).ToNot(HaveOccurred())
 			}()
 
@@ -82,6 +83,97 @@ var _ = Describe("API", func() {
 				d.Unmarshal(&s)
 				return s
 			}, 10*time.Second, 1*time.Second).Should(Equal("bar"))
+
+			events, err := c.Watch(ctx, "b", "f")
+			Expect(err).ToNot(HaveOccurred())
+			var ev blockchain.Event
+			Eventually(events, 10*time.Second).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(blockchain.EventPut))
+			ledger, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			value, _ := ledger.GetKey("b", "f")
+			Expect(ev.New).To(Equal(value))
+
+			Expect(c.Delete("b", "f")).To(Succeed())
+			Eventually(events, 30*time.Second).Should(Receive(&ev))
+			Expect(ev.Type).To(Equal(blockchain.EventDelete))
+			Expect(ev.Old).To(Equal(value))
+		})
+	})
+
+	Context("Captures packets", func() {
+		It("refuses the captures above the maximum size", func() {
+			d, _ := ioutil.TempDir("", "xxx")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+			e, _ := node.New(node.FromBase64(true, true, node.GenerateNewConnectionData().Base64()), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+
+			vpn := engine.NewController()
+			go func() {
+				err := API(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, e, nil, vpn, false)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+
+			c := client.NewClient(client.WithHost("unix://" + socket))
+			Eventually(func() error {
+				return c.StartCapture(engine.MaxCaptureSize)
+			}, 10*time.Second, 1*time.Second).ShouldNot(HaveOccurred())
+			Expect(vpn.Capturing()).To(BeTrue())
+
+			Expect(c.StopCapture()).To(Succeed())
+			Expect(c.StartCapture(engine.MaxCaptureSize + 1)).To(MatchError(ContainSubstring("400")))
+			Expect(vpn.Capturing()).To(BeFalse())
+		})
+	})
+
+	Context("Serves several networks", func() {
+		It("namespaces the routes of each network", func() {
+			d, _ := ioutil.TempDir("", "xxx")
+			defer os.RemoveAll(d)
+			socket := filepath.Join(d, "socket")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			l := node.Logger(logger.New(log.LevelFatal))
+
+			e, _ := node.New(node.FromBase64(true, true, node.GenerateNewConnectionData().Base64()), node.WithStore(&blockchain.MemoryStore{}), l)
+			e.Start(ctx)
+
+			e2, _ := node.New(node.FromBase64(true, true, node.GenerateNewConnectionData().Base64()), node.WithStore(&blockchain.MemoryStore{}), l)
+			e2.Start(ctx)
+
+			go func() {
+				err := Networks(ctx, fmt.Sprintf("unix://%s", socket), 10*time.Second, 20*time.Second, nil, false,
+					Network{Name: "a", Node: e}, Network{Name: "b", Node: e2})
+				Expect(err).ToNot(HaveOccurred())
+			}()
+
+			a := client.NewClient(client.WithHost("unix://"+socket), client.WithNetwork("a"))
+			b := client.NewClient(client.WithHost("unix://"+socket), client.WithNetwork("b"))
+			first := client.NewClient(client.WithHost("unix://" + socket))
+
+			Eventually(func() error {
+				return b.Put("b", "f", "bar")
+			}, 10*time.Second, 1*time.Second).ShouldNot(HaveOccurred())
+
+			Eventually(b.GetBuckets, 100*time.Second, 1*time.Second).Should(ContainElement("b"))
+			Consistently(a.GetBuckets, 5*time.Second, 1*time.Second).ShouldNot(ContainElement("b"))
+			Expect(first.GetBuckets()).ToNot(ContainElement("b"))
+
+			networks, err := first.Networks()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(networks).To(HaveLen(2))
+			Expect(networks[0].Name).To(Equal("a"))
+			Expect(networks[0].NodeID).To(Equal(e.Host().ID().String()))
+			Expect(networks[1].Name).To(Equal("b"))
+			Expect(networks[1].NodeID).To(Equal(e2.Host().ID().String()))
 		})
 	})
 })
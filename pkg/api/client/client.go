@@ -21,10 +21,13 @@ package client
 // THE SOFTWARE.
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -32,13 +35,16 @@ import (
 	"time"
 
 	"github.com/bhojpur/vpn/pkg/api"
+	apiTypes "github.com/bhojpur/vpn/pkg/api/types"
 	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/engine"
 	"github.com/bhojpur/vpn/pkg/types"
 )
 
 type (
 	Client struct {
 		host       string
+		network    string
 		httpClient *http.Client
 	}
 )
@@ -75,6 +81,14 @@ func WithHTTPClient(cl *http.Client) func(c *Client) error {
 	}
 }
 
+// WithNetwork selects one of the networks joined by the API daemon
+func WithNetwork(name string) func(c *Client) error {
+	return func(c *Client) error {
+		c.network = name
+		return nil
+	}
+}
+
 type Option func(c *Client) error
 
 func NewClient(o ...Option) *Client {
@@ -87,8 +101,16 @@ func NewClient(o ...Option) *Client {
 	return c
 }
 
+// url returns the URL of the endpoint in the network of the client
+func (c *Client) url(endpoint string) string {
+	if c.network != "" {
+		endpoint = fmt.Sprintf("%s/%s%s", api.NetworksURL, c.network, strings.TrimPrefix(endpoint, "/api"))
+	}
+	return fmt.Sprintf("%s%s", c.host, endpoint)
+}
+
 func (c *Client) do(method, endpoint string, params map[string]string) (*http.Response, error) {
-	baseURL := fmt.Sprintf("%s%s", c.host, endpoint)
+	baseURL := c.url(endpoint)
 
 	req, err := http.NewRequest(method, baseURL, nil)
 	if err != nil {
@@ -103,6 +125,20 @@ func (c *Client) do(method, endpoint string, params map[string]string) (*http.Re
 	return c.httpClient.Do(req)
 }
 
+// doJSON sends v as the JSON body of the request
+func (c *Client) doJSON(method, endpoint string, v interface{}) (*http.Response, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, c.url(endpoint), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	return c.httpClient.Do(req)
+}
+
 // Get methods (Services, Users, Files, Ledger, Blockchain, Machines)
 func (c *Client) Services() (resp []types.Service, err error) {
 	res, err := c.do(http.MethodGet, api.ServiceURL, nil)
@@ -216,6 +252,239 @@ func (c *Client) Machines() (resp []types.Machine, err error) {
 	return
 }
 
+// Networks returns the networks joined by the API daemon, whichever network the client selected
+func (c *Client) Networks() (resp []apiTypes.Network, err error) {
+	res, err := c.httpClient.Get(fmt.Sprintf("%s%s", c.host, api.NetworksURL))
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Routes() (resp []types.Route, err error) {
+	res, err := c.do(http.MethodGet, api.RoutesURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) ACL() (resp []types.ACLRule, err error) {
+	res, err := c.do(http.MethodGet, api.ACLURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) VPNMetrics() (resp engine.Metrics, err error) {
+	res, err := c.do(http.MethodGet, api.VPNMetricsURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Paths returns the path used to reach each peer, directly or through a relay
+func (c *Client) Paths() (resp []engine.Path, err error) {
+	res, err := c.do(http.MethodGet, api.PathsURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+func (c *Client) Bridge() (resp []engine.BridgeEntry, err error) {
+	res, err := c.do(http.MethodGet, api.BridgeURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// ExitNodes returns the state of the exit nodes of each network
+func (c *Client) ExitNodes() (resp []engine.ExitNodeStatus, err error) {
+	res, err := c.do(http.MethodGet, api.ExitNodesURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Interface returns the configuration of the VPN interface
+func (c *Client) Interface() (resp engine.InterfaceConfig, err error) {
+	res, err := c.do(http.MethodGet, api.InterfaceURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Reconfigure changes the addresses, the MTU and the advertised routes of the VPN interface
+func (c *Client) Reconfigure(cfg engine.InterfaceConfig) (err error) {
+	res, err := c.doJSON(http.MethodPut, api.InterfaceURL, cfg)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status '%s'", res.Status)
+	}
+	return
+}
+
+// Shaping returns the bandwidth limits of the VPN
+func (c *Client) Shaping() (resp engine.Shaping, err error) {
+	res, err := c.do(http.MethodGet, api.ShapingURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// SetShaping replaces the bandwidth limits of the VPN
+func (c *Client) SetShaping(s engine.Shaping) (err error) {
+	res, err := c.doJSON(http.MethodPut, api.ShapingURL, s)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status '%s'", res.Status)
+	}
+	return
+}
+
+// SetPeerLimit sets the bandwidth limit of a peer, removing it if l has no limit
+func (c *Client) SetPeerLimit(peer string, l engine.Limit) (err error) {
+	method := http.MethodPut
+	if l == (engine.Limit{}) {
+		method = http.MethodDelete
+	}
+	res, err := c.do(method, fmt.Sprintf("%s/peers/%s", api.ShapingURL, peer), map[string]string{"in": fmt.Sprint(l.In), "out": fmt.Sprint(l.Out)})
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status '%s'", res.Status)
+	}
+	return
+}
+
+// StartCapture starts capturing the last size packets of the VPN
+func (c *Client) StartCapture(size int) (err error) {
+	res, err := c.do(http.MethodPut, api.CaptureURL, map[string]string{"size": fmt.Sprint(size)})
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status '%s'", res.Status)
+	}
+	return
+}
+
+// StopCapture stops capturing packets
+func (c *Client) StopCapture() (err error) {
+	res, err := c.do(http.MethodDelete, api.CaptureURL, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status '%s'", res.Status)
+	}
+	return
+}
+
+// Capture writes the captured packets selected by the filter to w in the pcapng format.
+// since and until are RFC3339 times or durations ago, and can be empty
+func (c *Client) Capture(w io.Writer, filter, since, until string) (err error) {
+	res, err := c.do(http.MethodGet, api.CaptureURL, map[string]string{"filter": filter, "since": since, "until": until})
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status '%s'", res.Status)
+	}
+	_, err = io.Copy(w, res.Body)
+	return
+}
+
 func (c *Client) GetBucket(b string) (resp map[string]blockchain.Data, err error) {
 	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s", api.LedgerURL, b), nil)
 	if err != nil {
@@ -254,6 +523,72 @@ func (c *Client) GetBuckets() (resp []string, err error) {
 	return
 }
 
+// Provenance returns the peer which last wrote each key of the bucket
+func (c *Client) Provenance(b string) (resp map[string]blockchain.Provenance, err error) {
+	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s", api.ProvenanceURL, b), nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err = json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return
+}
+
+// Watch returns the changes of the ledger, of a bucket (all if empty) and of a key if given.
+// The channel is closed when the context is done or the connection is closed, which
+// the server does after an overflow event if the changes are not read fast enough.
+// The client must not have a timeout, as the events are streamed
+func (c *Client) Watch(ctx context.Context, bucket, key string) (<-chan blockchain.Event, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url(api.EventsURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Set("bucket", bucket)
+	q.Set("key", key)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Add("Accept", "text/event-stream")
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status '%s'", res.Status)
+	}
+
+	events := make(chan blockchain.Event)
+	go func() {
+		defer close(events)
+		defer res.Body.Close()
+		scanner := bufio.NewScanner(res.Body)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			// Only the data lines are needed, the event type is in the data too
+			data := strings.TrimPrefix(scanner.Text(), "data: ")
+			if data == scanner.Text() {
+				continue
+			}
+			var e blockchain.Event
+			if err := json.Unmarshal([]byte(data), &e); err != nil {
+				return
+			}
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
 func (c *Client) GetBucketKey(b, k string) (resp blockchain.Data, err error) {
 	res, err := c.do(http.MethodGet, fmt.Sprintf("%s/%s/%s", api.LedgerURL, b, k), nil)
 	if err != nil {
@@ -36,6 +36,22 @@ type Block struct {
 	Storage   map[string]map[string]Data
 	Hash      string
 	PrevHash  string
+
+	// Clock holds the timestamp of the last write of each key. The keys
+	// missing in the storage are deleted. Empty in the legacy blocks
+	Clock map[string]map[string]Timestamp `json:",omitempty"`
+
+	// Signatures holds the signature of the last write of each key by its writer
+	Signatures map[string]map[string][]byte `json:",omitempty"`
+
+	// Expires holds the logical time, in nanoseconds, after which each key
+	// written with a TTL is dropped
+	Expires map[string]map[string]int64 `json:",omitempty"`
+
+	// Delta is set on the blocks sent with only the keys changed
+	Delta bool `json:",omitempty"`
+	// Digest is set on the messages announcing the state of the sender, without data
+	Digest string `json:",omitempty"`
 }
 
 // Blockchain is a series of validated Blocks
@@ -61,6 +77,15 @@ func (newBlock Block) IsValid(oldBlock Block) bool {
 // Checksum does SHA256 hashing of the block
 func (b Block) Checksum() string {
 	record := fmt.Sprint(b.Index, b.Timestamp, b.Storage, b.PrevHash)
+	if b.Clock != nil {
+		record += fmt.Sprint(b.Clock)
+	}
+	if b.Signatures != nil {
+		record += fmt.Sprint(b.Signatures)
+	}
+	if b.Expires != nil {
+		record += fmt.Sprint(b.Expires)
+	}
 	h := sha256.New()
 	h.Write([]byte(record))
 	hashed := h.Sum(nil)
@@ -81,3 +106,13 @@ func (oldBlock Block) NewBlock(s map[string]map[string]Data) Block {
 
 	return newBlock
 }
+
+// stateBlock returns a block after oldBlock with the data of the state
+func (oldBlock Block) stateBlock(s state, index int) Block {
+	newBlock := s.block()
+	newBlock.Index = index
+	newBlock.Timestamp = time.Now().UTC().String()
+	newBlock.PrevHash = oldBlock.Hash
+	newBlock.Hash = newBlock.Checksum()
+	return newBlock
+}
@@ -0,0 +1,135 @@
+package blockchain
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock timestamp. It orders the writes
+// of the ledger, ties being broken by the writer
+type Timestamp struct {
+	// Wall is the physical time in nanoseconds
+	Wall int64
+	// Logical orders the writes with the same physical time
+	Logical uint32
+	// Node is the writer
+	Node string `json:",omitempty"`
+}
+
+// Compare returns -1, 0 or +1 if t is before, equal or after o
+func (t Timestamp) Compare(o Timestamp) int {
+	switch {
+	case t.Wall != o.Wall:
+		return compareInt(t.Wall, o.Wall)
+	case t.Logical != o.Logical:
+		return compareInt(int64(t.Logical), int64(o.Logical))
+	default:
+		return strings.Compare(t.Node, o.Node)
+	}
+}
+
+// Before returns true if t is before o
+func (t Timestamp) Before(o Timestamp) bool {
+	return t.Compare(o) < 0
+}
+
+func compareInt(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// maxClockSkew is how far ahead of the local physical time the writes of
+// the peers can be. The writes further ahead are rejected, otherwise a peer
+// with its clock in the future would win every key and move the clocks
+// of the network forward, expiring the keys with a TTL
+const maxClockSkew = time.Minute
+
+// clock is a hybrid logical clock: its timestamps follow the physical time, and
+// are always after the ones observed from the other writers, even with clock skew
+type clock struct {
+	sync.Mutex
+	last Timestamp
+	node string
+	now  func() time.Time
+}
+
+func newClock() *clock {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &clock{node: hex.EncodeToString(id), now: time.Now}
+}
+
+// tick returns the timestamp of a local write
+func (c *clock) tick() Timestamp {
+	c.Lock()
+	defer c.Unlock()
+	if wall := c.now().UnixNano(); wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	c.last.Node = c.node
+	return c.last
+}
+
+// observe moves the clock after a timestamp received from another writer
+func (c *clock) observe(t Timestamp) {
+	c.Lock()
+	defer c.Unlock()
+	if t.Wall > c.last.Wall || (t.Wall == c.last.Wall && t.Logical > c.last.Logical) {
+		c.last.Wall, c.last.Logical = t.Wall, t.Logical
+	}
+}
+
+// time returns the logical time of the clock: the physical time, or the last
+// timestamp if after it. The expiries are evaluated against it
+func (c *clock) time() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	if wall := c.now(); wall.UnixNano() > c.last.Wall {
+		return wall
+	}
+	return time.Unix(0, c.last.Wall)
+}
+
+// physical returns the physical time of the clock
+func (c *clock) physical() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now()
+}
+
+// setNode sets the writer of the timestamps
+func (c *clock) setNode(node string) {
+	c.Lock()
+	defer c.Unlock()
+	c.node = node
+}
@@ -0,0 +1,186 @@
+package blockchain
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+)
+
+// errUnsigned is returned for the writes without signature, i.e. of the legacy blocks
+var errUnsigned = errors.New("unsigned write")
+
+// Provenance is the last write of a key
+type Provenance struct {
+	// Writer is the peer which wrote the key, empty for the legacy blocks
+	Writer  string
+	Time    time.Time
+	Deleted bool
+	Signed  bool
+	// Expires is the time after which the key is dropped, zero if never
+	Expires time.Time
+}
+
+// signedWrite is the content of a write signed by its writer
+type signedWrite struct {
+	Bucket, Key string
+	Value       Data
+	Deleted     bool
+	Stamp       Timestamp
+	Expires     int64 `json:",omitempty"`
+}
+
+func (e entry) payload(bucket, key string) []byte {
+	b, _ := json.Marshal(signedWrite{Bucket: bucket, Key: key, Value: e.value, Deleted: e.deleted, Stamp: e.stamp, Expires: e.expires})
+	return b
+}
+
+// verify returns an error if the write is not signed by the peer of its timestamp
+func (e entry) verify(bucket, key string) error {
+	if e.signature == "" {
+		return errUnsigned
+	}
+	id, err := peer.Decode(e.stamp.Node)
+	if err != nil {
+		return errors.Wrapf(err, "invalid writer of %s/%s", bucket, key)
+	}
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return errors.Wrapf(err, "no public key for the writer of %s/%s", bucket, key)
+	}
+	ok, err := pub.Verify(e.payload(bucket, key), []byte(e.signature))
+	if err != nil {
+		return errors.Wrapf(err, "could not verify %s/%s", bucket, key)
+	}
+	if !ok {
+		return fmt.Errorf("invalid signature of %s/%s by %s", bucket, key, id.String())
+	}
+	return nil
+}
+
+// Authorizer returns an error if the writer can not write the key of a bucket.
+// value is empty for a deletion, current is the value of the key, empty if none,
+// and data returns the current data of a bucket
+type Authorizer func(writer, key string, value, current Data, data func(bucket string) map[string]Data) error
+
+// Authorize checks the writers of the keys of the bucket received from the
+// peers with the authorizer, in addition to their signature
+func (l *Ledger) Authorize(bucket string, a Authorizer) {
+	l.Lock()
+	defer l.Unlock()
+	if l.authorizers == nil {
+		l.authorizers = map[string]Authorizer{}
+	}
+	l.authorizers[bucket] = a
+}
+
+// authorize returns an error if the writer of the signed entry can not replace the
+// current one of the state s (to be called with the lock held)
+func (l *Ledger) authorize(s state, bucket, key string, e entry) error {
+	a, ok := l.authorizers[bucket]
+	if !ok {
+		return nil
+	}
+	now := l.clock.time()
+	live := func(e entry) bool { return !e.deleted && !e.expired(now) }
+
+	value, old := e.value, Data("")
+	if e.deleted {
+		value = ""
+	}
+	if current := s[bucket][key]; live(current) {
+		old = current.value
+	}
+	data := func(bucket string) map[string]Data {
+		d := map[string]Data{}
+		for k, e := range s[bucket] {
+			if live(e) {
+				d[k] = e.value
+			}
+		}
+		return d
+	}
+	return errors.Wrapf(a(e.stamp.Node, key, value, old, data), "unauthorized write of %s/%s", bucket, key)
+}
+
+// SetIdentity signs the writes of the ledger with the key of the peer. The writes
+// received are verified against the key of their writer, which has to be embedded
+// in its peer ID (e.g. Ed25519)
+func (l *Ledger) SetIdentity(key crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.key = key
+	l.clock.setNode(id.String())
+	return nil
+}
+
+// AcceptUnsigned accepts the writes without signature, i.e. from the peers running
+// a version which doesn't sign the ledger. Their writer can not be verified.
+// Otherwise only the ones of the legacy blocks are merged, for the keys not
+// signed yet out of the buckets with an authorizer
+func (l *Ledger) AcceptUnsigned(b bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.unsigned = b
+}
+
+// write returns the entry written locally for the ttl (if not 0), signed if the
+// ledger has an identity (to be called with the lock held)
+func (l *Ledger) write(bucket, key string, e entry, ttl time.Duration) entry {
+	e.stamp = l.clock.tick()
+	if ttl > 0 {
+		e.expires = e.stamp.Wall + int64(ttl)
+	}
+	if l.key != nil {
+		if sig, err := l.key.Sign(e.payload(bucket, key)); err == nil {
+			e.signature = string(sig)
+		}
+	}
+	return e
+}
+
+// Provenance returns the writer of each key of the bucket, deleted ones included
+func (l *Ledger) Provenance(bucket string) map[string]Provenance {
+	l.Lock()
+	defer l.Unlock()
+
+	res := map[string]Provenance{}
+	for k, e := range stateOf(l.blockchain.Last())[bucket] {
+		p := Provenance{Writer: e.stamp.Node, Deleted: e.deleted, Signed: e.signature != ""}
+		if e.stamp.Wall != 0 {
+			p.Time = time.Unix(0, e.stamp.Wall).UTC()
+		}
+		if e.expires != 0 {
+			p.Expires = time.Unix(0, e.expires).UTC()
+		}
+		res[k] = p
+	}
+	return res
+}
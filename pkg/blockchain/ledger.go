@@ -25,6 +25,7 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -33,12 +34,27 @@ import (
 
 	"github.com/bhojpur/vpn/pkg/hub"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/pkg/errors"
 )
 
 type Ledger struct {
 	sync.Mutex
 	blockchain Store
+	clock      *clock
+
+	// key signs the writes, unsigned accepts the writes without signature
+	key      crypto.PrivKey
+	unsigned bool
+	// authorizers check the writers of the keys of their bucket
+	authorizers map[string]Authorizer
+
+	// catchUp is called with the peers announcing a different state
+	catchUp func(peer string)
+	// digest of the block with the hash digestOf
+	digest, digestOf string
+	// watchers receive the changes of the blocks
+	watchers map[*watcher]struct{}
 
 	channel io.Writer
 
@@ -53,22 +69,27 @@ type Store interface {
 
 // New returns a new ledger which writes to the writer
 func New(w io.Writer, s Store) *Ledger {
-	c := &Ledger{channel: w, blockchain: s}
+	c := &Ledger{channel: w, blockchain: s, clock: newClock()}
 	if s.Len() == 0 {
 		c.newGenesis()
 	}
+	c.clock.observe(stateOf(s.Last()).latest())
 	return c
 }
 
 func (l *Ledger) newGenesis() {
 	t := time.Now()
 	genesisBlock := Block{}
-	genesisBlock = Block{0, t.String(), map[string]map[string]Data{}, genesisBlock.Checksum(), ""}
+	genesisBlock = Block{0, t.String(), map[string]map[string]Data{}, genesisBlock.Checksum(), "", nil, nil, nil, false, ""}
 	l.blockchain.Add(genesisBlock)
 }
 
-// Syncronizer starts a goroutine which
-// writes the blockchain to the  periodically
+// Syncronizer starts a goroutine which announces the state of the ledger
+// periodically. The peers with a different state pull the writes they miss
+// with the function set by SetCatchUp. While accepting the unsigned writes,
+// the whole last block is sent instead, as expected by the older peers. The
+// digests have the index 0, so that the older peers ignore them
+// The keys expired are dropped before each announce
 func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 	go func() {
 		t := time.NewTicker(t)
@@ -77,15 +98,18 @@ func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 			select {
 			case <-t.C:
 				l.Lock()
+				l.expire()
+				msg := l.blockchain.Last()
+				if !l.unsigned {
+					msg = Block{Timestamp: msg.Timestamp, Digest: l.lastDigest()}
+				}
+				l.Unlock()
 
-				bytes, err := json.Marshal(l.blockchain.Last())
+				bytes, err := json.Marshal(msg)
 				if err != nil {
 					log.Println(err)
 				}
-
-				l.channel.Write(compress(bytes).Bytes())
-
-				l.Unlock()
+				l.send(bytes)
 			case <-ctx.Done():
 				return
 			}
@@ -93,6 +117,59 @@ func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 	}()
 }
 
+// expire adds a block without the keys expired, if any. Every peer drops them
+// at the same logical time, so there is nothing to send (to be called with the lock held)
+func (l *Ledger) expire() {
+	last := l.blockchain.Last()
+	s := stateOf(last)
+	if s.prune(l.clock.time()) {
+		l.commit(last, last.stateBlock(s, last.Index+1))
+	}
+}
+
+// SetCatchUp sets the function called with the peers announcing a different
+// state, to pull the writes missing (see Versions and Since)
+func (l *Ledger) SetCatchUp(f func(peer string)) {
+	l.Lock()
+	defer l.Unlock()
+	l.catchUp = f
+}
+
+// lastDigest returns the digest of the state of the last block (to be called with the lock held)
+func (l *Ledger) lastDigest() string {
+	last := l.blockchain.Last()
+	if l.digestOf != last.Hash {
+		l.digest, l.digestOf = stateOf(last).digest(l.clock.time()), last.Hash
+	}
+	return l.digest
+}
+
+// Versions returns the timestamp of the last write of each key, deleted ones included
+func (l *Ledger) Versions() map[string]map[string]Timestamp {
+	l.Lock()
+	defer l.Unlock()
+	return stateOf(l.blockchain.Last()).versions()
+}
+
+// Since returns a delta block with the writes after the versions of a peer
+func (l *Ledger) Since(versions map[string]map[string]Timestamp) Block {
+	l.Lock()
+	defer l.Unlock()
+	last := l.blockchain.Last()
+	return deltaBlock(last, stateOf(last).since(versions))
+}
+
+// deltaBlock returns a block with only the writes of s, sent after the block b.
+// Its index is 0: the older peers take the blocks with a higher index than
+// theirs as the whole state, they would drop the keys missing otherwise
+func deltaBlock(b Block, s state) Block {
+	delta := b.stateBlock(s, 0)
+	delta.PrevHash = b.PrevHash
+	delta.Delta = true
+	delta.Hash = delta.Checksum()
+	return delta
+}
+
 func compress(b []byte) *bytes.Buffer {
 	var buf bytes.Buffer
 	gz := gzip.NewWriter(&buf)
@@ -131,12 +208,82 @@ func (l *Ledger) Update(f *Ledger, h *hub.Message, c chan *hub.Message) (err err
 		return
 	}
 
+	if block.Digest != "" {
+		l.Lock()
+		differs, catchUp := block.Digest != l.lastDigest(), l.catchUp
+		l.Unlock()
+		if differs && catchUp != nil && h.SenderID != "" {
+			catchUp(h.SenderID)
+		}
+		return
+	}
+
+	return l.Merge(*block, h.SenderID)
+}
+
+// Merge applies the writes of a block received from a peer which are after
+// the ones of the ledger. Only the writes signed by their writer are merged, and
+// the ones of the legacy blocks which don't replace them. An error is returned
+// if some are rejected
+func (l *Ledger) Merge(block Block, from string) (err error) {
 	l.Lock()
-	if block.Index > l.blockchain.Len() {
-		l.blockchain.Add(*block)
+	defer l.Unlock()
+
+	last := l.blockchain.Last()
+	local := stateOf(last)
+	var remote state
+	legacy := !block.Delta && block.Clock == nil
+	if legacy {
+		// The peers which don't merge the ledger send all the data, the highest index wins
+		if block.Index <= l.blockchain.Len() {
+			return
+		}
+		remote = legacyState(block, local)
+	} else {
+		remote = stateOf(block)
 	}
-	l.Unlock()
 
+	var rejected []error
+	maxWall := l.clock.physical().Add(maxClockSkew).UnixNano()
+	valid := func(bucket, key string, e entry) bool {
+		if e.stamp.Wall > maxWall {
+			rejected = append(rejected, fmt.Errorf("write of %s/%s is %s ahead of the local clock", bucket, key, time.Duration(e.stamp.Wall-maxWall)+maxClockSkew))
+			return false
+		}
+		verr := e.verify(bucket, key)
+		if verr == nil {
+			verr = l.authorize(local, bucket, key, e)
+		}
+		switch {
+		case verr == nil:
+			return true
+		case errors.Is(verr, errUnsigned):
+			// Until they are upgraded, the legacy peers still write the keys
+			// not signed yet, out of the buckets with an authorizer
+			return l.unsigned || legacy && l.authorizers[bucket] == nil && local[bucket][key].signature == ""
+		}
+		rejected = append(rejected, verr)
+		return false
+	}
+	changed := local.merge(remote, l.clock.time(), valid)
+	if len(rejected) > 0 {
+		err = errors.Wrapf(rejected[0], "%d writes rejected from %s", len(rejected), from)
+	}
+	if !changed {
+		return
+	}
+	l.clock.observe(local.latest())
+
+	// Use the block as is if it has all the writes, so that the peers agree on it
+	if !block.Delta && block.Clock != nil && block.Index > last.Index && block.Checksum() == block.Hash && local.equal(remote) {
+		l.commit(last, block)
+		return
+	}
+	index := last.Index + 1
+	if !block.Delta && block.Index >= index {
+		index = block.Index + 1
+	}
+	l.commit(last, last.stateBlock(local, index))
 	return
 }
 
@@ -203,6 +350,18 @@ func (l *Ledger) AnnounceUpdate(ctx context.Context, interval time.Duration, buc
 	})
 }
 
+// AnnounceTTL keeps the key written with the ttl, writing it again if differing or
+// when half of the ttl passed, so that it expires only once not announced anymore
+func (l *Ledger) AnnounceTTL(ctx context.Context, interval, ttl time.Duration, bucket, key string, value interface{}) {
+	l.Announce(ctx, interval, func() {
+		v, exists := l.GetKey(bucket, key)
+		realv, _ := json.Marshal(value)
+		if left, _ := l.TTL(bucket, key); !exists || string(v) != string(realv) || left < ttl/2 {
+			l.AddTTL(bucket, map[string]interface{}{key: value}, ttl)
+		}
+	})
+}
+
 // Persist Keeps announcing something into the blockchain until it is reconciled
 func (l *Ledger) Persist(ctx context.Context, interval, timeout time.Duration, bucket, key string, value interface{}) {
 	put, cancel := context.WithTimeout(ctx, timeout)
@@ -253,6 +412,24 @@ func (l *Ledger) Exists(b string, f func(Data) bool) (exists bool) {
 	return
 }
 
+// TTL returns the time left before the key expires, 0 if it doesn't. The keys
+// expired and not dropped yet don't exist
+func (l *Ledger) TTL(b, k string) (ttl time.Duration, exists bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	last := l.blockchain.Last()
+	if _, exists = last.Storage[b][k]; !exists {
+		return
+	}
+	if expires := last.Expires[b][k]; expires != 0 {
+		if ttl = time.Duration(expires - l.clock.time().UnixNano()); ttl <= 0 {
+			return 0, false
+		}
+	}
+	return
+}
+
 // CurrentData returns the current ledger data (locking)
 func (l *Ledger) CurrentData() map[string]map[string]Data {
 	l.Lock()
@@ -290,57 +467,55 @@ func (b buckets) copy() map[string]map[string]Data {
 
 // Add data to the blockchain
 func (l *Ledger) Add(b string, s map[string]interface{}) {
-	l.Lock()
-	current := buckets(l.blockchain.Last().Storage).copy()
+	l.AddTTL(b, s, 0)
+}
 
-	for s, k := range s {
-		if _, exists := current[b]; !exists {
-			current[b] = make(map[string]Data)
-		}
-		dat, _ := json.Marshal(k)
-		current[b][s] = Data(string(dat))
+// AddTTL writes the keys to the bucket for the ttl: they are dropped by every peer
+// when the logical time of the ledger passes it, unless written again before.
+// The keys never expire with a ttl of 0
+func (l *Ledger) AddTTL(b string, s map[string]interface{}, ttl time.Duration) {
+	l.Lock()
+	last := l.blockchain.Last()
+	current, changed := stateOf(last), state{}
+	for k, v := range s {
+		dat, _ := json.Marshal(v)
+		e := l.write(b, k, entry{value: Data(string(dat))}, ttl)
+		current.set(b, k, e)
+		changed.set(b, k, e)
 	}
+	msg := l.writeState(last, current, changed)
 	l.Unlock()
-	l.writeData(current)
+	l.send(msg)
 }
 
 // Delete data from the ledger (locking)
 func (l *Ledger) Delete(b string, k string) {
 	l.Lock()
-	new := make(map[string]map[string]Data)
-	for bb, kk := range l.blockchain.Last().Storage {
-		if _, exists := new[bb]; !exists {
-			new[bb] = make(map[string]Data)
-		}
-		// Copy all keys/v except b/k
-		for kkk, v := range kk {
-			if !(bb == b && kkk == k) {
-				new[bb][kkk] = v
-			}
-		}
-	}
+	last := l.blockchain.Last()
+	current, changed := stateOf(last), state{}
+	e := l.write(b, k, entry{deleted: true}, 0)
+	current.set(b, k, e)
+	changed.set(b, k, e)
+	msg := l.writeState(last, current, changed)
 	l.Unlock()
-	l.writeData(new)
+	l.send(msg)
 }
 
 // DeleteBucket deletes a bucket from the ledger (locking)
 func (l *Ledger) DeleteBucket(b string) {
 	l.Lock()
-	new := make(map[string]map[string]Data)
-	for bb, kk := range l.blockchain.Last().Storage {
-		// Copy all except the specified bucket
-		if bb == b {
-			continue
-		}
-		if _, exists := new[bb]; !exists {
-			new[bb] = make(map[string]Data)
-		}
-		for kkk, v := range kk {
-			new[bb][kkk] = v
+	last := l.blockchain.Last()
+	current, changed := stateOf(last), state{}
+	for k, e := range current[b] {
+		if !e.deleted {
+			e := l.write(b, k, entry{deleted: true}, 0)
+			current.set(b, k, e)
+			changed.set(b, k, e)
 		}
 	}
+	msg := l.writeState(last, current, changed)
 	l.Unlock()
-	l.writeData(new)
+	l.send(msg)
 }
 
 // String returns the blockchain as string
@@ -354,19 +529,32 @@ func (l *Ledger) Index() int {
 	return l.blockchain.Len()
 }
 
-func (l *Ledger) writeData(s map[string]map[string]Data) {
-	newBlock := l.blockchain.Last().NewBlock(s)
+// writeState adds a block with the state after the last one, returning the message
+// sent to the peers with the changed writes (to be called with the lock held)
+func (l *Ledger) writeState(last Block, s, changed state) []byte {
+	s.prune(l.clock.time())
+	block := last.stateBlock(s, last.Index+1)
+	l.commit(last, block)
 
-	if newBlock.IsValid(l.blockchain.Last()) {
-		l.Lock()
-		l.blockchain.Add(newBlock)
-		l.Unlock()
+	if changed.len() == 0 {
+		return nil
 	}
-
-	bytes, err := json.Marshal(l.blockchain.Last())
+	msg := deltaBlock(block, changed)
+	if l.unsigned {
+		msg = block
+	}
+	bytes, err := json.Marshal(msg)
 	if err != nil {
 		log.Println(err)
+		return nil
 	}
+	return bytes
+}
 
-	l.channel.Write(compress(bytes).Bytes())
+// send compresses and sends a message to the peers
+func (l *Ledger) send(msg []byte) {
+	if msg == nil {
+		return
+	}
+	l.channel.Write(compress(msg).Bytes())
 }
@@ -0,0 +1,461 @@
+package blockchain_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/hub"
+)
+
+// wire records the messages written by a ledger
+type wire struct {
+	sync.Mutex
+	sent [][]byte
+}
+
+func (w *wire) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.sent = append(w.sent, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func (w *wire) messages() []*hub.Message {
+	w.Lock()
+	defer w.Unlock()
+	res := []*hub.Message{}
+	for _, m := range w.sent {
+		res = append(res, &hub.Message{Message: string(m)})
+	}
+	return res
+}
+
+// message returns the last message written
+func (w *wire) message() *hub.Message {
+	m := w.messages()
+	return m[len(m)-1]
+}
+
+// blockOf returns the last block written
+func blockOf(w *wire) Block {
+	r, err := gzip.NewReader(bytes.NewReader([]byte(w.message().Message)))
+	Expect(err).ToNot(HaveOccurred())
+	var b Block
+	Expect(json.NewDecoder(r).Decode(&b)).To(Succeed())
+	return b
+}
+
+// deliver updates the ledger with all the messages written to w
+func deliver(l *Ledger, w *wire) error {
+	for _, m := range w.messages() {
+		if err := l.Update(nil, m, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newLedger() (*Ledger, *wire) {
+	w := &wire{}
+	l := New(w, &MemoryStore{})
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(l.SetIdentity(key)).To(Succeed())
+	return l, w
+}
+
+func compress(b Block) *hub.Message {
+	dat, err := json.Marshal(b)
+	Expect(err).ToNot(HaveOccurred())
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(dat)
+	gz.Close()
+	return &hub.Message{Message: buf.String()}
+}
+
+func value(l *Ledger, b, k string) string {
+	var s string
+	v, exists := l.GetKey(b, k)
+	if exists {
+		v.Unmarshal(&s)
+	}
+	return s
+}
+
+// legacyBlock returns a message with a block written by a peer which doesn't merge the ledger
+func legacyBlock(index int, t time.Time, storage map[string]map[string]Data) *hub.Message {
+	b := Block{Index: index, Timestamp: t.UTC().String(), Storage: storage}
+	b.Hash = b.Checksum()
+	return compress(b)
+}
+
+// legacyUpdate applies a message as the peers which don't merge the ledger do: the
+// block is taken as the whole state if its index is higher than the one of last
+func legacyUpdate(last Block, m *hub.Message) Block {
+	r, err := gzip.NewReader(bytes.NewReader([]byte(m.Message)))
+	Expect(err).ToNot(HaveOccurred())
+	var b Block
+	Expect(json.NewDecoder(r).Decode(&b)).To(Succeed())
+	if b.Index > last.Index {
+		return b
+	}
+	return last
+}
+
+var _ = Describe("Ledger", func() {
+	It("merges the concurrent writes", func() {
+		a, wa := newLedger()
+		b, wb := newLedger()
+
+		a.Add("machines", map[string]interface{}{"10.1.0.1": "a"})
+		a.Add("machines", map[string]interface{}{"10.1.0.3": "a"})
+		b.Add("machines", map[string]interface{}{"10.1.0.2": "b"})
+		b.Add("machines", map[string]interface{}{"10.1.0.3": "b"})
+
+		Expect(deliver(a, wb)).To(Succeed())
+		Expect(deliver(b, wa)).To(Succeed())
+
+		Expect(a.CurrentData()).To(Equal(b.CurrentData()))
+		Expect(value(a, "machines", "10.1.0.1")).To(Equal("a"))
+		Expect(value(a, "machines", "10.1.0.2")).To(Equal("b"))
+		// The last write wins
+		Expect(value(a, "machines", "10.1.0.3")).To(Equal("b"))
+	})
+
+	It("converges regardless of the order of the blocks", func() {
+		a, wa := newLedger()
+		b, wb := newLedger()
+		c, _ := newLedger()
+
+		a.Add("users", map[string]interface{}{"foo": "a"})
+		ma := wa.message()
+		b.Add("users", map[string]interface{}{"foo": "b", "bar": "b"})
+		mb := wb.message()
+
+		Expect(a.Update(nil, mb, nil)).To(Succeed())
+		Expect(c.Update(nil, mb, nil)).To(Succeed())
+		Expect(c.Update(nil, ma, nil)).To(Succeed())
+		Expect(b.Update(nil, ma, nil)).To(Succeed())
+
+		Expect(a.CurrentData()).To(Equal(b.CurrentData()))
+		Expect(c.CurrentData()).To(Equal(b.CurrentData()))
+	})
+
+	It("propagates the deletions", func() {
+		a, wa := newLedger()
+		b, wb := newLedger()
+
+		a.Add("dns", map[string]interface{}{"foo.": "a", "bar.": "a"})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		Expect(value(b, "dns", "foo.")).To(Equal("a"))
+
+		b.Delete("dns", "foo.")
+		Expect(a.Update(nil, wb.message(), nil)).To(Succeed())
+		_, exists := a.GetKey("dns", "foo.")
+		Expect(exists).To(BeFalse())
+		Expect(value(a, "dns", "bar.")).To(Equal("a"))
+
+		// An older block doesn't write the key again
+		a.Add("dns", map[string]interface{}{"baz.": "a"})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		_, exists = b.GetKey("dns", "foo.")
+		Expect(exists).To(BeFalse())
+		Expect(value(b, "dns", "baz.")).To(Equal("a"))
+
+		b.DeleteBucket("dns")
+		Expect(a.Update(nil, wb.message(), nil)).To(Succeed())
+		Expect(a.CurrentData()).ToNot(HaveKey("dns"))
+	})
+
+	It("keeps the writes made after a deletion", func() {
+		a, wa := newLedger()
+		b, wb := newLedger()
+
+		a.Add("healthcheck", map[string]interface{}{"a": "1"})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		b.DeleteBucket("healthcheck")
+		mb := wb.message()
+		a.Add("healthcheck", map[string]interface{}{"a": "2"})
+
+		Expect(a.Update(nil, mb, nil)).To(Succeed())
+		Expect(value(a, "healthcheck", "a")).To(Equal("2"))
+	})
+
+	It("ignores the writes it already has", func() {
+		a, wa := newLedger()
+		b, _ := newLedger()
+
+		a.Add("users", map[string]interface{}{"foo": "a"})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		index := b.Index()
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		Expect(b.Index()).To(Equal(index))
+	})
+
+	It("sends only the changed keys", func() {
+		a, wa := newLedger()
+		a.Add("dns", map[string]interface{}{"foo.": "a", "bar.": "a"})
+		a.Add("dns", map[string]interface{}{"baz.": "a"})
+
+		delta := blockOf(wa)
+		Expect(delta.Delta).To(BeTrue())
+		Expect(delta.Storage).To(Equal(map[string]map[string]Data{"dns": {"baz.": `"a"`}}))
+		Expect(delta.Clock["dns"]).To(HaveLen(1))
+
+		a.Delete("dns", "foo.")
+		delta = blockOf(wa)
+		Expect(delta.Storage).To(BeEmpty())
+		Expect(delta.Clock["dns"]).To(HaveKey("foo."))
+	})
+
+	It("catches up with the writes missed", func() {
+		a, _ := newLedger()
+		b, wb := newLedger()
+		a.Add("machines", map[string]interface{}{"10.1.0.1": "a", "10.1.0.2": "a"})
+		a.Delete("machines", "10.1.0.2")
+		b.Add("machines", map[string]interface{}{"10.1.0.3": "b"})
+		Expect(deliver(a, wb)).To(Succeed())
+
+		c, _ := newLedger()
+		Expect(c.Merge(a.Since(c.Versions()), "a")).To(Succeed())
+		Expect(c.CurrentData()).To(Equal(a.CurrentData()))
+		Expect(c.Provenance("machines")).To(Equal(a.Provenance("machines")))
+
+		// Only the writes after the ones of the peer are sent
+		b.Add("machines", map[string]interface{}{"10.1.0.4": "b"})
+		since := b.Since(a.Versions())
+		Expect(since.Clock["machines"]).To(HaveLen(1))
+		Expect(a.Merge(since, "b")).To(Succeed())
+		Expect(a.Since(b.Versions()).Clock["machines"]).To(HaveLen(2))
+	})
+
+	It("announces its state to the peers", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a, wa := newLedger()
+		b, wb := newLedger()
+		a.Add("users", map[string]interface{}{"foo": "a"})
+		Expect(deliver(b, wa)).To(Succeed())
+
+		pulls := make(chan string, 10)
+		b.SetCatchUp(func(p string) { pulls <- p })
+		a.Syncronizer(ctx, 10*time.Millisecond)
+		Eventually(func() string { return blockOf(wa).Digest }, 5*time.Second).ShouldNot(BeEmpty())
+		first := blockOf(wa).Digest
+		digest := wa.message()
+		digest.SenderID = "a"
+		Expect(b.Update(nil, digest, nil)).To(Succeed())
+		Consistently(pulls, 100*time.Millisecond).ShouldNot(Receive())
+
+		b.Add("users", map[string]interface{}{"bar": "b"})
+		Expect(b.Update(nil, digest, nil)).To(Succeed())
+		Expect(pulls).To(Receive(Equal("a")))
+		Expect(deliver(a, wb)).To(Succeed())
+		Eventually(func() string { return blockOf(wa).Digest }, 5*time.Second).ShouldNot(Equal(first))
+	})
+
+	It("sends messages ignored by the legacy peers", func() {
+		a, wa := newLedger()
+		b, wb := newLedger()
+		a.Add("users", map[string]interface{}{"foo": "a"})
+		a.Add("users", map[string]interface{}{"bar": "a"})
+		b.Add("users", map[string]interface{}{"baz": "b"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		a.Syncronizer(ctx, 10*time.Millisecond)
+		Eventually(func() string { return blockOf(wa).Digest }, 5*time.Second).ShouldNot(BeEmpty())
+		cancel()
+
+		// A legacy peer at index 1 keeps its data, whatever the index of the others
+		old := Block{Index: 1, Storage: map[string]map[string]Data{"users": {"qux": `"legacy"`}}}
+		catchUp := compress(a.Since(b.Versions()))
+		for _, m := range append(append(wa.messages(), wb.messages()...), catchUp) {
+			Expect(legacyUpdate(old, m)).To(Equal(old))
+		}
+
+		// The upgraded peers still merge them
+		Expect(b.Update(nil, catchUp, nil)).To(Succeed())
+		Expect(value(b, "users", "foo")).To(Equal("a"))
+		Expect(value(b, "users", "bar")).To(Equal("a"))
+		Expect(deliver(a, wb)).To(Succeed())
+		Expect(a.CurrentData()).To(Equal(b.CurrentData()))
+	})
+
+	It("migrates the legacy blocks", func() {
+		a, _ := newLedger()
+		a.AcceptUnsigned(true)
+		a.Add("users", map[string]interface{}{"foo": "a", "bar": "a"})
+		index := a.Index()
+
+		// Lower indexes are ignored, as before
+		old := legacyBlock(index, time.Now(), map[string]map[string]Data{"users": {"baz": `"legacy"`}})
+		Expect(a.Update(nil, old, nil)).To(Succeed())
+		_, exists := a.GetKey("users", "baz")
+		Expect(exists).To(BeFalse())
+
+		// The newer ones are written at their time, the missing keys are deleted
+		Expect(a.Update(nil, legacyBlock(index+5, time.Now().Add(time.Second), map[string]map[string]Data{"users": {"foo": `"legacy"`}}), nil)).To(Succeed())
+		Expect(value(a, "users", "foo")).To(Equal("legacy"))
+		_, exists = a.GetKey("users", "bar")
+		Expect(exists).To(BeFalse())
+		Expect(a.Index()).To(BeNumerically(">", index+5))
+
+		a.Add("users", map[string]interface{}{"bar": "a"})
+		Expect(value(a, "users", "bar")).To(Equal("a"))
+		Expect(a.LastBlock().Clock["users"]).To(HaveKey("foo"))
+	})
+
+	It("merges the legacy blocks until the keys are signed", func() {
+		a, wa := newLedger()
+		b, _ := newLedger()
+		b.Authorize("trustzone", func(writer, key string, value, current Data, data func(string) map[string]Data) error { return nil })
+		a.Add("users", map[string]interface{}{"foo": "a"})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+
+		// The legacy peers write the keys not signed, out of the buckets with an authorizer
+		Expect(b.Update(nil, legacyBlock(10, time.Now().Add(time.Second), map[string]map[string]Data{
+			"users":     {"foo": `"legacy"`, "bar": `"legacy"`},
+			"trustzone": {"baz": `"legacy"`},
+		}), nil)).To(Succeed())
+		Expect(value(b, "users", "foo")).To(Equal("a"))
+		Expect(value(b, "users", "bar")).To(Equal("legacy"))
+		Expect(b.Provenance("users")["bar"].Signed).To(BeFalse())
+		_, exists := b.GetKey("trustzone", "baz")
+		Expect(exists).To(BeFalse())
+
+		// And delete them, but not the signed ones
+		Expect(b.Update(nil, legacyBlock(20, time.Now().Add(2*time.Second), map[string]map[string]Data{"users": {}}), nil)).To(Succeed())
+		_, exists = b.GetKey("users", "bar")
+		Expect(exists).To(BeFalse())
+		Expect(value(b, "users", "foo")).To(Equal("a"))
+
+		// Once signed, the keys are not written by the legacy peers anymore
+		b.Add("users", map[string]interface{}{"bar": "b"})
+		Expect(b.Update(nil, legacyBlock(30, time.Now().Add(3*time.Second), map[string]map[string]Data{"users": {"bar": `"legacy"`}}), nil)).To(Succeed())
+		Expect(value(b, "users", "bar")).To(Equal("b"))
+		Expect(value(b, "users", "foo")).To(Equal("a"))
+	})
+
+	It("migrates the legacy stores", func() {
+		s := &MemoryStore{}
+		b := Block{Index: 3, Timestamp: time.Now().UTC().String(), Storage: map[string]map[string]Data{"users": {"foo": `"legacy"`}}}
+		b.Hash = b.Checksum()
+		s.Add(b)
+
+		a := New(&wire{}, s)
+		Expect(value(a, "users", "foo")).To(Equal("legacy"))
+		Expect(a.Provenance("users")["foo"].Signed).To(BeFalse())
+		a.Add("users", map[string]interface{}{"bar": "a"})
+		Expect(value(a, "users", "foo")).To(Equal("legacy"))
+		Expect(a.Index()).To(Equal(4))
+		Expect(a.LastBlock().Clock["users"]).To(HaveKey("foo"))
+	})
+
+	It("records the writer of each key", func() {
+		a, wa := newLedger()
+		b, wb := newLedger()
+
+		a.Add("users", map[string]interface{}{"foo": "a"})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		b.Add("users", map[string]interface{}{"bar": "b"})
+		b.Delete("users", "foo")
+		Expect(deliver(a, wb)).To(Succeed())
+
+		p := a.Provenance("users")
+		Expect(p).To(HaveLen(2))
+		Expect(p["bar"].Writer).To(Equal(p["foo"].Writer))
+		Expect(p["foo"].Deleted).To(BeTrue())
+		Expect(p["bar"].Signed).To(BeTrue())
+		Expect(p["bar"].Time).ToNot(BeZero())
+		Expect(b.Provenance("users")).To(Equal(p))
+
+		id, err := peer.Decode(p["bar"].Writer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id.Validate()).To(Succeed())
+	})
+
+	It("rejects the forged writes", func() {
+		a, wa := newLedger()
+		b, _ := newLedger()
+		a.Add("trustzone", map[string]interface{}{"foo": "a"})
+
+		forged := blockOf(wa)
+		forged.Storage["trustzone"]["foo"] = `"forged"`
+		forged.Hash = forged.Checksum()
+		Expect(b.Update(nil, compress(forged), nil)).To(HaveOccurred())
+		_, exists := b.GetKey("trustzone", "foo")
+		Expect(exists).To(BeFalse())
+
+		// Unsigned writes are ignored, unless accepted
+		forged.Signatures = nil
+		forged.Hash = forged.Checksum()
+		Expect(b.Update(nil, compress(forged), nil)).To(Succeed())
+		_, exists = b.GetKey("trustzone", "foo")
+		Expect(exists).To(BeFalse())
+
+		b.AcceptUnsigned(true)
+		Expect(b.Update(nil, compress(forged), nil)).To(Succeed())
+		Expect(value(b, "trustzone", "foo")).To(Equal("forged"))
+	})
+
+	It("checks the writers with the authorizers of the buckets", func() {
+		a, wa := newLedger()
+		b, _ := newLedger()
+		b.Authorize("machines", func(writer, key string, value, current Data, data func(string) map[string]Data) error {
+			if value != "" && value != Data(`"`+writer+`"`) {
+				return errors.New("not the owner")
+			}
+			return nil
+		})
+
+		a.Add("machines", map[string]interface{}{"foo": "bar"})
+		Expect(b.Update(nil, wa.message(), nil)).To(MatchError(ContainSubstring("unauthorized write of machines/foo")))
+		_, exists := b.GetKey("machines", "foo")
+		Expect(exists).To(BeFalse())
+
+		writer := a.Provenance("machines")["foo"].Writer
+		a.Add("machines", map[string]interface{}{"foo": writer})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		Expect(value(b, "machines", "foo")).To(Equal(writer))
+
+		// The other buckets are not checked
+		a.Add("users", map[string]interface{}{"foo": "bar"})
+		Expect(b.Update(nil, wa.message(), nil)).To(Succeed())
+		Expect(value(b, "users", "foo")).To(Equal("bar"))
+	})
+})
@@ -0,0 +1,277 @@
+package blockchain
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// tombstoneTTL is how long the deletions are remembered. A key deleted
+// before is written again by the peers which missed its deletion
+const tombstoneTTL = 24 * time.Hour
+
+// entry is the last write of a key: a value, or its deletion
+type entry struct {
+	value   Data
+	deleted bool
+	stamp   Timestamp
+	// expires is the logical time (in nanoseconds) after which the key is dropped, 0 if never
+	expires int64
+
+	// signature of the write by its writer, empty if unsigned
+	signature string
+}
+
+// after returns true if the write e wins over o. Concurrent writes with the
+// same timestamp (i.e. migrated from the legacy blocks) are ordered by value
+func (e entry) after(o entry) bool {
+	if c := e.stamp.Compare(o.stamp); c != 0 {
+		return c > 0
+	}
+	if e.deleted != o.deleted {
+		return e.deleted
+	}
+	return strings.Compare(string(e.value), string(o.value)) > 0
+}
+
+// state is the ledger data as a last-writer-wins map of each bucket: merging
+// two states takes the last write of each key, so that the peers writing
+// concurrently converge to the same data regardless of the order of the blocks
+type state map[string]map[string]entry
+
+// stateOf returns the state of a block. The keys of the legacy blocks,
+// without a clock, are written at the time of the block
+func stateOf(b Block) state {
+	s := state{}
+	if b.Clock == nil {
+		stamp := legacyTimestamp(b)
+		for bucket, keys := range b.Storage {
+			for k, v := range keys {
+				s.set(bucket, k, entry{value: v, stamp: stamp})
+			}
+		}
+		return s
+	}
+	for bucket, keys := range b.Clock {
+		for k, stamp := range keys {
+			v, exists := b.Storage[bucket][k]
+			s.set(bucket, k, entry{value: v, deleted: !exists, stamp: stamp, expires: b.Expires[bucket][k], signature: string(b.Signatures[bucket][k])})
+		}
+	}
+	return s
+}
+
+// legacyState returns the state of a block sent by a peer which doesn't
+// merge the blocks. The keys missing in its block were deleted by the peer,
+// unless written after it
+func legacyState(b Block, local state) state {
+	s := stateOf(b)
+	stamp := legacyTimestamp(b)
+	for bucket, keys := range local {
+		for k, e := range keys {
+			if _, exists := s[bucket][k]; !exists && !e.deleted && e.stamp.Before(stamp) {
+				s.set(bucket, k, entry{deleted: true, stamp: stamp})
+			}
+		}
+	}
+	return s
+}
+
+// legacyTimestamp returns the time of a legacy block, or the zero
+// timestamp if it can not be parsed
+func legacyTimestamp(b Block) Timestamp {
+	ts := b.Timestamp
+	// Strip the monotonic clock reading
+	if i := strings.Index(ts, " m="); i >= 0 {
+		ts = ts[:i]
+	}
+	t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", ts)
+	if err != nil {
+		return Timestamp{}
+	}
+	return Timestamp{Wall: t.UnixNano()}
+}
+
+func (s state) set(bucket, key string, e entry) {
+	if _, exists := s[bucket]; !exists {
+		s[bucket] = map[string]entry{}
+	}
+	s[bucket][key] = e
+}
+
+// expired returns true if the write is to be forgotten at the time now: a deletion
+// older than the tombstoneTTL, or a key after its expiry
+func (e entry) expired(now time.Time) bool {
+	if e.deleted {
+		return e.stamp.Wall < now.Add(-tombstoneTTL).UnixNano()
+	}
+	return e.expires != 0 && e.expires <= now.UnixNano()
+}
+
+// merge applies the writes of o which are after the ones of s and accepted
+// by valid, returning true if s changed. The writes of o expired at the time
+// now are ignored
+func (s state) merge(o state, now time.Time, valid func(bucket, key string, e entry) bool) bool {
+	changed := false
+	for bucket, keys := range o {
+		for k, e := range keys {
+			if e.expired(now) {
+				continue
+			}
+			if cur, exists := s[bucket][k]; (!exists || e.after(cur)) && valid(bucket, k, e) {
+				s.set(bucket, k, e)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// equal returns true if s and o have the same writes
+func (s state) equal(o state) bool {
+	if s.len() != o.len() {
+		return false
+	}
+	for bucket, keys := range s {
+		for k, e := range keys {
+			if oe, exists := o[bucket][k]; !exists || oe != e {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s state) len() int {
+	n := 0
+	for _, keys := range s {
+		n += len(keys)
+	}
+	return n
+}
+
+// latest returns the timestamp of the last write
+func (s state) latest() Timestamp {
+	var t Timestamp
+	for _, keys := range s {
+		for _, e := range keys {
+			if t.Before(e.stamp) {
+				t = e.stamp
+			}
+		}
+	}
+	return t
+}
+
+// prune forgets the writes expired at the time now, returning true if s changed
+func (s state) prune(now time.Time) bool {
+	changed := false
+	for bucket, keys := range s {
+		for k, e := range keys {
+			if e.expired(now) {
+				delete(keys, k)
+				changed = true
+			}
+		}
+		if len(keys) == 0 {
+			delete(s, bucket)
+		}
+	}
+	return changed
+}
+
+// since returns the writes of s after the versions of the keys, as returned by versions
+func (s state) since(versions map[string]map[string]Timestamp) state {
+	res := state{}
+	for bucket, keys := range s {
+		for k, e := range keys {
+			if v, exists := versions[bucket][k]; !exists || v.Before(e.stamp) {
+				res.set(bucket, k, e)
+			}
+		}
+	}
+	return res
+}
+
+// versions returns the timestamp of the last write of each key
+func (s state) versions() map[string]map[string]Timestamp {
+	return s.block().Clock
+}
+
+// digest returns a hash of the last write of each key, the ones expired
+// at the time now excluded. Two peers with the same digest have the same data
+func (s state) digest(now time.Time) string {
+	writes := []string{}
+	for bucket, keys := range s {
+		for k, e := range keys {
+			if e.expired(now) {
+				continue
+			}
+			writes = append(writes, fmt.Sprintf("%q %q %d %d %q %t", bucket, k, e.stamp.Wall, e.stamp.Logical, e.stamp.Node, e.deleted))
+		}
+	}
+	sort.Strings(writes)
+	h := sha256.New()
+	for _, w := range writes {
+		h.Write([]byte(w))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// block returns a block with the storage, the clock, the expiries and the signatures of the state
+func (s state) block() Block {
+	b := Block{Storage: map[string]map[string]Data{}, Clock: map[string]map[string]Timestamp{}, Signatures: map[string]map[string][]byte{}}
+	for bucket, keys := range s {
+		b.Clock[bucket] = map[string]Timestamp{}
+		for k, e := range keys {
+			b.Clock[bucket][k] = e.stamp
+			if e.signature != "" {
+				if _, exists := b.Signatures[bucket]; !exists {
+					b.Signatures[bucket] = map[string][]byte{}
+				}
+				b.Signatures[bucket][k] = []byte(e.signature)
+			}
+			if e.expires != 0 {
+				if b.Expires == nil {
+					b.Expires = map[string]map[string]int64{}
+				}
+				if _, exists := b.Expires[bucket]; !exists {
+					b.Expires[bucket] = map[string]int64{}
+				}
+				b.Expires[bucket][k] = e.expires
+			}
+			if e.deleted {
+				continue
+			}
+			if _, exists := b.Storage[bucket]; !exists {
+				b.Storage[bucket] = map[string]Data{}
+			}
+			b.Storage[bucket][k] = e.value
+		}
+	}
+	return b
+}
@@ -0,0 +1,146 @@
+package blockchain_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeTime is a physical time moved by the tests
+type fakeTime struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (f *fakeTime) now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.t
+}
+
+func (f *fakeTime) add(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+	f.t = f.t.Add(d)
+}
+
+var _ = Describe("TTL", func() {
+	var (
+		clock *fakeTime
+	)
+
+	BeforeEach(func() {
+		clock = &fakeTime{t: time.Now()}
+	})
+
+	It("drops the keys after their ttl", func() {
+		a, _ := newLedger()
+		a.SetNow(clock.now)
+
+		a.AddTTL("healthcheck", map[string]interface{}{"a": "1"}, time.Minute)
+		a.Add("healthcheck", map[string]interface{}{"b": "1"})
+		ttl, exists := a.TTL("healthcheck", "a")
+		Expect(exists).To(BeTrue())
+		Expect(ttl).To(BeNumerically("~", time.Minute, time.Second))
+		ttl, exists = a.TTL("healthcheck", "b")
+		Expect(exists).To(BeTrue())
+		Expect(ttl).To(BeZero())
+
+		clock.add(30 * time.Second)
+		a.Expire()
+		Expect(value(a, "healthcheck", "a")).To(Equal("1"))
+
+		// Writing the key again renews it
+		a.AddTTL("healthcheck", map[string]interface{}{"a": "2"}, time.Minute)
+		clock.add(45 * time.Second)
+		a.Expire()
+		Expect(value(a, "healthcheck", "a")).To(Equal("2"))
+
+		clock.add(30 * time.Second)
+		_, exists = a.TTL("healthcheck", "a")
+		Expect(exists).To(BeFalse())
+		a.Expire()
+		_, exists = a.GetKey("healthcheck", "a")
+		Expect(exists).To(BeFalse())
+		Expect(value(a, "healthcheck", "b")).To(Equal("1"))
+	})
+
+	It("expires the keys on every peer, without messages", func() {
+		a, wa := newLedger()
+		b, wb := newLedger()
+		a.SetNow(clock.now)
+		b.SetNow(clock.now)
+
+		a.AddTTL("users", map[string]interface{}{"a": "1"}, time.Minute)
+		Expect(deliver(b, wa)).To(Succeed())
+		Expect(value(b, "users", "a")).To(Equal("1"))
+		Expect(b.Provenance("users")["a"].Expires).ToNot(BeZero())
+
+		clock.add(2 * time.Minute)
+		sent := len(wa.messages())
+		a.Expire()
+		b.Expire()
+		Expect(wa.messages()).To(HaveLen(sent))
+		Expect(wb.messages()).To(BeEmpty())
+		Expect(a.CurrentData()).To(Equal(b.CurrentData()))
+		Expect(a.CurrentData()).ToNot(HaveKey("users"))
+
+		// A peer which missed the expiry doesn't write the key again
+		c, _ := newLedger()
+		c.SetNow(clock.now)
+		Expect(deliver(c, wa)).To(Succeed())
+		Expect(c.CurrentData()).ToNot(HaveKey("users"))
+		Expect(deliver(a, wa)).To(Succeed())
+		Expect(a.CurrentData()).ToNot(HaveKey("users"))
+	})
+
+	It("rejects the writes of the peers with a clock far ahead", func() {
+		a, _ := newLedger()
+		b, wb := newLedger()
+		a.SetNow(clock.now)
+		a.AddTTL("healthcheck", map[string]interface{}{"a": "1"}, time.Minute)
+
+		// b is an hour ahead
+		future := &fakeTime{t: clock.now().Add(time.Hour)}
+		b.SetNow(future.now)
+		b.Add("machines", map[string]interface{}{"10.1.0.1": "b"})
+		Expect(deliver(a, wb)).ToNot(Succeed())
+		_, exists := a.GetKey("machines", "10.1.0.1")
+		Expect(exists).To(BeFalse())
+
+		// The clock of a didn't move, the keys with a TTL are kept
+		a.Expire()
+		Expect(value(a, "healthcheck", "a")).To(Equal("1"))
+		ttl, _ := a.TTL("healthcheck", "a")
+		Expect(ttl).To(BeNumerically("~", time.Minute, time.Second))
+
+		// A small skew is accepted
+		d, wd := newLedger()
+		d.SetNow((&fakeTime{t: clock.now().Add(30 * time.Second)}).now)
+		d.Add("machines", map[string]interface{}{"10.1.0.2": "d"})
+		Expect(deliver(a, wd)).To(Succeed())
+		Expect(value(a, "machines", "10.1.0.2")).To(Equal("d"))
+	})
+})
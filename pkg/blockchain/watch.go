@@ -0,0 +1,315 @@
+package blockchain
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// EventType is the type of a change of a key of the ledger
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+	// EventOverflow is the last event of a watcher which did not read the events
+	// fast enough, the events after the ones read are lost
+	EventOverflow EventType = "overflow"
+)
+
+// maxWatchQueue is the maximum number of changes queued for a watcher, besides the
+// keys sent first. The watchers reading slower are closed with an overflow event
+var maxWatchQueue = 4096
+
+// Event is a change of a key of the ledger
+type Event struct {
+	Type        EventType
+	Bucket, Key string
+	// Old is the value before the change, empty if the key is new
+	Old Data `json:",omitempty"`
+	// New is the value after the change, empty if the key is deleted
+	New Data `json:",omitempty"`
+	// Index is the index of the block with the change
+	Index int
+	// Writer is the peer which made the change, if known
+	Writer string `json:",omitempty"`
+}
+
+// watcher queues the events of a bucket, or of a key of a bucket, for a Watch
+type watcher struct {
+	sync.Mutex
+	bucket, key string
+	queue       []Event
+	notify      chan struct{}
+	// limit is the length of the queue after which the watcher overflows
+	limit      int
+	overflowed bool
+}
+
+func newWatcher(bucket string, key ...string) *watcher {
+	w := &watcher{bucket: bucket, notify: make(chan struct{}, 1), limit: maxWatchQueue}
+	if len(key) > 0 {
+		w.key = key[0]
+	}
+	return w
+}
+
+func (w *watcher) matches(e Event) bool {
+	return (w.bucket == "" || e.Bucket == w.bucket) && (w.key == "" || e.Key == w.key)
+}
+
+// load queues the keys sent first, which are not limited
+func (w *watcher) load(events []Event) {
+	w.Lock()
+	defer w.Unlock()
+	for _, e := range events {
+		if w.matches(e) {
+			w.queue = append(w.queue, e)
+			w.limit++
+		}
+	}
+}
+
+func (w *watcher) push(events []Event) {
+	w.Lock()
+	if w.overflowed {
+		w.Unlock()
+		return
+	}
+	for _, e := range events {
+		if w.matches(e) {
+			w.queue = append(w.queue, e)
+		}
+	}
+	if len(w.queue) > w.limit {
+		w.queue = []Event{{Type: EventOverflow, Bucket: w.bucket, Key: w.key}}
+		w.overflowed = true
+	}
+	w.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) pop() (Event, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.queue) == 0 {
+		return Event{}, false
+	}
+	e := w.queue[0]
+	w.queue = w.queue[1:]
+	if w.limit > maxWatchQueue {
+		w.limit--
+	}
+	return e, true
+}
+
+// Watch returns a channel with the changes of the keys of the bucket (of all the
+// buckets if empty), or of the given key only. The keys in the ledger are sent first
+// as put events. The events are queued until read, and the channel is closed when
+// the context is done, or after an overflow event if too many are queued: the
+// changes are then to be watched again
+func (l *Ledger) Watch(ctx context.Context, bucket string, key ...string) <-chan Event {
+	w := newWatcher(bucket, key...)
+	l.subscribe(w, func(last Block) { w.load(changes(Block{}, last, bucket)) })
+
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+		l.drain(ctx, w, func(e Event) bool {
+			select {
+			case out <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out
+}
+
+// subscribe adds a watcher, calling init with the last block before any change is sent to it
+func (l *Ledger) subscribe(w *watcher, init func(last Block)) {
+	l.Lock()
+	defer l.Unlock()
+	init(l.blockchain.Last())
+	if l.watchers == nil {
+		l.watchers = map[*watcher]struct{}{}
+	}
+	l.watchers[w] = struct{}{}
+}
+
+// drain passes the events of a watcher to f until the context is done or f returns false,
+// then removes the watcher
+func (l *Ledger) drain(ctx context.Context, w *watcher, f func(Event) bool) {
+	defer func() {
+		l.Lock()
+		delete(l.watchers, w)
+		l.Unlock()
+	}()
+	for {
+		e, ok := w.pop()
+		if !ok {
+			select {
+			case <-w.notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !f(e) || e.Type == EventOverflow {
+			return
+		}
+	}
+}
+
+// commit adds a block after last, and sends its changes to the watchers (to be called with the lock held)
+func (l *Ledger) commit(last, block Block) {
+	l.blockchain.Add(block)
+	if len(l.watchers) == 0 {
+		return
+	}
+
+	buckets := map[string]bool{}
+	for w := range l.watchers {
+		buckets[w.bucket] = true
+	}
+	events := []Event{}
+	if buckets[""] {
+		events = changes(last, block, "")
+	} else {
+		for b := range buckets {
+			events = append(events, changes(last, block, b)...)
+		}
+	}
+	if len(events) == 0 {
+		return
+	}
+	for w := range l.watchers {
+		w.push(events)
+	}
+}
+
+// changes returns the changes of the bucket (of all the buckets if empty) between two blocks
+func changes(old, new Block, bucket string) []Event {
+	names := map[string]bool{}
+	if bucket != "" {
+		names[bucket] = true
+	} else {
+		for b := range old.Storage {
+			names[b] = true
+		}
+		for b := range new.Storage {
+			names[b] = true
+		}
+	}
+
+	events := []Event{}
+	for b := range names {
+		before, after := old.Storage[b], new.Storage[b]
+		for k, v := range after {
+			if ov, exists := before[k]; !exists || ov != v {
+				events = append(events, Event{Type: EventPut, Bucket: b, Key: k, Old: ov, New: v, Index: new.Index, Writer: new.Clock[b][k].Node})
+			}
+		}
+		for k, ov := range before {
+			if _, exists := after[k]; !exists {
+				events = append(events, Event{Type: EventDelete, Bucket: b, Key: k, Old: ov, Index: new.Index, Writer: new.Clock[b][k].Node})
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Bucket != events[j].Bucket {
+			return events[i].Bucket < events[j].Bucket
+		}
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
+
+// BucketView is a copy of a bucket of the ledger, kept up to date with Watch
+type BucketView struct {
+	sync.RWMutex
+	data map[string]Data
+}
+
+// View returns a copy of the bucket, updated until the context is done
+func (l *Ledger) View(ctx context.Context, bucket string) *BucketView {
+	v := &BucketView{}
+	v.watch(ctx, l, bucket)
+	return v
+}
+
+// watch copies the bucket and applies its changes, copying it again on overflow
+func (v *BucketView) watch(ctx context.Context, l *Ledger, bucket string) {
+	w := newWatcher(bucket)
+	l.subscribe(w, func(last Block) {
+		v.Lock()
+		v.data = copyBucket(last.Storage[bucket])
+		v.Unlock()
+	})
+	go l.drain(ctx, w, func(e Event) bool {
+		if e.Type == EventOverflow {
+			v.watch(ctx, l, bucket)
+			return false
+		}
+		v.apply(e)
+		return true
+	})
+}
+
+func (v *BucketView) apply(e Event) {
+	v.Lock()
+	defer v.Unlock()
+	switch e.Type {
+	case EventPut:
+		v.data[e.Key] = e.New
+	case EventDelete:
+		delete(v.data, e.Key)
+	}
+}
+
+// Get returns the value of a key
+func (v *BucketView) Get(key string) (Data, bool) {
+	v.RLock()
+	defer v.RUnlock()
+	d, exists := v.data[key]
+	return d, exists
+}
+
+// Data returns a copy of the bucket
+func (v *BucketView) Data() map[string]Data {
+	v.RLock()
+	defer v.RUnlock()
+	return copyBucket(v.data)
+}
+
+func copyBucket(b map[string]Data) map[string]Data {
+	c := make(map[string]Data, len(b))
+	for k, d := range b {
+		c[k] = d
+	}
+	return c
+}
@@ -0,0 +1,159 @@
+package blockchain_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/blockchain"
+)
+
+func next(events <-chan Event) Event {
+	var e Event
+	Eventually(events, 5*time.Second).Should(Receive(&e))
+	return e
+}
+
+var _ = Describe("Watch", func() {
+	It("sends the keys of the bucket and their changes", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a, wa := newLedger()
+		b, _ := newLedger()
+		a.Add("machines", map[string]interface{}{"10.1.0.1": "a"})
+		a.Add("users", map[string]interface{}{"foo": "a"})
+
+		events := a.Watch(ctx, "machines")
+		e := next(events)
+		Expect(e.Type).To(Equal(EventPut))
+		Expect(e.Key).To(Equal("10.1.0.1"))
+		Expect(e.Old).To(BeEmpty())
+		Expect(e.New).To(Equal(Data(`"a"`)))
+
+		a.Add("users", map[string]interface{}{"bar": "a"})
+		a.Add("machines", map[string]interface{}{"10.1.0.1": "b"})
+		e = next(events)
+		Expect(e.Type).To(Equal(EventPut))
+		Expect(e.Old).To(Equal(Data(`"a"`)))
+		Expect(e.New).To(Equal(Data(`"b"`)))
+		Expect(e.Index).To(Equal(a.LastBlock().Index))
+
+		// The writes of the peers are sent too
+		remote := b.Watch(ctx, "machines", "10.1.0.1")
+		Expect(deliver(b, wa)).To(Succeed())
+		Expect(next(remote).New).To(Equal(Data(`"a"`)))
+		e = next(remote)
+		Expect(e.Old).To(Equal(Data(`"a"`)))
+		Expect(e.New).To(Equal(Data(`"b"`)))
+		Expect(e.Writer).ToNot(BeEmpty())
+		Consistently(remote).ShouldNot(Receive())
+
+		a.Delete("machines", "10.1.0.1")
+		e = next(events)
+		Expect(e.Type).To(Equal(EventDelete))
+		Expect(e.Old).To(Equal(Data(`"b"`)))
+		Expect(e.New).To(BeEmpty())
+		Consistently(events).ShouldNot(Receive())
+	})
+
+	It("closes the channel when the context is done", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		a, _ := newLedger()
+		events := a.Watch(ctx, "")
+		cancel()
+		Eventually(events).Should(BeClosed())
+	})
+
+	It("closes the watchers reading too slowly with an overflow event", func() {
+		defer SetMaxWatchQueue(2)()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a, _ := newLedger()
+		a.Add("machines", map[string]interface{}{"a": "1", "b": "1", "c": "1"})
+
+		// The keys sent first are not limited
+		events := a.Watch(ctx, "machines")
+		Expect(next(events).Type).To(Equal(EventPut))
+		Expect(next(events).Type).To(Equal(EventPut))
+		Expect(next(events).Type).To(Equal(EventPut))
+
+		for _, k := range []string{"d", "e", "f", "g"} {
+			a.Add("machines", map[string]interface{}{k: "1"})
+		}
+		// The changes read before overflowing are sent first
+		e := next(events)
+		for e.Type == EventPut {
+			e = next(events)
+		}
+		Expect(e.Type).To(Equal(EventOverflow))
+		Eventually(events).Should(BeClosed())
+
+		// The watchers reading fast enough are not closed
+		events = a.Watch(ctx, "machines")
+		for i := 0; i < 7; i++ {
+			Expect(next(events).Type).To(Equal(EventPut))
+		}
+		for _, k := range []string{"h", "i", "j", "k"} {
+			a.Add("machines", map[string]interface{}{k: "1"})
+			Expect(next(events).Key).To(Equal(k))
+		}
+	})
+
+	It("keeps a view of the bucket after overflowing", func() {
+		defer SetMaxWatchQueue(1)()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a, _ := newLedger()
+		v := a.View(ctx, "healthcheck")
+		for i := 0; i < 100; i++ {
+			a.Add("healthcheck", map[string]interface{}{fmt.Sprint(i): "1"})
+		}
+		a.Delete("healthcheck", "0")
+		Eventually(v.Data).Should(HaveLen(99))
+		_, exists := v.Get("0")
+		Expect(exists).To(BeFalse())
+	})
+
+	It("keeps a view of the bucket", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		a, _ := newLedger()
+		a.Add("healthcheck", map[string]interface{}{"a": "1"})
+		v := a.View(ctx, "healthcheck")
+		Expect(v.Data()).To(HaveKey("a"))
+
+		a.Add("healthcheck", map[string]interface{}{"b": "1"})
+		a.DeleteBucket("healthcheck")
+		a.Add("healthcheck", map[string]interface{}{"c": "1"})
+		Eventually(v.Data).Should(And(HaveLen(1), HaveKey("c")))
+		_, exists := v.Get("a")
+		Expect(exists).To(BeFalse())
+	})
+})
@@ -54,13 +54,25 @@ import (
 // It is used to generate opts for the node and the services before start.
 type Config struct {
 	NetworkConfig, NetworkToken                string
-	Address                                    string
+	Address, Address6                          string
 	Router                                     string
 	Interface                                  string
 	Libp2pLogLevel, LogLevel                   string
 	LowProfile, VPNLowProfile, BootstrapIface  bool
+	HostRoutes                                 bool
+	RouteTable                                 int
+	RoutingRule                                string
+	DisableIPv6, DisableRelay, Userspace       bool
+	TAP                                        bool
+	UserspaceProxy, Multicast, Compression     string
+	Transport, DatagramAddress                 string
 	Blacklist                                  []string
+	Routes, ExitNodes                          []string
+	PeerLimits, TrafficClasses                 []string
+	LimitIn, LimitOut                          int
+	ExitNodeTimeout                            time.Duration
 	Concurrency                                int
+	CaptureSize, MulticastRate                 int
 	FrameTimeout                               string
 	ChannelBufferSize, InterfaceMTU, PacketMTU int
 	NAT                                        NAT
@@ -99,6 +111,7 @@ type ResourceLimit struct {
 type Ledger struct {
 	AnnounceInterval, SyncInterval time.Duration
 	StateDir                       string
+	AcceptUnsigned                 bool
 }
 
 // Discovery allows to enable/disable discovery and
@@ -208,6 +221,7 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 		node.WithDiscoveryInterval(c.Discovery.Interval),
 		node.WithLedgerAnnounceTime(c.Ledger.AnnounceInterval),
 		node.WithLedgerInterval(c.Ledger.SyncInterval),
+		node.AcceptUnsignedLedger(c.Ledger.AcceptUnsigned),
 		node.Logger(llger),
 		node.WithDiscoveryBootstrapPeers(addrsList),
 		node.WithBlacklist(c.Blacklist...),
@@ -218,13 +232,48 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 		node.FromYaml(mDNS, dhtE, config, dhtOpts...),
 	}
 
+	exitNodes := []vpn.ExitNode{}
+	for _, e := range c.ExitNodes {
+		n, err := vpn.ParseExitNode(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		exitNodes = append(exitNodes, n)
+	}
+
+	shaping := vpn.Shaping{
+		Global:  vpn.Limit{In: c.LimitIn, Out: c.LimitOut},
+		Peers:   map[string]vpn.Limit{},
+		Classes: []vpn.TrafficClass{},
+	}
+	for _, l := range c.PeerLimits {
+		id, limit, err := vpn.ParsePeerLimit(l)
+		if err != nil {
+			return nil, nil, err
+		}
+		shaping.Peers[id] = limit
+	}
+	for _, t := range c.TrafficClasses {
+		class, err := vpn.ParseTrafficClass(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		shaping.Classes = append(shaping.Classes, class)
+	}
+
+	deviceType := water.DeviceType(water.TUN)
+	if c.TAP {
+		deviceType = water.TAP
+	}
+
 	vpnOpts := []vpn.Option{
 		vpn.WithConcurrency(c.Concurrency),
 		vpn.WithInterfaceAddress(address),
+		vpn.WithInterfaceAddress6(c.Address6),
 		vpn.WithLedgerAnnounceTime(c.Ledger.AnnounceInterval),
 		vpn.Logger(llger),
 		vpn.WithTimeout(c.FrameTimeout),
-		vpn.WithInterfaceType(water.TUN),
+		vpn.WithInterfaceType(deviceType),
 		vpn.NetLinkBootstrap(c.BootstrapIface),
 		vpn.WithChannelBufferSize(c.ChannelBufferSize),
 		vpn.WithInterfaceMTU(c.InterfaceMTU),
@@ -232,12 +281,49 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 		vpn.WithRouterAddress(router),
 		vpn.WithInterfaceName(iface),
 		vpn.WithMaxStreams(c.Connection.MaxStreams),
+		vpn.WithRoutes(c.Routes...),
+		vpn.WithExitNodes(exitNodes...),
+		vpn.WithUserspace(c.Userspace),
+		vpn.WithUserspaceProxy(c.UserspaceProxy),
+		vpn.WithCaptureSize(c.CaptureSize),
+		vpn.WithCompression(c.Compression),
+		vpn.WithTransport(c.Transport),
+		vpn.WithDatagramAddress(c.DatagramAddress),
+		vpn.WithMulticast(c.Multicast),
+		vpn.WithMulticastRate(c.MulticastRate),
 	}
 
 	if c.VPNLowProfile {
 		vpnOpts = append(vpnOpts, vpn.LowProfile)
 	}
 
+	if c.DisableIPv6 {
+		vpnOpts = append(vpnOpts, vpn.DisableIPv6)
+	}
+
+	if c.ExitNodeTimeout != 0 {
+		vpnOpts = append(vpnOpts, vpn.WithExitNodeTimeout(c.ExitNodeTimeout))
+	}
+
+	if c.DisableRelay {
+		vpnOpts = append(vpnOpts, vpn.DisableRelay)
+	}
+
+	if c.HostRoutes {
+		vpnOpts = append(vpnOpts, vpn.HostRoutes(true), vpn.WithRouteTable(c.RouteTable))
+		if c.RoutingRule != "" {
+			r, err := vpn.ParseRoutingRule(c.RoutingRule)
+			if err != nil {
+				return nil, nil, err
+			}
+			vpnOpts = append(vpnOpts, vpn.WithRoutingRule(r))
+		}
+	}
+
+	if c.LimitIn != 0 || c.LimitOut != 0 || len(shaping.Peers) != 0 || len(shaping.Classes) != 0 {
+		vpnOpts = append(vpnOpts, vpn.WithShaping(shaping))
+	}
+
 	libp2pOpts := []libp2p.Option{libp2p.UserAgent("BhojpurVPN")}
 
 	// AutoRelay section configuration
@@ -0,0 +1,138 @@
+package config
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var networkName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// Network is one of the networks joined by the same process.
+// The empty fields are taken from the process configuration,
+// so at most one network can leave the address or the interface empty
+type Network struct {
+	Name                 string
+	NetworkConfig, Token string
+	Address, Address6    string
+	Interface            string
+	DatagramAddress      string
+}
+
+// ParseNetwork parses a network in the 'name=prod,token=...,address=10.2.0.1/24,interface=vpn1' form.
+// The other keys are 'config' for a network configuration file, 'address6' and 'datagram-address'
+func ParseNetwork(s string) (Network, error) {
+	n := Network{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			return n, fmt.Errorf("invalid network option '%s'", kv)
+		}
+		switch v := strings.TrimSpace(p[1]); strings.TrimSpace(p[0]) {
+		case "name":
+			n.Name = v
+		case "token":
+			n.Token = v
+		case "config":
+			n.NetworkConfig = v
+		case "address":
+			n.Address = v
+		case "address6":
+			n.Address6 = v
+		case "interface":
+			n.Interface = v
+		case "datagram-address":
+			n.DatagramAddress = v
+		default:
+			return n, fmt.Errorf("invalid network option '%s'", p[0])
+		}
+	}
+
+	if !networkName.MatchString(n.Name) {
+		return n, fmt.Errorf("invalid network name '%s'", n.Name)
+	}
+	if n.Token == "" && n.NetworkConfig == "" {
+		return n, fmt.Errorf("network '%s' needs a token or a config", n.Name)
+	}
+	return n, nil
+}
+
+// ValidateNetworks returns an error if two networks share the same name,
+// interface, address or datagram address
+func ValidateNetworks(networks []Network) error {
+	seen := map[string]string{}
+	for _, n := range networks {
+		for _, f := range []struct {
+			field, value string
+			// An empty datagram address is a random port
+			shared bool
+		}{
+			{"name", n.Name, false},
+			{"interface", n.Interface, false},
+			{"address", n.Address, false},
+			{"datagram address", n.DatagramAddress, true},
+		} {
+			if f.value == "" && f.shared {
+				continue
+			}
+			key := f.field + "/" + f.value
+			if other, exists := seen[key]; exists {
+				if f.value == "" {
+					return fmt.Errorf("networks '%s' and '%s' both use the default %s", other, n.Name, f.field)
+				}
+				return fmt.Errorf("networks '%s' and '%s' both use the %s '%s'", other, n.Name, f.field, f.value)
+			}
+			seen[key] = n.Name
+		}
+	}
+	return nil
+}
+
+// Apply returns a copy of the process configuration for the network.
+// The ledger of each network is stored in its own directory
+func (n Network) Apply(c Config) Config {
+	c.NetworkToken = n.Token
+	c.NetworkConfig = n.NetworkConfig
+	for _, f := range []struct {
+		value string
+		field *string
+	}{
+		{n.Address, &c.Address},
+		{n.Address6, &c.Address6},
+		{n.Interface, &c.Interface},
+		{n.DatagramAddress, &c.DatagramAddress},
+	} {
+		if f.value != "" {
+			*f.field = f.value
+		}
+	}
+	if c.Ledger.StateDir != "" {
+		c.Ledger.StateDir = filepath.Join(c.Ledger.StateDir, n.Name)
+	}
+	return c
+}
@@ -0,0 +1,127 @@
+package config_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/config"
+)
+
+var _ = Describe("Networks", func() {
+	DescribeTable("parses the networks",
+		func(s string, expected Network) {
+			n, err := ParseNetwork(s)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(expected))
+		},
+		Entry("with a token", "name=prod,token=abc", Network{Name: "prod", Token: "abc"}),
+		Entry("with a config", "name=lab,config=/etc/vpn/lab.yaml", Network{Name: "lab", NetworkConfig: "/etc/vpn/lab.yaml"}),
+		Entry("with all the options",
+			"name=prod_1,token=abc,address=10.2.0.1/24,address6=fd00::1/64,interface=vpn1,datagram-address=:5351",
+			Network{Name: "prod_1", Token: "abc", Address: "10.2.0.1/24", Address6: "fd00::1/64", Interface: "vpn1", DatagramAddress: ":5351"}),
+		Entry("with spaces and empty options", " name = prod , token=abc,, ", Network{Name: "prod", Token: "abc"}),
+		Entry("with a token containing '='", "name=prod,token=YWJj==", Network{Name: "prod", Token: "YWJj=="}),
+	)
+
+	DescribeTable("rejects the invalid networks",
+		func(s, message string) {
+			_, err := ParseNetwork(s)
+			Expect(err).To(MatchError(message))
+		},
+		Entry("without a name", "token=abc", "invalid network name ''"),
+		Entry("with an invalid name", "name=prod/1,token=abc", "invalid network name 'prod/1'"),
+		Entry("without a token or a config", "name=prod,address=10.2.0.1/24", "network 'prod' needs a token or a config"),
+		Entry("with an unknown option", "name=prod,token=abc,mtu=1420", "invalid network option 'mtu'"),
+		Entry("with an option without a value", "name=prod,token", "invalid network option 'token'"),
+	)
+
+	DescribeTable("validates the networks",
+		func(networks []Network, message string) {
+			err := ValidateNetworks(networks)
+			if message == "" {
+				Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			Expect(err).To(MatchError(message))
+		},
+		Entry("with distinct networks", []Network{
+			{Name: "a", Interface: "vpn0", Address: "10.1.0.1/24"},
+			{Name: "b", Interface: "vpn1", Address: "10.2.0.1/24", DatagramAddress: ":5351"},
+		}, ""),
+		Entry("with one network using the defaults", []Network{
+			{Name: "a"},
+			{Name: "b", Interface: "vpn1", Address: "10.2.0.1/24"},
+		}, ""),
+		Entry("with random datagram ports", []Network{
+			{Name: "a", Interface: "vpn0", Address: "10.1.0.1/24"},
+			{Name: "b", Interface: "vpn1", Address: "10.2.0.1/24"},
+		}, ""),
+		Entry("with the same name", []Network{
+			{Name: "a", Interface: "vpn0", Address: "10.1.0.1/24"},
+			{Name: "a", Interface: "vpn1", Address: "10.2.0.1/24"},
+		}, "networks 'a' and 'a' both use the name 'a'"),
+		Entry("with the same interface", []Network{
+			{Name: "a", Interface: "vpn0", Address: "10.1.0.1/24"},
+			{Name: "b", Interface: "vpn0", Address: "10.2.0.1/24"},
+		}, "networks 'a' and 'b' both use the interface 'vpn0'"),
+		Entry("with the same address", []Network{
+			{Name: "a", Interface: "vpn0", Address: "10.1.0.1/24"},
+			{Name: "b", Interface: "vpn1", Address: "10.1.0.1/24"},
+		}, "networks 'a' and 'b' both use the address '10.1.0.1/24'"),
+		Entry("with the same datagram address", []Network{
+			{Name: "a", Interface: "vpn0", Address: "10.1.0.1/24", DatagramAddress: ":5351"},
+			{Name: "b", Interface: "vpn1", Address: "10.2.0.1/24", DatagramAddress: ":5351"},
+		}, "networks 'a' and 'b' both use the datagram address ':5351'"),
+		Entry("with two networks using the default interface", []Network{
+			{Name: "a", Address: "10.1.0.1/24"},
+			{Name: "b", Address: "10.2.0.1/24"},
+		}, "networks 'a' and 'b' both use the default interface"),
+	)
+
+	DescribeTable("applies the networks to the process configuration",
+		func(n Network, c Config, expected Config) {
+			Expect(n.Apply(c)).To(Equal(expected))
+		},
+		Entry("overriding the fields set",
+			Network{Name: "lab", Token: "abc", Address: "10.2.0.1/24", Address6: "fd00::1/64", Interface: "vpn1", DatagramAddress: ":5351"},
+			Config{NetworkToken: "xyz", Address: "10.1.0.1/24", Interface: "vpn0", LogLevel: "debug"},
+			Config{NetworkToken: "abc", Address: "10.2.0.1/24", Address6: "fd00::1/64", Interface: "vpn1", DatagramAddress: ":5351", LogLevel: "debug"}),
+		Entry("keeping the other ones",
+			Network{Name: "lab", NetworkConfig: "lab.yaml"},
+			Config{NetworkToken: "xyz", Address: "10.1.0.1/24", Interface: "vpn0"},
+			Config{NetworkConfig: "lab.yaml", Address: "10.1.0.1/24", Interface: "vpn0"}),
+		Entry("storing the ledger in a directory of the network",
+			Network{Name: "lab", Token: "abc"},
+			Config{Ledger: Ledger{StateDir: "/var/lib/vpn"}},
+			Config{NetworkToken: "abc", Ledger: Ledger{StateDir: filepath.Join("/var/lib/vpn", "lab")}}),
+	)
+
+	It("leaves the process configuration unchanged", func() {
+		c := Config{Address: "10.1.0.1/24", Ledger: Ledger{StateDir: "/var/lib/vpn"}}
+		Network{Name: "lab", Token: "abc", Address: "10.2.0.1/24"}.Apply(c)
+		Expect(c.Address).To(Equal("10.1.0.1/24"))
+		Expect(c.Ledger.StateDir).To(Equal("/var/lib/vpn"))
+	})
+})
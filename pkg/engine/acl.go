@@ -0,0 +1,434 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+const (
+	// flowTimeout is the idle time after which the replies of an allowed flow
+	// are evaluated again against the ACL
+	flowTimeout = 5 * time.Minute
+
+	// fragmentTimeout is how long the fragments of a packet are let through after
+	// its first one, as long as the hosts wait for them to reassemble it
+	fragmentTimeout = 30 * time.Second
+)
+
+// maxFlows is the number of flows, and of fragmented packets, tracked by the
+// firewall. Once full, random ones are evicted for the new ones: the replies of
+// a flow evicted are evaluated again against the ACL
+var maxFlows = 65536
+
+// protocolNames maps the protocol names usable in ACL rules to their IANA numbers
+var protocolNames = map[string]int{
+	"icmp":   1,
+	"tcp":    protocolTCP,
+	"udp":    protocolUDP,
+	"icmpv6": 58,
+	"sctp":   protocolSCTP,
+}
+
+// Flow describes the traffic evaluated against an ACL
+type Flow struct {
+	Src, Dst         net.IP
+	SrcPeer, DstPeer string
+	Protocol         int
+	DstPort          uint16
+
+	// Fragment is set for the fragments after the first one of a packet, which
+	// carry no ports: the rules on ports don't match them
+	Fragment bool
+}
+
+// endpoint matches the source or the destination of a flow, either
+// by address or by peer ID. The zero value matches anything
+type endpoint struct {
+	net  *net.IPNet
+	peer string
+}
+
+func parseEndpoint(s string) (endpoint, error) {
+	switch {
+	case s == "":
+		return endpoint{}, nil
+	case strings.Contains(s, "/"):
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return endpoint{}, err
+		}
+		return endpoint{net: n}, nil
+	case net.ParseIP(s) != nil:
+		ip := net.ParseIP(s)
+		bits := 8 * net.IPv6len
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 8*net.IPv4len
+		}
+		return endpoint{net: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}, nil
+	default:
+		if _, err := peer.Decode(s); err != nil {
+			return endpoint{}, fmt.Errorf("'%s' is not an address, a network nor a peer ID", s)
+		}
+		return endpoint{peer: s}, nil
+	}
+}
+
+func (e endpoint) match(ip net.IP, peerID string) bool {
+	switch {
+	case e.net != nil:
+		return ip != nil && e.net.Contains(ip)
+	case e.peer != "":
+		return e.peer == peerID
+	default:
+		return true
+	}
+}
+
+type aclRule struct {
+	types.ACLRule
+	allow            bool
+	src, dst         endpoint
+	protocol         int
+	portMin, portMax uint16
+}
+
+func parseProtocol(s string) (int, error) {
+	if s == "" {
+		return -1, nil
+	}
+	if p, ok := protocolNames[strings.ToLower(s)]; ok {
+		return p, nil
+	}
+	p, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol '%s'", s)
+	}
+	return int(p), nil
+}
+
+func parsePorts(s string) (uint16, uint16, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	min, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ports '%s'", s)
+	}
+	max, err := strconv.ParseUint(to, 10, 16)
+	if err != nil || max < min {
+		return 0, 0, fmt.Errorf("invalid ports '%s'", s)
+	}
+
+	return uint16(min), uint16(max), nil
+}
+
+func compileRule(r types.ACLRule) (aclRule, error) {
+	rule := aclRule{ACLRule: r}
+
+	switch r.Action {
+	case types.ACLAllow:
+		rule.allow = true
+	case types.ACLDeny:
+	default:
+		return rule, fmt.Errorf("invalid action '%s'", r.Action)
+	}
+
+	var err error
+	if rule.src, err = parseEndpoint(r.Source); err != nil {
+		return rule, err
+	}
+	if rule.dst, err = parseEndpoint(r.Destination); err != nil {
+		return rule, err
+	}
+	if rule.protocol, err = parseProtocol(r.Protocol); err != nil {
+		return rule, err
+	}
+	if rule.portMin, rule.portMax, err = parsePorts(r.Ports); err != nil {
+		return rule, err
+	}
+	if r.Ports != "" {
+		switch rule.protocol {
+		case protocolTCP, protocolUDP, protocolSCTP:
+		default:
+			return rule, fmt.Errorf("ports require one of the tcp, udp or sctp protocols")
+		}
+	}
+
+	return rule, nil
+}
+
+func (r aclRule) match(f Flow) bool {
+	if !r.src.match(f.Src, f.SrcPeer) || !r.dst.match(f.Dst, f.DstPeer) {
+		return false
+	}
+	if r.protocol >= 0 && r.protocol != f.Protocol {
+		return false
+	}
+	if r.Ports != "" && (f.Fragment || f.DstPort < r.portMin || f.DstPort > r.portMax) {
+		return false
+	}
+	return true
+}
+
+// ValidateACLRule returns an error if the rule cannot be enforced
+func ValidateACLRule(r types.ACLRule) error {
+	_, err := compileRule(r)
+	return err
+}
+
+// ACL is a set of rules, sorted in evaluation order
+type ACL []aclRule
+
+// NewACL returns an ACL from a list of rules. Invalid rules are skipped.
+func NewACL(rules ...types.ACLRule) ACL {
+	a := ACL{}
+	for _, r := range rules {
+		rule, err := compileRule(r)
+		if err != nil {
+			continue
+		}
+		a = append(a, rule)
+	}
+
+	sort.SliceStable(a, func(i, j int) bool {
+		if a[i].Priority != a[j].Priority {
+			return a[i].Priority < a[j].Priority
+		}
+		return a[i].ID < a[j].ID
+	})
+
+	return a
+}
+
+// Allowed returns true if the flow is allowed by the first matching rule,
+// or if no rule matches it
+func (a ACL) Allowed(f Flow) bool {
+	for _, r := range a {
+		if r.match(f) {
+			return r.allow
+		}
+	}
+	return true
+}
+
+// spoofed returns true if the peer src can not send packets from the address ip:
+// only its VPN addresses, the networks it advertises and, if it is an exit node in
+// use, the networks routed through it are accepted. The IPv6 link-local addresses
+// are accepted to multicast destinations, for the MLD reports
+func spoofed(t *RoutingTable, exits *exitRouter, src peer.ID, p *packetInfo) bool {
+	if t.owns(src, p.Src) {
+		return false
+	}
+	// The VPN addresses of the other machines are never routed through an exit node
+	if _, ok := t.lookupMachine(p.Src); ok {
+		return true
+	}
+	if p.Src.IsLinkLocalUnicast() && p.Dst.IsMulticast() {
+		return false
+	}
+	if exits != nil {
+		if e, _, ok := exits.lookup(p.Src); ok && e.id == src {
+			return false
+		}
+	}
+	return true
+}
+
+type flowKey struct {
+	src, dst         [net.IPv6len]byte
+	protocol         int
+	srcPort, dstPort uint16
+}
+
+func newFlowKey(src, dst net.IP, protocol int, srcPort, dstPort uint16) flowKey {
+	k := flowKey{protocol: protocol, srcPort: srcPort, dstPort: dstPort}
+	copy(k.src[:], src.To16())
+	copy(k.dst[:], dst.To16())
+	return k
+}
+
+// fragmentKey identifies the fragments of a packet
+type fragmentKey struct {
+	src, dst [net.IPv6len]byte
+	protocol int
+	id       uint32
+}
+
+func newFragmentKey(p *packetInfo) fragmentKey {
+	k := fragmentKey{protocol: p.Protocol, id: p.FragmentID}
+	copy(k.src[:], p.Src.To16())
+	copy(k.dst[:], p.Dst.To16())
+	return k
+}
+
+// firewall enforces the ACL on the packets, letting through the replies
+// of the flows it allowed, so rules need to be written only for the
+// direction initiating the connections. The fragments without ports
+// follow the first one of their packet
+type firewall struct {
+	sync.Mutex
+	flows     map[flowKey]time.Time
+	fragments map[fragmentKey]time.Time
+	lastPrune time.Time
+	now       func() time.Time
+	metrics   *metrics
+}
+
+func newFirewall(m *metrics) *firewall {
+	return &firewall{flows: map[flowKey]time.Time{}, fragments: map[fragmentKey]time.Time{}, lastPrune: time.Now(), now: time.Now, metrics: m}
+}
+
+// allowed evaluates the packet sent from srcPeer to dstPeer against the ACL
+func (f *firewall) allowed(acl ACL, p *packetInfo, srcPeer, dstPeer string) bool {
+	if len(acl) == 0 {
+		return true
+	}
+
+	if f.fragmentAllowed(p) || f.established(p) {
+		return true
+	}
+
+	following := p.Fragment && p.FragmentOffset != 0
+	if !acl.Allowed(Flow{
+		Src:      p.Src,
+		Dst:      p.Dst,
+		SrcPeer:  srcPeer,
+		DstPeer:  dstPeer,
+		Protocol: p.Protocol,
+		DstPort:  p.DstPort,
+		Fragment: following,
+	}) {
+		return false
+	}
+
+	// The fragments without ports are not part of a flow
+	if !following {
+		f.track(p)
+	}
+	return true
+}
+
+// fragmentAllowed returns true if the packet is a fragment following the first
+// one of an allowed packet
+func (f *firewall) fragmentAllowed(p *packetInfo) bool {
+	if !p.Fragment || p.FragmentOffset == 0 {
+		return false
+	}
+	k := newFragmentKey(p)
+	now := f.now()
+
+	f.Lock()
+	defer f.Unlock()
+
+	t, ok := f.fragments[k]
+	return ok && now.Sub(t) <= fragmentTimeout
+}
+
+// established returns true if the packet is a reply of an allowed flow
+func (f *firewall) established(p *packetInfo) bool {
+	k := newFlowKey(p.Src, p.Dst, p.Protocol, p.SrcPort, p.DstPort)
+	now := f.now()
+
+	f.Lock()
+	defer f.Unlock()
+
+	t, ok := f.flows[k]
+	if !ok || now.Sub(t) > flowTimeout {
+		return false
+	}
+	f.flows[k] = now
+	f.trackFragments(p, now)
+	f.prune(now)
+	return true
+}
+
+// track allows the replies of the packet flow
+func (f *firewall) track(p *packetInfo) {
+	k := newFlowKey(p.Dst, p.Src, p.Protocol, p.DstPort, p.SrcPort)
+	now := f.now()
+
+	f.Lock()
+	defer f.Unlock()
+
+	if _, ok := f.flows[k]; !ok && len(f.flows) >= maxFlows {
+		for old := range f.flows {
+			delete(f.flows, old)
+			break
+		}
+		f.metrics.flowEvicted()
+	}
+	f.flows[k] = now
+	f.trackFragments(p, now)
+	f.prune(now)
+}
+
+// prune drops the flows and the fragments timed out, at most every fragmentTimeout
+// (to be called with the lock held)
+func (f *firewall) prune(now time.Time) {
+	if now.Sub(f.lastPrune) <= fragmentTimeout {
+		return
+	}
+	for k, t := range f.flows {
+		if now.Sub(t) > flowTimeout {
+			delete(f.flows, k)
+		}
+	}
+	for k, t := range f.fragments {
+		if now.Sub(t) > fragmentTimeout {
+			delete(f.fragments, k)
+		}
+	}
+	f.lastPrune = now
+}
+
+// trackFragments allows the next fragments of the packet if it is the first
+// one (to be called with the lock held)
+func (f *firewall) trackFragments(p *packetInfo, now time.Time) {
+	if !p.Fragment || p.FragmentOffset != 0 {
+		return
+	}
+	k := newFragmentKey(p)
+	if _, ok := f.fragments[k]; !ok && len(f.fragments) >= maxFlows {
+		for old := range f.fragments {
+			delete(f.fragments, old)
+			break
+		}
+		f.metrics.flowEvicted()
+	}
+	f.fragments[k] = now
+}
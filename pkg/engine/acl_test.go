@@ -0,0 +1,345 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+// udpPacket returns an IPv4 UDP packet between the ports
+func udpPacket(src string, srcPort uint16, dst string, dstPort uint16) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint16(payload[0:2], srcPort)
+	binary.BigEndian.PutUint16(payload[2:4], dstPort)
+	return ipv4Packet(src, dst, 17, payload)
+}
+
+// ipv6UDP returns an IPv6 UDP packet to the port, after extension headers of 8
+// bytes of the given types
+func ipv6UDP(src, dst string, port uint16, headers ...int) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint16(payload[0:2], 4000)
+	binary.BigEndian.PutUint16(payload[2:4], port)
+	next := 17
+	for i := len(headers) - 1; i >= 0; i-- {
+		payload = append([]byte{byte(next), 0, 0, 0, 0, 0, 0, 0}, payload...)
+		next = headers[i]
+	}
+	b := ipv6Packet(src, dst, len(payload))
+	b[6] = byte(next)
+	copy(b[40:], payload)
+	return b
+}
+
+// fakeClock is a time moved by the tests
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) add(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+var _ = Describe("ACL", func() {
+	peerA := "12D3KooWQNeJdmS7pBg1EGLewVWd9UUk3MFu7hsER4J1voWdnt5Z"
+	peerB := "12D3KooWF6xQk9GysfPYbpJCuHkj5kpWzQ8dnsFxEByPNtUVVobx"
+
+	flow := func(src, dst string, protocol int, port uint16) Flow {
+		return Flow{
+			Src:      net.ParseIP(src),
+			Dst:      net.ParseIP(dst),
+			SrcPeer:  peerA,
+			DstPeer:  peerB,
+			Protocol: protocol,
+			DstPort:  port,
+		}
+	}
+
+	Context("Evaluation", func() {
+		It("allows everything without rules", func() {
+			Expect(NewACL().Allowed(flow("10.1.0.1", "10.1.0.2", 6, 22))).To(BeTrue())
+		})
+
+		It("applies the first matching rule by priority", func() {
+			acl := NewACL(
+				types.ACLRule{ID: "deny-all", Priority: 100, Action: types.ACLDeny},
+				types.ACLRule{ID: "ssh", Priority: 10, Action: types.ACLAllow, Destination: "10.1.0.0/24", Protocol: "tcp", Ports: "22"},
+				types.ACLRule{ID: "web", Priority: 20, Action: types.ACLAllow, Source: peerA, Protocol: "tcp", Ports: "8000-8080"},
+			)
+
+			Expect(acl.Allowed(flow("10.1.0.1", "10.1.0.2", 6, 22))).To(BeTrue())
+			Expect(acl.Allowed(flow("10.1.0.1", "10.2.0.2", 6, 22))).To(BeFalse())
+			Expect(acl.Allowed(flow("10.1.0.1", "10.1.0.2", 17, 22))).To(BeFalse())
+			Expect(acl.Allowed(flow("10.1.0.1", "10.2.0.2", 6, 8080))).To(BeTrue())
+			Expect(acl.Allowed(flow("10.1.0.1", "10.2.0.2", 6, 8081))).To(BeFalse())
+		})
+
+		It("matches peers and IPv6 addresses", func() {
+			acl := NewACL(
+				types.ACLRule{ID: "a", Action: types.ACLDeny, Source: peerB},
+				types.ACLRule{ID: "b", Action: types.ACLDeny, Destination: "fd00::2", Protocol: "icmpv6"},
+			)
+
+			Expect(acl.Allowed(flow("fd00::1", "fd00::2", 58, 0))).To(BeFalse())
+			Expect(acl.Allowed(flow("fd00::1", "fd00::3", 58, 0))).To(BeTrue())
+
+			f := flow("10.1.0.1", "10.1.0.2", 1, 0)
+			f.SrcPeer = peerB
+			Expect(acl.Allowed(f)).To(BeFalse())
+		})
+
+		It("matches the fragments without ports only with the rules without ports", func() {
+			acl := NewACL(
+				types.ACLRule{ID: "a", Priority: 10, Action: types.ACLDeny, Protocol: "udp", Ports: "0-100"},
+				types.ACLRule{ID: "b", Priority: 20, Action: types.ACLAllow, Protocol: "udp"},
+				types.ACLRule{ID: "c", Priority: 30, Action: types.ACLDeny},
+			)
+
+			Expect(acl.Allowed(flow("10.1.0.1", "10.1.0.2", 17, 0))).To(BeFalse())
+			f := flow("10.1.0.1", "10.1.0.2", 17, 0)
+			f.Fragment = true
+			Expect(acl.Allowed(f)).To(BeTrue())
+			f.Protocol = 6
+			Expect(acl.Allowed(f)).To(BeFalse())
+		})
+
+		It("skips invalid rules", func() {
+			acl := NewACL(types.ACLRule{ID: "a", Action: "drop"})
+			Expect(acl).To(BeEmpty())
+		})
+	})
+
+	Context("Validation", func() {
+		It("rejects invalid rules", func() {
+			Expect(ValidateACLRule(types.ACLRule{Action: "drop"})).To(HaveOccurred())
+			Expect(ValidateACLRule(types.ACLRule{Action: types.ACLAllow, Source: "foo"})).To(HaveOccurred())
+			Expect(ValidateACLRule(types.ACLRule{Action: types.ACLAllow, Protocol: "foo"})).To(HaveOccurred())
+			Expect(ValidateACLRule(types.ACLRule{Action: types.ACLAllow, Protocol: "tcp", Ports: "90-80"})).To(HaveOccurred())
+			Expect(ValidateACLRule(types.ACLRule{Action: types.ACLAllow, Protocol: "icmp", Ports: "80"})).To(HaveOccurred())
+		})
+
+		It("accepts valid rules", func() {
+			Expect(ValidateACLRule(types.ACLRule{Action: types.ACLDeny})).ToNot(HaveOccurred())
+			Expect(ValidateACLRule(types.ACLRule{Action: types.ACLAllow, Source: "10.1.0.1", Destination: "fd00::/8", Protocol: "udp", Ports: "53"})).ToNot(HaveOccurred())
+			Expect(ValidateACLRule(types.ACLRule{Action: types.ACLAllow, Source: peerA, Protocol: "47"})).ToNot(HaveOccurred())
+		})
+	})
+
+	Context("Firewall", func() {
+		acl := NewACL(
+			types.ACLRule{ID: "dns", Priority: 10, Action: types.ACLAllow, Destination: "10.1.0.2", Protocol: "udp", Ports: "53"},
+			types.ACLRule{ID: "deny", Priority: 20, Action: types.ACLDeny},
+		)
+		var (
+			clock *fakeClock
+			fw    *Firewall
+		)
+
+		BeforeEach(func() {
+			clock = &fakeClock{t: time.Now()}
+			fw = NewFirewall(clock.now)
+		})
+
+		allowed := func(packet []byte) bool {
+			ok, err := fw.Allowed(acl, packet, peerA, peerB)
+			Expect(err).ToNot(HaveOccurred())
+			return ok
+		}
+
+		It("lets through the replies of the flows allowed", func() {
+			reply := udpPacket("10.1.0.2", 53, "10.1.0.1", 4000)
+			Expect(allowed(reply)).To(BeFalse())
+
+			Expect(allowed(udpPacket("10.1.0.1", 4000, "10.1.0.2", 53))).To(BeTrue())
+			Expect(allowed(reply)).To(BeTrue())
+			// Only the replies of the flow
+			Expect(allowed(udpPacket("10.1.0.2", 53, "10.1.0.1", 4001))).To(BeFalse())
+			Expect(allowed(udpPacket("10.1.0.3", 53, "10.1.0.1", 4000))).To(BeFalse())
+		})
+
+		It("expires the idle flows", func() {
+			Expect(allowed(udpPacket("10.1.0.1", 4000, "10.1.0.2", 53))).To(BeTrue())
+			reply := udpPacket("10.1.0.2", 53, "10.1.0.1", 4000)
+
+			// The replies keep the flow alive
+			clock.add(4 * time.Minute)
+			Expect(allowed(reply)).To(BeTrue())
+			clock.add(4 * time.Minute)
+			Expect(allowed(reply)).To(BeTrue())
+
+			clock.add(6 * time.Minute)
+			Expect(allowed(reply)).To(BeFalse())
+		})
+
+		It("prunes the idle flows", func() {
+			Expect(allowed(udpPacket("10.1.0.1", 4000, "10.1.0.2", 53))).To(BeTrue())
+			Expect(allowed(udpPacket("10.1.0.1", 4001, "10.1.0.2", 53))).To(BeTrue())
+			Expect(fw.Flows()).To(Equal(2))
+
+			clock.add(6 * time.Minute)
+			Expect(allowed(udpPacket("10.1.0.1", 4002, "10.1.0.2", 53))).To(BeTrue())
+			Expect(fw.Flows()).To(Equal(1))
+		})
+
+		It("lets through the fragments of the packets allowed", func() {
+			payload := make([]byte, 1200)
+			binary.BigEndian.PutUint16(payload[0:2], 4000)
+			binary.BigEndian.PutUint16(payload[2:4], 53)
+			fragments, _, err := FitPacket(ipv4Packet("10.1.0.1", "10.1.0.2", 17, payload), 500)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(fragments)).To(BeNumerically(">", 2))
+			for _, f := range fragments {
+				Expect(allowed(f)).To(BeTrue())
+			}
+
+			// Not the ones of the packets denied
+			binary.BigEndian.PutUint16(payload[2:4], 54)
+			denied := ipv4Packet("10.1.0.1", "10.1.0.2", 17, payload)
+			binary.BigEndian.PutUint16(denied[4:6], 1)
+			others, _, err := FitPacket(denied, 500)
+			Expect(err).ToNot(HaveOccurred())
+			for _, f := range others {
+				Expect(allowed(f)).To(BeFalse())
+			}
+
+			clock.add(time.Minute)
+			Expect(allowed(fragments[1])).To(BeFalse())
+		})
+
+		It("finds the ports after the IPv6 extension headers", func() {
+			acl := NewACL(
+				types.ACLRule{ID: "dns", Priority: 10, Action: types.ACLAllow, Destination: "fd00::2", Protocol: "udp", Ports: "53"},
+				types.ACLRule{ID: "deny", Priority: 20, Action: types.ACLDeny},
+			)
+			allowed := func(packet []byte) bool {
+				ok, err := fw.Allowed(acl, packet, peerA, peerB)
+				Expect(err).ToNot(HaveOccurred())
+				return ok
+			}
+
+			// Hop-by-hop, routing and destination options
+			Expect(allowed(ipv6UDP("fd00::1", "fd00::2", 53, 0, 43, 60))).To(BeTrue())
+			Expect(allowed(ipv6UDP("fd00::1", "fd00::2", 54, 0, 43, 60))).To(BeFalse())
+			// Truncated chains carry no ports
+			Expect(allowed(ipv6UDP("fd00::1", "fd00::2", 53, 0, 43, 60)[:50])).To(BeFalse())
+
+			// Only the first fragment carries the ports, the others follow it
+			first := ipv6UDP("fd00::1", "fd00::2", 53, 0, 44)
+			first[51] = 1
+			binary.BigEndian.PutUint32(first[52:56], 7)
+			next := ipv6UDP("fd00::1", "fd00::2", 53, 44)
+			binary.BigEndian.PutUint16(next[42:44], 100<<3)
+			binary.BigEndian.PutUint32(next[44:48], 7)
+			Expect(allowed(next)).To(BeFalse())
+			Expect(allowed(first)).To(BeTrue())
+			Expect(allowed(next)).To(BeTrue())
+			binary.BigEndian.PutUint32(next[44:48], 8)
+			Expect(allowed(next)).To(BeFalse())
+		})
+
+		It("evicts flows once full", func() {
+			defer SetMaxFlows(2)()
+			Expect(allowed(udpPacket("10.1.0.1", 4000, "10.1.0.2", 53))).To(BeTrue())
+			Expect(allowed(udpPacket("10.1.0.1", 4001, "10.1.0.2", 53))).To(BeTrue())
+			Expect(allowed(udpPacket("10.1.0.1", 4000, "10.1.0.2", 53))).To(BeTrue())
+			Expect(fw.Evicted()).To(BeZero())
+
+			Expect(allowed(udpPacket("10.1.0.1", 4002, "10.1.0.2", 53))).To(BeTrue())
+			Expect(fw.Flows()).To(Equal(2))
+			Expect(fw.Evicted()).To(Equal(uint64(1)))
+			Expect(allowed(udpPacket("10.1.0.2", 53, "10.1.0.1", 4002))).To(BeTrue())
+		})
+
+		It("tracks nothing without rules", func() {
+			ok, err := fw.Allowed(ACL{}, udpPacket("10.1.0.1", 4000, "10.1.0.2", 53), peerA, peerB)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(fw.Flows()).To(BeZero())
+		})
+	})
+
+	Context("Anti-spoofing", func() {
+		self, a, b := newPeerID(), newPeerID(), newPeerID()
+		table := NewRoutingTable(blockchain.Block{
+			Storage: map[string]map[string]blockchain.Data{
+				protocol.MachinesLedgerKey: {
+					"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1"}),
+					"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2", Address6: "fd00::2"}),
+					"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3"}),
+				},
+				protocol.RoutesLedgerKey: {
+					"192.168.0.0/16": data(types.Route{PeerID: a.String(), Network: "192.168.0.0/16"}),
+				},
+			},
+		}, self.String())
+
+		spoofed := func(exits *ExitRouter, src peer.ID, packet []byte) bool {
+			s, err := Spoofed(table, exits, src, packet)
+			Expect(err).ToNot(HaveOccurred())
+			return s
+		}
+
+		It("accepts the addresses and the networks of the sender only", func() {
+			Expect(spoofed(nil, a, udpPacket("10.1.0.2", 1, "10.1.0.1", 2))).To(BeFalse())
+			Expect(spoofed(nil, a, ipv6Packet("fd00::2", "fd00::1", 40))).To(BeFalse())
+			Expect(spoofed(nil, a, udpPacket("192.168.1.1", 1, "10.1.0.1", 2))).To(BeFalse())
+
+			// The addresses of another machine, or of a network it doesn't advertise
+			Expect(spoofed(nil, b, udpPacket("10.1.0.2", 1, "10.1.0.1", 2))).To(BeTrue())
+			Expect(spoofed(nil, b, udpPacket("192.168.1.1", 1, "10.1.0.1", 2))).To(BeTrue())
+			Expect(spoofed(nil, a, udpPacket("8.8.8.8", 1, "10.1.0.1", 2))).To(BeTrue())
+		})
+
+		It("accepts the networks routed through the exit node in use", func() {
+			l := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+			exits, err := NewExitRouter([]ExitNode{{Address: "10.1.0.3"}}, l, self.String(), time.Minute)
+			Expect(err).ToNot(HaveOccurred())
+			exits.Refresh(table)
+
+			Expect(spoofed(exits, b, udpPacket("8.8.8.8", 53, "10.1.0.1", 2))).To(BeFalse())
+			Expect(spoofed(exits, a, udpPacket("8.8.8.8", 53, "10.1.0.1", 2))).To(BeTrue())
+			// The VPN addresses are not routed through the exit node
+			Expect(spoofed(exits, b, udpPacket("10.1.0.2", 53, "10.1.0.1", 2))).To(BeTrue())
+		})
+	})
+})
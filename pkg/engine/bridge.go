@@ -0,0 +1,405 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/songgao/packets/ethernet"
+)
+
+// maxBridgeEntries is the number of MAC (and IPv4) addresses learned by the
+// bridge, and maxPeerBridgeEntries the number of them learned from each peer.
+// Once full, the new addresses are not learned and their frames are flooded
+var (
+	maxBridgeEntries     = 8192
+	maxPeerBridgeEntries = 1024
+)
+
+const (
+	// macAgeing is how long the peer a MAC address was learned from is remembered
+	macAgeing = 5 * time.Minute
+
+	// maxEthernetHeader is the length of the Ethernet header of a double tagged frame
+	maxEthernetHeader = 6 + 6 + int(ethernet.DoubleTagged) + 2
+
+	arpRequest = 1
+	arpReply   = 2
+	arpLen     = 28
+)
+
+// ethernetInfo holds the header of an Ethernet frame read from (or
+// written to) the TAP interface
+type ethernetInfo struct {
+	Dst, Src  net.HardwareAddr
+	EtherType ethernet.Ethertype
+	Tagging   ethernet.Tagging
+	Payload   []byte
+
+	// IP is the header of the IP packet carried, nil for the other protocols
+	IP *packetInfo
+}
+
+// parseEthernet parses the header of an Ethernet frame, and the one of the IP packet it carries
+func parseEthernet(frame []byte) (*ethernetInfo, error) {
+	if len(frame) < 14 {
+		return nil, errors.New("ethernet frame too short")
+	}
+	f := ethernet.Frame(frame)
+	if len(frame) < 14+int(f.Tagging()) {
+		return nil, errors.New("ethernet frame too short")
+	}
+
+	e := &ethernetInfo{
+		Dst:       f.Destination(),
+		Src:       f.Source(),
+		EtherType: f.Ethertype(),
+		Tagging:   f.Tagging(),
+		Payload:   f.Payload(),
+	}
+	switch e.EtherType {
+	case ethernet.IPv4, ethernet.IPv6:
+		p, err := parsePacket(e.Payload)
+		if err != nil {
+			return nil, err
+		}
+		e.IP = p
+	}
+	return e, nil
+}
+
+// header returns the header of the IP packet carried, or an
+// empty one for the other protocols
+func (e *ethernetInfo) header() *packetInfo {
+	if e.IP != nil {
+		return e.IP
+	}
+	return &packetInfo{}
+}
+
+// FlowHash returns a hash of the IP packet 5-tuple, or of the
+// MAC addresses for the other protocols
+func (e *ethernetInfo) FlowHash() uint32 {
+	if e.IP != nil {
+		return e.IP.FlowHash()
+	}
+	h := fnv.New32a()
+	h.Write(e.Src)
+	h.Write(e.Dst)
+	h.Write(e.EtherType[:])
+	return h.Sum32()
+}
+
+// arpPacket is an ARP packet resolving IPv4 addresses to Ethernet ones
+type arpPacket struct {
+	Op                   uint16
+	SenderMAC, TargetMAC net.HardwareAddr
+	SenderIP, TargetIP   net.IP
+}
+
+func parseARP(payload []byte) (*arpPacket, error) {
+	if len(payload) < arpLen {
+		return nil, errors.New("arp packet too short")
+	}
+	// Ethernet hardware, IPv4 protocol
+	if binary.BigEndian.Uint16(payload[0:2]) != 1 || binary.BigEndian.Uint16(payload[2:4]) != 0x0800 ||
+		payload[4] != 6 || payload[5] != 4 {
+		return nil, errors.New("unsupported arp packet")
+	}
+	return &arpPacket{
+		Op:        binary.BigEndian.Uint16(payload[6:8]),
+		SenderMAC: net.HardwareAddr(payload[8:14]),
+		SenderIP:  net.IP(payload[14:18]),
+		TargetMAC: net.HardwareAddr(payload[18:24]),
+		TargetIP:  net.IP(payload[24:28]),
+	}, nil
+}
+
+// arpAnswer returns the reply to the ARP request, with mac as the address of its target
+func arpAnswer(req *arpPacket, mac net.HardwareAddr) ethernet.Frame {
+	var f ethernet.Frame
+	f.Prepare(req.SenderMAC, mac, ethernet.NotTagged, ethernet.ARP, arpLen)
+	p := f.Payload()
+	binary.BigEndian.PutUint16(p[0:2], 1)
+	binary.BigEndian.PutUint16(p[2:4], 0x0800)
+	p[4], p[5] = 6, 4
+	binary.BigEndian.PutUint16(p[6:8], arpReply)
+	copy(p[8:14], mac)
+	copy(p[14:18], req.TargetIP.To4())
+	copy(p[18:24], req.SenderMAC)
+	copy(p[24:28], req.SenderIP.To4())
+	return f
+}
+
+type macKey [6]byte
+
+func newMACKey(mac net.HardwareAddr) macKey {
+	var k macKey
+	copy(k[:], mac)
+	return k
+}
+
+type learnedMAC struct {
+	peer peer.ID
+	seen time.Time
+}
+
+type learnedIP struct {
+	mac  net.HardwareAddr
+	peer peer.ID
+	seen time.Time
+}
+
+// BridgeEntry is a MAC address learned from the frames of a peer
+type BridgeEntry struct {
+	MAC  string
+	Peer string
+	Seen time.Time
+}
+
+// bridge switches the Ethernet frames in TAP mode. It learns the peers the MAC
+// addresses are behind from the frames they send, and the MAC addresses of their IPv4
+// addresses from the ARP packets, to answer the ARP requests without flooding them
+type bridge struct {
+	sync.RWMutex
+	mac  net.HardwareAddr
+	macs map[macKey]learnedMAC
+	ips  map[ipKey]learnedIP
+
+	// peerMACs and peerIPs are the number of addresses learned from each peer
+	peerMACs, peerIPs map[peer.ID]int
+}
+
+// newBridge returns a bridge for the TAP interface with the given MAC address
+func newBridge(mac net.HardwareAddr) *bridge {
+	return &bridge{
+		mac:      mac,
+		macs:     map[macKey]learnedMAC{},
+		ips:      map[ipKey]learnedIP{},
+		peerMACs: map[peer.ID]int{},
+		peerIPs:  map[peer.ID]int{},
+	}
+}
+
+// admit returns true if an address learned from the peer id fits in a table
+// of size entries, counting it for the peer. known is set if the address is
+// already in the table, learned from owner
+func admit(count map[peer.ID]int, size int, owner peer.ID, known bool, id peer.ID) bool {
+	if known && owner == id {
+		return true
+	}
+	if count[id] >= maxPeerBridgeEntries || (!known && size >= maxBridgeEntries) {
+		return false
+	}
+	if known {
+		forget(count, owner)
+	}
+	count[id]++
+	return true
+}
+
+// forget decrements the number of addresses learned from the peer
+func forget(count map[peer.ID]int, id peer.ID) {
+	if count[id]--; count[id] <= 0 {
+		delete(count, id)
+	}
+}
+
+// learn records the source of a frame received from a peer
+func (b *bridge) learn(e *ethernetInfo, from peer.ID, now time.Time) {
+	if e.Src[0]&1 != 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	k := newMACKey(e.Src)
+	l, known := b.macs[k]
+	if !admit(b.peerMACs, len(b.macs), l.peer, known, from) {
+		return
+	}
+	b.macs[k] = learnedMAC{peer: from, seen: now}
+
+	if e.EtherType != ethernet.ARP {
+		return
+	}
+	if a, err := parseARP(e.Payload); err == nil && !a.SenderIP.IsUnspecified() && bytes.Equal(a.SenderMAC, e.Src) {
+		ik := newIPKey(a.SenderIP)
+		l, known := b.ips[ik]
+		if !admit(b.peerIPs, len(b.ips), l.peer, known, from) {
+			return
+		}
+		b.ips[ik] = learnedIP{mac: append(net.HardwareAddr{}, a.SenderMAC...), peer: from, seen: now}
+	}
+}
+
+// local forgets the MAC address of a frame read from the interface,
+// the host moved to the local segment
+func (b *bridge) local(mac net.HardwareAddr) {
+	k := newMACKey(mac)
+	b.RLock()
+	_, found := b.macs[k]
+	b.RUnlock()
+	if found {
+		b.Lock()
+		if l, ok := b.macs[k]; ok {
+			forget(b.peerMACs, l.peer)
+			delete(b.macs, k)
+		}
+		b.Unlock()
+	}
+}
+
+// lookup returns the peer a unicast MAC address is behind
+func (b *bridge) lookup(mac net.HardwareAddr, now time.Time) (peer.ID, bool) {
+	if mac[0]&1 != 0 {
+		return "", false
+	}
+	b.RLock()
+	defer b.RUnlock()
+	l, ok := b.macs[newMACKey(mac)]
+	if !ok || now.Sub(l.seen) > macAgeing {
+		return "", false
+	}
+	return l.peer, true
+}
+
+// resolve returns the MAC address of a remote IPv4 address: the one of the TAP
+// interface of a VPN node, or the one learned from the ARP packets of the peers
+func (b *bridge) resolve(t *RoutingTable, ip net.IP, self peer.ID, now time.Time) (net.HardwareAddr, bool) {
+	if e, ok := t.lookupMachine(ip); ok && e.id != self && e.mac != nil {
+		return e.mac, true
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+	l, ok := b.ips[newIPKey(ip)]
+	if !ok || now.Sub(l.seen) > macAgeing {
+		return nil, false
+	}
+	// The host must still be behind a peer
+	if m, ok := b.macs[newMACKey(l.mac)]; !ok || now.Sub(m.seen) > macAgeing {
+		return nil, false
+	}
+	return l.mac, true
+}
+
+// answer returns the reply to an ARP request read from the interface,
+// if the MAC address of its target is known
+func (b *bridge) answer(t *RoutingTable, e *ethernetInfo, self peer.ID, now time.Time) (ethernet.Frame, bool) {
+	if e.EtherType != ethernet.ARP || e.Tagging != ethernet.NotTagged {
+		return nil, false
+	}
+	a, err := parseARP(e.Payload)
+	if err != nil || a.Op != arpRequest || a.TargetIP.Equal(a.SenderIP) {
+		return nil, false
+	}
+	mac, ok := b.resolve(t, a.TargetIP, self, now)
+	if !ok {
+		return nil, false
+	}
+	return arpAnswer(a, mac), true
+}
+
+// expire removes the entries not refreshed for macAgeing
+func (b *bridge) expire(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	for k, l := range b.macs {
+		if now.Sub(l.seen) > macAgeing {
+			forget(b.peerMACs, l.peer)
+			delete(b.macs, k)
+		}
+	}
+	for k, l := range b.ips {
+		if now.Sub(l.seen) > macAgeing {
+			forget(b.peerIPs, l.peer)
+			delete(b.ips, k)
+		}
+	}
+}
+
+func (b *bridge) run(ctx context.Context) {
+	t := time.NewTicker(macAgeing)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			b.expire(now)
+		}
+	}
+}
+
+// entries returns the MAC addresses learned, sorted
+func (b *bridge) entries() []BridgeEntry {
+	b.RLock()
+	defer b.RUnlock()
+	res := []BridgeEntry{}
+	for k, l := range b.macs {
+		res = append(res, BridgeEntry{MAC: net.HardwareAddr(k[:]).String(), Peer: l.peer.String(), Seen: l.seen})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].MAC < res[j].MAC })
+	return res
+}
+
+// targets returns the peers a frame read from the interface is sent to: the
+// one its destination was learned from, or all the online peers in TAP mode
+func (b *bridge) targets(t *RoutingTable, e *ethernetInfo, online func(peer.ID) bool, now time.Time) ([]*tableEntry, bool) {
+	if id, ok := b.lookup(e.Dst, now); ok {
+		if entry, ok := t.peers[id]; ok {
+			return []*tableEntry{entry}, false
+		}
+	}
+	res := []*tableEntry{}
+	for _, entry := range t.peers {
+		if entry.mac != nil && online(entry.id) {
+			res = append(res, entry)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res, true
+}
+
+// errNotBridged is returned for the frames of the peers which are not in TAP mode
+var errNotBridged = errors.New("peer not in tap mode")
+
+// checkBridged returns an error if the peer doesn't send Ethernet frames
+func checkBridged(t *RoutingTable, id peer.ID) error {
+	e, ok := t.peers[id]
+	if !ok {
+		return fmt.Errorf("'%s' not found in the routing table", id.String())
+	}
+	if e.mac == nil {
+		return errNotBridged
+	}
+	return nil
+}
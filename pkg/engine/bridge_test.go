@@ -0,0 +1,208 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/songgao/packets/ethernet"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+func mac(s string) net.HardwareAddr {
+	m, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// ethernetFrame returns an untagged frame carrying payload
+func ethernetFrame(dst, src string, t ethernet.Ethertype, payload []byte) []byte {
+	var f ethernet.Frame
+	f.Prepare(mac(dst), mac(src), ethernet.NotTagged, t, len(payload))
+	copy(f.Payload(), payload)
+	return f
+}
+
+// arp returns an ARP packet of sender for target
+func arp(op uint16, senderMAC, senderIP, targetIP string) []byte {
+	b := make([]byte, 28)
+	binary.BigEndian.PutUint16(b[0:2], 1)
+	binary.BigEndian.PutUint16(b[2:4], 0x0800)
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:8], op)
+	copy(b[8:14], mac(senderMAC))
+	copy(b[14:18], net.ParseIP(senderIP).To4())
+	copy(b[24:28], net.ParseIP(targetIP).To4())
+	return b
+}
+
+var _ = Describe("Bridge", func() {
+	self, a, b, tun := newPeerID(), newPeerID(), newPeerID(), newPeerID()
+	const (
+		selfMAC = "02:00:00:00:00:01"
+		aMAC    = "02:00:00:00:00:02"
+		bMAC    = "02:00:00:00:00:03"
+		host    = "02:00:00:00:01:01"
+		local   = "02:00:00:00:02:01"
+		bcast   = "ff:ff:ff:ff:ff:ff"
+	)
+
+	table := NewRoutingTable(blockchain.Block{
+		Storage: map[string]map[string]blockchain.Data{
+			protocol.MachinesLedgerKey: {
+				"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1", MAC: selfMAC}),
+				"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2", MAC: aMAC}),
+				"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3", MAC: bMAC}),
+				"10.1.0.4": data(types.Machine{PeerID: tun.String(), Address: "10.1.0.4"}),
+			},
+		},
+	}, self.String())
+
+	It("floods the frames to unknown and broadcast destinations", func() {
+		br := NewBridge(mac(selfMAC))
+		frame := ethernetFrame(host, local, ethernet.IPv4, ipv4Packet("10.1.0.1", "10.1.0.20", 17, []byte{0, 1, 0, 2, 0, 8, 0, 0}))
+		targets, flooded, err := br.Targets(table, frame, a, b, tun)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flooded).To(BeTrue())
+		Expect(targets).To(ConsistOf(a, b))
+
+		targets, flooded, err = br.Targets(table, ethernetFrame(bcast, local, ethernet.ARP, arp(1, local, "10.1.0.1", "10.1.0.20")), a)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flooded).To(BeTrue())
+		Expect(targets).To(ConsistOf(a))
+	})
+
+	It("learns the peers the MAC addresses are behind", func() {
+		br := NewBridge(mac(selfMAC))
+		Expect(br.Learn(ethernetFrame(local, host, ethernet.IPv4, ipv4Packet("10.1.0.20", "10.1.0.1", 17, []byte{0, 1, 0, 2, 0, 8, 0, 0})), b)).To(Succeed())
+		Expect(br.Entries()).To(HaveLen(1))
+		Expect(br.Entries()[0].MAC).To(Equal(host))
+		Expect(br.Entries()[0].Peer).To(Equal(b.String()))
+
+		targets, flooded, err := br.Targets(table, ethernetFrame(host, local, ethernet.ARP, arp(2, local, "10.1.0.1", "10.1.0.20")), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flooded).To(BeFalse())
+		Expect(targets).To(ConsistOf(b))
+
+		// Broadcast sources are never learned
+		Expect(br.Learn(ethernetFrame(local, bcast, ethernet.ARP, arp(1, bcast, "10.1.0.30", "10.1.0.1")), a)).To(Succeed())
+		Expect(br.Entries()).To(HaveLen(1))
+	})
+
+	It("answers the ARP requests for the known addresses", func() {
+		br := NewBridge(mac(selfMAC))
+
+		// The addresses of the peers in TAP mode are in the ledger
+		reply, ok, err := br.Answer(table, ethernetFrame(bcast, local, ethernet.ARP, arp(1, local, "10.1.0.1", "10.1.0.2")), self)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		f := ethernet.Frame(reply)
+		Expect(f.Destination()).To(Equal(mac(local)))
+		Expect(f.Source()).To(Equal(mac(aMAC)))
+		Expect(f.Ethertype()).To(Equal(ethernet.ARP))
+		p := f.Payload()
+		Expect(binary.BigEndian.Uint16(p[6:8])).To(Equal(uint16(2)))
+		Expect(net.HardwareAddr(p[8:14])).To(Equal(mac(aMAC)))
+		Expect(net.IP(p[14:18]).String()).To(Equal("10.1.0.2"))
+		Expect(net.IP(p[24:28]).String()).To(Equal("10.1.0.1"))
+
+		// The ones of the hosts behind the peers are learned from their ARP packets
+		_, ok, err = br.Answer(table, ethernetFrame(bcast, local, ethernet.ARP, arp(1, local, "10.1.0.1", "10.1.0.20")), self)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeFalse())
+
+		Expect(br.Learn(ethernetFrame(local, host, ethernet.ARP, arp(2, host, "10.1.0.20", "10.1.0.1")), b)).To(Succeed())
+		reply, ok, err = br.Answer(table, ethernetFrame(bcast, local, ethernet.ARP, arp(1, local, "10.1.0.1", "10.1.0.20")), self)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeTrue())
+		Expect(ethernet.Frame(reply).Source()).To(Equal(mac(host)))
+
+		// Gratuitous ARP is flooded
+		_, ok, err = br.Answer(table, ethernetFrame(bcast, local, ethernet.ARP, arp(1, local, "10.1.0.2", "10.1.0.2")), self)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ok).To(BeFalse())
+	})
+
+	It("learns a bounded number of addresses from each peer and in total", func() {
+		defer SetMaxBridgeEntries(3, 2)()
+		br := NewBridge(mac(selfMAC))
+		learn := func(from peer.ID, hosts ...string) {
+			for _, h := range hosts {
+				Expect(br.Learn(ethernetFrame(bcast, h, ethernet.ARP, arp(1, h, "10.1.0."+h[len(h)-2:], "10.1.0.1")), from)).To(Succeed())
+			}
+		}
+		peers := func() map[string]int {
+			res := map[string]int{}
+			for _, e := range br.Entries() {
+				res[e.Peer]++
+			}
+			return res
+		}
+
+		learn(a, "02:00:00:00:01:11", "02:00:00:00:01:12", "02:00:00:00:01:13")
+		Expect(peers()).To(Equal(map[string]int{a.String(): 2}))
+		Expect(br.Addresses()).To(Equal(2))
+
+		learn(b, "02:00:00:00:01:21", "02:00:00:00:01:22")
+		Expect(peers()).To(Equal(map[string]int{a.String(): 2, b.String(): 1}))
+		Expect(br.Addresses()).To(Equal(3))
+
+		// The addresses learned are refreshed, and move between the peers with room
+		learn(a, "02:00:00:00:01:11")
+		Expect(peers()).To(Equal(map[string]int{a.String(): 2, b.String(): 1}))
+		learn(b, "02:00:00:00:01:11")
+		Expect(peers()).To(Equal(map[string]int{a.String(): 1, b.String(): 2}))
+		learn(b, "02:00:00:00:01:12")
+		Expect(peers()).To(Equal(map[string]int{a.String(): 1, b.String(): 2}))
+		Expect(br.Entries()).To(ContainElement(And(HaveField("MAC", "02:00:00:00:01:12"), HaveField("Peer", a.String()))))
+
+		// Until they age
+		br.Expire(time.Now().Add(time.Hour))
+		Expect(br.Entries()).To(BeEmpty())
+		Expect(br.Addresses()).To(BeZero())
+		learn(a, "02:00:00:00:01:13", "02:00:00:00:01:14")
+		Expect(peers()).To(Equal(map[string]int{a.String(): 2}))
+	})
+
+	It("accepts frames only from the peers in TAP mode", func() {
+		Expect(CheckBridged(table, a)).To(Succeed())
+		Expect(CheckBridged(table, tun)).To(HaveOccurred())
+		Expect(CheckBridged(table, newPeerID())).To(HaveOccurred())
+	})
+
+	It("rejects truncated frames", func() {
+		br := NewBridge(mac(selfMAC))
+		Expect(br.Learn([]byte{1, 2, 3}, a)).ToNot(Succeed())
+		frame := ethernetFrame(host, local, ethernet.IPv4, ipv4Packet("10.1.0.1", "10.1.0.20", 17, nil))
+		Expect(br.Learn(frame[:20], a)).ToNot(Succeed())
+	})
+})
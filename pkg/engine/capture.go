@@ -0,0 +1,264 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// DefaultCaptureSize is the default number of packets kept by a capture
+const DefaultCaptureSize = 4096
+
+// MaxCaptureSize is the maximum number of packets kept by a capture. The
+// ring keeps a copy of every packet, up to about 100MB with a 1500 MTU
+const MaxCaptureSize = 65536
+
+// captureRecord is a packet captured on the interface
+type captureRecord struct {
+	time    time.Time
+	inbound bool
+	data    []byte
+}
+
+// captureRing keeps the last packets sent and received through the interface
+type captureRing struct {
+	sync.Mutex
+	records []captureRecord
+	next    int
+	full    bool
+}
+
+func newCaptureRing(size int) *captureRing {
+	if size < 1 {
+		size = DefaultCaptureSize
+	}
+	if size > MaxCaptureSize {
+		size = MaxCaptureSize
+	}
+	return &captureRing{records: make([]captureRecord, size)}
+}
+
+// add records a copy of the packet, overwriting the oldest one if the ring is full
+func (r *captureRing) add(inbound bool, packet []byte) {
+	data := make([]byte, len(packet))
+	copy(data, packet)
+
+	r.Lock()
+	defer r.Unlock()
+	r.records[r.next] = captureRecord{time: time.Now(), inbound: inbound, data: data}
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the captured packets, oldest first
+func (r *captureRing) snapshot() []captureRecord {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.full {
+		return append([]captureRecord{}, r.records[:r.next]...)
+	}
+	return append(append([]captureRecord{}, r.records[r.next:]...), r.records[:r.next]...)
+}
+
+// CaptureFilter selects the captured packets. Packets are selected if they were captured
+// in the time window, and both the source or the destination match each of the
+// networks and ports given. Zero values match any packet
+type CaptureFilter struct {
+	Since, Until time.Time
+	Networks     []*net.IPNet
+	Ports        []uint16
+
+	// Protocol is the transport protocol number, 0 matches any
+	Protocol int
+}
+
+// ParseCaptureFilter parses a BPF-like expression of terms joined by "and", e.g.
+// "host 10.1.0.2 and tcp and port 22". Supported terms are "host <address>",
+// "net <cidr>", "port <port>", "proto <name|number>" and the protocol names
+// (tcp, udp, icmp, icmpv6, sctp). An empty expression matches any packet
+func ParseCaptureFilter(expr string) (CaptureFilter, error) {
+	f := CaptureFilter{}
+
+	fields := strings.Fields(strings.ToLower(expr))
+	for i := 0; i < len(fields); i++ {
+		term := fields[i]
+		if _, ok := protocolNames[term]; ok {
+			f.Protocol = protocolNames[term]
+			continue
+		}
+
+		switch term {
+		case "and":
+			continue
+		case "host", "net", "port", "proto":
+		default:
+			return f, fmt.Errorf("unexpected '%s' in filter", term)
+		}
+
+		if i+1 >= len(fields) {
+			return f, fmt.Errorf("missing value for '%s' in filter", term)
+		}
+		i++
+		value := fields[i]
+
+		switch term {
+		case "host":
+			e, err := parseEndpoint(value)
+			if err != nil || e.net == nil || strings.Contains(value, "/") {
+				return f, fmt.Errorf("invalid host '%s'", value)
+			}
+			f.Networks = append(f.Networks, e.net)
+		case "net":
+			_, n, err := net.ParseCIDR(value)
+			if err != nil {
+				return f, fmt.Errorf("invalid network '%s'", value)
+			}
+			f.Networks = append(f.Networks, n)
+		case "port":
+			p, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return f, fmt.Errorf("invalid port '%s'", value)
+			}
+			f.Ports = append(f.Ports, uint16(p))
+		case "proto":
+			p, err := parseProtocol(value)
+			if err != nil {
+				return f, err
+			}
+			f.Protocol = p
+		}
+	}
+
+	return f, nil
+}
+
+func (f CaptureFilter) match(r captureRecord, frames bool) bool {
+	if !f.Since.IsZero() && r.time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && r.time.After(f.Until) {
+		return false
+	}
+	if len(f.Networks) == 0 && len(f.Ports) == 0 && f.Protocol == 0 {
+		return true
+	}
+
+	p, err := parseRecord(r.data, frames)
+	if err != nil {
+		return false
+	}
+	if f.Protocol != 0 && p.Protocol != f.Protocol {
+		return false
+	}
+	for _, n := range f.Networks {
+		if !n.Contains(p.Src) && !n.Contains(p.Dst) {
+			return false
+		}
+	}
+	for _, port := range f.Ports {
+		if p.SrcPort != port && p.DstPort != port {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRecord parses the header of a captured packet, or of the
+// IP packet of a captured Ethernet frame
+func parseRecord(data []byte, frames bool) (*packetInfo, error) {
+	if !frames {
+		return parsePacket(data)
+	}
+	e, err := parseEthernet(data)
+	if err != nil {
+		return nil, err
+	}
+	if e.IP == nil {
+		return nil, errors.New("not an ip packet")
+	}
+	return e.IP, nil
+}
+
+// writeCapture writes the packets selected by the filter to w in the pcapng format,
+// frames being set for the Ethernet frames of the TAP mode. Packets sent and received
+// are recorded on two distinct interfaces
+func writeCapture(w io.Writer, name string, records []captureRecord, f CaptureFilter, frames bool) error {
+	out := pcapgo.NgInterface{
+		Name:        name,
+		Description: "packets sent to the VPN",
+		OS:          runtime.GOOS,
+		LinkType:    layers.LinkTypeRaw,
+	}
+	if frames {
+		out.LinkType = layers.LinkTypeEthernet
+	}
+	in := out
+	in.Description = "packets received from the VPN"
+
+	pw, err := pcapgo.NewNgWriterInterface(w, out, pcapgo.NgWriterOptions{
+		SectionInfo: pcapgo.NgSectionInfo{
+			Hardware:    runtime.GOARCH,
+			OS:          runtime.GOOS,
+			Application: "vpnsvr",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	inID, err := pw.AddInterface(in)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		if !f.match(r, frames) {
+			continue
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     r.time,
+			CaptureLength: len(r.data),
+			Length:        len(r.data),
+		}
+		if r.inbound {
+			ci.InterfaceIndex = inID
+		}
+		if err := pw.WritePacket(ci, r.data); err != nil {
+			return err
+		}
+	}
+
+	return pw.Flush()
+}
@@ -0,0 +1,93 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"github.com/google/gopacket/pcapgo"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+)
+
+var _ = Describe("Capture", func() {
+	Context("Filter", func() {
+		It("parses expressions", func() {
+			f, err := ParseCaptureFilter("host 10.1.0.2 and tcp and port 22 and net fd00::/8")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Protocol).To(Equal(6))
+			Expect(f.Ports).To(Equal([]uint16{22}))
+			Expect(f.Networks).To(HaveLen(2))
+			Expect(f.Networks[0].Contains(net.ParseIP("10.1.0.2"))).To(BeTrue())
+			Expect(f.Networks[0].Contains(net.ParseIP("10.1.0.3"))).To(BeFalse())
+			Expect(f.Networks[1].Contains(net.ParseIP("fd12::1"))).To(BeTrue())
+
+			f, err = ParseCaptureFilter("proto 47")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Protocol).To(Equal(47))
+		})
+
+		It("matches anything when empty", func() {
+			f, err := ParseCaptureFilter("")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f).To(Equal(CaptureFilter{}))
+		})
+
+		It("rejects invalid expressions", func() {
+			for _, expr := range []string{"host", "host foo", "host 10.1.0.0/24", "net 10.1.0.1", "port 70000", "proto foo", "foo"} {
+				_, err := ParseCaptureFilter(expr)
+				Expect(err).To(HaveOccurred(), expr)
+			}
+		})
+	})
+
+	Context("Controller", func() {
+		It("refuses the captures above the maximum size", func() {
+			c := &Config{}
+			Expect(WithCaptureSize(MaxCaptureSize)(c)).To(Succeed())
+			Expect(c.CaptureSize).To(Equal(MaxCaptureSize))
+			Expect(WithCaptureSize(MaxCaptureSize + 1)(c)).To(HaveOccurred())
+		})
+
+		It("writes pcapng captures only when capturing", func() {
+			ctrl := NewController()
+			Expect(ctrl.Capturing()).To(BeFalse())
+			Expect(ctrl.WriteCapture(&bytes.Buffer{}, CaptureFilter{})).To(MatchError(ErrNoCapture))
+
+			ctrl.StartCapture(10)
+			Expect(ctrl.Capturing()).To(BeTrue())
+
+			b := &bytes.Buffer{}
+			Expect(ctrl.WriteCapture(b, CaptureFilter{})).ToNot(HaveOccurred())
+			r, err := pcapgo.NewNgReader(b, pcapgo.DefaultNgReaderOptions)
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = r.ReadPacketData()
+			Expect(err).To(Equal(io.EOF))
+
+			ctrl.StopCapture()
+			Expect(ctrl.Capturing()).To(BeFalse())
+		})
+	})
+})
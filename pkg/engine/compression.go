@@ -0,0 +1,185 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/libp2p/go-libp2p-core/network"
+	p2pprotocol "github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/bhojpur/vpn/pkg/protocol"
+)
+
+// Codecs compressing the frames sent to the peers. The codec is negotiated
+// along with the stream protocol, peers not supporting it fall back to
+// uncompressed frames
+const (
+	CompressionNone   = ""
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+const (
+	// minCompressSize is the size below which frames are not compressed
+	minCompressSize = 128
+	// maxCompressBackoff is the maximum number of frames sent uncompressed
+	// after an incompressible one
+	maxCompressBackoff = 64
+)
+
+type codec interface {
+	compress(src []byte) []byte
+	decompress(dst, src []byte) ([]byte, error)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+type zstdCodec struct{}
+
+func (zstdCodec) init() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxFrameSize))
+	})
+}
+
+func (z zstdCodec) compress(src []byte) []byte {
+	z.init()
+	return zstdEncoder.EncodeAll(src, nil)
+}
+
+func (z zstdCodec) decompress(dst, src []byte) ([]byte, error) {
+	z.init()
+	return zstdDecoder.DecodeAll(src, dst[:0])
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) compress(src []byte) []byte {
+	return snappy.Encode(nil, src)
+}
+
+func (snappyCodec) decompress(dst, src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("decompressed frame too large: %d bytes", n)
+	}
+	return snappy.Decode(dst, src)
+}
+
+// codecs are the codecs by protocol
+var codecs = map[p2pprotocol.ID]codec{
+	protocol.BhojpurVPNZstd.ID():   zstdCodec{},
+	protocol.BhojpurVPNSnappy.ID(): snappyCodec{},
+}
+
+// ValidateCompression returns an error if the codec is not supported
+func ValidateCompression(codec string) error {
+	if _, ok := compressionProtocol(codec); !ok && codec != CompressionNone {
+		return fmt.Errorf("unsupported compression codec '%s'", codec)
+	}
+	return nil
+}
+
+// compressionProtocol returns the stream protocol compressing the frames with codec
+func compressionProtocol(codec string) (protocol.Protocol, bool) {
+	switch codec {
+	case CompressionZstd:
+		return protocol.BhojpurVPNZstd, true
+	case CompressionSnappy:
+		return protocol.BhojpurVPNSnappy, true
+	}
+	return "", false
+}
+
+// streamProtocols returns the stream protocols to negotiate with the
+// peers, by order of preference
+func streamProtocols(c *Config) []p2pprotocol.ID {
+	ids := []p2pprotocol.ID{}
+	if p, ok := compressionProtocol(c.Compression); ok {
+		ids = append(ids, p.ID())
+	}
+	return append(ids, protocol.BhojpurVPNFramed.ID(), protocol.BhojpurVPN.ID())
+}
+
+// isFramed returns true if the stream protocol sends frames, compressed or not
+func isFramed(s network.Stream) bool {
+	if s.Protocol() == protocol.BhojpurVPNFramed.ID() {
+		return true
+	}
+	_, ok := codecs[s.Protocol()]
+	return ok
+}
+
+// codecStream is a stream compressing the frames with the negotiated codec.
+// Compression is skipped for an increasing number of frames after each
+// incompressible one, so that encrypted or already compressed traffic
+// does not waste CPU time
+type codecStream struct {
+	network.Stream
+	codec codec
+
+	skip, backoff int32
+}
+
+// newCodecStream wraps the stream if its protocol compresses the frames
+func newCodecStream(s network.Stream) network.Stream {
+	if c, ok := codecs[s.Protocol()]; ok {
+		return &codecStream{Stream: s, codec: c}
+	}
+	return s
+}
+
+// compress returns the compressed payload, or false if it is not worth it
+func (s *codecStream) compress(payload []byte) ([]byte, bool) {
+	if len(payload) < minCompressSize {
+		return nil, false
+	}
+	if atomic.LoadInt32(&s.skip) > 0 {
+		atomic.AddInt32(&s.skip, -1)
+		return nil, false
+	}
+
+	out := s.codec.compress(payload)
+	if len(out) > len(payload)-len(payload)/8 {
+		backoff := atomic.LoadInt32(&s.backoff)*2 + 1
+		if backoff > maxCompressBackoff {
+			backoff = maxCompressBackoff
+		}
+		atomic.StoreInt32(&s.backoff, backoff)
+		atomic.StoreInt32(&s.skip, backoff)
+		return nil, false
+	}
+	atomic.StoreInt32(&s.backoff, 0)
+	return out, true
+}
@@ -0,0 +1,71 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"crypto/rand"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+)
+
+var _ = Describe("Compression", func() {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: 10.1.0.1\r\n\r\n"), 20)
+	random := make([]byte, 1000)
+	rand.Read(random)
+
+	It("validates the codec", func() {
+		Expect(ValidateCompression(CompressionZstd)).ToNot(HaveOccurred())
+		Expect(ValidateCompression(CompressionSnappy)).ToNot(HaveOccurred())
+		Expect(ValidateCompression(CompressionNone)).ToNot(HaveOccurred())
+		Expect(ValidateCompression("lzma")).To(HaveOccurred())
+	})
+
+	for _, codec := range []string{CompressionZstd, CompressionSnappy} {
+		codec := codec
+		It("compresses the packets with "+codec, func() {
+			b, sizes, err := WritePackets(codec, text, []byte("small"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sizes[0]).To(BeNumerically("<", len(text)/2))
+			Expect(sizes[1]).To(Equal(len("small")))
+
+			packets, err := ReadPackets(codec, b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(packets).To(Equal([][]byte{text, []byte("small")}))
+		})
+
+		It("skips compression after incompressible packets with "+codec, func() {
+			b, sizes, err := WritePackets(codec, random, text, text, text, text)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sizes[0]).To(Equal(len(random)))
+			// Compression is skipped for the next packet, then resumed
+			Expect(sizes[1]).To(Equal(len(text)))
+			Expect(sizes[2]).To(BeNumerically("<", len(text)/2))
+
+			packets, err := ReadPackets(codec, b)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(packets).To(Equal([][]byte{random, text, text, text, text}))
+		})
+	}
+})
@@ -21,6 +21,7 @@ package engine
 // THE SOFTWARE.
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/ipfs/go-log"
@@ -31,23 +32,81 @@ type Config struct {
 	Interface        *water.Interface
 	InterfaceName    string
 	InterfaceAddress string
-	RouterAddress    string
 	InterfaceMTU     int
 	MTU              int
 	DeviceType       water.DeviceType
 
+	// InterfaceAddress6 is the IPv6 address of the interface (CIDR).
+	// If empty, an ULA is derived from the network and the IPv4 address.
+	InterfaceAddress6 string
+
+	// Routes are the networks (CIDR) reachable through this node
+	// which are advertised to the other peers
+	Routes []string
+
+	// ExitNodes route the traffic sent from this node to networks outside of
+	// the VPN. They are considered down ExitNodeTimeout after their last healthcheck
+	ExitNodes       []ExitNode
+	ExitNodeTimeout time.Duration
+
+	// RouterAddress is the VPN address of an exit node routing the default
+	// networks, added to ExitNodes by Apply.
+	//
+	// Deprecated: use ExitNodes
+	RouterAddress string
+
 	LedgerAnnounceTime time.Duration
 	Logger             log.StandardLogger
 
+	// Controller exposes the engine runtime state
+	Controller *Controller
+
 	NetLinkBootstrap bool
 
+	// HostRoutes routes the networks advertised by the peers and the ones of
+	// the exit nodes to the interface. They are added to RouteTable if set, the
+	// main table otherwise, which is looked up according to RoutingRule if set
+	HostRoutes  bool
+	RouteTable  int
+	RoutingRule *RoutingRule
+
+	// Userspace runs the VPN over an embedded TCP/IP stack instead of a TUN
+	// device, UserspaceProxy is the optional listen address of an HTTP proxy
+	// to reach the VPN nodes through it
+	Userspace      bool
+	UserspaceProxy string
+
+	// CaptureSize is the number of packets to capture from startup, 0 to disable
+	CaptureSize int
+
+	// Compression is the codec compressing the packets sent to the peers supporting it
+	Compression string
+
+	// Shaping holds the bandwidth limits applied at startup, if set
+	Shaping *Shaping
+
+	// Transport carries the packets to the peers, the one of the network token
+	// if empty. DatagramAddress is the UDP address the datagrams are received on
+	Transport       string
+	DatagramAddress string
+
+	// Multicast is the replication mode of the broadcast and multicast packets,
+	// and MulticastRate the number of them replicated per second, 0 for no limit
+	Multicast     string
+	MulticastRate int
+
 	// Frame timeout
 	Timeout time.Duration
 
+	// Concurrency is the number of workers handling packets, and
+	// ChannelBufferSize the size of the queue of each of them. The packets
+	// read while the queue of their flow is full are dropped
 	Concurrency       int
 	ChannelBufferSize int
 	MaxStreams        int
 	lowProfile        bool
+	disableIPv6       bool
+	disableRelay      bool
 }
 
 type Option func(cfg *Config) error
@@ -63,6 +122,24 @@ func (cfg *Config) Apply(opts ...Option) error {
 			return err
 		}
 	}
+	return cfg.applyRouterAddress()
+}
+
+// applyRouterAddress adds the exit node of RouterAddress, once
+func (cfg *Config) applyRouterAddress() error {
+	if cfg.RouterAddress == "" {
+		return nil
+	}
+	router := ExitNode{Address: cfg.RouterAddress}
+	if err := validateExitNode(router); err != nil {
+		return err
+	}
+	for _, e := range cfg.ExitNodes {
+		if e.Address == router.Address && len(e.Networks) == 0 {
+			return nil
+		}
+	}
+	cfg.ExitNodes = append(cfg.ExitNodes, router)
 	return nil
 }
 
@@ -79,6 +156,45 @@ var LowProfile Option = func(cfg *Config) error {
 	return nil
 }
 
+// DisableIPv6 disables IPv6 addressing and routing on the interface
+var DisableIPv6 Option = func(cfg *Config) error {
+	cfg.disableIPv6 = true
+
+	return nil
+}
+
+// DisableRelay stops forwarding the traffic between the peers
+// which can not reach each other directly
+var DisableRelay Option = func(cfg *Config) error {
+	cfg.disableRelay = true
+
+	return nil
+}
+
+// HostRoutes routes the networks reachable through the VPN to the interface
+func HostRoutes(b bool) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.HostRoutes = b
+		return nil
+	}
+}
+
+// WithRouteTable adds the routes to the interface to a dedicated routing table
+func WithRouteTable(t int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.RouteTable = t
+		return nil
+	}
+}
+
+// WithRoutingRule selects the traffic routed with the dedicated routing table
+func WithRoutingRule(r RoutingRule) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.RoutingRule = &r
+		return nil
+	}
+}
+
 func WithInterface(i *water.Interface) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.Interface = i
@@ -107,6 +223,13 @@ func Logger(l log.StandardLogger) func(cfg *Config) error {
 		return nil
 	}
 }
+
+// WithRouterAddress routes all the traffic sent from this node to networks
+// outside of the VPN through the node with the VPN address i. Unlike before
+// the exit nodes, the VPN nodes and the networks advertised by the peers are
+// still reached directly.
+//
+// Deprecated: use WithExitNodes
 func WithRouterAddress(i string) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.RouterAddress = i
@@ -114,6 +237,27 @@ func WithRouterAddress(i string) func(cfg *Config) error {
 	}
 }
 
+// WithExitNodes routes the traffic to networks outside of the VPN through the given nodes
+func WithExitNodes(e ...ExitNode) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		for _, n := range e {
+			if err := validateExitNode(n); err != nil {
+				return err
+			}
+		}
+		cfg.ExitNodes = append(cfg.ExitNodes, e...)
+		return nil
+	}
+}
+
+// WithExitNodeTimeout sets the time after which an exit node which did not send any healthcheck is considered down
+func WithExitNodeTimeout(d time.Duration) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.ExitNodeTimeout = d
+		return nil
+	}
+}
+
 func WithLedgerAnnounceTime(t time.Duration) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.LedgerAnnounceTime = t
@@ -169,3 +313,102 @@ func WithInterfaceAddress(i string) func(cfg *Config) error {
 		return nil
 	}
 }
+
+func WithInterfaceAddress6(i string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.InterfaceAddress6 = i
+		return nil
+	}
+}
+
+// WithRoutes adds networks to be advertised as reachable through this node
+func WithRoutes(r ...string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Routes = append(cfg.Routes, r...)
+		return nil
+	}
+}
+
+// WithController binds the engine to the given Controller
+func WithController(ctrl *Controller) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Controller = ctrl
+		return nil
+	}
+}
+
+// WithUserspace runs the VPN over an userspace TCP/IP stack, requiring no TUN device nor privileges
+func WithUserspace(b bool) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Userspace = b
+		return nil
+	}
+}
+
+// WithUserspaceProxy starts an HTTP proxy on the given address to reach the VPN in userspace mode
+func WithUserspaceProxy(listen string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.UserspaceProxy = listen
+		return nil
+	}
+}
+
+// WithCaptureSize starts capturing the last i packets sent and received through the VPN,
+// at most MaxCaptureSize
+func WithCaptureSize(i int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if i > MaxCaptureSize {
+			return fmt.Errorf("invalid capture size '%d', the maximum is %d", i, MaxCaptureSize)
+		}
+		cfg.CaptureSize = i
+		return nil
+	}
+}
+
+// WithMulticast replicates the broadcast and multicast packets to the peers, with the given mode
+func WithMulticast(mode string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Multicast = mode
+		return ValidateMulticastMode(mode)
+	}
+}
+
+// WithMulticastRate limits the broadcast and multicast packets replicated per second
+func WithMulticastRate(i int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.MulticastRate = i
+		return nil
+	}
+}
+
+// WithCompression compresses the packets sent to the peers with the given codec, if they support it
+func WithCompression(codec string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Compression = codec
+		return ValidateCompression(codec)
+	}
+}
+
+// WithShaping sets the bandwidth limits applied at startup
+func WithShaping(s Shaping) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Shaping = &s
+		return ValidateShaping(s)
+	}
+}
+
+// WithTransport sets the transport carrying the packets to the peers
+func WithTransport(t string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Transport = t
+		return ValidateTransport(t)
+	}
+}
+
+// WithDatagramAddress sets the UDP address the datagrams are received on, e.g. ":5353"
+func WithDatagramAddress(a string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.DatagramAddress = a
+		return nil
+	}
+}
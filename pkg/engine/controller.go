@@ -0,0 +1,330 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// ErrNoUserspace is returned when dialing or listening on a
+// VPN which is not running in userspace mode
+var ErrNoUserspace = errors.New("userspace network stack not available")
+
+// Controller gives access to the runtime state of a VPN engine, e.g. to expose it
+// over the API. It can be created before the engine is started, and is bound to it
+// with WithController.
+type Controller struct {
+	sync.Mutex
+	scheduler *scheduler
+	net       *netstack.Net
+	metrics   *metrics
+	paths     *paths
+	exits     *exitRouter
+	shaper    *shaper
+	iface     string
+
+	// capture holds the *captureRing, or a nil one when not capturing
+	capture atomic.Value
+
+	// datagrams holds the *datagrams, or a nil one when sending packets over streams
+	datagrams atomic.Value
+
+	// bridge holds the *bridge in TAP mode, or a nil one
+	bridge atomic.Value
+
+	// local holds the *interfaceState of the running engine, and
+	// reconfigure applies a new one to it
+	local       atomic.Value
+	reconfigure func(InterfaceConfig) error
+}
+
+// NewController returns a new Controller, not bound to any engine
+func NewController() *Controller {
+	c := &Controller{metrics: newMetrics(), paths: newPaths(), shaper: newShaper()}
+	c.capture.Store((*captureRing)(nil))
+	c.datagrams.Store((*datagrams)(nil))
+	c.bridge.Store((*bridge)(nil))
+	c.local.Store(&interfaceState{})
+	return c
+}
+
+func (c *Controller) localInterface() *interfaceState {
+	return c.local.Load().(*interfaceState)
+}
+
+func (c *Controller) setInterface(s *interfaceState) {
+	c.local.Store(s)
+}
+
+func (c *Controller) setReconfigure(f func(InterfaceConfig) error) {
+	c.Lock()
+	defer c.Unlock()
+	c.reconfigure = f
+}
+
+// Interface returns the configuration of the VPN interface
+func (c *Controller) Interface() InterfaceConfig {
+	cfg := c.localInterface().config
+	cfg.Routes = append([]string{}, cfg.Routes...)
+	return cfg
+}
+
+// Reconfigure changes the addresses, the MTU and the advertised routes of the VPN
+// interface, without restarting the engine. It returns ErrNotRunning if the engine
+// is not running
+func (c *Controller) Reconfigure(cfg InterfaceConfig) error {
+	c.Lock()
+	f := c.reconfigure
+	c.Unlock()
+	if f == nil {
+		return ErrNotRunning
+	}
+	return f(cfg)
+}
+
+func (c *Controller) setDatagrams(d *datagrams) {
+	c.datagrams.Store(d)
+}
+
+func (c *Controller) datagramTransport() *datagrams {
+	return c.datagrams.Load().(*datagrams)
+}
+
+func (c *Controller) setBridge(b *bridge) {
+	c.bridge.Store(b)
+}
+
+func (c *Controller) ethernetBridge() *bridge {
+	return c.bridge.Load().(*bridge)
+}
+
+// Bridge returns the MAC addresses learned from the peers in TAP mode
+func (c *Controller) Bridge() []BridgeEntry {
+	b := c.ethernetBridge()
+	if b == nil {
+		return []BridgeEntry{}
+	}
+	return b.entries()
+}
+
+func (c *Controller) setScheduler(s *scheduler) {
+	c.Lock()
+	defer c.Unlock()
+	c.scheduler = s
+}
+
+// SchedulerStats returns the statistics of the packet queues.
+// It is empty if the engine is not running
+func (c *Controller) SchedulerStats() SchedulerStats {
+	c.Lock()
+	defer c.Unlock()
+	if c.scheduler == nil {
+		return SchedulerStats{}
+	}
+	return c.scheduler.Stats()
+}
+
+// Metrics returns the traffic counters of the engine, along with the
+// statistics of the packet queues
+func (c *Controller) Metrics() Metrics {
+	m := c.metrics.snapshot()
+	m.Scheduler = c.SchedulerStats()
+	return m
+}
+
+// PeerMetrics returns the traffic counters of the given peer
+func (c *Controller) PeerMetrics(peer string) (PeerMetrics, bool) {
+	m, ok := c.metrics.snapshot().Peers[peer]
+	return m, ok
+}
+
+func (c *Controller) setExits(e *exitRouter) {
+	c.Lock()
+	defer c.Unlock()
+	c.exits = e
+}
+
+func (c *Controller) exitRouter() *exitRouter {
+	c.Lock()
+	defer c.Unlock()
+	return c.exits
+}
+
+// ExitNodes returns the state of the exit nodes of each network.
+// It is empty if the engine is not running
+func (c *Controller) ExitNodes() []ExitNodeStatus {
+	c.Lock()
+	defer c.Unlock()
+	if c.exits == nil {
+		return []ExitNodeStatus{}
+	}
+	return c.exits.statusList()
+}
+
+// Paths returns the path used to reach each peer the engine sent packets to,
+// either directly or through a relay
+func (c *Controller) Paths() []Path {
+	return c.paths.list()
+}
+
+// Shaping returns the bandwidth limits of the engine
+func (c *Controller) Shaping() Shaping {
+	return c.shaper.config()
+}
+
+// SetShaping replaces the bandwidth limits of the engine
+func (c *Controller) SetShaping(s Shaping) error {
+	return c.shaper.set(s)
+}
+
+// SetPeerLimit sets the bandwidth limit of a peer, removing it if l has no limit
+func (c *Controller) SetPeerLimit(peer string, l Limit) error {
+	return c.shaper.update(func(s *Shaping) {
+		if l == (Limit{}) {
+			delete(s.Peers, peer)
+			return
+		}
+		s.Peers[peer] = l
+	})
+}
+
+func (c *Controller) setNet(n *netstack.Net) {
+	c.Lock()
+	defer c.Unlock()
+	c.net = n
+}
+
+func (c *Controller) getNet() (*netstack.Net, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.net == nil {
+		return nil, ErrNoUserspace
+	}
+	return c.net, nil
+}
+
+// DialContext connects to the address on the named network ("tcp", "udp", and their
+// "4" and "6" variants) through the VPN. It requires the engine to run in userspace mode
+func (c *Controller) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n, err := c.getNet()
+	if err != nil {
+		return nil, err
+	}
+	return n.DialContext(ctx, network, address)
+}
+
+// Listen announces on the VPN address for incoming TCP connections, e.g. ":8080".
+// It requires the engine to run in userspace mode
+func (c *Controller) Listen(address string) (net.Listener, error) {
+	n, err := c.getNet()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := n.ListenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ListenPacket listens on the VPN address for UDP packets, e.g. ":53".
+// It requires the engine to run in userspace mode
+func (c *Controller) ListenPacket(address string) (net.PacketConn, error) {
+	n, err := c.getNet()
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := n.ListenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ErrNoCapture is returned when reading the packets of a capture which is not running
+var ErrNoCapture = errors.New("no capture running")
+
+func (c *Controller) setInterfaceName(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.iface = name
+}
+
+// InterfaceName returns the name of the interface of the VPN
+func (c *Controller) InterfaceName() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.iface
+}
+
+func (c *Controller) captureRing() *captureRing {
+	return c.capture.Load().(*captureRing)
+}
+
+// StartCapture starts capturing the last size packets sent and received
+// through the VPN interface, discarding any previous capture. The size is
+// clamped to MaxCaptureSize
+func (c *Controller) StartCapture(size int) {
+	c.capture.Store(newCaptureRing(size))
+}
+
+// StopCapture stops capturing packets, discarding the captured ones
+func (c *Controller) StopCapture() {
+	c.capture.Store((*captureRing)(nil))
+}
+
+// Capturing returns true if packets are being captured
+func (c *Controller) Capturing() bool {
+	return c.captureRing() != nil
+}
+
+// WriteCapture writes the captured packets selected by the filter to w in the pcapng format
+func (c *Controller) WriteCapture(w io.Writer, f CaptureFilter) error {
+	r := c.captureRing()
+	if r == nil {
+		return ErrNoCapture
+	}
+
+	c.Lock()
+	name := c.iface
+	c.Unlock()
+
+	return writeCapture(w, name, r.snapshot(), f, c.ethernetBridge() != nil)
+}
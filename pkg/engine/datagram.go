@@ -0,0 +1,554 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	manet "github.com/multiformats/go-multiaddr/net"
+
+	"github.com/bhojpur/vpn/pkg/protocol"
+)
+
+// Transports carrying the packets between the peers
+const (
+	// TransportStream sends the packets over libp2p streams
+	TransportStream = "stream"
+	// TransportDatagram sends the packets as UDP datagrams, falling
+	// back to streams when the peer can not be reached with them
+	TransportDatagram = "datagram"
+)
+
+const (
+	// datagramKeepalive is the interval at which the sessions are kept alive
+	datagramKeepalive = 10 * time.Second
+	// datagramTimeout is the time after which a peer is reached again with
+	// streams, when no datagram was received from it
+	datagramTimeout = 3 * datagramKeepalive
+	// datagramRetry is the minimum time between two handshakes with a peer
+	datagramRetry = datagramTimeout
+
+	datagramVersion    = 1
+	datagramHelloSize  = 1 + 2 + 4 + 32
+	datagramHeaderSize = 1 + 4 + 8
+	maxDatagramSize    = 1<<16 - 1
+
+	datagramTypePacket    byte = 0
+	datagramTypeKeepalive byte = 1
+)
+
+// errNoDatagramSession is returned when sending datagrams to a peer
+// without a confirmed session
+var errNoDatagramSession = errors.New("no datagram session")
+
+// ValidateTransport returns an error if t is not a supported transport
+func ValidateTransport(t string) error {
+	switch t {
+	case "", TransportStream, TransportDatagram:
+		return nil
+	}
+	return fmt.Errorf("unsupported transport '%s'", t)
+}
+
+// datagramHello is sent by each peer over the handshake stream: it accepts
+// the datagrams sent to port, tagged with session and sealed with key. As the
+// stream is authenticated with the libp2p identities, so are the datagrams
+type datagramHello struct {
+	port    uint16
+	session uint32
+	key     [32]byte
+}
+
+func (h *datagramHello) marshal() []byte {
+	b := make([]byte, datagramHelloSize)
+	b[0] = datagramVersion
+	binary.BigEndian.PutUint16(b[1:3], h.port)
+	binary.BigEndian.PutUint32(b[3:7], h.session)
+	copy(b[7:], h.key[:])
+	return b
+}
+
+func (h *datagramHello) unmarshal(b []byte) error {
+	if b[0] != datagramVersion {
+		return fmt.Errorf("unsupported datagram version %d", b[0])
+	}
+	h.port = binary.BigEndian.Uint16(b[1:3])
+	h.session = binary.BigEndian.Uint32(b[3:7])
+	copy(h.key[:], b[7:])
+	return nil
+}
+
+// replayWindow rejects the datagrams received twice, or too late
+type replayWindow struct {
+	last   uint64
+	bitmap uint64
+}
+
+func (w *replayWindow) accept(n uint64) bool {
+	if n > w.last {
+		if shift := n - w.last; shift < 64 {
+			w.bitmap = w.bitmap<<shift | 1
+		} else {
+			w.bitmap = 1
+		}
+		w.last = n
+		return true
+	}
+	diff := w.last - n
+	if diff >= 64 || w.bitmap&(1<<diff) != 0 {
+		return false
+	}
+	w.bitmap |= 1 << diff
+	return true
+}
+
+// datagramSession holds the keys of the datagrams exchanged with a peer
+type datagramSession struct {
+	peer    peer.ID
+	created time.Time
+
+	recvID uint32
+	recv   cipher.AEAD
+	// window is guarded by the lock of the datagrams
+	window replayWindow
+
+	sendID  uint32
+	send    cipher.AEAD
+	counter uint64
+
+	// addr is the *net.UDPAddr of the peer, updated from the datagrams received
+	addr atomic.Value
+	// lastRecv is the time of the last datagram received, in unix nanoseconds
+	lastRecv int64
+}
+
+// confirmed returns true if the peer is reachable with datagrams
+func (s *datagramSession) confirmed(now time.Time) bool {
+	last := atomic.LoadInt64(&s.lastRecv)
+	return last != 0 && now.Sub(time.Unix(0, last)) < datagramTimeout
+}
+
+// datagrams is the UDP side channel the packets are sent through
+type datagrams struct {
+	sync.Mutex
+	conn     *net.UDPConn
+	peers    map[peer.ID]*datagramSession
+	sessions map[uint32]*datagramSession
+	attempts map[peer.ID]time.Time
+
+	// pending are the sessions replacing the ones of peers, until the peers
+	// confirm them. The sessions replaced are accepted until they are idle
+	pending map[peer.ID]*datagramSession
+	// handshakes are the peers a handshake is in progress with, true if
+	// this node started it
+	handshakes map[peer.ID]bool
+}
+
+// newDatagrams listens for datagrams on the UDP address, e.g. ":0"
+func newDatagrams(address string) (*datagrams, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &datagrams{
+		conn:       conn,
+		peers:      map[peer.ID]*datagramSession{},
+		sessions:   map[uint32]*datagramSession{},
+		attempts:   map[peer.ID]time.Time{},
+		pending:    map[peer.ID]*datagramSession{},
+		handshakes: map[peer.ID]bool{},
+	}, nil
+}
+
+func (d *datagrams) close() error {
+	return d.conn.Close()
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// handshake exchanges the session keys with the peer id over rw. The
+// datagrams are sent to ip, on the port announced by the peer
+func (d *datagrams) handshake(rw io.ReadWriter, id peer.ID, ip net.IP) error {
+	local := &datagramHello{port: uint16(d.conn.LocalAddr().(*net.UDPAddr).Port)}
+	if _, err := rand.Read(local.key[:]); err != nil {
+		return err
+	}
+
+	recv, err := newAEAD(local.key[:])
+	if err != nil {
+		return err
+	}
+	s := &datagramSession{peer: id, created: time.Now(), recv: recv}
+
+	d.Lock()
+	for {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			d.Unlock()
+			return err
+		}
+		local.session = binary.BigEndian.Uint32(b[:])
+		if _, ok := d.sessions[local.session]; !ok {
+			break
+		}
+	}
+	// The session is reserved until the keys are exchanged
+	s.recvID = local.session
+	d.sessions[s.recvID] = nil
+	d.Unlock()
+
+	err = d.exchange(rw, local, s, ip)
+
+	d.Lock()
+	if err != nil {
+		delete(d.sessions, s.recvID)
+		d.Unlock()
+		return err
+	}
+	d.sessions[s.recvID] = s
+	d.install(s, time.Now())
+	d.Unlock()
+
+	// The first datagram opens the NAT mappings, and confirms
+	// the session to the peer
+	return d.write(s, datagramTypeKeepalive, nil)
+}
+
+// install makes s the session of its peer, or the pending one if the
+// current session is confirmed. The sessions of older handshakes completed
+// after s are never installed, so both peers agree on the last one
+func (d *datagrams) install(s *datagramSession, now time.Time) {
+	cur, pending := d.peers[s.peer], d.pending[s.peer]
+	for _, e := range []*datagramSession{cur, pending} {
+		if e != nil && e.created.After(s.created) {
+			return
+		}
+	}
+	if cur != nil && cur.confirmed(now) {
+		d.pending[s.peer] = s
+		return
+	}
+	delete(d.pending, s.peer)
+	d.peers[s.peer] = s
+}
+
+// promote replaces the session of the peer of s with it, once confirmed
+func (d *datagrams) promote(s *datagramSession) {
+	d.Lock()
+	defer d.Unlock()
+	if d.pending[s.peer] == s {
+		delete(d.pending, s.peer)
+		d.peers[s.peer] = s
+	}
+}
+
+// begin returns true if a handshake with the peer id can start, started by
+// self if initiator is set. When both peers start one at the same time, the
+// one of the lowest peer ID is the only one completed
+func (d *datagrams) begin(self, id peer.ID, initiator bool) bool {
+	d.Lock()
+	defer d.Unlock()
+	if started, ok := d.handshakes[id]; ok {
+		if initiator || !started || self < id {
+			return false
+		}
+	}
+	d.handshakes[id] = initiator
+	return true
+}
+
+// end marks the handshake with the peer id started by begin as done
+func (d *datagrams) end(id peer.ID, initiator bool) {
+	d.Lock()
+	defer d.Unlock()
+	if started, ok := d.handshakes[id]; ok && started == initiator {
+		delete(d.handshakes, id)
+	}
+}
+
+func (d *datagrams) exchange(rw io.ReadWriter, local *datagramHello, s *datagramSession, ip net.IP) error {
+	if _, err := rw.Write(local.marshal()); err != nil {
+		return err
+	}
+	b := make([]byte, datagramHelloSize)
+	if _, err := io.ReadFull(rw, b); err != nil {
+		return err
+	}
+	remote := &datagramHello{}
+	if err := remote.unmarshal(b); err != nil {
+		return err
+	}
+
+	send, err := newAEAD(remote.key[:])
+	if err != nil {
+		return err
+	}
+	s.send, s.sendID = send, remote.session
+	s.addr.Store(&net.UDPAddr{IP: ip, Port: int(remote.port)})
+	return nil
+}
+
+// handleStream answers the handshakes of the peers accepted
+func (d *datagrams) handleStream(accept func(peer.ID) bool) func(stream network.Stream) {
+	return func(stream network.Stream) {
+		defer stream.Close()
+		id := stream.Conn().RemotePeer()
+		ip, err := remoteIP(stream)
+		if err != nil || !accept(id) || !d.begin(stream.Conn().LocalPeer(), id, false) {
+			stream.Reset()
+			return
+		}
+		defer d.end(id, false)
+		stream.SetDeadline(time.Now().Add(datagramKeepalive))
+		if err := d.handshake(stream, id, ip); err != nil {
+			stream.Reset()
+		}
+	}
+}
+
+// connect starts a handshake with the peer id in the background, unless
+// one was attempted recently
+func (d *datagrams) connect(h host.Host, id peer.ID, timeout time.Duration) {
+	now := time.Now()
+	d.Lock()
+	if last, ok := d.attempts[id]; ok && now.Sub(last) < datagramRetry {
+		d.Unlock()
+		return
+	}
+	d.attempts[id] = now
+	d.Unlock()
+
+	if !d.begin(h.ID(), id, true) {
+		return
+	}
+	go func() {
+		defer d.end(id, true)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		stream, err := h.NewStream(ctx, id, protocol.BhojpurVPNDatagram.ID())
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		ip, err := remoteIP(stream)
+		if err != nil {
+			stream.Reset()
+			return
+		}
+		stream.SetDeadline(time.Now().Add(timeout))
+		if err := d.handshake(stream, id, ip); err != nil {
+			stream.Reset()
+		}
+	}()
+}
+
+// remoteIP returns the IP address of the peer of a stream. Relayed
+// connections have none, so the peer can not be reached with datagrams
+func remoteIP(stream network.Stream) (net.IP, error) {
+	addr, err := manet.ToNetAddr(stream.Conn().RemoteMultiaddr())
+	if err != nil {
+		return nil, err
+	}
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, nil
+	case *net.TCPAddr:
+		return a.IP, nil
+	}
+	return nil, fmt.Errorf("no ip address in %s", addr.String())
+}
+
+// send seals packet in a datagram to the peer id. It returns the size of the
+// datagram, or errNoDatagramSession if the peer is not reachable with datagrams
+func (d *datagrams) send(id peer.ID, packet []byte) (int, error) {
+	d.Lock()
+	s, ok := d.peers[id]
+	d.Unlock()
+	if !ok || !s.confirmed(time.Now()) {
+		return 0, errNoDatagramSession
+	}
+	if len(packet)+datagramHeaderSize+s.send.Overhead() > maxDatagramSize {
+		return 0, fmt.Errorf("packet of %d bytes too large for a datagram", len(packet))
+	}
+	return datagramHeaderSize + len(packet) + s.send.Overhead(), d.write(s, datagramTypePacket, packet)
+}
+
+func (d *datagrams) write(s *datagramSession, typ byte, payload []byte) error {
+	b := make([]byte, datagramHeaderSize, datagramHeaderSize+len(payload)+s.send.Overhead())
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:5], s.sendID)
+	binary.BigEndian.PutUint64(b[5:13], atomic.AddUint64(&s.counter, 1))
+
+	nonce := make([]byte, s.send.NonceSize())
+	copy(nonce[len(nonce)-8:], b[5:13])
+	b = s.send.Seal(b, nonce, payload, b[:datagramHeaderSize])
+
+	_, err := d.conn.WriteToUDP(b, s.addr.Load().(*net.UDPAddr))
+	return err
+}
+
+// open authenticates a datagram received from addr, returning its peer and
+// packet. The packet is empty for keepalives
+func (d *datagrams) open(b []byte, addr *net.UDPAddr) (peer.ID, []byte, error) {
+	if len(b) < datagramHeaderSize {
+		return "", nil, fmt.Errorf("truncated datagram of %d bytes", len(b))
+	}
+	typ, id, counter := b[0], binary.BigEndian.Uint32(b[1:5]), binary.BigEndian.Uint64(b[5:13])
+	if typ != datagramTypePacket && typ != datagramTypeKeepalive {
+		return "", nil, fmt.Errorf("unknown datagram type %d", typ)
+	}
+
+	d.Lock()
+	s := d.sessions[id]
+	d.Unlock()
+	if s == nil {
+		return "", nil, fmt.Errorf("unknown datagram session %d", id)
+	}
+
+	nonce := make([]byte, s.recv.NonceSize())
+	copy(nonce[len(nonce)-8:], b[5:13])
+	packet, err := s.recv.Open(b[datagramHeaderSize:datagramHeaderSize], nonce, b[datagramHeaderSize:], b[:datagramHeaderSize])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid datagram from %s: %w", addr.String(), err)
+	}
+
+	d.Lock()
+	fresh := s.window.accept(counter)
+	d.Unlock()
+	if !fresh {
+		return "", nil, fmt.Errorf("replayed datagram from %s", addr.String())
+	}
+
+	// The peer may have roamed, or be behind a NAT
+	s.addr.Store(addr)
+	if atomic.SwapInt64(&s.lastRecv, time.Now().UnixNano()) == 0 {
+		d.promote(s)
+		d.write(s, datagramTypeKeepalive, nil)
+	}
+	return s.peer, packet, nil
+}
+
+// run reads the datagrams until ctx is done, handing the packets to receive
+// along with the size of their datagram
+func (d *datagrams) run(ctx context.Context, receive func(src peer.ID, packet []byte, wire int)) {
+	go func() {
+		<-ctx.Done()
+		d.close()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		src, packet, err := d.open(buf[:n], addr)
+		if err != nil || len(packet) == 0 {
+			continue
+		}
+		receive(src, packet, n)
+	}
+}
+
+// keepalive keeps the sessions alive until ctx is done, and removes
+// the ones the peers stopped answering to
+func (d *datagrams) keepalive(ctx context.Context) {
+	t := time.NewTicker(datagramKeepalive)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, s := range d.expire(now) {
+				d.write(s, datagramTypeKeepalive, nil)
+			}
+		}
+	}
+}
+
+// expire removes the sessions without datagrams received for a while, and
+// the ones replaced once idle, returning the sessions of the peers
+func (d *datagrams) expire(now time.Time) []*datagramSession {
+	d.Lock()
+	defer d.Unlock()
+	alive := []*datagramSession{}
+	for recvID, s := range d.sessions {
+		if s == nil {
+			// Reserved by a handshake in progress
+			continue
+		}
+		last := s.created
+		if l := atomic.LoadInt64(&s.lastRecv); l != 0 {
+			last = time.Unix(0, l)
+		}
+		switch {
+		case d.peers[s.peer] == s:
+			if now.Sub(last) <= 2*datagramTimeout {
+				alive = append(alive, s)
+				continue
+			}
+			delete(d.peers, s.peer)
+		case d.pending[s.peer] == s:
+			if now.Sub(last) <= 2*datagramTimeout {
+				continue
+			}
+			delete(d.pending, s.peer)
+		case now.Sub(last) <= datagramKeepalive:
+			// Replaced, the peer may still be confirming the new session
+			continue
+		}
+		delete(d.sessions, recvID)
+	}
+	for id, last := range d.attempts {
+		if now.Sub(last) > datagramRetry {
+			delete(d.attempts, id)
+		}
+	}
+	return alive
+}
@@ -0,0 +1,176 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+)
+
+var _ = Describe("Datagrams", func() {
+	var a, b *Datagrams
+	pa, pb := newPeerID(), newPeerID()
+
+	BeforeEach(func() {
+		var err error
+		a, b, err = NewDatagramPair(pa, pb)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		a.Close()
+		b.Close()
+	})
+
+	It("validates the transport", func() {
+		Expect(ValidateTransport("")).To(Succeed())
+		Expect(ValidateTransport(TransportStream)).To(Succeed())
+		Expect(ValidateTransport(TransportDatagram)).To(Succeed())
+		Expect(ValidateTransport("quic")).ToNot(Succeed())
+	})
+
+	It("sends nothing until the peer is confirmed", func() {
+		_, err := a.Send(pb, []byte("packet"))
+		Expect(err).To(HaveOccurred())
+		_, err = a.Send(newPeerID(), []byte("packet"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("exchanges packets authenticated with the session keys", func() {
+		Expect(a.Confirm()).To(Succeed())
+		Expect(b.Confirm()).To(Succeed())
+
+		wire, err := a.Send(pb, []byte("from a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(wire).To(BeNumerically(">", len("from a")))
+
+		src, packet, err := b.Receive()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src).To(Equal(pa))
+		Expect(packet).To(Equal([]byte("from a")))
+
+		_, err = b.Send(pa, []byte("from b"))
+		Expect(err).ToNot(HaveOccurred())
+		src, packet, err = a.Receive()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src).To(Equal(pb))
+		Expect(packet).To(Equal([]byte("from b")))
+	})
+
+	It("rejects the replayed and tampered datagrams", func() {
+		Expect(a.Confirm()).To(Succeed())
+		Expect(b.Confirm()).To(Succeed())
+
+		_, err := a.Send(pb, []byte("packet"))
+		Expect(err).ToNot(HaveOccurred())
+
+		var raw []byte
+		for {
+			d, addr, err := b.ReadDatagram()
+			Expect(err).ToNot(HaveOccurred())
+			_, packet, err := b.Open(d, addr)
+			Expect(err).ToNot(HaveOccurred())
+			if len(packet) > 0 {
+				raw = d
+				break
+			}
+		}
+
+		_, _, err = b.Open(raw, nil)
+		Expect(err).To(HaveOccurred())
+
+		_, err = a.Send(pb, []byte("packet"))
+		Expect(err).ToNot(HaveOccurred())
+		d, addr, err := b.ReadDatagram()
+		Expect(err).ToNot(HaveOccurred())
+		d[len(d)-1] ^= 0xff
+		_, _, err = b.Open(d, addr)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("keeps the previous session until the new one is confirmed", func() {
+		Expect(a.Confirm()).To(Succeed())
+		Expect(b.Confirm()).To(Succeed())
+		recv, send, ok := a.Session(pb)
+		Expect(ok).To(BeTrue())
+
+		Expect(Handshake(a, b, pa, pb)).To(Succeed())
+		r, s, _ := a.Session(pb)
+		Expect(r).To(Equal(recv))
+		Expect(s).To(Equal(send))
+
+		// b confirms the new session, and still accepts the previous one
+		_, err := a.Send(pb, []byte("previous"))
+		Expect(err).ToNot(HaveOccurred())
+		src, packet, err := b.Receive()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src).To(Equal(pa))
+		Expect(packet).To(Equal([]byte("previous")))
+
+		// a confirms the new session once it receives a datagram with it
+		Eventually(func() uint32 {
+			Expect(a.Confirm()).To(Succeed())
+			r, _, _ := a.Session(pb)
+			return r
+		}).ShouldNot(Equal(recv))
+		r, s, _ = a.Session(pb)
+		Expect(s).ToNot(Equal(send))
+		br, bs, _ := b.Session(pa)
+		Expect(br).To(Equal(s))
+		Expect(bs).To(Equal(r))
+
+		_, err = a.Send(pb, []byte("new"))
+		Expect(err).ToNot(HaveOccurred())
+		_, packet, err = b.Receive()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(packet).To(Equal([]byte("new")))
+	})
+
+	It("agrees on the handshake of the lowest peer when they cross", func() {
+		low, high := pa, pb
+		if high < low {
+			low, high = high, low
+		}
+		dl, dh, completed, err := CrossedHandshakes(low, high)
+		Expect(err).ToNot(HaveOccurred())
+		defer dl.Close()
+		defer dh.Close()
+		Expect(completed).To(Equal(1))
+
+		lr, ls, ok := dl.Session(high)
+		Expect(ok).To(BeTrue())
+		hr, hs, ok := dh.Session(low)
+		Expect(ok).To(BeTrue())
+		Expect(ls).To(Equal(hr))
+		Expect(hs).To(Equal(lr))
+
+		Expect(dl.Confirm()).To(Succeed())
+		Expect(dh.Confirm()).To(Succeed())
+		_, err = dh.Send(low, []byte("from high"))
+		Expect(err).ToNot(HaveOccurred())
+		src, packet, err := dl.Receive()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src).To(Equal(high))
+		Expect(packet).To(Equal([]byte("from high")))
+	})
+})
@@ -71,8 +71,27 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 		//  1. Get available nodes. Filter from Machine those that do not have an IP.
 		//  2. Get the leader among them. If we are not, we wait
 		//  3. If we are the leader, pick an IP and start the VPN with that IP
+		// The state is evaluated again on the changes of the machines and of the leader,
+		// or after a while as the nodes expire
+		wctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		machines := b.View(wctx, protocol.MachinesLedgerKey)
+		machineEvents := b.Watch(wctx, protocol.MachinesLedgerKey)
+		leaderEvents := b.Watch(wctx, "dhcp", "leader")
 		for wantedIP == "" {
-			time.Sleep(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case _, ok := <-machineEvents:
+				if !ok {
+					machineEvents = b.Watch(wctx, protocol.MachinesLedgerKey)
+				}
+			case _, ok := <-leaderEvents:
+				if !ok {
+					leaderEvents = b.Watch(wctx, "dhcp", "leader")
+				}
+			case <-time.After(5 * time.Second):
+			}
 
 			// This network service is blocking and calls in before VPN, hence it needs to registered before VPN
 			nodes := services.AvailableNodes(b, maxTime)
@@ -80,7 +99,7 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 			currentIPs := map[string]string{}
 			ips := []string{}
 
-			for _, t := range b.LastBlock().Storage[protocol.MachinesLedgerKey] {
+			for _, t := range machines.Data() {
 				var m types.Machine
 				t.Unmarshal(&m)
 				currentIPs[m.PeerID] = m.Address
@@ -33,19 +33,19 @@ import (
 	"github.com/ipfs/go-log"
 	"github.com/libp2p/go-libp2p-core/network"
 	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/songgao/water"
 
 	"github.com/bhojpur/vpn/pkg/blockchain"
 	"github.com/bhojpur/vpn/pkg/logger"
 	"github.com/bhojpur/vpn/pkg/node"
 	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/services"
 	"github.com/bhojpur/vpn/pkg/stream"
 	"github.com/bhojpur/vpn/pkg/types"
 	internal "github.com/bhojpur/vpn/pkg/version"
 
 	"github.com/pkg/errors"
 	"github.com/songgao/packets/ethernet"
-	"github.com/songgao/water"
-	"golang.org/x/net/ipv4"
 )
 
 type streamManager interface {
@@ -63,17 +63,81 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 			Timeout:            15 * time.Second,
 			Logger:             logger.New(log.LevelDebug),
 			MaxStreams:         30,
+			MulticastRate:      DefaultMulticastRate,
+			ExitNodeTimeout:    DefaultExitNodeTimeout,
 		}
 		if err := c.Apply(p...); err != nil {
 			return err
 		}
 
-		ifce, err := createInterface(c)
+		if c.Controller == nil {
+			c.Controller = NewController()
+		}
+		c.Controller.setInterfaceName(c.InterfaceName)
+		if c.CaptureSize > 0 {
+			c.Controller.StartCapture(c.CaptureSize)
+		}
+		if c.Shaping != nil {
+			if err := c.Controller.SetShaping(*c.Shaping); err != nil {
+				return err
+			}
+		}
+
+		// The addresses, the MTU and the routes of the interface can be changed at runtime
+		mtu := c.InterfaceMTU
+		if mtu == 0 {
+			mtu = c.MTU
+		}
+		local, err := newInterfaceState(InterfaceConfig{
+			Address:  c.InterfaceAddress,
+			Address6: c.InterfaceAddress6,
+			MTU:      mtu,
+			Routes:   c.Routes,
+		}, c.disableIPv6, nc.RoomName)
 		if err != nil {
 			return err
 		}
+		c.InterfaceAddress6 = local.config.Address6
+		c.Controller.setInterface(local)
+		ip, ip6 := local.ip, local.ip6
+
+		var ifce io.ReadWriteCloser
+		if c.Userspace {
+			dev, tnet, err := createNetstack(c, ip, ip6)
+			if err != nil {
+				return err
+			}
+			c.Controller.setNet(tnet)
+			defer c.Controller.setNet(nil)
+			ifce = dev
+
+			if c.UserspaceProxy != "" {
+				serveProxy(ctx, c, c.UserspaceProxy)
+			}
+		} else {
+			dev, err := createInterface(c)
+			if err != nil {
+				return err
+			}
+			ifce = dev
+		}
 		defer ifce.Close()
 
+		// In TAP mode, Ethernet frames are switched to the peers by MAC address
+		if c.DeviceType == water.TAP {
+			if c.Userspace {
+				return errors.New("tap mode is not supported in userspace mode")
+			}
+			i, err := net.InterfaceByName(c.InterfaceName)
+			if err != nil {
+				return errors.Wrap(err, "could not read the tap interface")
+			}
+			br := newBridge(i.HardwareAddr)
+			c.Controller.setBridge(br)
+			defer c.Controller.setBridge(nil)
+			go br.run(ctx)
+		}
+
 		var mgr streamManager
 
 		if !c.lowProfile {
@@ -89,41 +153,159 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 			}()
 		}
 
-		// Set stream handler during runtime
-		n.Host().SetStreamHandler(protocol.BhojpurVPN.ID(), streamHandler(b, ifce, c))
+		// The routing table is kept in memory, and rebuilt when the ledger changes
+		routing := newRoutingCache(b, n.Host().ID().String())
+		go routing.run(ctx, routingTableRefresh)
 
-		// Announce our IP
-		ip, _, err := net.ParseCIDR(c.InterfaceAddress)
+		// The exit nodes are selected from the routing table and the healthchecks
+		exits, err := newExitRouter(c.ExitNodes, b, n.Host().ID().String(), c.ExitNodeTimeout)
 		if err != nil {
 			return err
 		}
+		c.Controller.setExits(exits)
+		go exits.run(ctx, routing, routingTableRefresh)
+
+		// The ACL is enforced on both the packets sent and received
+		fw := newFirewall(c.Controller.metrics)
+
+		// Broadcast and multicast packets are replicated to the peers
+		mc := newMulticast(c.Multicast, c.MulticastRate, local.network)
+
+		// The packets are sent as datagrams to the peers reachable with them
+		if c.Transport == "" {
+			c.Transport = nc.Transport
+		}
+		if err := ValidateTransport(c.Transport); err != nil {
+			return err
+		}
+		if c.Transport == TransportDatagram {
+			dg, err := newDatagrams(c.DatagramAddress)
+			if err != nil {
+				return errors.Wrap(err, "could not listen for datagrams")
+			}
+			defer dg.close()
+			c.Controller.setDatagrams(dg)
+			defer c.Controller.setDatagrams(nil)
+
+			n.Host().SetStreamHandler(protocol.BhojpurVPNDatagram.ID(), dg.handleStream(func(id peer.ID) bool {
+				routing.refresh()
+				return routing.Table().HasPeer(id)
+			}))
+			go receiveDatagrams(ctx, dg, c, n, routing, ifce, fw, mc)
+			go dg.keepalive(ctx)
+		}
+
+		// Set stream handlers during runtime. Legacy peers speak raw packets,
+		// newer ones negotiate the framed protocol, optionally compressed
+		handler := streamHandler(mgr, n, routing, ifce, c, fw, mc)
+		n.Host().SetStreamHandler(protocol.BhojpurVPN.ID(), handler)
+		n.Host().SetStreamHandler(protocol.BhojpurVPNFramed.ID(), handler)
+		for p := range codecs {
+			n.Host().SetStreamHandler(p, handler)
+		}
 
+		// Announce our IP, the advertisements expiring once we stop
+		ttl := services.AdvertisementTTL(c.LedgerAnnounceTime)
+		connected := func(id peer.ID) bool {
+			return n.Host().Network().Connectedness(id) == network.Connected
+		}
+		advertisedBy := map[string]string{}
 		b.Announce(
 			ctx,
 			c.LedgerAnnounceTime,
 			func() {
+				local := c.Controller.localInterface()
+				ip, ip6, mtu := local.ip.String(), ipString(local.ip6), local.config.MTU
+				mac := ""
+				if br := c.Controller.ethernetBridge(); br != nil {
+					mac = br.mac.String()
+				}
+
 				machine := &types.Machine{}
 				// Retrieve current ID for ip in the blockchain
-				existingValue, found := b.GetKey(protocol.MachinesLedgerKey, ip.String())
+				existingValue, found := b.GetKey(protocol.MachinesLedgerKey, ip)
 				existingValue.Unmarshal(machine)
 
-				// If mismatch, update the blockchain
-				if !found || machine.PeerID != n.Host().ID().String() {
+				// If mismatch or about to expire, update the blockchain
+				left, _ := b.TTL(protocol.MachinesLedgerKey, ip)
+				if !found || machine.PeerID != n.Host().ID().String() || machine.Address6 != ip6 || machine.MTU != mtu || machine.MAC != mac || left < ttl/2 {
 					updatedMap := map[string]interface{}{}
-					updatedMap[ip.String()] = newBlockChainData(n, ip.String())
-					b.Add(protocol.MachinesLedgerKey, updatedMap)
+					updatedMap[ip] = newBlockChainData(n, ip, ip6, mtu, mac)
+					b.AddTTL(protocol.MachinesLedgerKey, updatedMap, ttl)
+				}
+
+				// Announce the networks reachable through us
+				for _, r := range local.routes {
+					owner := announceRoute(b, r, n.Host().ID().String(), ttl, connected)
+					if owner != advertisedBy[r] && owner != n.Host().ID().String() {
+						c.Logger.Warnf("%s is already advertised by %s, not advertising it until it expires", r, owner)
+					}
+					advertisedBy[r] = owner
+				}
+
+				// Announce the peers we can relay the traffic to
+				if !c.disableRelay {
+					announceReachability(b, n, routing.Table(), ttl)
 				}
 			},
 		)
 
-		if c.NetLinkBootstrap {
+		if c.NetLinkBootstrap && !c.Userspace {
 			if err := prepareInterface(c); err != nil {
 				return err
 			}
+
+			// The networks reachable through the VPN are routed to the interface
+			// until shutdown
+			if c.HostRoutes {
+				hr, err := newHostRouter(c)
+				if err != nil {
+					return errors.Wrap(err, "could not set up the host routes")
+				}
+				defer hr.close()
+				for _, p := range exits.policies {
+					if ones, _ := p.net.Mask.Size(); ones == 0 && c.RouteTable == 0 {
+						c.Logger.Warnf("%s is routed through the exit nodes only with a dedicated routing table", p.net.String())
+					}
+				}
+				hr.start(ctx, routing, exits, c.Controller.localInterface, func() []net.IP {
+					return underlayAddresses(n.Host().Network())
+				}, routingTableRefresh)
+			}
 		}
 
+		// Reconfigurations are applied to the interface, and the addresses
+		// and routes removed are deleted from the ledger
+		var reconfiguring sync.Mutex
+		c.Controller.setReconfigure(func(cfg InterfaceConfig) error {
+			reconfiguring.Lock()
+			defer reconfiguring.Unlock()
+
+			old := c.Controller.localInterface()
+			local, err := newInterfaceState(cfg, c.disableIPv6, nc.RoomName)
+			if err != nil {
+				return err
+			}
+			if local.addressChanged(old) {
+				if c.Userspace {
+					return errors.New("the addresses and the mtu can not be changed in userspace mode")
+				}
+				if c.NetLinkBootstrap {
+					if err := reconfigureInterface(c, old, local); err != nil {
+						return errors.Wrap(err, "could not reconfigure the interface")
+					}
+				}
+			}
+
+			mc.setNetwork(local.network)
+			c.Controller.setInterface(local)
+			withdraw(ctx, b, c, n.Host().ID().String(), old, local)
+			return nil
+		})
+		defer c.Controller.setReconfigure(nil)
+
 		// read packets from the interface
-		return readPackets(ctx, mgr, c, n, b, ifce)
+		return readPackets(ctx, mgr, c, n, routing, exits, ifce, fw, mc)
 	}
 }
 
@@ -133,18 +315,47 @@ func Register(p ...Option) ([]node.Option, error) {
 	return []node.Option{node.WithNetworkService(VPNNetworkService(p...))}, nil
 }
 
-func streamHandler(l *blockchain.Ledger, ifce *water.Interface, c *Config) func(stream network.Stream) {
+func streamHandler(mgr streamManager, n *node.Node, routing *routingCache, ifce io.Writer, c *Config, fw *firewall, mc *multicast) func(stream network.Stream) {
 	return func(stream network.Stream) {
-		if !l.Exists(protocol.MachinesLedgerKey,
-			func(d blockchain.Data) bool {
-				machine := &types.Machine{}
-				d.Unmarshal(machine)
-				return machine.PeerID == stream.Conn().RemotePeer().String()
-			}) {
+		// Peers which joined since the last refresh of the routing table
+		// are looked up again
+		if !routing.Table().HasPeer(stream.Conn().RemotePeer()) {
+			routing.refresh()
+			if !routing.Table().HasPeer(stream.Conn().RemotePeer()) {
+				stream.Reset()
+				return
+			}
+		}
+
+		remotePeer, localPeer := stream.Conn().RemotePeer(), stream.Conn().LocalPeer()
+		if c.Controller.ethernetBridge() != nil && !isFramed(stream) {
+			c.Logger.Debugf("resetting the unframed stream of %s, not supported in TAP mode", remotePeer.String())
 			stream.Reset()
 			return
 		}
-		_, err := io.Copy(ifce.ReadWriteCloser, stream)
+		reader := newPacketReader(stream)
+		err := copyPackets(ifce, reader, func(packet []byte, fh *forwardHeader) bool {
+			src := remotePeer
+			if fh != nil {
+				// Frames to other peers are relayed, the others were
+				// forwarded to us on behalf of their source
+				if fh.Dst != localPeer {
+					if err := forwardFrame(mgr, c, n, routing.Table(), remotePeer, fh, packet); err != nil {
+						c.Controller.metrics.drop(DropRelay)
+						c.Logger.Debugf("could not relay frame from %s: %s", remotePeer.String(), err.Error())
+					}
+					return false
+				}
+				fsrc, err := forwardedSource(routing.Table(), remotePeer, fh)
+				if err != nil {
+					c.Controller.metrics.drop(DropRelay)
+					c.Logger.Debugf("dropping forwarded frame: %s", err.Error())
+					return false
+				}
+				src = fsrc
+			}
+			return acceptPacket(c, routing, fw, mc, src, localPeer, packet, reader.WireSize())
+		})
 		if err != nil {
 			stream.Reset()
 		}
@@ -154,7 +365,81 @@ func streamHandler(l *blockchain.Ledger, ifce *water.Interface, c *Config) func(
 	}
 }
 
-func newBlockChainData(n *node.Node, address string) types.Machine {
+// acceptPacket returns true if a packet received from the peer src can be written
+// to the interface. wire is the size of the packet as it was received
+func acceptPacket(c *Config, routing *routingCache, fw *firewall, mc *multicast, src, self peer.ID, packet []byte, wire int) bool {
+	remote, local := src.String(), self.String()
+
+	var header *packetInfo
+	if br := c.Controller.ethernetBridge(); br != nil {
+		e, err := parseEthernet(packet)
+		if err == nil {
+			err = checkBridged(routing.Table(), src)
+		}
+		if err != nil {
+			c.Controller.metrics.drop(DropParse)
+			c.Logger.Debugf("could not handle frame from %s: %s", remote, err.Error())
+			return false
+		}
+		// The ACL applies to the IP packets only. Their sources are not checked, as
+		// the hosts bridged behind a peer have any address
+		if e.IP != nil && !fw.allowed(routing.Table().acl, e.IP, remote, local) {
+			c.Controller.metrics.drop(DropACL)
+			c.Logger.Debugf("frame from %s to %s denied by the ACL", e.IP.Src.String(), e.IP.Dst.String())
+			return false
+		}
+		br.learn(e, src, time.Now())
+		header = e.header()
+	} else {
+		p, err := parsePacket(packet)
+		if err != nil {
+			c.Controller.metrics.drop(DropParse)
+			c.Logger.Debugf("could not handle frame from %s: %s", remote, err.Error())
+			return false
+		}
+		// The source is checked before the ACL and the flows it tracks
+		if spoofed(routing.Table(), c.Controller.exitRouter(), src, p) {
+			c.Controller.metrics.drop(DropSpoofed)
+			c.Logger.Debugf("packet from %s spoofing %s", remote, p.Src.String())
+			return false
+		}
+		if !fw.allowed(routing.Table().acl, p, remote, local) {
+			c.Controller.metrics.drop(DropACL)
+			c.Logger.Debugf("frame from %s to %s denied by the ACL", p.Src.String(), p.Dst.String())
+			return false
+		}
+		mc.snoop(packet, p, src, time.Now())
+		header = p
+	}
+	if !c.Controller.shaper.shape(remote, directionIn, header, len(packet)) {
+		c.Controller.metrics.drop(DropShaped)
+		return false
+	}
+	c.Controller.metrics.received(remote, len(packet), wire)
+	if r := c.Controller.captureRing(); r != nil {
+		r.add(true, packet)
+	}
+	return true
+}
+
+// receiveDatagrams writes to the interface the packets received as datagrams
+func receiveDatagrams(ctx context.Context, dg *datagrams, c *Config, n *node.Node, routing *routingCache, ifce io.Writer, fw *firewall, mc *multicast) {
+	self := n.Host().ID()
+	dg.run(ctx, func(src peer.ID, packet []byte, wire int) {
+		if !routing.Table().HasPeer(src) {
+			return
+		}
+		if !acceptPacket(c, routing, fw, mc, src, self, packet, wire) {
+			return
+		}
+		if _, err := ifce.Write(packet); err != nil {
+			c.Controller.metrics.drop(DropWrite)
+			c.Logger.Debugf("could not write packet from %s: %s", src.String(), err.Error())
+		}
+	})
+}
+
+func newBlockChainData(n *node.Node, address, address6 string, mtu int, mac string) types.Machine {
 	hostname, _ := os.Hostname()
 
 	return types.Machine{
@@ -164,12 +449,32 @@ func newBlockChainData(n *node.Node, address string) types.Machine {
 		Arch:     runtime.GOARCH,
 		Version:  internal.Version,
 		Address:  address,
+		Address6: address6,
+		MTU:      mtu,
+		MAC:      mac,
 	}
 }
 
-func getFrame(ifce *water.Interface, c *Config) (ethernet.Frame, error) {
+// ipString returns the string form of ip, or an empty string if unset
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func getFrame(ifce io.Reader, c *Config) (ethernet.Frame, error) {
 	var frame ethernet.Frame
-	frame.Resize(c.MTU)
+	// Packets up to the interface MTU are read, so that the ones
+	// above the path MTU can be fragmented or rejected
+	size := c.MTU
+	if mtu := localMTU(c); mtu > size {
+		size = mtu
+	}
+	if c.Controller.ethernetBridge() != nil {
+		size += maxEthernetHeader
+	}
+	frame.Resize(size)
 
 	n, err := ifce.Read([]byte(frame))
 	if err != nil {
@@ -180,99 +485,275 @@ func getFrame(ifce *water.Interface, c *Config) (ethernet.Frame, error) {
 	return frame, nil
 }
 
-func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, ip net.IP, ledger *blockchain.Ledger, ifce *water.Interface) error {
+func handleFrame(mgr streamManager, frame ethernet.Frame, header *packetInfo, c *Config, n *node.Node, routing *routingCache, exits *exitRouter, ifce io.ReadWriteCloser, fw *firewall, mc *multicast) error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
 	defer cancel()
 
-	header, err := ipv4.ParseHeader(frame)
-	if err != nil {
-		return errors.Wrap(err, "could not parse ipv4 header from frame")
-	}
-
-	dst := header.Dst.String()
-	if c.RouterAddress != "" && header.Src.Equal(ip) {
-		dst = c.RouterAddress
+	if mc.replicated(header.Dst) {
+		return replicateFrame(ctx, mgr, frame, header, c, n, routing.Table(), fw, mc)
 	}
 
 	// Query the routing table
-	value, found := ledger.GetKey(protocol.MachinesLedgerKey, dst)
+	table := routing.Table()
+	entry, found := exits.route(table, header.Dst, c.Controller.localInterface().local(header.Src))
 	if !found {
-		return fmt.Errorf("'%s' not found in the routing table", dst)
+		c.Controller.metrics.drop(DropNoRoute)
+		return fmt.Errorf("'%s' not found in the routing table", header.Dst.String())
 	}
-	machine := &types.Machine{}
-	value.Unmarshal(machine)
 
-	// Decode the Peer
-	d, err := peer.Decode(machine.PeerID)
-	if err != nil {
-		return errors.Wrap(err, "could not decode peer")
+	if !fw.allowed(table.acl, header, n.Host().ID().String(), entry.name) {
+		c.Controller.metrics.drop(DropACL)
+		return fmt.Errorf("frame from %s to %s denied by the ACL", header.Src.String(), header.Dst.String())
+	}
+
+	if !c.Controller.shaper.shape(entry.name, directionOut, header, len(frame)) {
+		c.Controller.metrics.drop(DropShaped)
+		return fmt.Errorf("frame to %s above the bandwidth limits", entry.name)
+	}
+
+	// Frames above the MTU of the path are fragmented, or rejected
+	// with an ICMP error for the host to lower its path MTU
+	var via *tableEntry
+	if r, ok := c.Controller.paths.relay(entry.id, time.Now()); ok {
+		via = table.peers[r]
 	}
+	if mtu := pathMTU(localMTU(c), entry, via); len(frame) > mtu {
+		fragments, err := fitPacket(frame, header, mtu, ifce)
+		if err != nil {
+			c.Controller.metrics.drop(DropMTU)
+			return err
+		}
+		for _, f := range fragments {
+			if err := sendFrame(ctx, mgr, f, c, n, table, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return sendFrame(ctx, mgr, frame, c, n, table, entry)
+}
+
+// replicateFrame sends a broadcast or multicast frame to the online peers
+func replicateFrame(ctx context.Context, mgr streamManager, frame ethernet.Frame, header *packetInfo, c *Config, n *node.Node, table *RoutingTable, fw *firewall, mc *multicast) error {
+	if !mc.allow() {
+		c.Controller.metrics.drop(DropRateLimit)
+		return fmt.Errorf("replication rate exceeded, dropping frame to %s", header.Dst.String())
+	}
+
+	self := n.Host().ID()
+	online := func(id peer.ID) bool {
+		return id != self && n.Host().Network().Connectedness(id) == network.Connected
+	}
+	for _, e := range mc.targets(table, header, online, time.Now()) {
+		if !fw.allowed(table.acl, header, self.String(), e.name) {
+			c.Controller.metrics.drop(DropACL)
+			continue
+		}
+		if !c.Controller.shaper.shape(e.name, directionOut, header, len(frame)) {
+			c.Controller.metrics.drop(DropShaped)
+			continue
+		}
+		if err := sendFrame(ctx, mgr, frame, c, n, table, e); err != nil {
+			c.Logger.Debugf("could not replicate frame to %s: %s", e.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// handleEthernetFrame switches a frame read from the TAP interface to the peer
+// its destination MAC address was learned from, flooding it to the online
+// peers in TAP mode if unknown. ARP requests are answered locally when possible
+func handleEthernetFrame(mgr streamManager, frame ethernet.Frame, e *ethernetInfo, c *Config, n *node.Node, routing *routingCache, ifce io.ReadWriteCloser, fw *firewall, mc *multicast) error {
+	br := c.Controller.ethernetBridge()
+	if br == nil {
+		return errors.New("tap mode is not enabled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	now := time.Now()
+	self := n.Host().ID()
+	table := routing.Table()
+	br.local(e.Src)
+
+	if reply, ok := br.answer(table, e, self, now); ok {
+		_, err := ifce.Write(reply)
+		return err
+	}
+
+	online := func(id peer.ID) bool {
+		return id != self && n.Host().Network().Connectedness(id) == network.Connected
+	}
+	targets, flooded := br.targets(table, e, online, now)
+	if flooded && !mc.allow() {
+		c.Controller.metrics.drop(DropRateLimit)
+		return fmt.Errorf("flooding rate exceeded, dropping frame to %s", e.Dst.String())
+	}
+
+	header := e.header()
+	for _, entry := range targets {
+		if e.IP != nil && !fw.allowed(table.acl, e.IP, self.String(), entry.name) {
+			c.Controller.metrics.drop(DropACL)
+			continue
+		}
+		if !c.Controller.shaper.shape(entry.name, directionOut, header, len(frame)) {
+			c.Controller.metrics.drop(DropShaped)
+			continue
+		}
+		if err := sendFrame(ctx, mgr, frame, c, n, table, entry); err != nil {
+			c.Logger.Debugf("could not send frame to %s: %s", entry.name, err.Error())
+		}
+	}
+	return nil
+}
+
+// errStreamOpen is returned when a stream to a peer can not be opened
+var errStreamOpen = errors.New("could not open stream")
 
+// sendFrame writes a frame to a peer. If the peer can not be reached directly,
+// the frame is forwarded by a relay connected to it
+func sendFrame(ctx context.Context, mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, table *RoutingTable, entry *tableEntry) error {
+	if dg := c.Controller.datagramTransport(); dg != nil {
+		wire, err := dg.send(entry.id, frame)
+		if err == nil {
+			c.Controller.metrics.sent(entry.name, len(frame), wire)
+			return nil
+		}
+		// Streams are used until the peer is reachable with datagrams
+		dg.connect(n.Host(), entry.id, c.Timeout)
+	}
+
+	if via, ok := c.Controller.paths.relay(entry.id, time.Now()); ok {
+		if r, found := table.peers[via]; found {
+			if wire, err := relayFrame(ctx, mgr, frame, c, n, r, entry); err == nil {
+				c.Controller.metrics.sent(entry.name, len(frame), wire)
+				return nil
+			}
+		}
+	}
+
+	var wire int
+	err := writeStream(ctx, mgr, c, n, entry, func(s network.Stream) (err error) {
+		wire, err = writePacket(s, frame)
+		return err
+	})
+	if err == nil {
+		c.Controller.paths.direct(entry.id, pathMTU(localMTU(c), entry, nil), time.Now())
+		c.Controller.metrics.sent(entry.name, len(frame), wire)
+		return nil
+	}
+	if !errors.Is(err, errStreamOpen) {
+		c.Controller.metrics.drop(DropWrite)
+		return err
+	}
+
+	// Fallback to the peers connected to both ends
+	self := n.Host().ID()
+	for _, r := range table.relays[entry.id] {
+		if r.id == self || n.Host().Network().Connectedness(r.id) != network.Connected {
+			continue
+		}
+		wire, rerr := relayFrame(ctx, mgr, frame, c, n, r, entry)
+		if rerr != nil {
+			c.Logger.Debugf("could not relay frame to %s through %s: %s", entry.name, r.name, rerr.Error())
+			continue
+		}
+		c.Controller.paths.relayed(entry.id, r.id, pathMTU(localMTU(c), entry, r), time.Now())
+		c.Controller.metrics.sent(entry.name, len(frame), wire)
+		return nil
+	}
+
+	c.Controller.metrics.drop(DropStreamOpen)
+	return err
+}
+
+// writeStream writes to the stream of a peer, opening it if necessary
+func writeStream(ctx context.Context, mgr streamManager, c *Config, n *node.Node, entry *tableEntry, write func(network.Stream) error) error {
+	d, peerID := entry.id, entry.name
+
+	var err error
 	var stream network.Stream
 	if mgr != nil {
 		// Open a stream if necessary
 		stream, err = mgr.HasStream(n.Host().Network(), d)
 		if err == nil {
-			_, err = stream.Write(frame)
+			err = write(stream)
 			if err == nil {
 				return nil
 			}
+			c.Controller.metrics.streamFailed(peerID)
 			mgr.Disconnected(n.Host().Network(), stream)
 		}
 	}
 
-	stream, err = n.Host().NewStream(ctx, d, protocol.BhojpurVPN.ID())
+	// Prefer the compressed and framed protocols, falling back to raw packets for legacy peers
+	stream, err = n.Host().NewStream(ctx, d, streamProtocols(c)...)
 	if err != nil {
-		return fmt.Errorf("could not open stream to %s: %w", d.String(), err)
+		c.Controller.metrics.streamFailed(peerID)
+		return fmt.Errorf("%w to %s: %s", errStreamOpen, d.String(), err.Error())
 	}
+	c.Controller.metrics.streamOpened(peerID)
+	stream = newCodecStream(stream)
 
 	if mgr != nil {
 		mgr.Connected(n.Host().Network(), stream)
 	}
 
-	_, err = stream.Write(frame)
+	err = write(stream)
+	if err != nil {
+		c.Controller.metrics.streamFailed(peerID)
+	}
 	if c.lowProfile {
-		return stream.Close()
+		if cerr := stream.Close(); err == nil {
+			err = cerr
+		}
 	}
 	return err
 }
 
 func connectionWorker(
-	p chan ethernet.Frame,
+	p chan packet,
 	mgr streamManager,
 	c *Config,
 	n *node.Node,
-	ip net.IP,
 	wg *sync.WaitGroup,
-	ledger *blockchain.Ledger,
-	ifce *water.Interface) {
+	routing *routingCache,
+	exits *exitRouter,
+	ifce io.ReadWriteCloser,
+	fw *firewall,
+	mc *multicast) {
 	defer wg.Done()
 	for f := range p {
-		if err := handleFrame(mgr, f, c, n, ip, ledger, ifce); err != nil {
+		var err error
+		if f.eth != nil {
+			err = handleEthernetFrame(mgr, f.frame, f.eth, c, n, routing, ifce, fw, mc)
+		} else {
+			err = handleFrame(mgr, f.frame, f.info, c, n, routing, exits, ifce, fw, mc)
+		}
+		if err != nil {
 			c.Logger.Debugf("could not handle frame: %s", err.Error())
 		}
 	}
 }
 
 // redirects packets from the interface to the node using the routing table in the blockchain
-func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node, ledger *blockchain.Ledger, ifce *water.Interface) error {
-	ip, _, err := net.ParseCIDR(c.InterfaceAddress)
-	if err != nil {
-		return err
-	}
-
+func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node, routing *routingCache, exits *exitRouter, ifce io.ReadWriteCloser, fw *firewall, mc *multicast) error {
 	wg := new(sync.WaitGroup)
 
-	packets := make(chan ethernet.Frame, c.ChannelBufferSize)
+	// Each worker has its own queue, packets of the same flow are always
+	// handled by the same worker so they are not reordered
+	sched := newScheduler(c.Concurrency, c.ChannelBufferSize)
+	c.Controller.setScheduler(sched)
 
 	defer func() {
-		close(packets)
+		sched.Close()
 		wg.Wait()
 	}()
 
-	for i := 0; i < c.Concurrency; i++ {
+	for _, q := range sched.queues {
 		wg.Add(1)
-		go connectionWorker(packets, mgr, c, n, ip, wg, ledger, ifce)
+		go connectionWorker(q, mgr, c, n, wg, routing, exits, ifce, fw, mc)
 	}
 
 	for {
@@ -286,7 +767,35 @@ func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node
 				continue
 			}
 
-			packets <- frame
+			if r := c.Controller.captureRing(); r != nil {
+				r.add(false, frame)
+			}
+
+			if c.Controller.ethernetBridge() != nil {
+				eth, err := parseEthernet(frame)
+				if err != nil {
+					c.Controller.metrics.drop(DropParse)
+					c.Logger.Debugf("could not handle frame: %s", err.Error())
+					continue
+				}
+				if !sched.Enqueue(packet{frame: frame, eth: eth}) {
+					c.Controller.metrics.drop(DropQueueFull)
+					c.Logger.Debugf("queue full, dropping frame to %s", eth.Dst.String())
+				}
+				continue
+			}
+
+			header, err := parsePacket(frame)
+			if err != nil {
+				c.Controller.metrics.drop(DropParse)
+				c.Logger.Debugf("could not handle frame: %s", err.Error())
+				continue
+			}
+
+			if !sched.Enqueue(packet{frame: frame, info: header}) {
+				c.Controller.metrics.drop(DropQueueFull)
+				c.Logger.Debugf("queue full, dropping frame to %s", header.Dst.String())
+			}
 		}
 	}
 }
@@ -0,0 +1,256 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/services"
+)
+
+// DefaultExitNodeTimeout is the time after which an exit node which
+// did not send any healthcheck is considered down
+const DefaultExitNodeTimeout = 5 * time.Minute
+
+// defaultExitNetworks are routed through the exit nodes
+// configured without any network
+var defaultExitNetworks = []string{"0.0.0.0/0", "::/0"}
+
+// ExitNode is a VPN node the traffic to Networks is routed through. Among the
+// exit nodes of a network, the healthy one with the lowest Priority is used.
+type ExitNode struct {
+	// Address is the VPN address of the node
+	Address  string
+	Priority int
+	Networks []string
+}
+
+// ParseExitNode parses an exit node from a comma separated list of key=value
+// pairs: address, priority and network, which can be repeated. The exit node
+// routes the default networks if none is given, e.g.
+// "address=10.1.0.5,priority=10,network=172.16.0.0/12"
+func ParseExitNode(s string) (ExitNode, error) {
+	e := ExitNode{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return e, fmt.Errorf("invalid exit node option '%s'", kv)
+		}
+		switch k, v := parts[0], parts[1]; k {
+		case "address":
+			e.Address = v
+		case "priority":
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				return e, fmt.Errorf("invalid exit node priority '%s'", v)
+			}
+			e.Priority = p
+		case "network":
+			e.Networks = append(e.Networks, v)
+		default:
+			return e, fmt.Errorf("unknown exit node option '%s'", k)
+		}
+	}
+	return e, validateExitNode(e)
+}
+
+func validateExitNode(e ExitNode) error {
+	if net.ParseIP(e.Address) == nil {
+		return fmt.Errorf("invalid exit node address '%s'", e.Address)
+	}
+	for _, n := range e.Networks {
+		if _, _, err := net.ParseCIDR(n); err != nil {
+			return fmt.Errorf("invalid exit node network '%s'", n)
+		}
+	}
+	return nil
+}
+
+// ExitNodeStatus is the state of an exit node for one of its networks.
+// Active is set on the exit node the traffic to the network is routed through
+type ExitNodeStatus struct {
+	Network  string
+	Address  string
+	Peer     string `json:",omitempty"`
+	Priority int
+	Healthy  bool
+	Active   bool
+}
+
+type exitPolicy struct {
+	net   *net.IPNet
+	nodes []ExitNode
+}
+
+// exitRouter routes the traffic through the exit nodes. The exit node of each
+// network is selected again on every refresh, from the routing table and the
+// healthchecks in the ledger
+type exitRouter struct {
+	// policies are sorted for longest prefix matching, and
+	// their exit nodes by priority
+	policies []exitPolicy
+	ledger   *blockchain.Ledger
+	self     string
+	timeout  time.Duration
+
+	// active holds the []*tableEntry selected for each policy,
+	// and status the []ExitNodeStatus
+	active atomic.Value
+	status atomic.Value
+}
+
+func newExitRouter(nodes []ExitNode, ledger *blockchain.Ledger, self string, timeout time.Duration) (*exitRouter, error) {
+	policies := map[string]*exitPolicy{}
+	for _, e := range nodes {
+		if err := validateExitNode(e); err != nil {
+			return nil, err
+		}
+		networks := e.Networks
+		if len(networks) == 0 {
+			networks = defaultExitNetworks
+		}
+		for _, n := range networks {
+			_, ipnet, _ := net.ParseCIDR(n)
+			p, ok := policies[ipnet.String()]
+			if !ok {
+				p = &exitPolicy{net: ipnet}
+				policies[ipnet.String()] = p
+			}
+			p.nodes = append(p.nodes, e)
+		}
+	}
+
+	r := &exitRouter{ledger: ledger, self: self, timeout: timeout}
+	for _, p := range policies {
+		sort.SliceStable(p.nodes, func(i, j int) bool { return p.nodes[i].Priority < p.nodes[j].Priority })
+		r.policies = append(r.policies, *p)
+	}
+	sort.Slice(r.policies, func(i, j int) bool {
+		a, _ := r.policies[i].net.Mask.Size()
+		b, _ := r.policies[j].net.Mask.Size()
+		if a != b {
+			return a > b
+		}
+		return r.policies[i].net.String() < r.policies[j].net.String()
+	})
+	r.active.Store(make([]*tableEntry, len(r.policies)))
+	r.status.Store([]ExitNodeStatus{})
+	return r, nil
+}
+
+// refresh selects the exit node of each network. If none is healthy,
+// the one with the lowest priority is used
+func (r *exitRouter) refresh(t *RoutingTable) {
+	healthy := map[string]bool{}
+	for _, id := range services.AvailableNodes(r.ledger, r.timeout) {
+		healthy[id] = true
+	}
+
+	active := make([]*tableEntry, len(r.policies))
+	status := []ExitNodeStatus{}
+	for i, p := range r.policies {
+		entries := make([]*tableEntry, len(p.nodes))
+		statuses := make([]ExitNodeStatus, len(p.nodes))
+		selected := -1
+		for j, n := range p.nodes {
+			statuses[j] = ExitNodeStatus{Network: p.net.String(), Address: n.Address, Priority: n.Priority}
+			e, ok := t.lookupMachine(net.ParseIP(n.Address))
+			if !ok || e.name == r.self {
+				continue
+			}
+			entries[j] = e
+			statuses[j].Peer = e.name
+			statuses[j].Healthy = healthy[e.name]
+			if selected < 0 || (statuses[j].Healthy && !statuses[selected].Healthy) {
+				selected = j
+			}
+		}
+		if selected >= 0 {
+			active[i] = entries[selected]
+			statuses[selected].Active = true
+		}
+		status = append(status, statuses...)
+	}
+
+	r.active.Store(active)
+	r.status.Store(status)
+}
+
+func (r *exitRouter) run(ctx context.Context, routing *routingCache, interval time.Duration) {
+	if len(r.policies) == 0 {
+		return
+	}
+	r.refresh(routing.Table())
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			r.refresh(routing.Table())
+		}
+	}
+}
+
+// lookup returns the exit node of the most specific network containing ip,
+// along with the network prefix length
+func (r *exitRouter) lookup(ip net.IP) (*tableEntry, int, bool) {
+	active := r.active.Load().([]*tableEntry)
+	for i, p := range r.policies {
+		if p.net.Contains(ip) && active[i] != nil {
+			bits, _ := p.net.Mask.Size()
+			return active[i], bits, true
+		}
+	}
+	return nil, 0, false
+}
+
+// route resolves the peer to send the packets to dst to: the VPN nodes first,
+// then the most specific of the networks advertised by the peers and of the
+// networks routed through the exit nodes. The exit nodes route only the
+// packets sent from this node (local)
+func (r *exitRouter) route(t *RoutingTable, dst net.IP, local bool) (*tableEntry, bool) {
+	if e, ok := t.lookupMachine(dst); ok {
+		return e, true
+	}
+
+	e, bits, found := t.lookupRoute(dst)
+	if local {
+		if x, b, ok := r.lookup(dst); ok && (!found || b >= bits) {
+			return x, true
+		}
+	}
+	return e, found
+}
+
+func (r *exitRouter) statusList() []ExitNodeStatus {
+	return r.status.Load().([]ExitNodeStatus)
+}
@@ -0,0 +1,143 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+var _ = Describe("Exit nodes", func() {
+	self, a, b := newPeerID(), newPeerID(), newPeerID()
+
+	table := NewRoutingTable(blockchain.Block{
+		Storage: map[string]map[string]blockchain.Data{
+			protocol.MachinesLedgerKey: {
+				"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1"}),
+				"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2"}),
+				"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3"}),
+			},
+			protocol.RoutesLedgerKey: {
+				"192.168.0.0/16": data(types.Route{PeerID: a.String(), Network: "192.168.0.0/16"}),
+			},
+		},
+	}, self.String())
+
+	nodes := []ExitNode{
+		{Address: "10.1.0.3", Priority: 10},
+		{Address: "10.1.0.2", Priority: 20},
+		{Address: "10.1.0.3", Priority: 10, Networks: []string{"172.20.0.0/16"}},
+	}
+
+	alive := func(l *blockchain.Ledger, ids ...string) {
+		for _, id := range ids {
+			l.Add(protocol.HealthCheckKey, map[string]interface{}{id: time.Now().UTC().Format(time.RFC3339)})
+		}
+	}
+
+	route := func(r *ExitRouter, dst string) string {
+		p, found := r.Route(table, net.ParseIP(dst), true)
+		if !found {
+			return ""
+		}
+		return p.String()
+	}
+
+	It("parses exit nodes", func() {
+		e, err := ParseExitNode("address=10.1.0.5,priority=10,network=0.0.0.0/0,network=172.16.0.0/12")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e).To(Equal(ExitNode{Address: "10.1.0.5", Priority: 10, Networks: []string{"0.0.0.0/0", "172.16.0.0/12"}}))
+
+		_, err = ParseExitNode("address=foo")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseExitNode("address=10.1.0.5,network=foo")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseExitNode("address=10.1.0.5,weight=1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("maps the deprecated router address to an exit node", func() {
+		c := &Config{}
+		Expect(c.Apply(WithRouterAddress("10.1.0.5"))).To(Succeed())
+		Expect(c.RouterAddress).To(Equal("10.1.0.5"))
+		Expect(c.ExitNodes).To(Equal([]ExitNode{{Address: "10.1.0.5"}}))
+
+		// Set directly by the library users, and applied once
+		c = &Config{RouterAddress: "10.1.0.6"}
+		Expect(c.Apply(WithExitNodes(ExitNode{Address: "10.1.0.7", Priority: 10}))).To(Succeed())
+		Expect(c.Apply()).To(Succeed())
+		Expect(c.ExitNodes).To(Equal([]ExitNode{{Address: "10.1.0.7", Priority: 10}, {Address: "10.1.0.6"}}))
+
+		Expect((&Config{}).Apply(WithRouterAddress(""))).To(Succeed())
+		Expect((&Config{}).Apply(WithRouterAddress("foo"))).To(MatchError("invalid exit node address 'foo'"))
+	})
+
+	It("fails over to the healthy exit nodes", func() {
+		l := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+		r, err := NewExitRouter(nodes, l, self.String(), time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+
+		// None is healthy, the one with the lowest priority is used
+		r.Refresh(table)
+		Expect(route(r, "8.8.8.8")).To(Equal(b.String()))
+
+		alive(l, a.String())
+		r.Refresh(table)
+		Expect(route(r, "8.8.8.8")).To(Equal(a.String()))
+		Expect(r.Status()).To(ContainElement(ExitNodeStatus{
+			Network: "0.0.0.0/0", Address: "10.1.0.2", Peer: a.String(), Priority: 20, Healthy: true, Active: true,
+		}))
+
+		alive(l, b.String())
+		r.Refresh(table)
+		Expect(route(r, "8.8.8.8")).To(Equal(b.String()))
+	})
+
+	It("routes by destination", func() {
+		l := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+		alive(l, a.String(), b.String())
+		r, err := NewExitRouter([]ExitNode{
+			{Address: "10.1.0.2"},
+			{Address: "10.1.0.3", Networks: []string{"172.20.0.0/16"}},
+		}, l, self.String(), time.Minute)
+		Expect(err).ToNot(HaveOccurred())
+		r.Refresh(table)
+
+		Expect(route(r, "8.8.8.8")).To(Equal(a.String()))
+		Expect(route(r, "172.20.1.1")).To(Equal(b.String()))
+		// The VPN nodes and the more specific advertised networks are not routed through the exit nodes
+		Expect(route(r, "10.1.0.3")).To(Equal(b.String()))
+		Expect(route(r, "192.168.1.1")).To(Equal(a.String()))
+
+		// Only the packets sent from this node are
+		_, found := r.Route(table, net.ParseIP("8.8.8.8"), false)
+		Expect(found).To(BeFalse())
+	})
+})
@@ -0,0 +1,684 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	p2pprotocol "github.com/libp2p/go-libp2p-core/protocol"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+)
+
+// Multicast exposes the broadcast and multicast replication to the tests
+type Multicast = multicast
+
+func NewMulticast(mode string, limit int, n *net.IPNet) *Multicast {
+	return newMulticast(mode, limit, n)
+}
+
+func (m *multicast) Replicated(dst net.IP) bool {
+	return m.replicated(dst)
+}
+
+func (m *multicast) Allow() bool {
+	return m.allow()
+}
+
+func (m *multicast) Snoop(packet []byte, from peer.ID) error {
+	p, err := parsePacket(packet)
+	if err != nil {
+		return err
+	}
+	m.snoop(packet, p, from, time.Now())
+	return nil
+}
+
+// Targets returns the peers of the table a packet is replicated to, online
+// being the peers connected
+func (m *multicast) Targets(t *RoutingTable, packet []byte, online ...peer.ID) ([]peer.ID, error) {
+	p, err := parsePacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	connected := map[peer.ID]bool{}
+	for _, id := range online {
+		connected[id] = true
+	}
+	res := []peer.ID{}
+	for _, e := range m.targets(t, p, func(id peer.ID) bool { return connected[id] }, time.Now()) {
+		res = append(res, e.id)
+	}
+	return res, nil
+}
+
+// EncodeForward returns the frame relaying packet from src to dst
+func EncodeForward(src, dst peer.ID, packet []byte) ([]byte, error) {
+	payload, err := encodeForward(src, dst, packet)
+	if err != nil {
+		return nil, err
+	}
+	return encodeFrame(flagForward, payload)
+}
+
+// ReadFrame reads a packet from a framed stream, along with the
+// peers of its forwarding header if any
+func ReadFrame(r io.Reader) (packet []byte, src, dst peer.ID, err error) {
+	packet, fh, err := newFrameReader(r, nil).ReadPacket()
+	if fh != nil {
+		src, dst = fh.Src, fh.Dst
+	}
+	return packet, src, dst, err
+}
+
+// ForwardedSource returns the source of a frame from src to dst forwarded by via
+func ForwardedSource(t *RoutingTable, via, src, dst peer.ID) (peer.ID, error) {
+	return forwardedSource(t, via, &forwardHeader{Src: src, Dst: dst})
+}
+
+// Firewall exposes the stateful firewall to the tests
+type Firewall = firewall
+
+func NewFirewall(now func() time.Time) *Firewall {
+	f := newFirewall(newMetrics())
+	f.now, f.lastPrune = now, now()
+	return f
+}
+
+func (f *firewall) Allowed(acl ACL, packet []byte, srcPeer, dstPeer string) (bool, error) {
+	p, err := parsePacket(packet)
+	if err != nil {
+		return false, err
+	}
+	return f.allowed(acl, p, srcPeer, dstPeer), nil
+}
+
+// Flows returns the number of flows tracked
+func (f *firewall) Flows() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.flows)
+}
+
+// Evicted returns the number of flows evicted
+func (f *firewall) Evicted() uint64 {
+	return f.metrics.snapshot().FlowsEvicted
+}
+
+// SetMaxFlows sets the number of flows tracked by the firewalls, returning
+// a function restoring the previous one
+func SetMaxFlows(n int) func() {
+	old := maxFlows
+	maxFlows = n
+	return func() { maxFlows = old }
+}
+
+// Spoofed returns true if the packet can not be sent by the peer src
+func Spoofed(t *RoutingTable, exits *ExitRouter, src peer.ID, packet []byte) (bool, error) {
+	p, err := parsePacket(packet)
+	if err != nil {
+		return false, err
+	}
+	return spoofed(t, exits, src, p), nil
+}
+
+// ExitRouter exposes the exit node selection to the tests
+type ExitRouter = exitRouter
+
+func NewExitRouter(nodes []ExitNode, ledger *blockchain.Ledger, self string, timeout time.Duration) (*ExitRouter, error) {
+	return newExitRouter(nodes, ledger, self, timeout)
+}
+
+func (r *exitRouter) Refresh(t *RoutingTable) {
+	r.refresh(t)
+}
+
+func (r *exitRouter) Route(t *RoutingTable, dst net.IP, local bool) (peer.ID, bool) {
+	e, ok := r.route(t, dst, local)
+	if !ok {
+		return "", false
+	}
+	return e.id, true
+}
+
+func (r *exitRouter) Status() []ExitNodeStatus {
+	return r.statusList()
+}
+
+// bufferStream is a stream writing to a buffer
+type bufferStream struct {
+	network.Stream
+	buf      bytes.Buffer
+	protocol p2pprotocol.ID
+}
+
+func (b *bufferStream) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *bufferStream) Protocol() p2pprotocol.ID {
+	return b.protocol
+}
+
+// WritePackets writes the packets to a stream compressed with codec, returning
+// the stream content and the size of each packet on the wire
+func WritePackets(codec string, packets ...[]byte) ([]byte, []int, error) {
+	p, ok := compressionProtocol(codec)
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported codec %s", codec)
+	}
+	s := newCodecStream(&bufferStream{protocol: p.ID()})
+	sizes := []int{}
+	for _, packet := range packets {
+		n, err := writePacket(s, packet)
+		if err != nil {
+			return nil, nil, err
+		}
+		sizes = append(sizes, n)
+	}
+	return s.(*codecStream).Stream.(*bufferStream).buf.Bytes(), sizes, nil
+}
+
+// ReadPackets reads the packets of a stream compressed with codec
+func ReadPackets(codec string, b []byte) ([][]byte, error) {
+	p, _ := compressionProtocol(codec)
+	r := newFrameReader(bytes.NewReader(b), codecs[p.ID()])
+	packets := [][]byte{}
+	for {
+		packet, _, err := r.ReadPacket()
+		if err == io.EOF {
+			return packets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, append([]byte{}, packet...))
+	}
+}
+
+// FitPacket returns the fragments of a packet above mtu, or the ICMP error
+// written back to the interface
+func FitPacket(packet []byte, mtu int) ([][]byte, []byte, error) {
+	p, err := parsePacket(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ifce bytes.Buffer
+	fragments, err := fitPacket(packet, p, mtu, &ifce)
+	return fragments, ifce.Bytes(), err
+}
+
+// Checksum returns the internet checksum of b
+func Checksum(b []byte) uint16 {
+	return checksum(b, 0)
+}
+
+// PathMTU returns the MTU of the path to id, through via if set
+func (t *RoutingTable) PathMTU(local int, id, via peer.ID) int {
+	var r *tableEntry
+	if via != "" {
+		r = t.peers[via]
+	}
+	return pathMTU(local, t.peers[id], r)
+}
+
+// Datagrams exposes the datagram transport to the tests
+type Datagrams = datagrams
+
+// NewDatagramPair returns the datagram transports of the peers a and b on
+// the loopback, after their handshake
+func NewDatagramPair(a, b peer.ID) (*Datagrams, *Datagrams, error) {
+	da, err := newDatagrams("127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := newDatagrams("127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return da, db, Handshake(da, db, a, b)
+}
+
+// tcpPipe returns the ends of a TCP connection on the loopback
+func tcpPipe() (net.Conn, net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	remote := <-accepted
+	if remote == nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not accept the connection")
+	}
+	return conn, remote, nil
+}
+
+// Handshake exchanges new session keys between da of the peer a, which
+// starts the handshake, and db of the peer b
+func Handshake(da, db *Datagrams, a, b peer.ID) error {
+	ca, cb, err := tcpPipe()
+	if err != nil {
+		return err
+	}
+	defer ca.Close()
+	defer cb.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- db.handshake(cb, a, net.ParseIP("127.0.0.1"))
+	}()
+	if err := da.handshake(ca, b, net.ParseIP("127.0.0.1")); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+// CrossedHandshakes returns the datagram transports of the peers a and b on
+// the loopback, after they both started a handshake with the other one at
+// the same time. It returns the number of handshakes completed
+func CrossedHandshakes(a, b peer.ID) (*Datagrams, *Datagrams, int, error) {
+	da, err := newDatagrams("127.0.0.1:0")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	db, err := newDatagrams("127.0.0.1:0")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	ds := map[peer.ID]*datagrams{a: da, b: db}
+	for self, d := range ds {
+		other := a
+		if self == a {
+			other = b
+		}
+		if !d.begin(self, other, true) {
+			return nil, nil, 0, fmt.Errorf("handshake of %s not started", self)
+		}
+	}
+
+	// Both handshakes are received while both are in progress
+	crossed := [][2]peer.ID{{a, b}, {b, a}}
+	accepted := []bool{}
+	for _, p := range crossed {
+		accepted = append(accepted, ds[p[1]].begin(p[1], p[0], false))
+	}
+
+	completed := make(chan bool, 2)
+	var responders sync.WaitGroup
+	for i, p := range crossed {
+		from, to, ok := p[0], p[1], accepted[i]
+		cf, ct, err := tcpPipe()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		responders.Add(1)
+		go func() {
+			defer responders.Done()
+			defer ct.Close()
+			if !ok {
+				return
+			}
+			defer ds[to].end(from, false)
+			ds[to].handshake(ct, from, net.ParseIP("127.0.0.1"))
+		}()
+		go func() {
+			defer cf.Close()
+			defer ds[from].end(to, true)
+			cf.SetDeadline(time.Now().Add(5 * time.Second))
+			completed <- ds[from].handshake(cf, to, net.ParseIP("127.0.0.1")) == nil
+		}()
+	}
+
+	n := 0
+	for i := 0; i < 2; i++ {
+		if <-completed {
+			n++
+		}
+	}
+	responders.Wait()
+	return da, db, n, nil
+}
+
+// Session returns the receiving and sending IDs of the session with the peer id
+func (d *datagrams) Session(id peer.ID) (uint32, uint32, bool) {
+	d.Lock()
+	defer d.Unlock()
+	s, ok := d.peers[id]
+	if !ok {
+		return 0, 0, false
+	}
+	return s.recvID, s.sendID, true
+}
+
+// Expire removes the sessions expired at now
+func (d *datagrams) Expire(now time.Time) {
+	d.expire(now)
+}
+
+func (d *datagrams) Close() error {
+	return d.close()
+}
+
+func (d *datagrams) Send(id peer.ID, packet []byte) (int, error) {
+	return d.send(id, packet)
+}
+
+// ReadDatagram reads the next datagram, unauthenticated
+func (d *datagrams) ReadDatagram() ([]byte, *net.UDPAddr, error) {
+	d.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, maxDatagramSize)
+	n, addr, err := d.conn.ReadFromUDP(b)
+	return b[:n], addr, err
+}
+
+func (d *datagrams) Open(b []byte, addr *net.UDPAddr) (peer.ID, []byte, error) {
+	return d.open(b, addr)
+}
+
+// Receive returns the next packet received, skipping the keepalives
+func (d *datagrams) Receive() (peer.ID, []byte, error) {
+	for {
+		b, addr, err := d.ReadDatagram()
+		if err != nil {
+			return "", nil, err
+		}
+		id, packet, err := d.open(b, addr)
+		if err != nil || len(packet) > 0 {
+			return id, packet, err
+		}
+	}
+}
+
+// Confirm reads the keepalives of the handshake, so that packets can be sent
+func (d *datagrams) Confirm() error {
+	b, addr, err := d.ReadDatagram()
+	if err != nil {
+		return err
+	}
+	_, _, err = d.open(b, addr)
+	return err
+}
+
+// Shaper exposes the bandwidth limits to the tests
+type Shaper = shaper
+
+func NewShaper(s Shaping) (*Shaper, error) {
+	sh := newShaper()
+	return sh, sh.set(s)
+}
+
+// Admit returns how long to delay a packet sent (or received if in is set)
+// at now, or false if it is dropped
+func (s *shaper) Admit(peer string, in bool, packet []byte, now time.Time) (time.Duration, bool) {
+	p, err := parsePacket(packet)
+	if err != nil {
+		return 0, false
+	}
+	direction := directionOut
+	if in {
+		direction = directionIn
+	}
+	return s.admit(peer, direction, p, len(packet), now)
+}
+
+// HostNetworks returns the networks routed to the interface configured with local,
+// and the ones refused, with the peers connected to the underlay addresses
+func (r *exitRouter) HostNetworks(t *RoutingTable, local InterfaceConfig, disableIPv6 bool, table int, underlay ...string) ([]string, []string, error) {
+	l, err := newInterfaceState(local, disableIPv6, "room")
+	if err != nil {
+		return nil, nil, err
+	}
+	ips := []net.IP{}
+	for _, u := range underlay {
+		ips = append(ips, net.ParseIP(u))
+	}
+	nets, refused := hostNetworks(t, r, l, ips, table)
+	res, ref := []string{}, []string{}
+	for n := range nets {
+		res = append(res, n)
+	}
+	for n := range refused {
+		ref = append(ref, n)
+	}
+	sort.Strings(res)
+	sort.Strings(ref)
+	return res, ref, nil
+}
+
+// HostRouter exposes the routes of the interface to the tests
+type HostRouter = hostRouter
+
+func NewHostRouter(c *Config) (*HostRouter, error) {
+	return newHostRouter(c)
+}
+
+// Sync routes the networks to the interface
+func (h *hostRouter) Sync(networks ...string) error {
+	nets := map[string]*net.IPNet{}
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return err
+		}
+		nets[ipnet.String()] = ipnet
+	}
+	h.sync(nets, nil)
+	return nil
+}
+
+func (h *hostRouter) Close() {
+	h.close()
+}
+
+// Bridge exposes the switching of the Ethernet frames to the tests
+type Bridge = bridge
+
+func NewBridge(mac net.HardwareAddr) *Bridge {
+	return newBridge(mac)
+}
+
+// Learn records the source of a frame received from a peer
+func (b *bridge) Learn(frame []byte, from peer.ID) error {
+	e, err := parseEthernet(frame)
+	if err != nil {
+		return err
+	}
+	b.learn(e, from, time.Now())
+	return nil
+}
+
+// Answer returns the reply to an ARP request read from the interface
+func (b *bridge) Answer(t *RoutingTable, frame []byte, self peer.ID) ([]byte, bool, error) {
+	e, err := parseEthernet(frame)
+	if err != nil {
+		return nil, false, err
+	}
+	reply, ok := b.answer(t, e, self, time.Now())
+	return reply, ok, nil
+}
+
+// Targets returns the peers a frame read from the interface is sent to,
+// online being the peers connected
+func (b *bridge) Targets(t *RoutingTable, frame []byte, online ...peer.ID) ([]peer.ID, bool, error) {
+	e, err := parseEthernet(frame)
+	if err != nil {
+		return nil, false, err
+	}
+	connected := map[peer.ID]bool{}
+	for _, id := range online {
+		connected[id] = true
+	}
+	res := []peer.ID{}
+	targets, flooded := b.targets(t, e, func(id peer.ID) bool { return connected[id] }, time.Now())
+	for _, e := range targets {
+		res = append(res, e.id)
+	}
+	return res, flooded, nil
+}
+
+func (b *bridge) Entries() []BridgeEntry {
+	return b.entries()
+}
+
+// CheckBridged returns an error if the peer is not in TAP mode
+func CheckBridged(t *RoutingTable, id peer.ID) error {
+	return checkBridged(t, id)
+}
+
+// NewScheduler returns a scheduler of workers queues of the given size
+func NewScheduler(workers, size int) *scheduler {
+	return newScheduler(workers, size)
+}
+
+// EnqueueFrame parses an IP packet and puts it in the queue of its flow
+func (s *scheduler) EnqueueFrame(frame []byte) (bool, error) {
+	p, err := parsePacket(frame)
+	if err != nil {
+		return false, err
+	}
+	return s.Enqueue(packet{frame: frame, info: p}), nil
+}
+
+// Drain returns the frames of the queue i, which must be closed
+func (s *scheduler) Drain(i int) [][]byte {
+	frames := [][]byte{}
+	for p := range s.queues[i] {
+		frames = append(frames, p.frame)
+	}
+	return frames
+}
+
+// FlowHash returns the flow hash of an IP packet
+func FlowHash(frame []byte) (uint32, error) {
+	p, err := parsePacket(frame)
+	if err != nil {
+		return 0, err
+	}
+	return p.FlowHash(), nil
+}
+
+const (
+	FrameVersion   = frameVersion
+	MaxFrameSize   = maxFrameSize
+	FlagForward    = flagForward
+	FlagCompressed = flagCompressed
+)
+
+// EncodeFrame returns the payload prefixed with the frame header
+func EncodeFrame(flags byte, payload []byte) ([]byte, error) {
+	return encodeFrame(flags, payload)
+}
+
+// NewFrameReader returns a reader of the frames of an uncompressed stream
+func NewFrameReader(r io.Reader) *frameReader {
+	return newFrameReader(r, nil)
+}
+
+// NewRawReader returns a reader of the packets written unframed
+func NewRawReader(r io.Reader) *rawReader {
+	return newRawReader(r)
+}
+
+// SetMaxBridgeEntries sets the number of addresses learned by the bridges,
+// and from each peer, returning a function restoring the previous ones
+func SetMaxBridgeEntries(total, perPeer int) func() {
+	t, p := maxBridgeEntries, maxPeerBridgeEntries
+	maxBridgeEntries, maxPeerBridgeEntries = total, perPeer
+	return func() {
+		maxBridgeEntries, maxPeerBridgeEntries = t, p
+	}
+}
+
+// Addresses returns the number of IPv4 addresses learned
+func (b *bridge) Addresses() int {
+	b.RLock()
+	defer b.RUnlock()
+	return len(b.ips)
+}
+
+func (b *bridge) Expire(now time.Time) {
+	b.expire(now)
+}
+
+// Counters exposes the traffic counters to the tests
+type Counters = metrics
+
+func NewCounters() *Counters {
+	return newMetrics()
+}
+
+func (m *metrics) Sent(peer string, size, wire int) {
+	m.sent(peer, size, wire)
+}
+
+func (m *metrics) Received(peer string, size, wire int) {
+	m.received(peer, size, wire)
+}
+
+func (m *metrics) Drop(reason string) {
+	m.drop(reason)
+}
+
+func (m *metrics) Relayed(peer string) {
+	m.relayed(peer)
+}
+
+func (m *metrics) StreamOpened(peer string) {
+	m.streamOpened(peer)
+}
+
+func (m *metrics) StreamFailed(peer string) {
+	m.streamFailed(peer)
+}
+
+func (m *metrics) Snapshot() Metrics {
+	return m.snapshot()
+}
+
+// AnnounceRoute advertises the network r through self, connected being the peers connected
+func AnnounceRoute(b *blockchain.Ledger, r, self string, ttl time.Duration, connected ...peer.ID) string {
+	return announceRoute(b, r, self, ttl, func(id peer.ID) bool {
+		for _, c := range connected {
+			if c == id {
+				return true
+			}
+		}
+		return false
+	})
+}
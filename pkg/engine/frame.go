@@ -0,0 +1,323 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Frames exchanged over the protocol.BhojpurVPNFramed stream protocol are
+// prefixed by a fixed size header:
+//
+//	+---------+---------+-------------------+
+//	| version |  flags  |  length (uint16)  |
+//	+---------+---------+-------------------+
+//
+// Flags are reserved for extensions negotiated between peers (e.g. compression
+// or batching). Frames carrying a version or flags unknown to the receiver are
+// rejected, and the stream is reset.
+//
+// Frames with the flagForward flag are relayed by a third peer, when the source
+// can not reach the destination directly. Their payload is prefixed by a
+// forwarding header with the source and destination peer IDs:
+//
+//	+------------+-----+------------+-----+--------+
+//	| src length | src | dst length | dst | packet |
+//	+------------+-----+------------+-----+--------+
+//
+// Frames with the flagCompressed flag have their payload compressed with the
+// codec negotiated along with the stream protocol.
+const (
+	frameVersion    = 1
+	frameHeaderSize = 4
+	maxFrameSize    = 1<<16 - 1
+
+	flagForward    byte = 1 << 0
+	flagCompressed byte = 1 << 1
+
+	supportedFlags = flagForward | flagCompressed
+)
+
+// forwardHeader holds the peers a relayed frame is sent from and to
+type forwardHeader struct {
+	Src, Dst peer.ID
+}
+
+// encodeForward returns the payload of the frame relaying packet from src to dst
+func encodeForward(src, dst peer.ID, packet []byte) ([]byte, error) {
+	if len(src) > 255 || len(dst) > 255 {
+		return nil, fmt.Errorf("peer ID too long")
+	}
+
+	payload := make([]byte, 0, 2+len(src)+len(dst)+len(packet))
+	payload = append(payload, byte(len(src)))
+	payload = append(payload, src...)
+	payload = append(payload, byte(len(dst)))
+	payload = append(payload, dst...)
+	payload = append(payload, packet...)
+
+	return payload, nil
+}
+
+// decodeForward parses the forwarding header of a relayed frame,
+// returning it along with the packet
+func decodeForward(payload []byte) (*forwardHeader, []byte, error) {
+	h := &forwardHeader{}
+	for _, id := range []*peer.ID{&h.Src, &h.Dst} {
+		if len(payload) < 1 || len(payload) < 1+int(payload[0]) {
+			return nil, nil, fmt.Errorf("truncated forwarding header")
+		}
+		size := int(payload[0])
+		*id = peer.ID(payload[1 : 1+size])
+		payload = payload[1+size:]
+	}
+	if err := h.Src.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid source peer: %w", err)
+	}
+	if err := h.Dst.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid destination peer: %w", err)
+	}
+	return h, payload, nil
+}
+
+// encodeFrame returns the payload prefixed with the frame header.
+// The frame is returned as a single buffer so it can be written atomically to the stream
+func encodeFrame(flags byte, payload []byte) ([]byte, error) {
+	if len(payload) > maxFrameSize {
+		return nil, fmt.Errorf("frame too large: %d bytes", len(payload))
+	}
+
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = frameVersion
+	buf[1] = flags
+	binary.BigEndian.PutUint16(buf[2:frameHeaderSize], uint16(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+
+	return buf, nil
+}
+
+// frameReader reads length-prefixed frames from a stream, decompressing
+// them with codec
+type frameReader struct {
+	r      *bufio.Reader
+	header [frameHeaderSize]byte
+	buf    []byte
+	codec  codec
+	dbuf   []byte
+	wire   int
+}
+
+func newFrameReader(r io.Reader, c codec) *frameReader {
+	f := &frameReader{r: bufio.NewReader(r), buf: make([]byte, maxFrameSize), codec: c}
+	if c != nil {
+		f.dbuf = make([]byte, maxFrameSize)
+	}
+	return f
+}
+
+// Next returns the flags and the payload of the next frame. The payload is
+// only valid until the next call to Next
+func (f *frameReader) Next() (byte, []byte, error) {
+	if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	if f.header[0] != frameVersion {
+		return 0, nil, fmt.Errorf("unsupported frame version %d", f.header[0])
+	}
+
+	flags := f.header[1]
+	if flags&^supportedFlags != 0 {
+		return 0, nil, fmt.Errorf("unsupported frame flags %#x", flags)
+	}
+
+	size := int(binary.BigEndian.Uint16(f.header[2:]))
+	if _, err := io.ReadFull(f.r, f.buf[:size]); err != nil {
+		return 0, nil, err
+	}
+	f.wire = size
+
+	if flags&flagCompressed == 0 {
+		return flags, f.buf[:size], nil
+	}
+	if f.codec == nil {
+		return 0, nil, fmt.Errorf("compressed frame on an uncompressed stream")
+	}
+	payload, err := f.codec.decompress(f.dbuf, f.buf[:size])
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decompress frame: %w", err)
+	}
+	if len(payload) > maxFrameSize {
+		return 0, nil, fmt.Errorf("decompressed frame too large: %d bytes", len(payload))
+	}
+	return flags, payload, nil
+}
+
+// WireSize returns the size on the wire of the last frame payload
+func (f *frameReader) WireSize() int {
+	return f.wire
+}
+
+// writePacket writes a packet to the stream, using framing if it was negotiated with the peer.
+// It returns the size of the packet on the wire
+func writePacket(s network.Stream, packet []byte) (int, error) {
+	if !isFramed(s) {
+		// Legacy peers read raw packets from the stream
+		return s.Write(packet)
+	}
+	return writeFrame(s, 0, packet)
+}
+
+// writeFrame writes a frame to the stream, compressing the payload if a codec
+// was negotiated and it is worth it. It returns the size of the payload on the wire
+func writeFrame(s network.Stream, flags byte, payload []byte) (int, error) {
+	if cs, ok := s.(*codecStream); ok {
+		if compressed, ok := cs.compress(payload); ok {
+			payload = compressed
+			flags |= flagCompressed
+		}
+	}
+
+	frame, err := encodeFrame(flags, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = s.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// packetReader reads one packet at a time from a stream. The forwarding
+// header is returned along with the packets relayed by the peer
+type packetReader interface {
+	ReadPacket() ([]byte, *forwardHeader, error)
+	// WireSize returns the size on the wire of the last packet read
+	WireSize() int
+}
+
+// ReadPacket returns the payload of the next frame
+func (f *frameReader) ReadPacket() ([]byte, *forwardHeader, error) {
+	flags, payload, err := f.Next()
+	if err != nil || flags&flagForward == 0 {
+		return payload, nil, err
+	}
+	h, packet, err := decodeForward(payload)
+	return packet, h, err
+}
+
+// rawReader reads the packets written unframed by legacy peers, splitting
+// the stream with the packet length found in the IP header. The Ethernet
+// frames have no length: the legacy peers in TAP mode can not interoperate
+type rawReader struct {
+	r    *bufio.Reader
+	buf  []byte
+	size int
+}
+
+func newRawReader(r io.Reader) *rawReader {
+	return &rawReader{r: bufio.NewReader(r), buf: make([]byte, maxFrameSize)}
+}
+
+// ReadPacket returns the next packet, which is only valid until the next call
+func (p *rawReader) ReadPacket() ([]byte, *forwardHeader, error) {
+	b, err := p.r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var size int
+	switch v := int(b[0] >> 4); v {
+	case ipv4.Version:
+		h, err := p.r.Peek(4)
+		if err != nil {
+			return nil, nil, err
+		}
+		size = int(binary.BigEndian.Uint16(h[2:4]))
+		if size < ipv4.HeaderLen {
+			return nil, nil, fmt.Errorf("invalid ipv4 packet length %d", size)
+		}
+	case ipv6.Version:
+		h, err := p.r.Peek(6)
+		if err != nil {
+			return nil, nil, err
+		}
+		size = ipv6.HeaderLen + int(binary.BigEndian.Uint16(h[4:6]))
+		if size > len(p.buf) {
+			return nil, nil, fmt.Errorf("ipv6 packet too large: %d bytes", size)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported ip version %d", v)
+	}
+
+	if _, err := io.ReadFull(p.r, p.buf[:size]); err != nil {
+		return nil, nil, err
+	}
+	p.size = size
+
+	return p.buf[:size], nil, nil
+}
+
+// WireSize returns the size of the last packet
+func (p *rawReader) WireSize() int {
+	return p.size
+}
+
+// newPacketReader returns a reader for the packets sent by the peer,
+// depending on the protocol negotiated on the stream
+func newPacketReader(s network.Stream) packetReader {
+	if isFramed(s) {
+		return newFrameReader(s, codecs[s.Protocol()])
+	}
+	return newRawReader(s)
+}
+
+// copyPackets writes every packet read from r and accepted by the filter
+// as a single packet to w. The filter is given the forwarding header of the
+// relayed packets
+func copyPackets(w io.Writer, r packetReader, accept func(packet []byte, fh *forwardHeader) bool) error {
+	for {
+		packet, fh, err := r.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !accept(packet, fh) {
+			continue
+		}
+
+		if _, err := w.Write(packet); err != nil {
+			return err
+		}
+	}
+}
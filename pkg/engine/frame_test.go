@@ -0,0 +1,175 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+)
+
+var _ = Describe("Frames", func() {
+	// concat returns the frames written one after the other on a stream
+	concat := func(frames ...[]byte) io.Reader {
+		return bytes.NewReader(bytes.Join(frames, nil))
+	}
+
+	Context("Framed streams", func() {
+		It("reads back the frames encoded", func() {
+			payloads := [][]byte{
+				ipv4Packet("10.1.0.1", "10.1.0.2", 17, make([]byte, 100)),
+				{},
+				bytes.Repeat([]byte{0xab}, MaxFrameSize),
+			}
+			frames := [][]byte{}
+			for i, p := range payloads {
+				flags := byte(0)
+				if i == 1 {
+					flags = FlagForward
+				}
+				f, err := EncodeFrame(flags, p)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(f).To(HaveLen(4 + len(p)))
+				Expect(f[0]).To(BeEquivalentTo(FrameVersion))
+				Expect(f[1]).To(Equal(flags))
+				Expect(int(binary.BigEndian.Uint16(f[2:4]))).To(Equal(len(p)))
+				frames = append(frames, f)
+			}
+
+			r := NewFrameReader(concat(frames...))
+			for i, p := range payloads {
+				flags, payload, err := r.Next()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(flags == FlagForward).To(Equal(i == 1))
+				Expect(payload).To(Equal(p))
+				Expect(r.WireSize()).To(Equal(len(p)))
+			}
+			_, _, err := r.Next()
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("refuses to encode the frames above the maximum size", func() {
+			_, err := EncodeFrame(0, make([]byte, MaxFrameSize+1))
+			Expect(err).To(MatchError(ContainSubstring("frame too large")))
+		})
+
+		It("rejects the frames of an unknown version", func() {
+			f, err := EncodeFrame(0, []byte{1, 2, 3})
+			Expect(err).ToNot(HaveOccurred())
+			f[0] = FrameVersion + 1
+
+			_, _, err = NewFrameReader(concat(f)).Next()
+			Expect(err).To(MatchError(ContainSubstring("unsupported frame version")))
+		})
+
+		It("rejects the frames with unknown flags", func() {
+			f, err := EncodeFrame(1<<7, []byte{1, 2, 3})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, err = NewFrameReader(concat(f)).Next()
+			Expect(err).To(MatchError(ContainSubstring("unsupported frame flags")))
+		})
+
+		It("rejects the compressed frames on an uncompressed stream", func() {
+			f, err := EncodeFrame(FlagCompressed, []byte{1, 2, 3})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, err = NewFrameReader(concat(f)).Next()
+			Expect(err).To(MatchError(ContainSubstring("compressed frame on an uncompressed stream")))
+		})
+
+		It("fails on the truncated headers and payloads", func() {
+			f, err := EncodeFrame(0, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, err = NewFrameReader(concat(f[:2])).Next()
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+
+			_, _, err = NewFrameReader(concat(f[:len(f)-1])).Next()
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+		})
+
+		It("fails on the truncated forwarding headers", func() {
+			f, err := EncodeFrame(FlagForward, []byte{38, 1, 2})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, _, _, err = ReadFrame(concat(f))
+			Expect(err).To(MatchError(ContainSubstring("truncated forwarding header")))
+		})
+	})
+
+	Context("Unframed streams", func() {
+		It("splits the packets with the length of their IP header", func() {
+			packets := [][]byte{
+				ipv4Packet("10.1.0.1", "10.1.0.2", 17, make([]byte, 100)),
+				ipv6Packet("fd00::1", "fd00::2", 200),
+				ipv4Packet("10.1.0.1", "10.1.0.2", 17, nil),
+			}
+
+			r := NewRawReader(concat(packets...))
+			for _, p := range packets {
+				packet, fh, err := r.ReadPacket()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fh).To(BeNil())
+				Expect(packet).To(Equal(p))
+				Expect(r.WireSize()).To(Equal(len(p)))
+			}
+			_, _, err := r.ReadPacket()
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("rejects the packets of an unknown version", func() {
+			_, _, err := NewRawReader(concat([]byte{0x50, 0, 0, 20})).ReadPacket()
+			Expect(err).To(MatchError(ContainSubstring("unsupported ip version 5")))
+		})
+
+		It("rejects the IPv4 packets shorter than their header", func() {
+			p := ipv4Packet("10.1.0.1", "10.1.0.2", 17, nil)
+			binary.BigEndian.PutUint16(p[2:4], 19)
+
+			_, _, err := NewRawReader(concat(p)).ReadPacket()
+			Expect(err).To(MatchError(ContainSubstring("invalid ipv4 packet length 19")))
+		})
+
+		It("rejects the IPv6 packets above the maximum size", func() {
+			p := ipv6Packet("fd00::1", "fd00::2", 8)
+			binary.BigEndian.PutUint16(p[4:6], 0xffff)
+
+			_, _, err := NewRawReader(concat(p)).ReadPacket()
+			Expect(err).To(MatchError(ContainSubstring("ipv6 packet too large")))
+		})
+
+		It("fails on the truncated packets", func() {
+			p := ipv4Packet("10.1.0.1", "10.1.0.2", 17, make([]byte, 100))
+
+			_, _, err := NewRawReader(concat(p[:len(p)-1])).ReadPacket()
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+
+			_, _, err = NewRawReader(concat(p[:3])).ReadPacket()
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
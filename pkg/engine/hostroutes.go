@@ -0,0 +1,299 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// RoutingRule selects the traffic routed with the dedicated routing table,
+// like 'ip rule [not] from Source fwmark Mark lookup table priority Priority'
+type RoutingRule struct {
+	Priority int
+	Source   string
+	Mark     int
+	Invert   bool
+}
+
+// ParseRoutingRule parses a routing rule from a comma separated list of
+// key=value pairs: priority, from and fwmark, and 'not' to invert the
+// selection, e.g. "priority=1000,not,fwmark=0x51"
+func ParseRoutingRule(s string) (RoutingRule, error) {
+	r := RoutingRule{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "not" {
+			r.Invert = true
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return r, fmt.Errorf("invalid routing rule option '%s'", kv)
+		}
+		switch k, v := parts[0], parts[1]; k {
+		case "priority":
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				return r, fmt.Errorf("invalid routing rule priority '%s'", v)
+			}
+			r.Priority = p
+		case "from":
+			r.Source = v
+		case "fwmark":
+			m, err := strconv.ParseUint(v, 0, 32)
+			if err != nil {
+				return r, fmt.Errorf("invalid routing rule fwmark '%s'", v)
+			}
+			r.Mark = int(m)
+		default:
+			return r, fmt.Errorf("unknown routing rule option '%s'", k)
+		}
+	}
+	return r, validateRoutingRule(r)
+}
+
+func validateRoutingRule(r RoutingRule) error {
+	if r.Priority < 0 {
+		return fmt.Errorf("invalid routing rule priority '%d'", r.Priority)
+	}
+	if r.Source != "" {
+		if _, _, err := net.ParseCIDR(r.Source); err != nil {
+			return fmt.Errorf("invalid routing rule source '%s'", r.Source)
+		}
+	}
+	return nil
+}
+
+// minMainPrefix is the shortest prefix routed in the main table for each
+// address length. Shorter ones, like 0.0.0.0/1 and 128.0.0.0/1, would catch
+// most of the traffic of the host just like the default networks
+var minMainPrefix = map[int]int{8 * net.IPv4len: 8, 8 * net.IPv6len: 16}
+
+// hostNetworks returns the networks routed to the interface: the ones advertised
+// by the peers and the ones of the exit nodes. The default networks are routed only
+// in a dedicated table, in the main one they would catch the connections to the peers.
+// For the same reason the networks containing the underlay addresses of the peers
+// are never routed, but for the ones of the exit nodes in a dedicated table, which
+// the routing rule applies to. The networks refused are returned with the reason
+func hostNetworks(t *RoutingTable, exits *exitRouter, local *interfaceState, underlay []net.IP, table int) (map[string]*net.IPNet, map[string]string) {
+	own := map[string]bool{}
+	for _, r := range local.routes {
+		own[r] = true
+	}
+
+	nets := map[string]*net.IPNet{}
+	refused := map[string]string{}
+	add := func(n *net.IPNet, exit bool) {
+		ones, bits := n.Mask.Size()
+		switch {
+		case ones == 0 && table == 0:
+		case bits == 8*net.IPv6len && local.ip6 == nil:
+		// The networks routed through this node, and the VPN network
+		// which is already routed to the interface
+		case own[n.String()]:
+		case local.network.Contains(n.IP) && ones >= onesOf(local.network):
+		case table == 0 && ones < minMainPrefix[bits]:
+			refused[n.String()] = "it is too wide for the main routing table"
+		case (table == 0 || !exit) && containsAny(n, underlay):
+			refused[n.String()] = "it contains the address of a peer"
+		default:
+			nets[n.String()] = n
+		}
+	}
+	for _, p := range t.routes {
+		add(p.net, false)
+	}
+	for _, p := range exits.policies {
+		add(p.net, true)
+	}
+	return nets, refused
+}
+
+func containsAny(n *net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// underlayAddresses returns the addresses the peers are connected to, the
+// ones of the relays for the relayed connections
+func underlayAddresses(n network.Network) []net.IP {
+	ips := []net.IP{}
+	for _, c := range n.Conns() {
+		if ip, err := manet.ToIP(c.RemoteMultiaddr()); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func onesOf(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// hostRouter keeps the routes of the interface in sync with the networks
+// reachable through the VPN, and removes them on close
+type hostRouter struct {
+	c         *Config
+	table     int
+	installed map[string]*net.IPNet
+	failed    map[string]bool
+	refused   map[string]bool
+
+	// families holds the families of the routing rules added, true for IPv6
+	families []bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newHostRouter adds the routing rules of the dedicated table, if any
+func newHostRouter(c *Config) (*hostRouter, error) {
+	h := &hostRouter{
+		c:         c,
+		table:     c.RouteTable,
+		installed: map[string]*net.IPNet{},
+		failed:    map[string]bool{},
+		refused:   map[string]bool{},
+	}
+	// The default, main and local tables are reserved
+	if h.table < 0 || (h.table >= 253 && h.table <= 255) {
+		return nil, fmt.Errorf("invalid routing table '%d'", h.table)
+	}
+	if h.table == 0 || c.RoutingRule == nil {
+		return h, nil
+	}
+	if err := validateRoutingRule(*c.RoutingRule); err != nil {
+		return nil, err
+	}
+
+	// A rule without source applies to both families
+	families := []bool{false}
+	if r := c.RoutingRule.Source; r != "" {
+		ip, _, _ := net.ParseCIDR(r)
+		families = []bool{ip.To4() == nil}
+	} else if !c.disableIPv6 {
+		families = append(families, true)
+	}
+	for _, ipv6 := range families {
+		if err := addRoutingRule(c, *c.RoutingRule, ipv6); err != nil {
+			h.close()
+			return nil, err
+		}
+		h.families = append(h.families, ipv6)
+	}
+	return h, nil
+}
+
+// sync routes nets to the interface, and removes the other routes. The
+// networks refused are reported once
+func (h *hostRouter) sync(nets map[string]*net.IPNet, refused map[string]string) {
+	for k, reason := range refused {
+		if !h.refused[k] {
+			h.c.Logger.Warnf("not routing %s to the interface: %s", k, reason)
+			h.refused[k] = true
+		}
+	}
+	for k := range h.refused {
+		if _, ok := refused[k]; !ok {
+			delete(h.refused, k)
+		}
+	}
+	for k, n := range h.installed {
+		if _, ok := nets[k]; ok {
+			continue
+		}
+		if err := delHostRoute(h.c, n, h.table); err != nil {
+			h.c.Logger.Warnf("could not remove the route to %s: %s", k, err.Error())
+			continue
+		}
+		delete(h.installed, k)
+	}
+	for k, n := range nets {
+		if _, ok := h.installed[k]; ok {
+			continue
+		}
+		if err := addHostRoute(h.c, n, h.table); err != nil {
+			// Retried on the next sync, reported once
+			if !h.failed[k] {
+				h.c.Logger.Warnf("could not add the route to %s: %s", k, err.Error())
+				h.failed[k] = true
+			}
+			continue
+		}
+		delete(h.failed, k)
+		h.installed[k] = n
+	}
+}
+
+// start syncs the routes in the background until close
+func (h *hostRouter) start(ctx context.Context, routing *routingCache, exits *exitRouter, local func() *interfaceState, underlay func() []net.IP, interval time.Duration) {
+	ctx, h.cancel = context.WithCancel(ctx)
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		h.run(ctx, routing, exits, local, underlay, interval)
+	}()
+}
+
+// run syncs the routes at every interval until the context is done
+func (h *hostRouter) run(ctx context.Context, routing *routingCache, exits *exitRouter, local func() *interfaceState, underlay func() []net.IP, interval time.Duration) {
+	h.sync(hostNetworks(routing.Table(), exits, local(), underlay(), h.table))
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.sync(hostNetworks(routing.Table(), exits, local(), underlay(), h.table))
+		}
+	}
+}
+
+// close removes the routes and the routing rules
+func (h *hostRouter) close() {
+	if h.cancel != nil {
+		h.cancel()
+		<-h.done
+		h.cancel = nil
+	}
+	h.sync(map[string]*net.IPNet{}, nil)
+	for _, ipv6 := range h.families {
+		if err := delRoutingRule(h.c, *h.c.RoutingRule, ipv6); err != nil {
+			h.c.Logger.Warnf("could not remove the routing rule: %s", err.Error())
+		}
+	}
+	h.families = nil
+}
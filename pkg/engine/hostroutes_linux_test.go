@@ -0,0 +1,136 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"runtime"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/logger"
+)
+
+var _ = Describe("Host routes in a network namespace", func() {
+	// inNamespace runs f in a new network namespace with a veth interface
+	inNamespace := func(f func(link netlink.Link)) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+
+		origin, err := netns.Get()
+		Expect(err).ToNot(HaveOccurred())
+		defer origin.Close()
+
+		ns, err := netns.New()
+		if err != nil {
+			Skip("could not create a network namespace: " + err.Error())
+		}
+		defer ns.Close()
+		defer netns.Set(origin)
+
+		link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "vpntest0"}, PeerName: "vpntest1"}
+		Expect(netlink.LinkAdd(link)).To(Succeed())
+		Expect(netlink.LinkSetUp(link)).To(Succeed())
+		addr, err := netlink.ParseAddr("10.1.0.1/24")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+
+		f(link)
+	}
+
+	routes := func(link netlink.Link, table int) []string {
+		filter := &netlink.Route{LinkIndex: link.Attrs().Index, Table: table}
+		list, err := netlink.RouteListFiltered(netlink.FAMILY_V4, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+		Expect(err).ToNot(HaveOccurred())
+		res := []string{}
+		for _, r := range list {
+			if r.Dst == nil {
+				res = append(res, "0.0.0.0/0")
+				continue
+			}
+			res = append(res, r.Dst.String())
+		}
+		return res
+	}
+
+	rules := func(table int) int {
+		list, err := netlink.RuleList(netlink.FAMILY_V4)
+		Expect(err).ToNot(HaveOccurred())
+		n := 0
+		for _, r := range list {
+			if r.Table == table {
+				n++
+			}
+		}
+		return n
+	}
+
+	It("adds and removes the routes in the main table", func() {
+		inNamespace(func(link netlink.Link) {
+			h, err := NewHostRouter(&Config{InterfaceName: "vpntest0", Logger: logger.New(log.LevelFatal)})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(h.Sync("192.168.0.0/16", "172.20.0.0/16")).To(Succeed())
+			Expect(routes(link, 254)).To(ContainElements("192.168.0.0/16", "172.20.0.0/16"))
+
+			Expect(h.Sync("192.168.0.0/16")).To(Succeed())
+			Expect(routes(link, 254)).ToNot(ContainElement("172.20.0.0/16"))
+
+			h.Close()
+			Expect(routes(link, 254)).ToNot(ContainElement("192.168.0.0/16"))
+		})
+	})
+
+	It("uses a dedicated table and rule", func() {
+		inNamespace(func(link netlink.Link) {
+			c := &Config{
+				InterfaceName: "vpntest0",
+				RouteTable:    100,
+				RoutingRule:   &RoutingRule{Priority: 1000, Source: "192.168.1.0/24"},
+				Logger:        logger.New(log.LevelFatal),
+			}
+			h, err := NewHostRouter(c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules(100)).To(Equal(1))
+
+			// A rule left over is replaced
+			h2, err := NewHostRouter(c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(rules(100)).To(Equal(1))
+			h2.Close()
+			Expect(rules(100)).To(Equal(0))
+
+			h, err = NewHostRouter(c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(h.Sync("0.0.0.0/0", "192.168.0.0/16")).To(Succeed())
+			Expect(routes(link, 100)).To(ConsistOf("0.0.0.0/0", "192.168.0.0/16"))
+			Expect(routes(link, 254)).ToNot(ContainElement("192.168.0.0/16"))
+
+			h.Close()
+			Expect(routes(link, 100)).To(BeEmpty())
+			Expect(rules(100)).To(Equal(0))
+		})
+	})
+})
@@ -0,0 +1,126 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+var _ = Describe("Host routes", func() {
+	self, a, b := newPeerID(), newPeerID(), newPeerID()
+
+	table := NewRoutingTable(blockchain.Block{
+		Storage: map[string]map[string]blockchain.Data{
+			protocol.MachinesLedgerKey: {
+				"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1"}),
+				"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2"}),
+				"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3"}),
+			},
+			protocol.RoutesLedgerKey: {
+				"192.168.0.0/16":  data(types.Route{PeerID: a.String(), Network: "192.168.0.0/16"}),
+				"fd00:1::/64":     data(types.Route{PeerID: a.String(), Network: "fd00:1::/64"}),
+				"10.1.0.128/25":   data(types.Route{PeerID: a.String(), Network: "10.1.0.128/25"}),
+				"172.30.0.0/16":   data(types.Route{PeerID: b.String(), Network: "172.30.0.0/16"}),
+				"10.9.0.0/16":     data(types.Route{PeerID: self.String(), Network: "10.9.0.0/16"}),
+				"0.0.0.0/1":       data(types.Route{PeerID: b.String(), Network: "0.0.0.0/1"}),
+				"128.0.0.0/1":     data(types.Route{PeerID: b.String(), Network: "128.0.0.0/1"}),
+				"198.51.100.0/24": data(types.Route{PeerID: b.String(), Network: "198.51.100.0/24"}),
+			},
+		},
+	}, self.String())
+
+	exits, err := NewExitRouter([]ExitNode{
+		{Address: "10.1.0.3"},
+		{Address: "10.1.0.2", Networks: []string{"172.20.0.0/16"}},
+	}, blockchain.New(ioutil.Discard, &blockchain.MemoryStore{}), self.String(), time.Minute)
+	Expect(err).ToNot(HaveOccurred())
+
+	It("parses routing rules", func() {
+		r, err := ParseRoutingRule("priority=1000,not,fwmark=0x51")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r).To(Equal(RoutingRule{Priority: 1000, Mark: 0x51, Invert: true}))
+
+		r, err = ParseRoutingRule("from=192.168.1.0/24")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r).To(Equal(RoutingRule{Source: "192.168.1.0/24"}))
+
+		_, err = ParseRoutingRule("from=foo")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRoutingRule("priority=-1")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseRoutingRule("table=10")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("routes the remote networks to the interface", func() {
+		local := InterfaceConfig{Address: "10.1.0.1/24", MTU: 1420, Routes: []string{"172.30.0.0/16"}}
+
+		// Neither the VPN network nor the networks routed through
+		// this node, nor the default networks in the main table
+		// nor the catch-all networks
+		nets, _, err := exits.HostNetworks(table, local, false, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nets).To(Equal([]string{"172.20.0.0/16", "192.168.0.0/16", "198.51.100.0/24", "fd00:1::/64"}))
+
+		nets, _, err = exits.HostNetworks(table, local, false, 100)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nets).To(Equal([]string{"0.0.0.0/0", "0.0.0.0/1", "128.0.0.0/1", "172.20.0.0/16", "192.168.0.0/16", "198.51.100.0/24", "::/0", "fd00:1::/64"}))
+
+		nets, _, err = exits.HostNetworks(table, local, true, 100)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nets).To(Equal([]string{"0.0.0.0/0", "0.0.0.0/1", "128.0.0.0/1", "172.20.0.0/16", "192.168.0.0/16", "198.51.100.0/24"}))
+
+		// The network advertised inside of the VPN one is routed once the VPN network shrinks
+		nets, _, err = exits.HostNetworks(table, InterfaceConfig{Address: "10.1.0.1/25", MTU: 1420}, true, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nets).To(Equal([]string{"10.1.0.128/25", "172.20.0.0/16", "172.30.0.0/16", "192.168.0.0/16", "198.51.100.0/24"}))
+	})
+
+	It("refuses the networks catching the traffic to the peers", func() {
+		local := InterfaceConfig{Address: "10.1.0.1/24", MTU: 1420}
+
+		nets, refused, err := exits.HostNetworks(table, local, true, 0, "198.51.100.7", "172.20.0.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nets).To(Equal([]string{"172.30.0.0/16", "192.168.0.0/16"}))
+		Expect(refused).To(Equal([]string{"0.0.0.0/1", "128.0.0.0/1", "172.20.0.0/16", "198.51.100.0/24"}))
+
+		// The routing rule of the dedicated table selects the traffic routed
+		// through the exit nodes, but not the one of the networks advertised
+		nets, refused, err = exits.HostNetworks(table, local, true, 100, "198.51.100.7", "172.20.0.1", "203.0.113.1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(nets).To(Equal([]string{"0.0.0.0/0", "0.0.0.0/1", "172.20.0.0/16", "172.30.0.0/16", "192.168.0.0/16"}))
+		Expect(refused).To(Equal([]string{"128.0.0.0/1", "198.51.100.0/24"}))
+	})
+
+	It("rejects the reserved routing tables", func() {
+		_, err := NewHostRouter(&Config{HostRoutes: true, RouteTable: 254})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -24,6 +24,8 @@ package engine
 // THE SOFTWARE.
 
 import (
+	"net"
+
 	"github.com/songgao/water"
 	"github.com/vishvananda/netlink"
 )
@@ -58,9 +60,127 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 
+	if c.InterfaceAddress6 != "" {
+		addr6, err := netlink.ParseAddr(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+
+		err = netlink.AddrAdd(link, addr6)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = netlink.LinkSetUp(link)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// reconfigureInterface applies the changes from old to new to the interface
+func reconfigureInterface(c *Config, old, new *interfaceState) error {
+	link, err := netlink.LinkByName(c.InterfaceName)
+	if err != nil {
+		return err
+	}
+
+	if new.config.MTU != old.config.MTU {
+		if err := netlink.LinkSetMTU(link, new.config.MTU); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range [][2]string{
+		{old.config.Address, new.config.Address},
+		{old.config.Address6, new.config.Address6},
+	} {
+		if a[0] == a[1] {
+			continue
+		}
+		// The new address is added before the old one is removed,
+		// so that the interface is never left without any
+		if a[1] != "" {
+			addr, err := netlink.ParseAddr(a[1])
+			if err != nil {
+				return err
+			}
+			if err := netlink.AddrReplace(link, addr); err != nil {
+				return err
+			}
+		}
+		if a[0] != "" {
+			addr, err := netlink.ParseAddr(a[0])
+			if err != nil {
+				return err
+			}
+			if err := netlink.AddrDel(link, addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hostRoute(c *Config, n *net.IPNet, table int) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(c.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       n,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     table,
+	}, nil
+}
+
+// addHostRoute routes the network to the interface, in the main table if table is 0
+func addHostRoute(c *Config, n *net.IPNet, table int) error {
+	r, err := hostRoute(c, n, table)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteReplace(r)
+}
+
+func delHostRoute(c *Config, n *net.IPNet, table int) error {
+	r, err := hostRoute(c, n, table)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteDel(r)
+}
+
+func routingRule(c *Config, r RoutingRule, ipv6 bool) *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Table = c.RouteTable
+	rule.Invert = r.Invert
+	if r.Priority > 0 {
+		rule.Priority = r.Priority
+	}
+	rule.Family = netlink.FAMILY_V4
+	if ipv6 {
+		rule.Family = netlink.FAMILY_V6
+	}
+	if r.Source != "" {
+		_, rule.Src, _ = net.ParseCIDR(r.Source)
+	}
+	if r.Mark != 0 {
+		rule.Mark = r.Mark
+	}
+	return rule
+}
+
+// addRoutingRule looks up the routing table of the VPN according to the rule.
+// The rule left over by a previous run is replaced
+func addRoutingRule(c *Config, r RoutingRule, ipv6 bool) error {
+	rule := routingRule(c, r, ipv6)
+	netlink.RuleDel(rule)
+	return netlink.RuleAdd(rule)
+}
+
+func delRoutingRule(c *Config, r RoutingRule, ipv6 bool) error {
+	return netlink.RuleDel(routingRule(c, r, ipv6))
+}
@@ -24,6 +24,7 @@ package engine
 // THE SOFTWARE.
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -41,9 +42,72 @@ func prepareInterface(c *Config) error {
 	if err != nil {
 		log.Println(err)
 	}
+	if c.InterfaceAddress6 != "" {
+		err = netsh("interface", "ipv6", "add", "address", c.InterfaceName, c.InterfaceAddress6)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// reconfigureInterface applies the changes from old to new to the interface
+func reconfigureInterface(c *Config, old, new *interfaceState) error {
+	if new.config.Address != old.config.Address {
+		if err := netsh("interface", "ip", "set", "address", "name=", c.InterfaceName, "static", new.config.Address); err != nil {
+			return err
+		}
+	}
+	if new.config.MTU != old.config.MTU {
+		if err := netsh("interface", "ipv4", "set", "subinterface", c.InterfaceName, "mtu=", fmt.Sprintf("%d", new.config.MTU)); err != nil {
+			return err
+		}
+	}
+	if new.config.Address6 != old.config.Address6 {
+		if new.config.Address6 != "" {
+			if err := netsh("interface", "ipv6", "add", "address", c.InterfaceName, new.config.Address6); err != nil {
+				return err
+			}
+		}
+		if old.config.Address6 != "" {
+			if err := netsh("interface", "ipv6", "delete", "address", c.InterfaceName, old.ip6.String()); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// addHostRoute routes the network to the interface. Only the main table is supported
+func addHostRoute(c *Config, n *net.IPNet, table int) error {
+	if table != 0 {
+		return errors.New("routing tables are not supported on windows")
+	}
+	return netsh("interface", routeFamily(n), "add", "route", n.String(), c.InterfaceName, "store=active")
+}
+
+func delHostRoute(c *Config, n *net.IPNet, table int) error {
+	if table != 0 {
+		return errors.New("routing tables are not supported on windows")
+	}
+	return netsh("interface", routeFamily(n), "delete", "route", n.String(), c.InterfaceName)
+}
+
+func routeFamily(n *net.IPNet) string {
+	if n.IP.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+func addRoutingRule(c *Config, r RoutingRule, ipv6 bool) error {
+	return errors.New("routing rules are not supported on windows")
+}
+
+func delRoutingRule(c *Config, r RoutingRule, ipv6 bool) error {
+	return errors.New("routing rules are not supported on windows")
+}
+
 func createInterface(c *Config) (*water.Interface, error) {
 	// TUN on Windows requires address and network to be set on device creation stage
 	// We also set network to 0.0.0.0/0 so we able to reach networks behind the node
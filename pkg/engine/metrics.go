@@ -0,0 +1,201 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Reasons for which packets are dropped by the engine
+const (
+	DropParse      = "parse"
+	DropQueueFull  = "queue_full"
+	DropNoRoute    = "no_route"
+	DropACL        = "acl"
+	DropStreamOpen = "stream_open"
+	DropWrite      = "write"
+	DropRateLimit  = "rate_limit"
+	DropRelay      = "relay"
+	DropMTU        = "mtu"
+	DropShaped     = "shaped"
+	DropSpoofed    = "spoofed"
+	// DropUnknown counts the drops for a reason not listed above
+	DropUnknown = "unknown"
+)
+
+var dropReasons = []string{DropParse, DropQueueFull, DropNoRoute, DropACL, DropStreamOpen, DropWrite, DropRateLimit, DropRelay, DropMTU, DropShaped, DropSpoofed, DropUnknown}
+
+// PeerMetrics are the traffic counters of a peer. Out counts the packets
+// sent to the peer, In the ones received from it, and Relayed the ones
+// forwarded on its behalf to another peer. WireBytes are the bytes of the
+// packets once compressed, and the compression ratios the packet bytes by
+// byte on the wire
+type PeerMetrics struct {
+	PacketsIn, PacketsOut         uint64
+	BytesIn, BytesOut             uint64
+	WireBytesIn, WireBytesOut     uint64
+	StreamsOpened                 uint64
+	StreamFailures                uint64
+	Relayed                       uint64
+	CompressionIn, CompressionOut float64
+}
+
+// Metrics are the traffic counters of the engine since it was started
+type Metrics struct {
+	PacketsIn, PacketsOut uint64
+	BytesIn, BytesOut     uint64
+	Dropped               uint64
+
+	// FlowsEvicted is the number of flows, and of fragmented packets, evicted
+	// by the firewall once full
+	FlowsEvicted uint64
+
+	// Drops are the dropped packets by reason
+	Drops map[string]uint64
+	Peers map[string]PeerMetrics
+
+	Scheduler SchedulerStats
+}
+
+// metrics collects the traffic counters, which are updated atomically
+type metrics struct {
+	// flowsEvicted is first to be 64-bit aligned for the atomic operations
+	flowsEvicted uint64
+
+	sync.RWMutex
+	peers map[string]*PeerMetrics
+	drops map[string]*uint64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		peers: map[string]*PeerMetrics{},
+		drops: map[string]*uint64{},
+	}
+	for _, r := range dropReasons {
+		m.drops[r] = new(uint64)
+	}
+	return m
+}
+
+func (m *metrics) peer(id string) *PeerMetrics {
+	m.RLock()
+	p, ok := m.peers[id]
+	m.RUnlock()
+	if ok {
+		return p
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if p, ok := m.peers[id]; ok {
+		return p
+	}
+	p = &PeerMetrics{}
+	m.peers[id] = p
+	return p
+}
+
+func (m *metrics) sent(peer string, size, wire int) {
+	p := m.peer(peer)
+	atomic.AddUint64(&p.PacketsOut, 1)
+	atomic.AddUint64(&p.BytesOut, uint64(size))
+	atomic.AddUint64(&p.WireBytesOut, uint64(wire))
+}
+
+func (m *metrics) received(peer string, size, wire int) {
+	p := m.peer(peer)
+	atomic.AddUint64(&p.PacketsIn, 1)
+	atomic.AddUint64(&p.BytesIn, uint64(size))
+	atomic.AddUint64(&p.WireBytesIn, uint64(wire))
+}
+
+// ratio returns the compression ratio of size bytes sent as wire bytes
+func ratio(size, wire uint64) float64 {
+	if wire == 0 {
+		return 0
+	}
+	return float64(size) / float64(wire)
+}
+
+func (m *metrics) streamOpened(peer string) {
+	atomic.AddUint64(&m.peer(peer).StreamsOpened, 1)
+}
+
+func (m *metrics) streamFailed(peer string) {
+	atomic.AddUint64(&m.peer(peer).StreamFailures, 1)
+}
+
+func (m *metrics) relayed(peer string) {
+	atomic.AddUint64(&m.peer(peer).Relayed, 1)
+}
+
+func (m *metrics) drop(reason string) {
+	d, ok := m.drops[reason]
+	if !ok {
+		d = m.drops[DropUnknown]
+	}
+	atomic.AddUint64(d, 1)
+}
+
+func (m *metrics) flowEvicted() {
+	atomic.AddUint64(&m.flowsEvicted, 1)
+}
+
+// snapshot returns a copy of the counters
+func (m *metrics) snapshot() Metrics {
+	s := Metrics{
+		FlowsEvicted: atomic.LoadUint64(&m.flowsEvicted),
+		Drops:        map[string]uint64{},
+		Peers:        map[string]PeerMetrics{},
+	}
+
+	for r, d := range m.drops {
+		s.Drops[r] = atomic.LoadUint64(d)
+		s.Dropped += s.Drops[r]
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+	for id, p := range m.peers {
+		pm := PeerMetrics{
+			PacketsIn:      atomic.LoadUint64(&p.PacketsIn),
+			PacketsOut:     atomic.LoadUint64(&p.PacketsOut),
+			BytesIn:        atomic.LoadUint64(&p.BytesIn),
+			BytesOut:       atomic.LoadUint64(&p.BytesOut),
+			WireBytesIn:    atomic.LoadUint64(&p.WireBytesIn),
+			WireBytesOut:   atomic.LoadUint64(&p.WireBytesOut),
+			StreamsOpened:  atomic.LoadUint64(&p.StreamsOpened),
+			StreamFailures: atomic.LoadUint64(&p.StreamFailures),
+			Relayed:        atomic.LoadUint64(&p.Relayed),
+		}
+		pm.CompressionIn = ratio(pm.BytesIn, pm.WireBytesIn)
+		pm.CompressionOut = ratio(pm.BytesOut, pm.WireBytesOut)
+		s.Peers[id] = pm
+		s.PacketsIn += pm.PacketsIn
+		s.PacketsOut += pm.PacketsOut
+		s.BytesIn += pm.BytesIn
+		s.BytesOut += pm.BytesOut
+	}
+
+	return s
+}
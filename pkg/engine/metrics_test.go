@@ -0,0 +1,110 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+)
+
+var _ = Describe("Metrics", func() {
+	It("counts the traffic of each peer, and in total", func() {
+		m := NewCounters()
+		m.Sent("a", 1000, 500)
+		m.Sent("a", 1000, 500)
+		m.Received("a", 300, 300)
+		m.Received("b", 100, 50)
+		m.StreamOpened("a")
+		m.StreamFailed("b")
+		m.Relayed("b")
+
+		s := m.Snapshot()
+		Expect(s.Peers).To(HaveLen(2))
+		Expect(s.Peers["a"]).To(Equal(PeerMetrics{
+			PacketsIn: 1, PacketsOut: 2,
+			BytesIn: 300, BytesOut: 2000,
+			WireBytesIn: 300, WireBytesOut: 1000,
+			StreamsOpened:  1,
+			CompressionIn:  1,
+			CompressionOut: 2,
+		}))
+		Expect(s.Peers["b"]).To(Equal(PeerMetrics{
+			PacketsIn: 1, BytesIn: 100, WireBytesIn: 50,
+			StreamFailures: 1,
+			Relayed:        1,
+			CompressionIn:  2,
+		}))
+		Expect(s.PacketsIn).To(BeEquivalentTo(2))
+		Expect(s.PacketsOut).To(BeEquivalentTo(2))
+		Expect(s.BytesIn).To(BeEquivalentTo(400))
+		Expect(s.BytesOut).To(BeEquivalentTo(2000))
+	})
+
+	It("counts the drops by reason", func() {
+		m := NewCounters()
+		Expect(m.Snapshot().Dropped).To(BeZero())
+		Expect(m.Snapshot().Drops).To(HaveKeyWithValue(DropACL, BeZero()))
+
+		m.Drop(DropACL)
+		m.Drop(DropACL)
+		m.Drop(DropQueueFull)
+
+		s := m.Snapshot()
+		Expect(s.Drops[DropACL]).To(BeEquivalentTo(2))
+		Expect(s.Drops[DropQueueFull]).To(BeEquivalentTo(1))
+		Expect(s.Dropped).To(BeEquivalentTo(3))
+	})
+
+	It("counts the drops for unknown reasons instead of panicking", func() {
+		m := NewCounters()
+		Expect(func() { m.Drop("not a reason") }).ToNot(Panic())
+
+		s := m.Snapshot()
+		Expect(s.Drops).ToNot(HaveKey("not a reason"))
+		Expect(s.Drops[DropUnknown]).To(BeEquivalentTo(1))
+		Expect(s.Dropped).To(BeEquivalentTo(1))
+	})
+
+	It("counts concurrently", func() {
+		m := NewCounters()
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					m.Sent("a", 10, 10)
+					m.Drop(DropNoRoute)
+				}
+			}()
+		}
+		wg.Wait()
+
+		s := m.Snapshot()
+		Expect(s.Peers["a"].PacketsOut).To(BeEquivalentTo(8000))
+		Expect(s.BytesOut).To(BeEquivalentTo(80000))
+		Expect(s.Drops[DropNoRoute]).To(BeEquivalentTo(8000))
+	})
+})
@@ -0,0 +1,306 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"golang.org/x/time/rate"
+)
+
+// Replication modes of the broadcast and multicast packets
+const (
+	// MulticastDisabled drops the broadcast and multicast packets
+	MulticastDisabled = ""
+	// MulticastAll replicates them to all the online peers
+	MulticastAll = "all"
+	// MulticastIGMP replicates the multicast packets only to the peers which
+	// joined the group (with IGMP, or MLD for IPv6). Broadcast, link-local
+	// multicast and membership reports are still sent to all the online peers
+	MulticastIGMP = "igmp"
+)
+
+// DefaultMulticastRate is the default number of broadcast and
+// multicast packets replicated per second
+const DefaultMulticastRate = 100
+
+// membershipTimeout is the time a peer stays member of a group without
+// renewing its report (the IGMP Group Membership Interval)
+const membershipTimeout = 260 * time.Second
+
+const (
+	protocolIGMP   = 2
+	protocolICMPv6 = 58
+)
+
+// IGMP and MLD message types
+const (
+	igmpV1Report  = 0x12
+	igmpV2Report  = 0x16
+	igmpV2Leave   = 0x17
+	igmpV3Report  = 0x22
+	mldV1Report   = 131
+	mldV1Done     = 132
+	mldV2Report   = 143
+	recordInclude = 1
+	recordToIncl  = 3
+	recordBlock   = 6
+)
+
+// ValidateMulticastMode returns an error if mode is not a known replication mode
+func ValidateMulticastMode(mode string) error {
+	switch mode {
+	case MulticastDisabled, MulticastAll, MulticastIGMP:
+		return nil
+	default:
+		return fmt.Errorf("invalid multicast mode '%s'", mode)
+	}
+}
+
+// multicast replicates the broadcast and multicast packets to the peers,
+// tracking the groups they joined
+type multicast struct {
+	sync.Mutex
+	mode      string
+	broadcast net.IP
+	limiter   *rate.Limiter
+	groups    map[ipKey]map[peer.ID]time.Time
+}
+
+// newMulticast creates the replication state for the interface network n.
+// limit is the number of packets replicated per second, 0 for no limit
+func newMulticast(mode string, limit int, n *net.IPNet) *multicast {
+	m := &multicast{
+		mode:   mode,
+		groups: map[ipKey]map[peer.ID]time.Time{},
+	}
+	if n != nil {
+		m.broadcast = broadcastAddress(n)
+	}
+	if limit > 0 {
+		m.limiter = rate.NewLimiter(rate.Limit(limit), limit)
+	}
+	return m
+}
+
+// setNetwork changes the network of the interface, and its broadcast address
+func (m *multicast) setNetwork(n *net.IPNet) {
+	m.Lock()
+	defer m.Unlock()
+	m.broadcast = broadcastAddress(n)
+}
+
+// broadcastAddress returns the directed broadcast address of an IPv4 network
+func broadcastAddress(n *net.IPNet) net.IP {
+	ip := n.IP.To4()
+	if ip == nil || len(n.Mask) != net.IPv4len {
+		return nil
+	}
+	b := make(net.IP, net.IPv4len)
+	for i := range ip {
+		b[i] = ip[i] | ^n.Mask[i]
+	}
+	return b
+}
+
+// replicated returns true if packets to dst have to be replicated to the peers
+func (m *multicast) replicated(dst net.IP) bool {
+	if m.mode == MulticastDisabled {
+		return false
+	}
+	if dst.IsMulticast() || dst.Equal(net.IPv4bcast) {
+		return true
+	}
+	m.Lock()
+	defer m.Unlock()
+	return m.broadcast != nil && dst.Equal(m.broadcast)
+}
+
+// allow returns false if the replication rate limit is exceeded
+func (m *multicast) allow() bool {
+	return m.limiter == nil || m.limiter.Allow()
+}
+
+// flooded returns true if the packet is sent to all the online peers,
+// regardless of the groups they joined, as the IGMP and MLD (ICMPv6) messages
+func (m *multicast) flooded(p *packetInfo) bool {
+	return m.mode != MulticastIGMP ||
+		!p.Dst.IsMulticast() ||
+		p.Dst.IsLinkLocalMulticast() ||
+		p.Protocol == protocolIGMP ||
+		p.Protocol == protocolICMPv6
+}
+
+// targets returns the peers of the table the packet is replicated to,
+// among the online ones
+func (m *multicast) targets(t *RoutingTable, p *packetInfo, online func(peer.ID) bool, now time.Time) []*tableEntry {
+	var members map[peer.ID]time.Time
+	flooded := m.flooded(p)
+	if !flooded {
+		members = m.members(p.Dst, now)
+	}
+
+	res := []*tableEntry{}
+	for id, e := range t.peers {
+		if !flooded {
+			if _, ok := members[id]; !ok {
+				continue
+			}
+		}
+		if online(id) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// members returns a copy of the peers which joined the group, pruning the expired ones
+func (m *multicast) members(group net.IP, now time.Time) map[peer.ID]time.Time {
+	m.Lock()
+	defer m.Unlock()
+
+	k := newIPKey(group)
+	res := map[peer.ID]time.Time{}
+	for id, expires := range m.groups[k] {
+		if now.After(expires) {
+			delete(m.groups[k], id)
+			continue
+		}
+		res[id] = expires
+	}
+	if len(m.groups[k]) == 0 {
+		delete(m.groups, k)
+	}
+	return res
+}
+
+// snoop records the groups joined and left by a peer from its membership reports
+func (m *multicast) snoop(packet []byte, p *packetInfo, from peer.ID, now time.Time) {
+	if m.mode != MulticastIGMP || !p.Dst.IsMulticast() {
+		return
+	}
+	joined, left := parseMembership(packet, p)
+	if len(joined) == 0 && len(left) == 0 {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	for _, g := range joined {
+		k := newIPKey(g)
+		if _, ok := m.groups[k]; !ok {
+			m.groups[k] = map[peer.ID]time.Time{}
+		}
+		m.groups[k][from] = now.Add(membershipTimeout)
+	}
+	for _, g := range left {
+		k := newIPKey(g)
+		delete(m.groups[k], from)
+		if len(m.groups[k]) == 0 {
+			delete(m.groups, k)
+		}
+	}
+}
+
+// parseMembership returns the groups joined and left in an IGMP or MLD report
+func parseMembership(packet []byte, p *packetInfo) (joined, left []net.IP) {
+	switch p.Version {
+	case 4:
+		if p.Protocol != protocolIGMP || len(packet) == 0 {
+			return nil, nil
+		}
+		off := int(packet[0]&0x0f) * 4
+		if off > len(packet) {
+			return nil, nil
+		}
+		return parseIGMP(packet[off:])
+	case 6:
+		// MLD messages are sent with the router alert hop-by-hop option, skipped by parsePacket
+		if p.Protocol != protocolICMPv6 || p.Offset > len(packet) {
+			return nil, nil
+		}
+		return parseMLD(packet[p.Offset:])
+	}
+	return nil, nil
+}
+
+func parseIGMP(b []byte) (joined, left []net.IP) {
+	if len(b) < 8 {
+		return nil, nil
+	}
+	switch b[0] {
+	case igmpV1Report, igmpV2Report:
+		return []net.IP{copyIP(b[4:8])}, nil
+	case igmpV2Leave:
+		return nil, []net.IP{copyIP(b[4:8])}
+	case igmpV3Report:
+		return parseRecords(b[8:], int(binary.BigEndian.Uint16(b[6:8])), net.IPv4len)
+	}
+	return nil, nil
+}
+
+func parseMLD(b []byte) (joined, left []net.IP) {
+	switch {
+	case len(b) >= 8 && b[0] == mldV2Report:
+		return parseRecords(b[8:], int(binary.BigEndian.Uint16(b[6:8])), net.IPv6len)
+	case len(b) < 24:
+		return nil, nil
+	case b[0] == mldV1Report:
+		return []net.IP{copyIP(b[8:24])}, nil
+	case b[0] == mldV1Done:
+		return nil, []net.IP{copyIP(b[8:24])}
+	}
+	return nil, nil
+}
+
+// parseRecords parses the group records of IGMPv3 and MLDv2 reports. Filtering
+// by source is not supported: a group is joined unless no source is included
+func parseRecords(b []byte, n, size int) (joined, left []net.IP) {
+	for i := 0; i < n && len(b) >= 4+size; i++ {
+		typ, aux, sources := b[0], int(b[1]), int(binary.BigEndian.Uint16(b[2:4]))
+		group := copyIP(b[4 : 4+size])
+		switch {
+		case typ == recordBlock:
+		case (typ == recordInclude || typ == recordToIncl) && sources == 0:
+			left = append(left, group)
+		default:
+			joined = append(joined, group)
+		}
+
+		next := 4 + size + sources*size + aux*4
+		if next > len(b) {
+			break
+		}
+		b = b[next:]
+	}
+	return joined, left
+}
+
+func copyIP(b []byte) net.IP {
+	ip := make(net.IP, len(b))
+	copy(ip, b)
+	return ip
+}
@@ -0,0 +1,184 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/ipv4"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+// ipv4Packet returns an IPv4 packet with the given protocol and payload
+func ipv4Packet(src, dst string, proto int, payload []byte) []byte {
+	h := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(payload),
+		TTL:      1,
+		Protocol: proto,
+		Src:      net.ParseIP(src),
+		Dst:      net.ParseIP(dst),
+	}
+	b, err := h.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return append(b, payload...)
+}
+
+func igmpV2(typ byte, group string) []byte {
+	b := make([]byte, 8)
+	b[0] = typ
+	copy(b[4:], net.ParseIP(group).To4())
+	return ipv4Packet("10.1.0.2", group, 2, b)
+}
+
+// mldV2 returns an MLDv2 report, with the router alert hop-by-hop option,
+// changing the mode of the group to exclude (join) or include (leave)
+func mldV2(group string, join bool) []byte {
+	record := make([]byte, 20)
+	record[0] = 3
+	if join {
+		record[0] = 4
+	}
+	copy(record[4:], net.ParseIP(group))
+	icmp := append([]byte{143, 0, 0, 0, 0, 0, 0, 1}, record...)
+	hbh := []byte{58, 0, 5, 2, 0, 0, 1, 0}
+
+	b := make([]byte, 40)
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(hbh)+len(icmp)))
+	b[6], b[7] = 0, 1
+	copy(b[8:24], net.ParseIP("fd00::2"))
+	copy(b[24:40], net.ParseIP("ff02::16"))
+	return append(append(b, hbh...), icmp...)
+}
+
+var _ = Describe("Multicast", func() {
+	self, a, b := newPeerID(), newPeerID(), newPeerID()
+	_, network, _ := net.ParseCIDR("10.1.0.1/24")
+
+	table := NewRoutingTable(blockchain.Block{
+		Storage: map[string]map[string]blockchain.Data{
+			protocol.MachinesLedgerKey: {
+				"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1"}),
+				"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2"}),
+				"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3"}),
+			},
+		},
+	}, self.String())
+
+	udp := func(dst string) []byte {
+		return ipv4Packet("10.1.0.1", dst, 17, []byte{0, 1, 0, 2, 0, 8, 0, 0})
+	}
+
+	It("detects broadcast and multicast destinations", func() {
+		m := NewMulticast(MulticastAll, 0, network)
+		Expect(m.Replicated(net.ParseIP("10.1.0.255"))).To(BeTrue())
+		Expect(m.Replicated(net.ParseIP("255.255.255.255"))).To(BeTrue())
+		Expect(m.Replicated(net.ParseIP("224.0.0.251"))).To(BeTrue())
+		Expect(m.Replicated(net.ParseIP("ff02::fb"))).To(BeTrue())
+		Expect(m.Replicated(net.ParseIP("10.1.0.2"))).To(BeFalse())
+
+		m = NewMulticast(MulticastDisabled, 0, network)
+		Expect(m.Replicated(net.ParseIP("10.1.0.255"))).To(BeFalse())
+		Expect(m.Replicated(net.ParseIP("224.0.0.251"))).To(BeFalse())
+	})
+
+	It("validates the mode", func() {
+		Expect(ValidateMulticastMode("igmp")).ToNot(HaveOccurred())
+		Expect(ValidateMulticastMode("foo")).To(HaveOccurred())
+	})
+
+	It("replicates to all the online peers", func() {
+		m := NewMulticast(MulticastAll, 0, network)
+		targets, err := m.Targets(table, udp("239.255.255.250"), a)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(ConsistOf(a))
+
+		targets, err = m.Targets(table, udp("10.1.0.255"), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(ConsistOf(a, b))
+	})
+
+	It("replicates multicast only to the peers which joined the group", func() {
+		m := NewMulticast(MulticastIGMP, 0, network)
+		Expect(m.Snoop(igmpV2(0x16, "239.255.255.250"), a)).To(Succeed())
+
+		targets, err := m.Targets(table, udp("239.255.255.250"), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(ConsistOf(a))
+
+		// Link-local groups and broadcast are always flooded
+		targets, err = m.Targets(table, udp("224.0.0.251"), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(ConsistOf(a, b))
+
+		// So are the membership reports
+		targets, err = m.Targets(table, igmpV2(0x16, "239.1.1.1"), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(ConsistOf(a, b))
+
+		Expect(m.Snoop(igmpV2(0x17, "239.255.255.250"), a)).To(Succeed())
+		targets, err = m.Targets(table, udp("239.255.255.250"), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(BeEmpty())
+	})
+
+	It("snoops MLDv2 reports", func() {
+		m := NewMulticast(MulticastIGMP, 0, network)
+		packet := func(dst string) []byte {
+			b := make([]byte, 48)
+			b[0] = 6 << 4
+			binary.BigEndian.PutUint16(b[4:6], 8)
+			b[6] = 17
+			copy(b[8:24], net.ParseIP("fd00::1"))
+			copy(b[24:40], net.ParseIP(dst))
+			return b
+		}
+
+		Expect(m.Snoop(mldV2("ff05::c", true), b)).To(Succeed())
+		targets, err := m.Targets(table, packet("ff05::c"), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(Equal([]peer.ID{b}))
+
+		Expect(m.Snoop(mldV2("ff05::c", false), b)).To(Succeed())
+		targets, err = m.Targets(table, packet("ff05::c"), a, b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(targets).To(BeEmpty())
+	})
+
+	It("limits the replication rate", func() {
+		m := NewMulticast(MulticastAll, 2, network)
+		Expect(m.Allow()).To(BeTrue())
+		Expect(m.Allow()).To(BeTrue())
+		Expect(m.Allow()).To(BeFalse())
+	})
+})
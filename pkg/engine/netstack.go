@@ -0,0 +1,199 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// netstackDevice adapts the userspace network stack to the
+// packet interface used by the engine
+type netstackDevice struct {
+	tun.Device
+
+	// The stack can't be written once closed, streams
+	// might still be delivering packets to it
+	sync.RWMutex
+	closed bool
+}
+
+func (d *netstackDevice) Read(b []byte) (int, error) {
+	return d.Device.Read(b, 0)
+}
+
+func (d *netstackDevice) Write(b []byte) (int, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if d.closed {
+		return 0, os.ErrClosed
+	}
+	return d.Device.Write(b, 0)
+}
+
+func (d *netstackDevice) Close() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	return d.Device.Close()
+}
+
+// createNetstack creates an userspace TCP/IP stack bound to the VPN addresses. It
+// needs no TUN device nor privileges, and the VPN is reachable only in-process
+// (see Controller.DialContext and Controller.Listen) or via the optional HTTP proxy.
+func createNetstack(c *Config, ips ...net.IP) (*netstackDevice, *netstack.Net, error) {
+	addrs := []netip.Addr{}
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		if v4 := ip.To4(); v4 != nil {
+			ip = v4
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid address '%s'", ip.String())
+		}
+		addrs = append(addrs, addr)
+	}
+
+	mtu := c.InterfaceMTU
+	if mtu == 0 {
+		mtu = c.MTU
+	}
+
+	dev, tnet, err := netstack.CreateNetTUN(addrs, nil, mtu)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &netstackDevice{Device: dev}, tnet, nil
+}
+
+// proxyHandler is an HTTP proxy which dials the destinations through the userspace network stack.
+// It supports both plain HTTP requests and tunneling with the CONNECT method.
+type proxyHandler struct {
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	transport *http.Transport
+}
+
+func newProxyHandler(dial func(ctx context.Context, network, address string) (net.Conn, error)) *proxyHandler {
+	return &proxyHandler{
+		dial:      dial,
+		transport: &http.Transport{DialContext: dial},
+	}
+}
+
+func (p *proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+
+	if r.URL.Host == "" {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+
+	outreq := r.Clone(r.Context())
+	outreq.RequestURI = ""
+	outreq.Header.Del("Proxy-Connection")
+	outreq.Header.Del("Proxy-Authorization")
+
+	resp, err := p.transport.RoundTrip(outreq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		for _, s := range v {
+			w.Header().Add(k, s)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *proxyHandler) tunnel(w http.ResponseWriter, r *http.Request) {
+	dst, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		dst.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	src, _, err := hj.Hijack()
+	if err != nil {
+		dst.Close()
+		return
+	}
+
+	go func() {
+		defer dst.Close()
+		defer src.Close()
+		io.Copy(dst, src)
+	}()
+	go func() {
+		defer dst.Close()
+		defer src.Close()
+		io.Copy(src, dst)
+	}()
+}
+
+// serveProxy serves the HTTP proxy on the listen address until the context is cancelled
+func serveProxy(ctx context.Context, c *Config, listen string) {
+	srv := &http.Server{Addr: listen, Handler: newProxyHandler(c.Controller.DialContext)}
+
+	go func() {
+		<-ctx.Done()
+		ct, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		srv.Shutdown(ct)
+		cancel()
+	}()
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			c.Logger.Errorf("userspace proxy: %s", err.Error())
+		}
+	}()
+}
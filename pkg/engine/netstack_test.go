@@ -0,0 +1,257 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/logger"
+	node "github.com/bhojpur/vpn/pkg/node"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+var _ = Describe("Userspace mode", func() {
+	token := node.GenerateNewConnectionData().Base64()
+
+	logg := logger.New(log.LevelFatal)
+	l := node.Logger(logg)
+
+	start := func(ctx context.Context, address string, extra ...Option) (*node.Node, *Controller) {
+		ctrl := NewController()
+		vpnOpts, err := Register(append([]Option{
+			WithUserspace(true),
+			WithInterfaceAddress(address),
+			WithInterfaceMTU(1200),
+			WithPacketMTU(1420),
+			WithController(ctrl),
+			WithCompression(CompressionZstd),
+			Logger(logg),
+		}, extra...)...)
+		Expect(err).ToNot(HaveOccurred())
+
+		opts := append(vpnOpts,
+			node.FromBase64(true, true, token),
+			node.WithDiscoveryInterval(10*time.Second),
+			node.WithStore(&blockchain.MemoryStore{}),
+			l)
+		e, err := node.New(opts...)
+		Expect(err).ToNot(HaveOccurred())
+
+		// The VPN service blocks until the context is done
+		go e.Start(ctx)
+
+		ip, _, _ := net.ParseCIDR(address)
+		Eventually(func() error {
+			l, err := ctrl.Listen(net.JoinHostPort(ip.String(), "0"))
+			if err == nil {
+				l.Close()
+			}
+			return err
+		}, 30*time.Second, 1*time.Second).ShouldNot(HaveOccurred())
+
+		return e, ctrl
+	}
+
+	Context("Data plane", func() {
+		It("connects nodes without a TUN device", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, server := start(ctx, "10.1.0.1/24")
+
+			// The first node announces its machine before the second one joins
+			ll, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() bool {
+				_, found := ll.GetKey(protocol.MachinesLedgerKey, "10.1.0.1")
+				return found
+			}, 30*time.Second, 1*time.Second).Should(BeTrue())
+
+			e2, client := start(ctx, "10.1.0.2/24")
+			client.StartCapture(100)
+			Expect(e2.Host().Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()})).ToNot(HaveOccurred())
+
+			listener, err := server.Listen("10.1.0.1:8080")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Write([]byte("hello"))
+					conn.Close()
+				}
+			}()
+
+			Eventually(func() string {
+				ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				defer cancel()
+				conn, err := client.DialContext(ctx, "tcp", "10.1.0.1:8080")
+				if err != nil {
+					return ""
+				}
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				b, _ := ioutil.ReadAll(conn)
+				return string(b)
+			}, 120*time.Second, 1*time.Second).Should(Equal("hello"))
+
+			m, found := client.PeerMetrics(e.Host().ID().String())
+			Expect(found).To(BeTrue())
+			Expect(m.PacketsOut).ToNot(BeZero())
+			Expect(m.PacketsIn).ToNot(BeZero())
+			Expect(m.StreamsOpened).ToNot(BeZero())
+			Expect(m.WireBytesOut).ToNot(BeZero())
+			Expect(server.Metrics().PacketsIn).ToNot(BeZero())
+
+			f, err := ParseCaptureFilter("host 10.1.0.1 and tcp and port 8080")
+			Expect(err).ToNot(HaveOccurred())
+			b := &bytes.Buffer{}
+			Expect(client.WriteCapture(b, f)).ToNot(HaveOccurred())
+			r, err := pcapgo.NewNgReader(b, pcapgo.DefaultNgReaderOptions)
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = r.ReadPacketData()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("fragments the packets allowed by a port ACL", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// The packets above the MTU of the server are fragmented, only the
+			// first fragment carrying the port allowed
+			e, server := start(ctx, "10.1.0.5/24", WithInterfaceMTU(600))
+			ll, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			ll.Add(protocol.ACLLedgerKey, map[string]interface{}{
+				"dns":  types.ACLRule{ID: "dns", Priority: 10, Action: types.ACLAllow, Destination: "10.1.0.5", Protocol: "udp", Ports: "9000"},
+				"deny": types.ACLRule{ID: "deny", Priority: 20, Action: types.ACLDeny},
+			})
+			Eventually(func() bool {
+				_, found := ll.GetKey(protocol.MachinesLedgerKey, "10.1.0.5")
+				return found
+			}, 30*time.Second, 1*time.Second).Should(BeTrue())
+
+			e2, client := start(ctx, "10.1.0.6/24")
+			Expect(e2.Host().Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()})).ToNot(HaveOccurred())
+
+			conn, err := server.ListenPacket("10.1.0.5:9000")
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			Eventually(func() int {
+				ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				defer cancel()
+				c, err := client.DialContext(ctx, "udp", "10.1.0.5:9000")
+				if err != nil {
+					return 0
+				}
+				defer c.Close()
+				if _, err := c.Write(make([]byte, 1000)); err != nil {
+					return 0
+				}
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				b := make([]byte, 2000)
+				n, _, _ := conn.ReadFrom(b)
+				return n
+			}, 120*time.Second, 1*time.Second).Should(Equal(1000))
+			Expect(server.Metrics().Drops[DropACL]).To(BeZero())
+
+			// The other ports are denied
+			c, err := client.DialContext(ctx, "udp", "10.1.0.5:9001")
+			Expect(err).ToNot(HaveOccurred())
+			defer c.Close()
+			Eventually(func() uint64 {
+				c.Write([]byte("denied"))
+				return client.Metrics().Drops[DropACL] + server.Metrics().Drops[DropACL]
+			}, 30*time.Second, 1*time.Second).ShouldNot(BeZero())
+		})
+	})
+
+	Context("Reconfiguration", func() {
+		It("requires the engine to run", func() {
+			Expect(NewController().Reconfigure(InterfaceConfig{Address: "10.1.0.3/24", MTU: 1200})).To(MatchError(ErrNotRunning))
+		})
+
+		It("changes the advertised routes at runtime", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, ctrl := start(ctx, "10.1.0.3/24")
+			ll, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+
+			cfg := ctrl.Interface()
+			Expect(cfg.Address).To(Equal("10.1.0.3/24"))
+			Expect(cfg.Address6).ToNot(BeEmpty())
+			Expect(cfg.MTU).To(Equal(1200))
+			Expect(cfg.Routes).To(BeEmpty())
+
+			// The netstack addresses are fixed
+			changed := cfg
+			changed.Address = "10.1.0.4/24"
+			Expect(ctrl.Reconfigure(changed)).ToNot(Succeed())
+			changed = cfg
+			changed.Routes = []string{"invalid"}
+			Expect(ctrl.Reconfigure(changed)).ToNot(Succeed())
+
+			cfg.Routes = []string{"192.168.1.1/24"}
+			Expect(ctrl.Reconfigure(cfg)).To(Succeed())
+			Expect(ctrl.Interface().Routes).To(Equal([]string{"192.168.1.1/24"}))
+			Eventually(func() string {
+				route := &types.Route{}
+				v, _ := ll.GetKey(protocol.RoutesLedgerKey, "192.168.1.0/24")
+				v.Unmarshal(route)
+				return route.PeerID
+			}, 30*time.Second, 1*time.Second).Should(Equal(e.Host().ID().String()))
+
+			// The advertisements expire once the node stops renewing them
+			for bucket, key := range map[string]string{protocol.MachinesLedgerKey: "10.1.0.3", protocol.RoutesLedgerKey: "192.168.1.0/24"} {
+				ttl, found := ll.TTL(bucket, key)
+				Expect(found).To(BeTrue())
+				Expect(ttl).To(BeNumerically(">", 0), bucket)
+			}
+
+			cfg.Routes = nil
+			Expect(ctrl.Reconfigure(cfg)).To(Succeed())
+			Eventually(func() bool {
+				_, found := ll.GetKey(protocol.RoutesLedgerKey, "192.168.1.0/24")
+				return found
+			}, 30*time.Second, 1*time.Second).Should(BeFalse())
+		})
+	})
+})
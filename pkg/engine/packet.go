@@ -0,0 +1,156 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// IANA protocol numbers carrying ports
+const (
+	protocolTCP  = 6
+	protocolUDP  = 17
+	protocolSCTP = 132
+)
+
+// IPv6 extension headers, before the transport header
+const (
+	protocolHopByHop = 0
+	protocolRouting  = 43
+	protocolFragment = 44
+	protocolDestOpts = 60
+)
+
+// packetInfo holds the addressing details of an IP packet
+// read from (or written to) the interface
+type packetInfo struct {
+	Version  int
+	Src, Dst net.IP
+
+	// Protocol is the transport protocol, after the IPv6 extension headers,
+	// and Offset the offset of its header. SrcPort and DstPort are set only
+	// for protocols carrying ports (TCP, UDP, SCTP)
+	Protocol         int
+	Offset           int
+	SrcPort, DstPort uint16
+
+	// Fragment is set for the fragments of a packet, only the first of them
+	// carrying the ports. FragmentID identifies the fragments of a packet,
+	// and FragmentOffset is 0 for its first one
+	Fragment       bool
+	FragmentID     uint32
+	FragmentOffset int
+}
+
+// parsePacket parses the IP header of a frame, regardless of its address family
+func parsePacket(frame []byte) (*packetInfo, error) {
+	if len(frame) == 0 {
+		return nil, errors.New("empty frame")
+	}
+
+	switch v := int(frame[0] >> 4); v {
+	case ipv4.Version:
+		header, err := ipv4.ParseHeader(frame)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse ipv4 header from frame")
+		}
+		p := &packetInfo{Version: v, Src: header.Src, Dst: header.Dst, Protocol: header.Protocol, Offset: header.Len}
+		p.Fragment = header.FragOff != 0 || header.Flags&ipv4.MoreFragments != 0
+		if p.Fragment {
+			p.FragmentID, p.FragmentOffset = uint32(header.ID), header.FragOff
+		}
+		// Only the first fragment carries the transport header
+		if header.FragOff == 0 && header.Len <= len(frame) {
+			p.parsePorts(frame[header.Len:])
+		}
+		return p, nil
+	case ipv6.Version:
+		header, err := ipv6.ParseHeader(frame)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse ipv6 header from frame")
+		}
+		p := &packetInfo{Version: v, Src: header.Src, Dst: header.Dst}
+		p.parseExtensions(frame, header.NextHeader)
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unsupported ip version %d", v)
+	}
+}
+
+// parseExtensions walks the IPv6 extension headers from the next header after the
+// fixed one, up to the transport header. The chain truncated ends at its last header
+func (p *packetInfo) parseExtensions(frame []byte, next int) {
+	off := ipv6.HeaderLen
+	for {
+		if next == protocolFragment && off+8 <= len(frame) {
+			p.Fragment = true
+			p.FragmentID = binary.BigEndian.Uint32(frame[off+4 : off+8])
+			p.FragmentOffset = int(binary.BigEndian.Uint16(frame[off+2:off+4]) >> 3)
+			next, off = int(frame[off]), off+8
+		} else if (next == protocolHopByHop || next == protocolRouting || next == protocolDestOpts) && off+2 <= len(frame) {
+			next, off = int(frame[off]), off+(int(frame[off+1])+1)*8
+		} else {
+			break
+		}
+	}
+	p.Protocol, p.Offset = next, off
+
+	// Only the first fragment carries the transport header
+	if p.FragmentOffset == 0 && off <= len(frame) {
+		p.parsePorts(frame[off:])
+	}
+}
+
+func (p *packetInfo) parsePorts(payload []byte) {
+	switch p.Protocol {
+	case protocolTCP, protocolUDP, protocolSCTP:
+		if len(payload) >= 4 {
+			p.SrcPort = binary.BigEndian.Uint16(payload[0:2])
+			p.DstPort = binary.BigEndian.Uint16(payload[2:4])
+		}
+	}
+}
+
+// FlowHash returns a hash of the packet 5-tuple. Packets of the same flow
+// share the same hash. The ports of the fragments are left out, so all the
+// fragments of a packet share the hash of its addresses and protocol
+func (p *packetInfo) FlowHash() uint32 {
+	h := fnv.New32a()
+	h.Write(p.Src)
+	h.Write(p.Dst)
+
+	var b [5]byte
+	b[0] = byte(p.Protocol)
+	if !p.Fragment {
+		binary.BigEndian.PutUint16(b[1:3], p.SrcPort)
+		binary.BigEndian.PutUint16(b[3:5], p.DstPort)
+	}
+	h.Write(b[:])
+
+	return h.Sum32()
+}
@@ -0,0 +1,227 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP = 1
+
+	// minIPv6MTU is the minimum MTU of IPv6 links, bounding
+	// the size of the ICMPv6 errors
+	minIPv6MTU = 1280
+
+	flagDontFragment = 0x4000
+	flagMoreFragment = 0x2000
+	fragOffsetMask   = 0x1fff
+)
+
+// localMTU returns the MTU of the VPN interface
+func localMTU(c *Config) int {
+	return c.Controller.localInterface().config.MTU
+}
+
+// pathMTU returns the largest packet which can be sent to the peer e, through
+// the relay via if set: the smallest of the MTUs of the interfaces involved.
+// The peers announcing no MTU are assumed to share ours
+func pathMTU(local int, e, via *tableEntry) int {
+	mtu := local
+	for _, p := range []*tableEntry{e, via} {
+		if p != nil && p.mtu > 0 && p.mtu < mtu {
+			mtu = p.mtu
+		}
+	}
+	return mtu
+}
+
+// fitPacket returns the packets to send for a packet exceeding the path MTU.
+// IPv4 packets which can be fragmented are, for the others an ICMP "fragmentation
+// needed" (or ICMPv6 "packet too big") error is written back to the interface so
+// that the host lowers its path MTU
+func fitPacket(packet []byte, header *packetInfo, mtu int, ifce io.Writer) ([][]byte, error) {
+	if header.Version == ipv4.Version && binary.BigEndian.Uint16(packet[6:8])&flagDontFragment == 0 {
+		return fragmentIPv4(packet, mtu)
+	}
+
+	if isICMPError(packet, header) {
+		return nil, fmt.Errorf("dropping ICMP error of %d bytes above the path MTU %d", len(packet), mtu)
+	}
+
+	var reply []byte
+	if header.Version == ipv4.Version {
+		reply = icmpFragmentationNeeded(packet, header, mtu)
+	} else {
+		reply = icmpPacketTooBig(packet, header, mtu)
+	}
+	if _, err := ifce.Write(reply); err != nil {
+		return nil, fmt.Errorf("could not write ICMP error to the interface: %w", err)
+	}
+	return nil, fmt.Errorf("packet of %d bytes to %s above the path MTU %d", len(packet), header.Dst.String(), mtu)
+}
+
+// isICMPError returns true if the packet is an ICMP error, which never trigger other errors
+func isICMPError(packet []byte, header *packetInfo) bool {
+	switch {
+	case header.Version == ipv4.Version && header.Protocol == protocolICMP:
+		off := int(packet[0]&0x0f) * 4
+		if off >= len(packet) {
+			return false
+		}
+		switch packet[off] {
+		case 3, 4, 5, 11, 12:
+			return true
+		}
+	case header.Version == ipv6.Version && header.Protocol == protocolICMPv6:
+		return len(packet) > header.Offset && packet[header.Offset] < 128
+	}
+	return false
+}
+
+// fragmentIPv4 splits an IPv4 packet in fragments of at most mtu bytes. The
+// options of the header are copied to every fragment
+func fragmentIPv4(packet []byte, mtu int) ([][]byte, error) {
+	ihl := int(packet[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(packet[2:4]))
+	if total > len(packet) || total < ihl {
+		return nil, fmt.Errorf("invalid ipv4 packet length %d", total)
+	}
+
+	payload := packet[ihl:total]
+	size := (mtu - ihl) &^ 7
+	if size <= 0 {
+		return nil, fmt.Errorf("path MTU %d too small", mtu)
+	}
+
+	flags := binary.BigEndian.Uint16(packet[6:8])
+	offset := int(flags & fragOffsetMask)
+
+	fragments := [][]byte{}
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		f := make([]byte, ihl+end-off)
+		copy(f, packet[:ihl])
+		copy(f[ihl:], payload[off:end])
+		binary.BigEndian.PutUint16(f[2:4], uint16(len(f)))
+
+		fo := uint16(offset + off/8)
+		if end < len(payload) || flags&flagMoreFragment != 0 {
+			fo |= flagMoreFragment
+		}
+		binary.BigEndian.PutUint16(f[6:8], fo)
+		binary.BigEndian.PutUint16(f[10:12], 0)
+		binary.BigEndian.PutUint16(f[10:12], checksum(f[:ihl], 0))
+
+		fragments = append(fragments, f)
+	}
+	return fragments, nil
+}
+
+// icmpFragmentationNeeded returns the ICMP "fragmentation needed" error for
+// packet. It is sent on behalf of the destination of the packet
+func icmpFragmentationNeeded(packet []byte, header *packetInfo, mtu int) []byte {
+	quote := int(packet[0]&0x0f)*4 + 8
+	if quote > len(packet) {
+		quote = len(packet)
+	}
+
+	icmp := make([]byte, 8+quote)
+	icmp[0], icmp[1] = 3, 4
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(mtu))
+	copy(icmp[8:], packet[:quote])
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+
+	reply := make([]byte, ipv4.HeaderLen+len(icmp))
+	reply[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(reply[2:4], uint16(len(reply)))
+	reply[8] = 64
+	reply[9] = protocolICMP
+	copy(reply[12:16], header.Dst.To4())
+	copy(reply[16:20], header.Src.To4())
+	binary.BigEndian.PutUint16(reply[10:12], checksum(reply[:ipv4.HeaderLen], 0))
+	copy(reply[ipv4.HeaderLen:], icmp)
+
+	return reply
+}
+
+// icmpPacketTooBig returns the ICMPv6 "packet too big" error for packet.
+// It is sent on behalf of the destination of the packet
+func icmpPacketTooBig(packet []byte, header *packetInfo, mtu int) []byte {
+	quote := minIPv6MTU - ipv6.HeaderLen - 8
+	if quote > len(packet) {
+		quote = len(packet)
+	}
+
+	icmp := make([]byte, 8+quote)
+	icmp[0] = 2
+	binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+	copy(icmp[8:], packet[:quote])
+
+	src, dst := header.Dst.To16(), header.Src.To16()
+	pseudo := make([]byte, 0, 2*net.IPv6len+8)
+	pseudo = append(pseudo, src...)
+	pseudo = append(pseudo, dst...)
+	pseudo = append(pseudo, 0, 0, byte(len(icmp)>>8), byte(len(icmp)), 0, 0, 0, protocolICMPv6)
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, sum(pseudo)))
+
+	reply := make([]byte, ipv6.HeaderLen+len(icmp))
+	reply[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(reply[4:6], uint16(len(icmp)))
+	reply[6] = protocolICMPv6
+	reply[7] = 64
+	copy(reply[8:24], src)
+	copy(reply[24:40], dst)
+	copy(reply[ipv6.HeaderLen:], icmp)
+
+	return reply
+}
+
+// sum returns the ones' complement sum of b, as 16 bits words
+func sum(b []byte) uint32 {
+	var s uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b, starting from the partial sum initial
+func checksum(b []byte, initial uint32) uint16 {
+	s := initial + sum(b)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
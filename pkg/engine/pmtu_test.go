@@ -0,0 +1,152 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/ipv4"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+// dontFragment sets the DF flag of an IPv4 packet
+func dontFragment(packet []byte) []byte {
+	binary.BigEndian.PutUint16(packet[6:8], 0x4000)
+	binary.BigEndian.PutUint16(packet[10:12], 0)
+	binary.BigEndian.PutUint16(packet[10:12], Checksum(packet[:ipv4.HeaderLen]))
+	return packet
+}
+
+// ipv6Packet returns an IPv6 UDP packet with a payload of size bytes
+func ipv6Packet(src, dst string, size int) []byte {
+	b := make([]byte, 40+size)
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(size))
+	b[6], b[7] = 17, 64
+	copy(b[8:24], net.ParseIP(src))
+	copy(b[24:40], net.ParseIP(dst))
+	return b
+}
+
+var _ = Describe("Path MTU", func() {
+	self, a, b := newPeerID(), newPeerID(), newPeerID()
+
+	It("takes the smallest MTU of the path", func() {
+		table := NewRoutingTable(blockchain.Block{
+			Storage: map[string]map[string]blockchain.Data{
+				protocol.MachinesLedgerKey: {
+					"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1", MTU: 1420}),
+					"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2", MTU: 1380}),
+					"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3"}),
+				},
+			},
+		}, self.String())
+
+		Expect(table.PathMTU(1420, a, "")).To(Equal(1380))
+		Expect(table.PathMTU(1420, b, "")).To(Equal(1420))
+		Expect(table.PathMTU(1420, b, a)).To(Equal(1380))
+		Expect(table.PathMTU(1300, a, "")).To(Equal(1300))
+	})
+
+	It("fragments the IPv4 packets which can be", func() {
+		payload := make([]byte, 1000)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		packet := ipv4Packet("10.1.0.1", "10.1.0.2", 17, payload)
+
+		fragments, reply, err := FitPacket(packet, 500)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reply).To(BeEmpty())
+		Expect(fragments).To(HaveLen(3))
+
+		reassembled := []byte{}
+		for i, f := range fragments {
+			Expect(len(f)).To(BeNumerically("<=", 500))
+			Expect(int(binary.BigEndian.Uint16(f[2:4]))).To(Equal(len(f)))
+			Expect(Checksum(f[:ipv4.HeaderLen])).To(BeZero())
+
+			flags := binary.BigEndian.Uint16(f[6:8])
+			Expect(int(flags&0x1fff) * 8).To(Equal(len(reassembled)))
+			Expect(flags&0x2000 != 0).To(Equal(i < len(fragments)-1))
+			reassembled = append(reassembled, f[ipv4.HeaderLen:]...)
+		}
+		Expect(reassembled).To(Equal(payload))
+	})
+
+	It("replies fragmentation needed to IPv4 packets with DF set", func() {
+		packet := dontFragment(ipv4Packet("10.1.0.1", "10.1.0.2", 17, make([]byte, 1000)))
+
+		fragments, reply, err := FitPacket(packet, 500)
+		Expect(err).To(HaveOccurred())
+		Expect(fragments).To(BeEmpty())
+
+		Expect(reply).To(HaveLen(ipv4.HeaderLen + 8 + ipv4.HeaderLen + 8))
+		Expect(Checksum(reply[:ipv4.HeaderLen])).To(BeZero())
+		Expect(reply[9]).To(Equal(byte(1)))
+		Expect(net.IP(reply[12:16]).String()).To(Equal("10.1.0.2"))
+		Expect(net.IP(reply[16:20]).String()).To(Equal("10.1.0.1"))
+
+		icmp := reply[ipv4.HeaderLen:]
+		Expect(icmp[0]).To(Equal(byte(3)))
+		Expect(icmp[1]).To(Equal(byte(4)))
+		Expect(binary.BigEndian.Uint16(icmp[6:8])).To(Equal(uint16(500)))
+		Expect(Checksum(icmp)).To(BeZero())
+		Expect(icmp[8:]).To(Equal(packet[:ipv4.HeaderLen+8]))
+	})
+
+	It("replies packet too big to IPv6 packets", func() {
+		packet := ipv6Packet("fd00::1", "fd00::2", 2000)
+
+		_, reply, err := FitPacket(packet, 1400)
+		Expect(err).To(HaveOccurred())
+
+		Expect(len(reply)).To(Equal(1280))
+		Expect(reply[6]).To(Equal(byte(58)))
+		Expect(net.IP(reply[8:24]).String()).To(Equal("fd00::2"))
+		Expect(net.IP(reply[24:40]).String()).To(Equal("fd00::1"))
+
+		icmp := reply[40:]
+		Expect(icmp[0]).To(Equal(byte(2)))
+		Expect(binary.BigEndian.Uint32(icmp[4:8])).To(Equal(uint32(1400)))
+		Expect(icmp[8:]).To(Equal(packet[:len(icmp)-8]))
+
+		pseudo := append(append([]byte{}, reply[8:40]...), 0, 0, byte(len(icmp)>>8), byte(len(icmp)), 0, 0, 0, 58)
+		Expect(Checksum(append(pseudo, icmp...))).To(BeZero())
+	})
+
+	It("never replies to ICMP errors", func() {
+		icmp := make([]byte, 1000)
+		icmp[0] = 3
+		packet := dontFragment(ipv4Packet("10.1.0.1", "10.1.0.2", 1, icmp))
+
+		_, reply, err := FitPacket(packet, 500)
+		Expect(err).To(HaveOccurred())
+		Expect(reply).To(BeEmpty())
+	})
+})
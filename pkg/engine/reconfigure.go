@@ -0,0 +1,135 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+	"github.com/bhojpur/vpn/pkg/utils"
+)
+
+// withdrawTimeout is the time the addresses and routes removed from the
+// interface keep being deleted from the ledger
+const withdrawTimeout = time.Minute
+
+// ErrNotRunning is returned when reconfiguring an engine which is not running
+var ErrNotRunning = errors.New("engine not running")
+
+// InterfaceConfig is the configuration of the VPN interface, which can be
+// changed while the engine runs
+type InterfaceConfig struct {
+	// Address and Address6 are the IPv4 and IPv6 addresses of the interface (CIDR).
+	// If Address6 is empty, an ULA is derived from Address unless IPv6 is disabled
+	Address  string
+	Address6 string `json:",omitempty"`
+	MTU      int
+	// Routes are the networks (CIDR) reachable through this node
+	// which are advertised to the other peers
+	Routes []string
+}
+
+// interfaceState is a parsed InterfaceConfig, replaced as a whole on reconfiguration
+type interfaceState struct {
+	config  InterfaceConfig
+	ip, ip6 net.IP
+	network *net.IPNet
+	routes  []string
+}
+
+// newInterfaceState parses the configuration of the interface. room is the
+// network the IPv6 address is derived from
+func newInterfaceState(cfg InterfaceConfig, disableIPv6 bool, room string) (*interfaceState, error) {
+	ip, network, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MTU <= 0 || cfg.MTU > maxFrameSize {
+		return nil, fmt.Errorf("invalid mtu %d", cfg.MTU)
+	}
+	s := &interfaceState{ip: ip, network: network, routes: []string{}}
+
+	for _, r := range cfg.Routes {
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route '%s': %w", r, err)
+		}
+		s.routes = append(s.routes, n.String())
+	}
+
+	if disableIPv6 {
+		cfg.Address6 = ""
+	} else {
+		if cfg.Address6 == "" {
+			cfg.Address6 = utils.ULA(room, ip)
+		}
+		if s.ip6, _, err = net.ParseCIDR(cfg.Address6); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.Routes = append([]string{}, cfg.Routes...)
+	s.config = cfg
+	return s, nil
+}
+
+// local returns true if ip is one of the addresses of the interface
+func (s *interfaceState) local(ip net.IP) bool {
+	return ip.Equal(s.ip) || (s.ip6 != nil && ip.Equal(s.ip6))
+}
+
+// addressChanged returns true if the addresses or the MTU of the interface differ
+func (s *interfaceState) addressChanged(o *interfaceState) bool {
+	return s.config.Address != o.config.Address || s.config.Address6 != o.config.Address6 || s.config.MTU != o.config.MTU
+}
+
+// withdraw keeps deleting from the ledger the address and the routes of
+// old which are not announced anymore
+func withdraw(ctx context.Context, b *blockchain.Ledger, c *Config, self string, old, new *interfaceState) {
+	if !old.ip.Equal(new.ip) {
+		machine := &types.Machine{}
+		existing, found := b.GetKey(protocol.MachinesLedgerKey, old.ip.String())
+		if found && existing.Unmarshal(machine) == nil && machine.PeerID == self {
+			b.AnnounceDeleteBucketKey(ctx, c.LedgerAnnounceTime, withdrawTimeout, protocol.MachinesLedgerKey, old.ip.String())
+		}
+	}
+
+	current := map[string]bool{}
+	for _, r := range new.routes {
+		current[r] = true
+	}
+	for _, r := range old.routes {
+		if current[r] {
+			continue
+		}
+		route := &types.Route{}
+		existing, found := b.GetKey(protocol.RoutesLedgerKey, r)
+		if found && existing.Unmarshal(route) == nil && route.PeerID == self {
+			b.AnnounceDeleteBucketKey(ctx, c.LedgerAnnounceTime, withdrawTimeout, protocol.RoutesLedgerKey, r)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/songgao/packets/ethernet"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/node"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+// relayPathTimeout is the time a peer is reached through a relay,
+// before trying again to open a stream to it directly
+const relayPathTimeout = time.Minute
+
+// Path is the way the packets are sent to a peer: directly,
+// or forwarded by the Relay peer
+type Path struct {
+	Peer  string
+	Relay string `json:",omitempty"`
+	MTU   int
+	Since time.Time
+}
+
+type pathEntry struct {
+	relay   peer.ID
+	mtu     int
+	since   time.Time
+	expires time.Time
+}
+
+// paths tracks the path used to reach each peer
+type paths struct {
+	sync.RWMutex
+	peers map[peer.ID]*pathEntry
+}
+
+func newPaths() *paths {
+	return &paths{peers: map[peer.ID]*pathEntry{}}
+}
+
+// relay returns the relay to reach id through, if any
+func (p *paths) relay(id peer.ID, now time.Time) (peer.ID, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	e, ok := p.peers[id]
+	if !ok || e.relay == "" || now.After(e.expires) {
+		return "", false
+	}
+	return e.relay, true
+}
+
+// direct records that id is reached directly, with the given path MTU
+func (p *paths) direct(id peer.ID, mtu int, now time.Time) {
+	p.RLock()
+	e, ok := p.peers[id]
+	p.RUnlock()
+	if ok && e.relay == "" && e.mtu == mtu {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if ok && e.relay == "" {
+		now = e.since
+	}
+	p.peers[id] = &pathEntry{mtu: mtu, since: now}
+}
+
+// relayed records that id is reached through the relay via, with the given path MTU
+func (p *paths) relayed(id, via peer.ID, mtu int, now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.peers[id]
+	if !ok || e.relay != via {
+		e = &pathEntry{relay: via, since: now}
+		p.peers[id] = e
+	}
+	e.mtu = mtu
+	e.expires = now.Add(relayPathTimeout)
+}
+
+func (p *paths) list() []Path {
+	p.RLock()
+	defer p.RUnlock()
+	res := []Path{}
+	for id, e := range p.peers {
+		path := Path{Peer: id.String(), MTU: e.mtu, Since: e.since}
+		if e.relay != "" {
+			path.Relay = e.relay.String()
+		}
+		res = append(res, path)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Peer < res[j].Peer })
+	return res
+}
+
+// writeForward returns a function writing a relayed frame to a stream, failing
+// if the peer does not speak the framed protocol. The size of the frame payload
+// on the wire is stored in wire
+func writeForward(payload []byte, wire *int) func(s network.Stream) error {
+	return func(s network.Stream) (err error) {
+		if !isFramed(s) {
+			return fmt.Errorf("%s does not support relaying", s.Conn().RemotePeer().String())
+		}
+		*wire, err = writeFrame(s, flagForward, payload)
+		return err
+	}
+}
+
+// relayFrame sends a frame to dst, forwarded by the relay via. It
+// returns the size of the frame on the wire
+func relayFrame(ctx context.Context, mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, via, dst *tableEntry) (int, error) {
+	fwd, err := encodeForward(n.Host().ID(), dst.id, frame)
+	if err != nil {
+		return 0, err
+	}
+	var wire int
+	err = writeStream(ctx, mgr, c, n, via, writeForward(fwd, &wire))
+	return wire, err
+}
+
+// forwardFrame relays to its destination a frame received from the peer src.
+// Frames are forwarded only to the peers we are connected to, and never
+// relayed again
+func forwardFrame(mgr streamManager, c *Config, n *node.Node, table *RoutingTable, src peer.ID, fh *forwardHeader, packet []byte) error {
+	if c.disableRelay {
+		return fmt.Errorf("relaying is disabled")
+	}
+	if fh.Src != src {
+		return fmt.Errorf("%s can not relay the frames of %s", src.String(), fh.Src.String())
+	}
+	dst, ok := table.peers[fh.Dst]
+	if !ok {
+		return fmt.Errorf("'%s' not found in the routing table", fh.Dst.String())
+	}
+	if n.Host().Network().Connectedness(fh.Dst) != network.Connected {
+		return fmt.Errorf("not connected to %s", fh.Dst.String())
+	}
+	// Ethernet frames carry a packet up to the MTU
+	mtu := dst.mtu
+	if dst.mac != nil {
+		mtu += maxEthernetHeader
+	}
+	if dst.mtu > 0 && len(packet) > mtu {
+		return fmt.Errorf("packet of %d bytes above the MTU %d of %s", len(packet), mtu, fh.Dst.String())
+	}
+
+	fwd, err := encodeForward(fh.Src, fh.Dst, packet)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	var wire int
+	if err := writeStream(ctx, mgr, c, n, dst, writeForward(fwd, &wire)); err != nil {
+		return err
+	}
+	c.Controller.metrics.relayed(src.String())
+	return nil
+}
+
+// forwardedSource returns the source of a frame forwarded to us by the peer via. The
+// source is trusted only if both announce in the ledger to be connected to each other,
+// otherwise any member could send frames on behalf of another peer
+func forwardedSource(table *RoutingTable, via peer.ID, fh *forwardHeader) (peer.ID, error) {
+	if !table.HasPeer(fh.Src) {
+		return "", fmt.Errorf("frame relayed by %s from unknown peer %s", via.String(), fh.Src.String())
+	}
+	for _, r := range table.relays[fh.Src] {
+		if r.id == via {
+			return fh.Src, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not a relay of %s", via.String(), fh.Src.String())
+}
+
+// announceReachability updates the peers we are connected to in the ledger, the
+// announce expiring after ttl once we stop
+func announceReachability(b *blockchain.Ledger, n *node.Node, table *RoutingTable, ttl time.Duration) {
+	self := n.Host().ID()
+	peers := []string{}
+	for id, e := range table.peers {
+		if id != self && n.Host().Network().Connectedness(id) == network.Connected {
+			peers = append(peers, e.name)
+		}
+	}
+	sort.Strings(peers)
+
+	r := &types.Reachability{}
+	existingValue, found := b.GetKey(protocol.ReachabilityLedgerKey, self.String())
+	existingValue.Unmarshal(r)
+	left, _ := b.TTL(protocol.ReachabilityLedgerKey, self.String())
+	if found && strings.Join(r.Peers, ",") == strings.Join(peers, ",") && left >= ttl/2 {
+		return
+	}
+
+	b.AddTTL(protocol.ReachabilityLedgerKey, map[string]interface{}{
+		self.String(): &types.Reachability{PeerID: self.String(), Peers: peers},
+	}, ttl)
+}
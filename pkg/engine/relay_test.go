@@ -0,0 +1,116 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+var _ = Describe("Relay", func() {
+	self, a, b, c := newPeerID(), newPeerID(), newPeerID(), newPeerID()
+
+	It("encodes the forwarding header", func() {
+		frame, err := EncodeForward(a, b, []byte("packet"))
+		Expect(err).ToNot(HaveOccurred())
+
+		packet, src, dst, err := ReadFrame(bytes.NewReader(frame))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(packet).To(Equal([]byte("packet")))
+		Expect(src).To(Equal(a))
+		Expect(dst).To(Equal(b))
+	})
+
+	It("rejects truncated forwarding headers", func() {
+		frame, err := EncodeForward(a, b, nil)
+		Expect(err).ToNot(HaveOccurred())
+		frame[4+1+len(a)] = 255
+
+		_, _, _, err = ReadFrame(bytes.NewReader(frame))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("finds the relays of a peer in the reachability table", func() {
+		table := NewRoutingTable(blockchain.Block{
+			Storage: map[string]map[string]blockchain.Data{
+				protocol.MachinesLedgerKey: {
+					"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1"}),
+					"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2"}),
+					"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3"}),
+				},
+				protocol.ReachabilityLedgerKey: {
+					self.String(): data(types.Reachability{PeerID: self.String(), Peers: []string{a.String()}}),
+					a.String():    data(types.Reachability{PeerID: a.String(), Peers: []string{b.String(), self.String()}}),
+					b.String():    data(types.Reachability{PeerID: b.String(), Peers: []string{a.String()}}),
+					// Only VPN nodes can relay
+					c.String(): data(types.Reachability{PeerID: c.String(), Peers: []string{b.String()}}),
+				},
+			},
+		}, self.String())
+
+		Expect(table.Relays(b)).To(Equal([]peer.ID{a}))
+		Expect(table.Relays(a)).To(Equal([]peer.ID{b}))
+		Expect(table.Relays(self)).To(Equal([]peer.ID{a}))
+		Expect(table.Relays(c)).To(BeEmpty())
+	})
+
+	It("accepts the forwarded frames only from a relay of their source", func() {
+		table := NewRoutingTable(blockchain.Block{
+			Storage: map[string]map[string]blockchain.Data{
+				protocol.MachinesLedgerKey: {
+					"10.1.0.1": data(types.Machine{PeerID: self.String(), Address: "10.1.0.1"}),
+					"10.1.0.2": data(types.Machine{PeerID: a.String(), Address: "10.1.0.2"}),
+					"10.1.0.3": data(types.Machine{PeerID: b.String(), Address: "10.1.0.3"}),
+					"10.1.0.4": data(types.Machine{PeerID: c.String(), Address: "10.1.0.4"}),
+				},
+				protocol.ReachabilityLedgerKey: {
+					a.String(): data(types.Reachability{PeerID: a.String(), Peers: []string{b.String(), self.String()}}),
+					b.String(): data(types.Reachability{PeerID: b.String(), Peers: []string{a.String()}}),
+					c.String(): data(types.Reachability{PeerID: c.String(), Peers: []string{b.String(), self.String()}}),
+				},
+			},
+		}, self.String())
+
+		src, err := ForwardedSource(table, a, b, self)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(src).To(Equal(b))
+
+		// c claims to be connected to b, but b doesn't list it
+		Expect(table.Relays(b)).To(Equal([]peer.ID{a}))
+
+		// c is a member, but not connected to b: it can not spoof frames of b
+		_, err = ForwardedSource(table, c, b, self)
+		Expect(err).To(HaveOccurred())
+		// nor of a relay
+		_, err = ForwardedSource(table, c, a, self)
+		Expect(err).To(HaveOccurred())
+		_, err = ForwardedSource(table, a, newPeerID(), self)
+		Expect(err).To(HaveOccurred())
+	})
+})
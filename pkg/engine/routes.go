@@ -0,0 +1,105 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+type prefix struct {
+	net   *net.IPNet
+	route types.Route
+}
+
+// Routes is a set of advertised prefixes sorted for longest prefix matching
+type Routes []prefix
+
+// NewRoutes returns a routing table from a list of advertised routes.
+// Routes with an invalid network are skipped.
+func NewRoutes(routes ...types.Route) Routes {
+	r := Routes{}
+	for _, rr := range routes {
+		_, n, err := net.ParseCIDR(rr.Network)
+		if err != nil {
+			continue
+		}
+		r = append(r, prefix{net: n, route: rr})
+	}
+
+	sort.SliceStable(r, func(i, j int) bool {
+		a, _ := r[i].net.Mask.Size()
+		b, _ := r[j].net.Mask.Size()
+		return a > b
+	})
+
+	return r
+}
+
+// Lookup returns the most specific route containing ip
+func (r Routes) Lookup(ip net.IP) (types.Route, bool) {
+	p, ok := r.lookup(ip)
+	return p.route, ok
+}
+
+func (r Routes) lookup(ip net.IP) (prefix, bool) {
+	for _, p := range r {
+		if p.net.Contains(ip) {
+			return p, true
+		}
+	}
+	return prefix{}, false
+}
+
+// announceRoute advertises the network r through self in the ledger, the
+// announce expiring after ttl once we stop. The routes are keyed by network,
+// so the one advertised by another live peer is left to it instead of being
+// overwritten in turn, and taken over once it expires. The routes without
+// expiry, written by older nodes, are live while their peer is connected.
+// It returns the peer advertising the route
+func announceRoute(b *blockchain.Ledger, r, self string, ttl time.Duration, connected func(peer.ID) bool) string {
+	route := &types.Route{}
+	existingValue, found := b.GetKey(protocol.RoutesLedgerKey, r)
+	existingValue.Unmarshal(route)
+	left, live := b.TTL(protocol.RoutesLedgerKey, r)
+
+	if found && live && route.PeerID != self {
+		id, err := peer.Decode(route.PeerID)
+		if err == nil && (left > 0 || connected(id)) {
+			return route.PeerID
+		}
+	}
+	if found && live && route.PeerID == self && left >= ttl/2 {
+		return self
+	}
+
+	b.AddTTL(protocol.RoutesLedgerKey, map[string]interface{}{
+		r: &types.Route{PeerID: self, Network: r},
+	}, ttl)
+	return self
+}
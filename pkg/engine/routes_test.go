@@ -0,0 +1,128 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+var _ = Describe("Routes", func() {
+	routes := NewRoutes(
+		types.Route{PeerID: "a", Network: "10.0.0.0/8"},
+		types.Route{PeerID: "b", Network: "10.1.0.0/16"},
+		types.Route{PeerID: "c", Network: "fd00::/8"},
+		types.Route{PeerID: "d", Network: "invalid"},
+	)
+
+	Context("Lookup", func() {
+		It("picks the longest prefix", func() {
+			r, found := routes.Lookup(net.ParseIP("10.1.2.3"))
+			Expect(found).To(BeTrue())
+			Expect(r.PeerID).To(Equal("b"))
+
+			r, found = routes.Lookup(net.ParseIP("10.2.2.3"))
+			Expect(found).To(BeTrue())
+			Expect(r.PeerID).To(Equal("a"))
+		})
+		It("matches IPv6 prefixes", func() {
+			r, found := routes.Lookup(net.ParseIP("fd12::1"))
+			Expect(found).To(BeTrue())
+			Expect(r.PeerID).To(Equal("c"))
+		})
+		It("returns false when no prefix matches", func() {
+			_, found := routes.Lookup(net.ParseIP("192.168.1.1"))
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Context("Announce", func() {
+		a, b := newPeerID().String(), newPeerID().String()
+		owner := func(l *blockchain.Ledger) string {
+			route := types.Route{}
+			v, _ := l.GetKey(protocol.RoutesLedgerKey, "192.168.1.0/24")
+			v.Unmarshal(&route)
+			return route.PeerID
+		}
+
+		It("leaves the network advertised by another live peer to it", func() {
+			l := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+			Expect(AnnounceRoute(l, "192.168.1.0/24", a, time.Minute)).To(Equal(a))
+			Expect(owner(l)).To(Equal(a))
+
+			for i := 0; i < 3; i++ {
+				Expect(AnnounceRoute(l, "192.168.1.0/24", b, time.Minute)).To(Equal(a))
+				Expect(AnnounceRoute(l, "192.168.1.0/24", a, time.Minute)).To(Equal(a))
+			}
+			Expect(owner(l)).To(Equal(a))
+			Expect(l.Index()).To(Equal(1))
+		})
+
+		It("takes over the network once the announce of the other peer expires", func() {
+			l := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+			Expect(AnnounceRoute(l, "192.168.1.0/24", a, 200*time.Millisecond)).To(Equal(a))
+			Expect(AnnounceRoute(l, "192.168.1.0/24", b, time.Minute)).To(Equal(a))
+
+			Eventually(func() string {
+				return AnnounceRoute(l, "192.168.1.0/24", b, time.Minute)
+			}, 5*time.Second, 50*time.Millisecond).Should(Equal(b))
+			Expect(owner(l)).To(Equal(b))
+		})
+
+		It("leaves the networks without expiry to the connected peers only", func() {
+			l := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+			id, err := peer.Decode(a)
+			Expect(err).ToNot(HaveOccurred())
+			l.Add(protocol.RoutesLedgerKey, map[string]interface{}{
+				"192.168.1.0/24": &types.Route{PeerID: a, Network: "192.168.1.0/24"},
+			})
+
+			Expect(AnnounceRoute(l, "192.168.1.0/24", b, time.Minute, id)).To(Equal(a))
+			Expect(AnnounceRoute(l, "192.168.1.0/24", b, time.Minute)).To(Equal(b))
+			Expect(owner(l)).To(Equal(b))
+		})
+
+		It("renews the announce once half expired", func() {
+			l := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+			AnnounceRoute(l, "192.168.1.0/24", a, 400*time.Millisecond)
+			index := l.Index()
+			AnnounceRoute(l, "192.168.1.0/24", a, 400*time.Millisecond)
+			Expect(l.Index()).To(Equal(index))
+
+			time.Sleep(250 * time.Millisecond)
+			AnnounceRoute(l, "192.168.1.0/24", a, 400*time.Millisecond)
+			Expect(l.Index()).To(Equal(index + 1))
+			left, found := l.TTL(protocol.RoutesLedgerKey, "192.168.1.0/24")
+			Expect(found).To(BeTrue())
+			Expect(left).To(BeNumerically(">", 300*time.Millisecond))
+		})
+	})
+})
@@ -0,0 +1,296 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+// routingTableRefresh is the interval at which the routing table
+// is checked against the last block of the ledger
+const routingTableRefresh = time.Second
+
+// tableEntry is a peer resolved from the ledger
+type tableEntry struct {
+	id   peer.ID
+	name string
+
+	// mtu is the MTU of the interface of the peer, 0 if unknown
+	mtu int
+
+	// mac is the MAC address of the interface of the peers in TAP mode
+	mac net.HardwareAddr
+}
+
+type ipKey [net.IPv6len]byte
+
+func newIPKey(ip net.IP) ipKey {
+	var k ipKey
+	copy(k[:], ip.To16())
+	return k
+}
+
+// RoutingTable resolves the peers owning the VPN addresses and the advertised
+// networks, and holds the ACL. It is built from a ledger block, and never
+// modified afterwards so it can be read concurrently without locking
+type RoutingTable struct {
+	hash     string
+	machines map[ipKey]*tableEntry
+	peers    map[peer.ID]*tableEntry
+	routes   Routes
+	gateways map[string]*tableEntry
+	relays   map[peer.ID][]*tableEntry
+	acl      ACL
+}
+
+func decodeEntry(entries map[string]*tableEntry, id string) (*tableEntry, bool) {
+	if e, ok := entries[id]; ok {
+		return e, true
+	}
+	d, err := peer.Decode(id)
+	if err != nil {
+		return nil, false
+	}
+	e := &tableEntry{id: d, name: id}
+	entries[id] = e
+	return e, true
+}
+
+// NewRoutingTable builds the routing table from a ledger block. Routes advertised
+// by self are skipped, as well as entries with invalid addresses or peer IDs.
+func NewRoutingTable(b blockchain.Block, self string) *RoutingTable {
+	t := &RoutingTable{
+		hash:     b.Hash,
+		machines: map[ipKey]*tableEntry{},
+		peers:    map[peer.ID]*tableEntry{},
+		gateways: map[string]*tableEntry{},
+		relays:   map[peer.ID][]*tableEntry{},
+	}
+
+	entries := map[string]*tableEntry{}
+
+	for k, v := range b.Storage[protocol.MachinesLedgerKey] {
+		m := &types.Machine{}
+		if err := v.Unmarshal(m); err != nil {
+			continue
+		}
+		e, ok := decodeEntry(entries, m.PeerID)
+		if !ok {
+			continue
+		}
+		t.peers[e.id] = e
+		if m.MTU > 0 {
+			e.mtu = m.MTU
+		}
+		if mac, err := net.ParseMAC(m.MAC); err == nil {
+			e.mac = mac
+		}
+
+		// Machines are keyed by their IPv4 address
+		for _, a := range []string{k, m.Address6} {
+			if ip := net.ParseIP(a); ip != nil {
+				t.machines[newIPKey(ip)] = e
+			}
+		}
+	}
+
+	routes := []types.Route{}
+	for _, v := range b.Storage[protocol.RoutesLedgerKey] {
+		r := types.Route{}
+		if err := v.Unmarshal(&r); err != nil || r.PeerID == self {
+			continue
+		}
+		e, ok := decodeEntry(entries, r.PeerID)
+		if !ok {
+			continue
+		}
+		t.gateways[r.PeerID] = e
+		routes = append(routes, r)
+	}
+	t.routes = NewRoutes(routes...)
+
+	rules := []types.ACLRule{}
+	for _, v := range b.Storage[protocol.ACLLedgerKey] {
+		r := types.ACLRule{}
+		if err := v.Unmarshal(&r); err != nil {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	t.acl = NewACL(rules...)
+
+	// The VPN nodes connected to a peer can relay the traffic to it. Both have to
+	// announce the connection, a peer can not claim alone to relay another one
+	reach, reachers := map[peer.ID]map[peer.ID]bool{}, map[peer.ID]*tableEntry{}
+	for _, v := range b.Storage[protocol.ReachabilityLedgerKey] {
+		r := types.Reachability{}
+		if err := v.Unmarshal(&r); err != nil {
+			continue
+		}
+		e, ok := decodeEntry(entries, r.PeerID)
+		if !ok {
+			continue
+		}
+		reach[e.id], reachers[e.id] = map[peer.ID]bool{}, e
+		for _, p := range r.Peers {
+			if d, err := peer.Decode(p); err == nil && d != e.id {
+				reach[e.id][d] = true
+			}
+		}
+	}
+	for id, peers := range reach {
+		e := reachers[id]
+		if _, ok := t.peers[id]; !ok || e.name == self {
+			continue
+		}
+		for d := range peers {
+			if reach[d][id] {
+				t.relays[d] = append(t.relays[d], e)
+			}
+		}
+	}
+	for _, r := range t.relays {
+		sort.Slice(r, func(i, j int) bool { return r[i].name < r[j].name })
+	}
+
+	return t
+}
+
+func (t *RoutingTable) lookup(ip net.IP) (*tableEntry, bool) {
+	if e, ok := t.lookupMachine(ip); ok {
+		return e, true
+	}
+
+	// Fallback to the networks advertised by the peers
+	e, _, ok := t.lookupRoute(ip)
+	return e, ok
+}
+
+// lookupMachine returns the peer owning a VPN address
+func (t *RoutingTable) lookupMachine(ip net.IP) (*tableEntry, bool) {
+	e, ok := t.machines[newIPKey(ip)]
+	return e, ok
+}
+
+// lookupRoute returns the peer advertising the most specific
+// network containing ip, along with the network prefix length
+func (t *RoutingTable) lookupRoute(ip net.IP) (*tableEntry, int, bool) {
+	p, ok := t.routes.lookup(ip)
+	if !ok {
+		return nil, 0, false
+	}
+	e, ok := t.gateways[p.route.PeerID]
+	bits, _ := p.net.Mask.Size()
+	return e, bits, ok
+}
+
+// Lookup returns the peer to send the packets for ip to: either the
+// machine owning the address, or the peer advertising the most specific network
+func (t *RoutingTable) Lookup(ip net.IP) (peer.ID, bool) {
+	e, ok := t.lookup(ip)
+	if !ok {
+		return "", false
+	}
+	return e.id, true
+}
+
+// HasPeer returns true if the peer owns a VPN address
+func (t *RoutingTable) HasPeer(id peer.ID) bool {
+	_, ok := t.peers[id]
+	return ok
+}
+
+// owns returns true if ip is a VPN address of the peer, or in a network it advertises
+func (t *RoutingTable) owns(id peer.ID, ip net.IP) bool {
+	if e, ok := t.lookupMachine(ip); ok {
+		return e.id == id
+	}
+	for _, p := range t.routes {
+		if p.route.PeerID == id.String() && p.net.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Relays returns the peers which can forward the traffic to id
+func (t *RoutingTable) Relays(id peer.ID) []peer.ID {
+	res := []peer.ID{}
+	for _, e := range t.relays[id] {
+		res = append(res, e.id)
+	}
+	return res
+}
+
+// ACL returns the ACL distributed in the ledger
+func (t *RoutingTable) ACL() ACL {
+	return t.acl
+}
+
+// routingCache holds the routing table of the last block of the ledger.
+// The table is rebuilt only when the last block changes
+type routingCache struct {
+	ledger *blockchain.Ledger
+	self   string
+	table  atomic.Value
+}
+
+func newRoutingCache(ledger *blockchain.Ledger, self string) *routingCache {
+	r := &routingCache{ledger: ledger, self: self}
+	r.table.Store(NewRoutingTable(ledger.LastBlock(), self))
+	return r
+}
+
+// Table returns the current routing table
+func (r *routingCache) Table() *RoutingTable {
+	return r.table.Load().(*RoutingTable)
+}
+
+func (r *routingCache) refresh() {
+	b := r.ledger.LastBlock()
+	if b.Hash != r.Table().hash {
+		r.table.Store(NewRoutingTable(b, r.self))
+	}
+}
+
+// run refreshes the routing table at every interval until the context is done
+func (r *routingCache) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.refresh()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	. "github.com/bhojpur/vpn/pkg/engine"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
+)
+
+func newPeerID() peer.ID {
+	_, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	id, err := peer.IDFromPublicKey(pub)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func data(v interface{}) blockchain.Data {
+	b, _ := json.Marshal(v)
+	return blockchain.Data(b)
+}
+
+// machines returns n machines with addresses in 10.1.0.0/16, keyed by address
+func machines(n int) map[string]interface{} {
+	m := map[string]interface{}{}
+	for i := 0; i < n; i++ {
+		address := fmt.Sprintf("10.1.%d.%d", i/250, i%250+1)
+		m[address] = types.Machine{PeerID: newPeerID().String(), Address: address}
+	}
+	return m
+}
+
+var _ = Describe("Routing table", func() {
+	a, b, c := newPeerID(), newPeerID(), newPeerID()
+
+	block := blockchain.Block{
+		Hash: "hash",
+		Storage: map[string]map[string]blockchain.Data{
+			protocol.MachinesLedgerKey: {
+				"10.1.0.1": data(types.Machine{PeerID: a.String(), Address: "10.1.0.1", Address6: "fd00::1"}),
+				"10.1.0.2": data(types.Machine{PeerID: "invalid", Address: "10.1.0.2"}),
+			},
+			protocol.RoutesLedgerKey: {
+				"192.168.0.0/16": data(types.Route{PeerID: b.String(), Network: "192.168.0.0/16"}),
+				"192.168.1.0/24": data(types.Route{PeerID: c.String(), Network: "192.168.1.0/24"}),
+				"172.16.0.0/12":  data(types.Route{PeerID: a.String(), Network: "172.16.0.0/12"}),
+			},
+			protocol.ACLLedgerKey: {
+				"deny": data(types.ACLRule{ID: "deny", Action: types.ACLDeny}),
+			},
+		},
+	}
+	table := NewRoutingTable(block, a.String())
+
+	Context("Lookup", func() {
+		It("resolves the machines by address", func() {
+			p, found := table.Lookup(net.ParseIP("10.1.0.1"))
+			Expect(found).To(BeTrue())
+			Expect(p).To(Equal(a))
+
+			p, found = table.Lookup(net.ParseIP("fd00::1"))
+			Expect(found).To(BeTrue())
+			Expect(p).To(Equal(a))
+		})
+		It("falls back to the advertised networks", func() {
+			p, found := table.Lookup(net.ParseIP("192.168.1.10"))
+			Expect(found).To(BeTrue())
+			Expect(p).To(Equal(c))
+
+			p, found = table.Lookup(net.ParseIP("192.168.2.10"))
+			Expect(found).To(BeTrue())
+			Expect(p).To(Equal(b))
+		})
+		It("skips invalid peers and own routes", func() {
+			_, found := table.Lookup(net.ParseIP("10.1.0.2"))
+			Expect(found).To(BeFalse())
+			_, found = table.Lookup(net.ParseIP("172.16.0.1"))
+			Expect(found).To(BeFalse())
+		})
+		It("knows the peers owning an address", func() {
+			Expect(table.HasPeer(a)).To(BeTrue())
+			Expect(table.HasPeer(b)).To(BeFalse())
+		})
+		It("holds the ACL", func() {
+			Expect(table.ACL()).To(HaveLen(1))
+		})
+	})
+})
+
+// BenchmarkLedgerLookup measures the per-packet cost of resolving
+// the destination peer by querying the ledger
+func BenchmarkLedgerLookup(b *testing.B) {
+	ledger := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+	ledger.Add(protocol.MachinesLedgerKey, machines(500))
+	dst := net.ParseIP("10.1.1.100")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			value, found := ledger.GetKey(protocol.MachinesLedgerKey, dst.String())
+			if !found {
+				b.Fatal("machine not found")
+			}
+			machine := &types.Machine{}
+			value.Unmarshal(machine)
+			if _, err := peer.Decode(machine.PeerID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkRoutingTableLookup measures the per-packet cost of resolving
+// the destination peer with the routing table
+func BenchmarkRoutingTableLookup(b *testing.B) {
+	ledger := blockchain.New(ioutil.Discard, &blockchain.MemoryStore{})
+	ledger.Add(protocol.MachinesLedgerKey, machines(500))
+	table := NewRoutingTable(ledger.LastBlock(), "")
+	dst := net.ParseIP("10.1.1.100")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, found := table.Lookup(dst); !found {
+				b.Fatal("machine not found")
+			}
+		}
+	})
+}
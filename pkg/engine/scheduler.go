@@ -0,0 +1,129 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"sync/atomic"
+
+	"github.com/songgao/packets/ethernet"
+)
+
+const defaultQueueSize = 256
+
+// packet is a frame read from the interface along with its parsed header,
+// the one of the IP packet or of the Ethernet frame in TAP mode
+type packet struct {
+	frame ethernet.Frame
+	info  *packetInfo
+	eth   *ethernetInfo
+}
+
+func (p packet) flowHash() uint32 {
+	if p.eth != nil {
+		return p.eth.FlowHash()
+	}
+	return p.info.FlowHash()
+}
+
+// QueueStats are the statistics of a single worker queue
+type QueueStats struct {
+	Depth    int
+	Capacity int
+	Enqueued uint64
+	Dropped  uint64
+}
+
+// SchedulerStats are the statistics of the packet scheduler
+type SchedulerStats struct {
+	Queues   []QueueStats
+	Depth    int
+	Enqueued uint64
+	Dropped  uint64
+}
+
+// scheduler dispatches packets to a set of queues, each consumed by a single worker.
+// Packets are sharded by flow, so ordering within a flow is preserved while
+// different flows (and peers) are served in parallel.
+type scheduler struct {
+	queues   []chan packet
+	enqueued []uint64
+	dropped  []uint64
+}
+
+func newScheduler(workers, size int) *scheduler {
+	if workers < 1 {
+		workers = 1
+	}
+	if size < 1 {
+		size = defaultQueueSize
+	}
+
+	s := &scheduler{
+		queues:   make([]chan packet, workers),
+		enqueued: make([]uint64, workers),
+		dropped:  make([]uint64, workers),
+	}
+	for i := range s.queues {
+		s.queues[i] = make(chan packet, size)
+	}
+	return s
+}
+
+// Enqueue puts the packet in the queue of its flow. It doesn't block, and returns false
+// if the packet was dropped because the queue is full: like a full interface
+// queue, a busy worker sheds the load instead of stalling the reads of the
+// interface, and so the flows of the other workers
+func (s *scheduler) Enqueue(p packet) bool {
+	i := int(p.flowHash() % uint32(len(s.queues)))
+	select {
+	case s.queues[i] <- p:
+		atomic.AddUint64(&s.enqueued[i], 1)
+		return true
+	default:
+		atomic.AddUint64(&s.dropped[i], 1)
+		return false
+	}
+}
+
+// Close closes all the queues, workers drain them before exiting
+func (s *scheduler) Close() {
+	for _, q := range s.queues {
+		close(q)
+	}
+}
+
+// Stats returns a snapshot of the queues statistics
+func (s *scheduler) Stats() SchedulerStats {
+	stats := SchedulerStats{Queues: make([]QueueStats, len(s.queues))}
+	for i, q := range s.queues {
+		qs := QueueStats{
+			Depth:    len(q),
+			Capacity: cap(q),
+			Enqueued: atomic.LoadUint64(&s.enqueued[i]),
+			Dropped:  atomic.LoadUint64(&s.dropped[i]),
+		}
+		stats.Queues[i] = qs
+		stats.Depth += qs.Depth
+		stats.Enqueued += qs.Enqueued
+		stats.Dropped += qs.Dropped
+	}
+	return stats
+}
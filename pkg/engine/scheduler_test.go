@@ -0,0 +1,136 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"encoding/binary"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+)
+
+var _ = Describe("Scheduler", func() {
+	// seqPacket returns a UDP packet of the flow carrying a sequence number
+	seqPacket := func(srcPort uint16, seq int) []byte {
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint16(payload[0:2], srcPort)
+		binary.BigEndian.PutUint16(payload[2:4], 53)
+		binary.BigEndian.PutUint32(payload[8:12], uint32(seq))
+		return ipv4Packet("10.1.0.1", "10.1.0.2", 17, payload)
+	}
+
+	It("keeps the packets of a flow in order on a single queue", func() {
+		s := NewScheduler(4, 256)
+		for seq := 0; seq < 20; seq++ {
+			for port := uint16(1000); port < 1010; port++ {
+				ok, err := s.EnqueueFrame(seqPacket(port, seq))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeTrue())
+			}
+		}
+		s.Close()
+
+		queues := map[uint16]int{}
+		for i := 0; i < 4; i++ {
+			next := map[uint16]int{}
+			for _, f := range s.Drain(i) {
+				port := binary.BigEndian.Uint16(f[20:22])
+				if q, ok := queues[port]; ok {
+					Expect(q).To(Equal(i), "flow %d on several queues", port)
+				}
+				queues[port] = i
+				Expect(int(binary.BigEndian.Uint32(f[28:32]))).To(Equal(next[port]))
+				next[port]++
+			}
+			for _, n := range next {
+				Expect(n).To(Equal(20))
+			}
+		}
+		Expect(queues).To(HaveLen(10))
+	})
+
+	It("puts all the fragments of a packet on the queue of their flow", func() {
+		payload := make([]byte, 1000)
+		binary.BigEndian.PutUint16(payload[0:2], 1000)
+		binary.BigEndian.PutUint16(payload[2:4], 53)
+		packet := ipv4Packet("10.1.0.1", "10.1.0.2", 17, payload)
+
+		fragments, _, err := FitPacket(packet, 500)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fragments).To(HaveLen(3))
+
+		h, err := FlowHash(fragments[0])
+		Expect(err).ToNot(HaveOccurred())
+		for _, f := range fragments[1:] {
+			Expect(FlowHash(f)).To(Equal(h))
+		}
+
+		s := NewScheduler(8, 16)
+		for _, f := range fragments {
+			Expect(s.EnqueueFrame(f)).To(BeTrue())
+		}
+		s.Close()
+		for i := 0; i < 8; i++ {
+			if frames := s.Drain(i); len(frames) > 0 {
+				Expect(frames).To(Equal(fragments))
+			}
+		}
+	})
+
+	It("drops and counts the packets once the queue of their flow is full", func() {
+		s := NewScheduler(1, 2)
+		for seq := 0; seq < 5; seq++ {
+			ok, err := s.EnqueueFrame(seqPacket(1000, seq))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(Equal(seq < 2))
+		}
+
+		stats := s.Stats()
+		Expect(stats.Enqueued).To(BeEquivalentTo(2))
+		Expect(stats.Dropped).To(BeEquivalentTo(3))
+		Expect(stats.Depth).To(Equal(2))
+		Expect(stats.Queues).To(HaveLen(1))
+		Expect(stats.Queues[0].Capacity).To(Equal(2))
+	})
+
+	It("lets the workers drain the queues once closed", func() {
+		s := NewScheduler(2, 16)
+		sent := [][]byte{}
+		for seq := 0; seq < 8; seq++ {
+			p := seqPacket(uint16(1000+seq%2), seq)
+			Expect(s.EnqueueFrame(p)).To(BeTrue())
+			sent = append(sent, p)
+		}
+		s.Close()
+
+		received := 0
+		for i := 0; i < 2; i++ {
+			for _, f := range s.Drain(i) {
+				Expect(sent).To(ContainElement(f))
+				received++
+			}
+		}
+		Expect(received).To(Equal(len(sent)))
+		Expect(s.Stats().Depth).To(BeZero())
+	})
+})
@@ -0,0 +1,371 @@
+package engine
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Priority classes of the traffic. When a limit is reached, the bulk
+// packets leave the remaining bandwidth to the interactive ones
+const (
+	ClassInteractive = "interactive"
+	ClassBulk        = "bulk"
+)
+
+const (
+	// maxShapingDelay is the longest a packet is delayed to fit in a limit,
+	// the packets which would wait longer are dropped
+	maxShapingDelay = 50 * time.Millisecond
+	// minBurst is the minimum burst of a limit, in bytes
+	minBurst = 32 << 10
+	// bulkReserve is the share of the burst the bulk packets can not use
+	bulkReserve = 4
+)
+
+// Directions of the traffic shaped
+const (
+	directionIn = iota
+	directionOut
+)
+
+// Limit is a bandwidth limit in kbit/s of the traffic received (In)
+// and sent (Out), 0 for no limit
+type Limit struct {
+	In  int `json:",omitempty"`
+	Out int `json:",omitempty"`
+}
+
+// TrafficClass assigns to a priority class the packets of a protocol,
+// with either their source or destination port in Ports
+type TrafficClass struct {
+	Class    string
+	Protocol string `json:",omitempty"`
+	Ports    string `json:",omitempty"`
+}
+
+// Shaping holds the bandwidth limits of the engine, global and per peer ID. Packets
+// are classified by the first matching class, and are interactive if none matches
+type Shaping struct {
+	Global  Limit
+	Peers   map[string]Limit `json:",omitempty"`
+	Classes []TrafficClass   `json:",omitempty"`
+}
+
+// ParsePeerLimit parses the limit of a peer from a comma separated list of
+// key=value pairs: peer, in and out, e.g. "peer=12D3KooW...,in=1000,out=500"
+func ParsePeerLimit(s string) (string, Limit, error) {
+	var id string
+	l := Limit{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return "", l, fmt.Errorf("invalid peer limit option '%s'", kv)
+		}
+		switch k, v := parts[0], parts[1]; k {
+		case "peer":
+			id = v
+		case "in", "out":
+			r, err := strconv.Atoi(v)
+			if err != nil || r < 0 {
+				return "", l, fmt.Errorf("invalid peer limit '%s'", v)
+			}
+			if k == "in" {
+				l.In = r
+			} else {
+				l.Out = r
+			}
+		default:
+			return "", l, fmt.Errorf("unknown peer limit option '%s'", k)
+		}
+	}
+	if _, err := peer.Decode(id); err != nil {
+		return "", l, fmt.Errorf("invalid peer '%s'", id)
+	}
+	return id, l, nil
+}
+
+// ParseTrafficClass parses a traffic class from a comma separated list of key=value
+// pairs: class, protocol and ports, e.g. "class=bulk,protocol=tcp,ports=873"
+func ParseTrafficClass(s string) (TrafficClass, error) {
+	c := TrafficClass{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return c, fmt.Errorf("invalid traffic class option '%s'", kv)
+		}
+		switch k, v := parts[0], parts[1]; k {
+		case "class":
+			c.Class = v
+		case "protocol":
+			c.Protocol = v
+		case "ports":
+			c.Ports = v
+		default:
+			return c, fmt.Errorf("unknown traffic class option '%s'", k)
+		}
+	}
+	_, err := compileClass(c)
+	return c, err
+}
+
+// ValidateShaping returns an error if the limits or the classes are invalid
+func ValidateShaping(s Shaping) error {
+	_, err := newShapingState(s)
+	return err
+}
+
+type trafficClass struct {
+	bulk             bool
+	protocol         int
+	portMin, portMax uint16
+	ports            bool
+}
+
+func compileClass(c TrafficClass) (trafficClass, error) {
+	tc := trafficClass{ports: c.Ports != ""}
+	switch c.Class {
+	case ClassInteractive:
+	case ClassBulk:
+		tc.bulk = true
+	default:
+		return tc, fmt.Errorf("invalid traffic class '%s'", c.Class)
+	}
+	var err error
+	if tc.protocol, err = parseProtocol(c.Protocol); err != nil {
+		return tc, err
+	}
+	if tc.portMin, tc.portMax, err = parsePorts(c.Ports); err != nil {
+		return tc, err
+	}
+	return tc, nil
+}
+
+func (c trafficClass) match(p *packetInfo) bool {
+	if c.protocol >= 0 && c.protocol != p.Protocol {
+		return false
+	}
+	if !c.ports {
+		return true
+	}
+	in := func(port uint16) bool { return port >= c.portMin && port <= c.portMax }
+	return in(p.SrcPort) || in(p.DstPort)
+}
+
+// tokenBucket limits the bytes per second of a traffic
+type tokenBucket struct {
+	sync.Mutex
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+// newTokenBucket returns a bucket of kbps kbit/s, nil for no limit
+func newTokenBucket(kbps int) *tokenBucket {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	burst := rate / 4
+	if burst < minBurst {
+		burst = minBurst
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// take removes n tokens from the bucket, leaving at least floor ones. It returns
+// how long to wait before sending, or false if that is longer than max
+func (b *tokenBucket) take(n int, floor float64, max time.Duration, now time.Time) (time.Duration, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	var wait time.Duration
+	if missing := float64(n) + floor - b.tokens; missing > 0 {
+		wait = time.Duration(missing / b.rate * float64(time.Second))
+	}
+	if wait > max {
+		return 0, false
+	}
+	b.tokens -= float64(n)
+	return wait, true
+}
+
+func (b *tokenBucket) refund(n int) {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens += float64(n)
+}
+
+// shapingState are the buckets of a configuration, replaced as a whole
+type shapingState struct {
+	config  Shaping
+	classes []trafficClass
+	global  [2]*tokenBucket
+	peers   map[string][2]*tokenBucket
+}
+
+func newShapingState(s Shaping) (*shapingState, error) {
+	if s.Global.In < 0 || s.Global.Out < 0 {
+		return nil, fmt.Errorf("invalid global limit")
+	}
+	st := &shapingState{
+		config: s,
+		global: [2]*tokenBucket{newTokenBucket(s.Global.In), newTokenBucket(s.Global.Out)},
+		peers:  map[string][2]*tokenBucket{},
+	}
+	for id, l := range s.Peers {
+		if _, err := peer.Decode(id); err != nil {
+			return nil, fmt.Errorf("invalid peer '%s'", id)
+		}
+		if l.In < 0 || l.Out < 0 {
+			return nil, fmt.Errorf("invalid limit of peer '%s'", id)
+		}
+		st.peers[id] = [2]*tokenBucket{newTokenBucket(l.In), newTokenBucket(l.Out)}
+	}
+	for _, c := range s.Classes {
+		tc, err := compileClass(c)
+		if err != nil {
+			return nil, err
+		}
+		st.classes = append(st.classes, tc)
+	}
+	return st, nil
+}
+
+// shaper enforces the bandwidth limits on the packets sent and received
+type shaper struct {
+	// state holds the current *shapingState
+	state atomic.Value
+	// mu serializes the updates of the state
+	mu sync.Mutex
+}
+
+func newShaper() *shaper {
+	s := &shaper{}
+	st, _ := newShapingState(Shaping{})
+	s.state.Store(st)
+	return s
+}
+
+func (s *shaper) current() *shapingState {
+	return s.state.Load().(*shapingState)
+}
+
+// config returns a copy of the current configuration
+func (s *shaper) config() Shaping {
+	c := s.current().config
+	res := Shaping{Global: c.Global, Peers: map[string]Limit{}, Classes: append([]TrafficClass{}, c.Classes...)}
+	for id, l := range c.Peers {
+		res.Peers[id] = l
+	}
+	return res
+}
+
+func (s *shaper) set(c Shaping) error {
+	st, err := newShapingState(c)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Store(st)
+	return nil
+}
+
+// update changes the configuration with f, applied to a copy of it
+func (s *shaper) update(f func(c *Shaping)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.config()
+	f(&c)
+	st, err := newShapingState(c)
+	if err != nil {
+		return err
+	}
+	s.state.Store(st)
+	return nil
+}
+
+// admit returns how long to delay a packet of size bytes exchanged with the peer
+// in the given direction, or false if it has to be dropped
+func (s *shaper) admit(peer string, direction int, p *packetInfo, size int, now time.Time) (time.Duration, bool) {
+	st := s.current()
+	buckets := []*tokenBucket{st.global[direction]}
+	if b, ok := st.peers[peer]; ok {
+		buckets = append(buckets, b[direction])
+	}
+
+	bulk := false
+	for _, c := range st.classes {
+		if c.match(p) {
+			bulk = c.bulk
+			break
+		}
+	}
+
+	var wait time.Duration
+	for i, b := range buckets {
+		if b == nil {
+			continue
+		}
+		floor := 0.0
+		if bulk {
+			floor = b.burst / bulkReserve
+		}
+		w, ok := b.take(size, floor, maxShapingDelay, now)
+		if !ok {
+			for _, taken := range buckets[:i] {
+				if taken != nil {
+					taken.refund(size)
+				}
+			}
+			return 0, false
+		}
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait, true
+}
+
+// shape delays a packet to fit in the limits, returning false if it has to be dropped
+func (s *shaper) shape(peer string, direction int, p *packetInfo, size int) bool {
+	wait, ok := s.admit(peer, direction, p, size, time.Now())
+	if ok && wait > 0 {
+		time.Sleep(wait)
+	}
+	return ok
+}
@@ -0,0 +1,140 @@
+package engine_test
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/bhojpur/vpn/pkg/engine"
+)
+
+// tcpPacket returns an IPv4 TCP packet of size bytes to the port dst
+func tcpPacket(dst uint16, size int) []byte {
+	payload := make([]byte, size-20)
+	payload[2], payload[3] = byte(dst>>8), byte(dst)
+	return ipv4Packet("10.1.0.1", "10.1.0.2", 6, payload)
+}
+
+var _ = Describe("Shaping", func() {
+	a, b := newPeerID().String(), newPeerID().String()
+	now := time.Now()
+
+	It("parses the limits and the classes", func() {
+		id, l, err := ParsePeerLimit("peer=" + a + ",in=1000,out=500")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(id).To(Equal(a))
+		Expect(l).To(Equal(Limit{In: 1000, Out: 500}))
+
+		_, _, err = ParsePeerLimit("peer=foo,in=1000")
+		Expect(err).To(HaveOccurred())
+		_, _, err = ParsePeerLimit("peer=" + a + ",in=-1")
+		Expect(err).To(HaveOccurred())
+
+		c, err := ParseTrafficClass("class=bulk,protocol=tcp,ports=873")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(c).To(Equal(TrafficClass{Class: ClassBulk, Protocol: "tcp", Ports: "873"}))
+
+		_, err = ParseTrafficClass("class=urgent")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseTrafficClass("class=bulk,ports=22-1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("admits everything without limits", func() {
+		s, err := NewShaper(Shaping{})
+		Expect(err).ToNot(HaveOccurred())
+		for i := 0; i < 1000; i++ {
+			wait, ok := s.Admit(a, false, tcpPacket(80, 1500), now)
+			Expect(ok).To(BeTrue())
+			Expect(wait).To(BeZero())
+		}
+	})
+
+	It("delays, then drops the packets above the global limit", func() {
+		// 1000 kbit/s, 125000 bytes per second
+		s, err := NewShaper(Shaping{Global: Limit{Out: 1000}})
+		Expect(err).ToNot(HaveOccurred())
+
+		var delayed, dropped bool
+		for i := 0; i < 100 && !dropped; i++ {
+			wait, ok := s.Admit(a, false, tcpPacket(80, 1500), now)
+			Expect(wait).To(BeNumerically("<=", 50*time.Millisecond))
+			delayed = delayed || wait > 0
+			dropped = !ok
+		}
+		Expect(delayed).To(BeTrue())
+		Expect(dropped).To(BeTrue())
+
+		// The other direction is not limited, and the bucket refills
+		_, ok := s.Admit(a, true, tcpPacket(80, 1500), now)
+		Expect(ok).To(BeTrue())
+		wait, ok := s.Admit(a, false, tcpPacket(80, 1500), now.Add(time.Second))
+		Expect(ok).To(BeTrue())
+		Expect(wait).To(BeZero())
+	})
+
+	It("limits the peers separately", func() {
+		s, err := NewShaper(Shaping{Peers: map[string]Limit{a: {In: 1000}}})
+		Expect(err).ToNot(HaveOccurred())
+
+		for {
+			if _, ok := s.Admit(a, true, tcpPacket(80, 1500), now); !ok {
+				break
+			}
+		}
+		_, ok := s.Admit(b, true, tcpPacket(80, 1500), now)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("leaves bandwidth to the interactive packets", func() {
+		s, err := NewShaper(Shaping{
+			Global:  Limit{Out: 1000},
+			Classes: []TrafficClass{{Class: ClassInteractive, Protocol: "tcp", Ports: "22"}, {Class: ClassBulk}},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		for {
+			if _, ok := s.Admit(a, false, tcpPacket(873, 1500), now); !ok {
+				break
+			}
+		}
+		_, ok := s.Admit(a, false, tcpPacket(22, 1500), now)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("is changed at runtime through the controller", func() {
+		ctrl := NewController()
+		Expect(ctrl.SetShaping(Shaping{Global: Limit{In: 100}})).To(Succeed())
+		Expect(ctrl.SetPeerLimit(a, Limit{Out: 200})).To(Succeed())
+		Expect(ctrl.SetPeerLimit("foo", Limit{Out: 200})).ToNot(Succeed())
+
+		s := ctrl.Shaping()
+		Expect(s.Global).To(Equal(Limit{In: 100}))
+		Expect(s.Peers).To(Equal(map[string]Limit{a: {Out: 200}}))
+
+		Expect(ctrl.SetPeerLimit(a, Limit{})).To(Succeed())
+		Expect(ctrl.Shaping().Peers).To(BeEmpty())
+		Expect(ctrl.SetShaping(Shaping{Classes: []TrafficClass{{Class: "urgent"}}})).ToNot(Succeed())
+	})
+})
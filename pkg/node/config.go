@@ -63,8 +63,14 @@ type Config struct {
 	SealKeyLength    int
 	InterfaceAddress string
 
+	// Transport carries the VPN packets, as set in the network token
+	Transport string
+
 	Store blockchain.Store
 
+	// AcceptUnsignedLedger accepts the writes to the ledger of the peers which don't sign them
+	AcceptUnsignedLedger bool
+
 	// Handle is a handle consumed by HumanInterfaces to handle received messages
 	Handle                     func(bool, *hub.Message)
 	StreamHandlers             map[protocol.Protocol]StreamHandler
@@ -0,0 +1,209 @@
+package node
+
+// Copyright (c) 2018 Bhojpur Consulting Private Limited, India. All rights reserved.
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/pkg/errors"
+
+	"github.com/bhojpur/vpn/pkg/blockchain"
+	"github.com/bhojpur/vpn/pkg/protocol"
+)
+
+const (
+	// maxCatchUpSize is the maximum size of the writes pulled from a peer
+	maxCatchUpSize = 64 << 20
+
+	catchUpTimeout = time.Minute
+)
+
+// catchUpFunc returns the function pulling the writes missed from the peers with a different
+// ledger state, at most once per synchronization interval from each of them
+func (e *Node) catchUpFunc(ctx context.Context, ledger *blockchain.Ledger) func(string) {
+	var mu sync.Mutex
+	pulled := map[peer.ID]time.Time{}
+	return func(p string) {
+		id, err := peer.Decode(p)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		if time.Since(pulled[id]) < e.config.LedgerSyncronizationTime {
+			mu.Unlock()
+			return
+		}
+		pulled[id] = time.Now()
+		mu.Unlock()
+
+		go func() {
+			if err := e.catchUp(ctx, ledger, id); err != nil {
+				e.config.Logger.Debugf("could not catch up with the ledger of %s: %s", id.String(), err.Error())
+			}
+		}()
+	}
+}
+
+// catchUp pulls from a peer the writes missing in the ledger
+func (e *Node) catchUp(ctx context.Context, ledger *blockchain.Ledger, id peer.ID) error {
+	ctx, cancel := context.WithTimeout(ctx, catchUpTimeout)
+	defer cancel()
+
+	s, err := e.host.NewStream(ctx, id, protocol.LedgerProtocol.ID())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(catchUpTimeout))
+
+	if err := e.writeSealed(s, ledger.Versions()); err != nil {
+		s.Reset()
+		return err
+	}
+	if err := s.CloseWrite(); err != nil {
+		s.Reset()
+		return err
+	}
+
+	var block blockchain.Block
+	if err := e.readSealed(s, &block); err != nil {
+		s.Reset()
+		return err
+	}
+	return ledger.Merge(block, id.String())
+}
+
+// handleCatchUp sends to the peers the writes they miss. The requests and replies are
+// sealed like the messages of the room, only the members of the network can pull the ledger
+func (e *Node) handleCatchUp(ledger *blockchain.Ledger) func(network.Stream) {
+	return func(s network.Stream) {
+		defer s.Close()
+		s.SetDeadline(time.Now().Add(catchUpTimeout))
+
+		versions := map[string]map[string]blockchain.Timestamp{}
+		if err := e.readSealed(s, &versions); err != nil {
+			e.config.Logger.Debugf("invalid ledger catch up from %s: %s", s.Conn().RemotePeer().String(), err.Error())
+			s.Reset()
+			return
+		}
+		if err := e.writeSealed(s, ledger.Since(versions)); err != nil {
+			e.config.Logger.Debugf("could not send the ledger to %s: %s", s.Conn().RemotePeer().String(), err.Error())
+			s.Reset()
+		}
+	}
+}
+
+// writeSealed writes v compressed and sealed with the key of the room
+func (e *Node) writeSealed(w io.Writer, v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(dat)
+	gz.Close()
+
+	sealed, err := e.config.Sealer.Seal(buf.String(), e.sealkey())
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, sealed)
+	return err
+}
+
+// readSealed reads until EOF a value written by writeSealed
+func (e *Node) readSealed(r io.Reader, v interface{}) error {
+	sealed, err := ioutil.ReadAll(io.LimitReader(r, maxCatchUpSize+1))
+	if err != nil {
+		return err
+	}
+	if len(sealed) > maxCatchUpSize {
+		return errors.New("ledger catch up too large")
+	}
+	dat, err := e.config.Sealer.Unseal(string(sealed), e.sealkey())
+	if err != nil {
+		return errors.Wrap(err, "could not unseal")
+	}
+	gz, err := gzip.NewReader(bytes.NewReader([]byte(dat)))
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(io.LimitReader(gz, maxCatchUpSize)).Decode(v)
+}
+
+// authorizeWrites lets the peers write only the machines, routes and reachability
+// they own, and keeps them from adding themselves to the trust zone. Once the trust
+// zone has members, only they add the other peers to it and write the ACL
+func authorizeWrites(ledger *blockchain.Ledger) {
+	for _, bucket := range []string{protocol.MachinesLedgerKey, protocol.RoutesLedgerKey, protocol.ReachabilityLedgerKey} {
+		ledger.Authorize(bucket, ownedBy)
+	}
+	ledger.Authorize(protocol.TrustZoneKey, func(writer, key string, value, current blockchain.Data, data func(string) map[string]blockchain.Data) error {
+		if value == "" {
+			return nil
+		}
+		if key == writer {
+			return errors.New("a peer can not add itself to the trust zone")
+		}
+		return trusted(writer, data)
+	})
+	ledger.Authorize(protocol.ACLLedgerKey, func(writer, key string, value, current blockchain.Data, data func(string) map[string]blockchain.Data) error {
+		return trusted(writer, data)
+	})
+}
+
+// ownedBy returns an error if the value written, or the one replaced or deleted,
+// is not of the writer
+func ownedBy(writer, key string, value, current blockchain.Data, data func(string) map[string]blockchain.Data) error {
+	for _, v := range []blockchain.Data{value, current} {
+		if v == "" {
+			continue
+		}
+		owned := struct{ PeerID string }{}
+		if err := v.Unmarshal(&owned); err != nil {
+			return err
+		}
+		if owned.PeerID != writer {
+			return fmt.Errorf("owned by %s, written by %s", owned.PeerID, writer)
+		}
+	}
+	return nil
+}
+
+// trusted returns an error if the trust zone has members, and the writer is not one of them
+func trusted(writer string, data func(string) map[string]blockchain.Data) error {
+	tz := data(protocol.TrustZoneKey)
+	if _, member := tz[writer]; len(tz) > 0 && !member {
+		return fmt.Errorf("%s is not in the trust zone", writer)
+	}
+	return nil
+}
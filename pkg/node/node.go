@@ -103,6 +103,8 @@ func (e *Node) Ledger() (*blockchain.Ledger, error) {
 	}
 
 	e.ledger = blockchain.New(mw, e.config.Store)
+	e.ledger.AcceptUnsigned(e.config.AcceptUnsignedLedger)
+	authorizeWrites(e.ledger)
 	return e.ledger, nil
 }
 
@@ -131,7 +133,9 @@ func (e *Node) Start(ctx context.Context) error {
 		return err
 	}
 
-	// Send periodically messages to the channel with our blockchain content
+	// Send periodically the state of our ledger, the peers with a
+	// different one pull the writes they miss with a stream
+	ledger.SetCatchUp(e.catchUpFunc(ctx, ledger))
 	ledger.Syncronizer(ctx, e.config.LedgerSyncronizationTime)
 
 	// Start eventual declared NetworkServices
@@ -173,6 +177,12 @@ func (e *Node) startNetwork(ctx context.Context) error {
 		return err
 	}
 
+	// The writes to the ledger are signed with the key of the host
+	if err := ledger.SetIdentity(host.Peerstore().PrivKey(host.ID())); err != nil {
+		return err
+	}
+
+	host.SetStreamHandler(protocol.LedgerProtocol.ID(), e.handleCatchUp(ledger))
 	for pid, strh := range e.config.StreamHandlers {
 		host.SetStreamHandler(pid.ID(), network.StreamHandler(strh(e, ledger)))
 	}
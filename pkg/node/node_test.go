@@ -32,6 +32,8 @@ import (
 	"github.com/bhojpur/vpn/pkg/blockchain"
 	"github.com/bhojpur/vpn/pkg/logger"
 	. "github.com/bhojpur/vpn/pkg/node"
+	"github.com/bhojpur/vpn/pkg/protocol"
+	"github.com/bhojpur/vpn/pkg/types"
 )
 
 var _ = Describe("Node", func() {
@@ -93,6 +95,101 @@ var _ = Describe("Node", func() {
 		})
 	})
 
+	Context("Ledger", func() {
+		It("catches up with the writes made before joining", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, _ := New(FromBase64(true, true, token), WithStore(&blockchain.MemoryStore{}), WithDiscoveryInterval(10*time.Second), WithLedgerInterval(time.Second), l)
+			e.Start(ctx)
+			l1, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			l1.Add("foo", map[string]interface{}{"bar": "baz"})
+
+			e2, _ := New(FromBase64(true, true, token), WithStore(&blockchain.MemoryStore{}), WithDiscoveryInterval(10*time.Second), WithLedgerInterval(time.Second), l)
+			e2.Start(ctx)
+			l2, err := e2.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+
+			Eventually(func() string {
+				var s string
+				v, exists := l2.GetKey("foo", "bar")
+				if exists {
+					v.Unmarshal(&s)
+				}
+				return s
+			}, 240*time.Second, 1*time.Second).Should(Equal("baz"))
+			Expect(l2.Provenance("foo")["bar"].Writer).To(Equal(e.Host().ID().String()))
+		})
+
+		It("accepts only the writes of the owners of the keys", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, _ := New(FromBase64(true, true, token), WithStore(&blockchain.MemoryStore{}), WithDiscoveryInterval(10*time.Second), WithLedgerInterval(time.Second), l)
+			e2, _ := New(FromBase64(true, true, token), WithStore(&blockchain.MemoryStore{}), WithDiscoveryInterval(10*time.Second), WithLedgerInterval(time.Second), l)
+			e.Start(ctx)
+			e2.Start(ctx)
+			l1, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			l2, err := e2.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+
+			id, id2 := e.Host().ID().String(), e2.Host().ID().String()
+			l2.Add(protocol.MachinesLedgerKey, map[string]interface{}{
+				"10.1.0.1": types.Machine{PeerID: id, Address: "10.1.0.1"},
+				"10.1.0.2": types.Machine{PeerID: id2, Address: "10.1.0.2"},
+			})
+			l2.Add(protocol.TrustZoneKey, map[string]interface{}{id: "", id2: ""})
+
+			Eventually(func() bool {
+				_, exists := l1.GetKey(protocol.TrustZoneKey, id)
+				return exists
+			}, 240*time.Second, 1*time.Second).Should(BeTrue())
+			_, exists := l1.GetKey(protocol.MachinesLedgerKey, "10.1.0.2")
+			Expect(exists).To(BeTrue())
+			_, exists = l1.GetKey(protocol.MachinesLedgerKey, "10.1.0.1")
+			Expect(exists).To(BeFalse())
+			_, exists = l1.GetKey(protocol.TrustZoneKey, id2)
+			Expect(exists).To(BeFalse())
+
+			// The keys of the others can not be overwritten, and only the
+			// peers of the trust zone add the others to it and write the ACL
+			l1.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.3": types.Machine{PeerID: id, Address: "10.1.0.3"}})
+			Eventually(func() bool {
+				_, exists := l2.GetKey(protocol.MachinesLedgerKey, "10.1.0.3")
+				return exists
+			}, 240*time.Second, 1*time.Second).Should(BeTrue())
+			l2.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.3": types.Machine{PeerID: id2, Address: "10.1.0.3"}})
+			l2.Add(protocol.TrustZoneKey, map[string]interface{}{"foo": ""})
+			l2.Add(protocol.ACLLedgerKey, map[string]interface{}{"deny": types.ACLRule{ID: "deny", Action: types.ACLDeny}})
+			l2.Add(protocol.MachinesLedgerKey, map[string]interface{}{"10.1.0.4": types.Machine{PeerID: id2, Address: "10.1.0.4"}})
+
+			Eventually(func() bool {
+				_, exists := l1.GetKey(protocol.MachinesLedgerKey, "10.1.0.4")
+				return exists
+			}, 240*time.Second, 1*time.Second).Should(BeTrue())
+			m := types.Machine{}
+			v, _ := l1.GetKey(protocol.MachinesLedgerKey, "10.1.0.3")
+			Expect(v.Unmarshal(&m)).To(Succeed())
+			Expect(m.PeerID).To(Equal(id))
+			_, exists = l1.GetKey(protocol.TrustZoneKey, "foo")
+			Expect(exists).To(BeFalse())
+			_, exists = l1.GetKey(protocol.ACLLedgerKey, "deny")
+			Expect(exists).To(BeFalse())
+
+			l1.Add(protocol.TrustZoneKey, map[string]interface{}{id2: ""})
+			Eventually(func() string {
+				return l2.Provenance(protocol.TrustZoneKey)[id2].Writer
+			}, 240*time.Second, 1*time.Second).Should(Equal(id))
+			l2.Add(protocol.ACLLedgerKey, map[string]interface{}{"deny": types.ACLRule{ID: "deny", Action: types.ACLDeny}})
+			Eventually(func() bool {
+				_, exists := l1.GetKey(protocol.ACLLedgerKey, "deny")
+				return exists
+			}, 240*time.Second, 1*time.Second).Should(BeTrue())
+		})
+	})
+
 	Context("connection gater", func() {
 		It("blacklists", func() {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -204,6 +204,15 @@ func WithPeerGater(d Gater) Option {
 	}
 }
 
+// AcceptUnsignedLedger accepts the writes to the ledger without signature, i.e. of
+// the peers running an older version, while upgrading a network
+func AcceptUnsignedLedger(b bool) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.AcceptUnsignedLedger = b
+		return nil
+	}
+}
+
 func WithLedgerAnnounceTime(t time.Duration) func(cfg *Config) error {
 	return func(cfg *Config) error {
 		cfg.LedgerAnnounceTime = t
@@ -250,6 +259,9 @@ type YAMLConnectionConfig struct {
 	Rendezvous     string `yaml:"rendezvous"`
 	MDNS           string `yaml:"mdns"`
 	MaxMessageSize int    `yaml:"max_message_size"`
+
+	// Transport carries the VPN packets between the peers of the network
+	Transport string `yaml:"transport,omitempty"`
 }
 
 // Base64 returns the base64 string representation of the connection
@@ -286,6 +298,7 @@ func (y YAMLConnectionConfig) copy(mdns, dht bool, cfg *Config, opts ...dht.Opti
 	}
 	cfg.SealKeyLength = y.OTP.Crypto.Length
 	cfg.MaxMessageSize = y.MaxMessageSize
+	cfg.Transport = y.Transport
 }
 
 const defaultKeyLength = 32
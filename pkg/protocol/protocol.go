@@ -25,22 +25,33 @@ import (
 )
 
 const (
-	BhojpurVPN      Protocol = "/vpn/0.1"
-	ServiceProtocol Protocol = "/vpn/service/0.1"
-	FileProtocol    Protocol = "/vpn/file/0.1"
-	EgressProtocol  Protocol = "/vpn/egress/0.1"
+	BhojpurVPN       Protocol = "/vpn/0.1"
+	BhojpurVPNFramed Protocol = "/vpn/0.2"
+	// Framed protocols compressing the frames with a codec
+	BhojpurVPNZstd   Protocol = "/vpn/0.2/zstd"
+	BhojpurVPNSnappy Protocol = "/vpn/0.2/snappy"
+	// Handshake of the datagrams side channel
+	BhojpurVPNDatagram Protocol = "/vpn/0.2/datagram"
+	ServiceProtocol    Protocol = "/vpn/service/0.1"
+	FileProtocol       Protocol = "/vpn/file/0.1"
+	EgressProtocol     Protocol = "/vpn/egress/0.1"
+	// Pull of the ledger writes missed by a peer
+	LedgerProtocol Protocol = "/vpn/ledger/0.1"
 )
 
 const (
-	FilesLedgerKey    = "files"
-	MachinesLedgerKey = "machines"
-	ServicesLedgerKey = "services"
-	UsersLedgerKey    = "users"
-	HealthCheckKey    = "healthcheck"
-	DNSKey            = "dns"
-	EgressService     = "egress"
-	TrustZoneKey      = "trustzone"
-	TrustZoneAuthKey  = "trustzoneAuth"
+	ACLLedgerKey          = "acl"
+	FilesLedgerKey        = "files"
+	MachinesLedgerKey     = "machines"
+	ReachabilityLedgerKey = "reachability"
+	RoutesLedgerKey       = "routes"
+	ServicesLedgerKey     = "services"
+	UsersLedgerKey        = "users"
+	HealthCheckKey        = "healthcheck"
+	DNSKey                = "dns"
+	EgressService         = "egress"
+	TrustZoneKey          = "trustzone"
+	TrustZoneAuthKey      = "trustzoneAuth"
 )
 
 type Protocol string
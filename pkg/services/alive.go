@@ -27,46 +27,35 @@ import (
 	"github.com/bhojpur/vpn/pkg/blockchain"
 	"github.com/bhojpur/vpn/pkg/node"
 	"github.com/bhojpur/vpn/pkg/protocol"
-	"github.com/bhojpur/vpn/pkg/utils"
 )
 
+// AliveNetworkService writes the healthcheck of the node every announcetime. The
+// healthchecks expire after scrubTime, or maxtime if shorter as the node is then
+// offline, once the node stops renewing them
 func AliveNetworkService(announcetime, scrubTime, maxtime time.Duration) node.NetworkService {
+	ttl := scrubTime
+	if maxtime > 0 && maxtime < ttl {
+		ttl = maxtime
+	}
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
-		t := time.Now()
 		// By announcing periodically our service to the blockchain
 		b.Announce(
 			ctx,
 			announcetime,
 			func() {
 				// Keep-alive
-				b.Add(protocol.HealthCheckKey, map[string]interface{}{
+				b.AddTTL(protocol.HealthCheckKey, map[string]interface{}{
 					n.Host().ID().String(): time.Now().UTC().Format(time.RFC3339),
-				})
-
-				// Keep-alive scrub
-				nodes := AvailableNodes(b, maxtime)
-				if len(nodes) == 0 {
-					return
-				}
-				lead := utils.Leader(nodes)
-				if !t.Add(scrubTime).After(time.Now()) {
-					// Update timer so not-leader do not attempt to delete bucket afterwards
-					// prevent cycles
-					t = time.Now()
-
-					if lead == n.Host().ID().String() {
-						// Automatically scrub after some time passed
-						b.DeleteBucket(protocol.HealthCheckKey)
-					}
-				}
+				}, ttl)
 			},
 		)
 		return nil
 	}
 }
 
-// Alive announce the node every announce time, with a periodic scrub time for healthchecks
-// the maxtime is the time used to determine when a node is unreachable (after maxtime, its unreachable)
+// Alive announce the node every announce time, its healthchecks expiring after the scrub time.
+// The maxtime is the time used to determine when a node is unreachable (after maxtime, its unreachable),
+// its healthcheck expires then if the scrub time is longer
 func Alive(announcetime, scrubTime, maxtime time.Duration) []node.Option {
 	return []node.Option{
 		node.WithNetworkService(AliveNetworkService(announcetime, scrubTime, maxtime)),
@@ -31,6 +31,7 @@ import (
 	"github.com/bhojpur/vpn/pkg/blockchain"
 	"github.com/bhojpur/vpn/pkg/logger"
 	node "github.com/bhojpur/vpn/pkg/node"
+	"github.com/bhojpur/vpn/pkg/protocol"
 	. "github.com/bhojpur/vpn/pkg/services"
 )
 
@@ -76,7 +77,7 @@ var _ = Describe("Alive service", func() {
 		})
 	})
 
-	Context("Aliveness Scrub", func() {
+	Context("Healthcheck expiry", func() {
 		BeforeEach(func() {
 			opts = append(
 				Alive(10*time.Second, 30*time.Second, 15*time.Minute),
@@ -85,15 +86,17 @@ var _ = Describe("Alive service", func() {
 				l)
 		})
 
-		It("cleans up after a while", func() {
+		It("drops the nodes which stop renewing their healthcheck", func() {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
+			ctx2, cancel2 := context.WithCancel(context.Background())
+			defer cancel2()
 			e2, _ := node.New(append(opts, node.WithStore(&blockchain.MemoryStore{}))...)
 			e1, _ := node.New(append(opts, node.WithStore(&blockchain.MemoryStore{}))...)
 
 			e1.Start(ctx)
 			time.Sleep(5 * time.Second)
-			e2.Start(ctx)
+			e2.Start(ctx2)
 
 			ll, _ := e1.Ledger()
 
@@ -102,38 +105,38 @@ var _ = Describe("Alive service", func() {
 			matches := And(ContainElement(e2.Host().ID().String()),
 				ContainElement(e1.Host().ID().String()))
 
-			index := ll.LastBlock().Index
 			Eventually(func() []string {
-				ll, err := e1.Ledger()
-				if err != nil {
-					return []string{}
-				}
 				return AvailableNodes(ll, 15*time.Minute)
 			}, 120*time.Second, 1*time.Second).Should(matches)
 
-			Expect(ll.LastBlock().Index).ToNot(Equal(index))
-			index = ll.LastBlock().Index
+			ttl, exists := ll.TTL(protocol.HealthCheckKey, e2.Host().ID().String())
+			Expect(exists).To(BeTrue())
+			Expect(ttl).To(BeNumerically(">", 0))
 
+			// The healthchecks of the nodes alive are renewed, the others expire
+			cancel2()
 			Eventually(func() []string {
-				ll, err := e1.Ledger()
-				if err != nil {
-					return []string{}
-				}
 				return AvailableNodes(ll, 15*time.Minute)
-			}, 360*time.Second, 1*time.Second).Should(BeEmpty())
-
-			Expect(ll.LastBlock().Index).ToNot(Equal(index))
-			index = ll.LastBlock().Index
-
-			Eventually(func() []string {
-				ll, err := e1.Ledger()
-				if err != nil {
-					return []string{}
-				}
+			}, 120*time.Second, 1*time.Second).Should(Equal([]string{e1.Host().ID().String()}))
+			Consistently(func() []string {
 				return AvailableNodes(ll, 15*time.Minute)
-			}, 60*time.Second, 1*time.Second).Should(matches)
-			Expect(ll.LastBlock().Index).ToNot(Equal(index))
+			}, 40*time.Second, 1*time.Second).Should(Equal([]string{e1.Host().ID().String()}))
+		})
 
+		It("expires the healthchecks once the nodes are offline", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			e, _ := node.New(append(Alive(time.Second, 30*time.Second, 5*time.Second),
+				node.FromBase64(true, true, token), node.WithStore(&blockchain.MemoryStore{}), l)...)
+			e.Start(ctx)
+			ll, _ := e.Ledger()
+
+			Eventually(func() bool {
+				_, exists := ll.TTL(protocol.HealthCheckKey, e.Host().ID().String())
+				return exists
+			}, 10*time.Second, 100*time.Millisecond).Should(BeTrue())
+			ttl, _ := ll.TTL(protocol.HealthCheckKey, e.Host().ID().String())
+			Expect(ttl).To(BeNumerically("<=", 5*time.Second))
 		})
 	})
 })
@@ -105,21 +105,22 @@ func ProxyService(announceTime time.Duration, listenAddr string, deadtime time.D
 			deadTime:   deadtime,
 		}
 
-		// Announce ourselves so nodes accepts our connection
+		// Announce ourselves so nodes accepts our connection, until we stop
+		ttl := AdvertisementTTL(announceTime)
 		b.Announce(
 			ctx,
 			announceTime,
 			func() {
 				// Retrieve current ID for ip in the blockchain
-				_, found := b.GetKey(protocol.UsersLedgerKey, n.Host().ID().String())
-				// If mismatch, update the blockchain
-				if !found {
+				left, found := b.TTL(protocol.UsersLedgerKey, n.Host().ID().String())
+				// If missing or about to expire, update the blockchain
+				if !found || left < ttl/2 {
 					updatedMap := map[string]interface{}{}
 					updatedMap[n.Host().ID().String()] = &types.User{
 						PeerID:    n.Host().ID().String(),
 						Timestamp: time.Now().String(),
 					}
-					b.Add(protocol.UsersLedgerKey, updatedMap)
+					b.AddTTL(protocol.UsersLedgerKey, updatedMap, ttl)
 				}
 			},
 		)
@@ -103,22 +103,23 @@ func ShareFile(ll log.StandardLogger, announcetime time.Duration, fileID, filepa
 }
 
 func ReceiveFile(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, l log.StandardLogger, announcetime time.Duration, fileID string, path string) error {
-	// Announce ourselves so nodes accepts our connection
+	// Announce ourselves so nodes accepts our connection, until we stop
+	ttl := AdvertisementTTL(announcetime)
 	ledger.Announce(
 		ctx,
 		announcetime,
 		func() {
 			// Retrieve current ID for ip in the blockchain
-			_, found := ledger.GetKey(protocol.UsersLedgerKey, n.Host().ID().String())
+			left, found := ledger.TTL(protocol.UsersLedgerKey, n.Host().ID().String())
 
-			// If mismatch, update the blockchain
-			if !found {
+			// If missing or about to expire, update the blockchain
+			if !found || left < ttl/2 {
 				updatedMap := map[string]interface{}{}
 				updatedMap[n.Host().ID().String()] = &types.User{
 					PeerID:    n.Host().ID().String(),
 					Timestamp: time.Now().String(),
 				}
-				ledger.Add(protocol.UsersLedgerKey, updatedMap)
+				ledger.AddTTL(protocol.UsersLedgerKey, updatedMap, ttl)
 			}
 		},
 	)
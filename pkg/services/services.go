@@ -37,24 +37,73 @@ import (
 	"github.com/bhojpur/vpn/pkg/types"
 )
 
+// advertisementIntervals is the number of announce intervals after which the advertisements
+// of a node (its services and users) expire in the ledger, once it stops renewing them
+const advertisementIntervals = 10
+
+// AdvertisementTTL returns the time after which the advertisements of a node announced
+// every announcetime expire, once it stops renewing them. They are renewed when half of
+// it is left
+func AdvertisementTTL(announcetime time.Duration) time.Duration {
+	return advertisementIntervals * announcetime
+}
+
+// ExposeNetworkService writes the service to the ledger, and writes it again when
+// it is deleted or taken by another peer, or to renew it before it expires.
+// The writes are at most one every announcetime
 func ExposeNetworkService(announcetime time.Duration, serviceID string) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
-		b.Announce(
-			ctx,
-			announcetime,
-			func() {
+		ttl := AdvertisementTTL(announcetime)
+		events := b.Watch(ctx, protocol.ServicesLedgerKey, serviceID)
+		go func() {
+			var last time.Time
+			var retry <-chan time.Time
+			renew := time.NewTicker(announcetime)
+			defer renew.Stop()
+			expose := func() {
 				// Retrieve current ID for ip in the blockchain
 				existingValue, found := b.GetKey(protocol.ServicesLedgerKey, serviceID)
 				service := &types.Service{}
 				existingValue.Unmarshal(service)
-				// If mismatch, update the blockchain
-				if !found || service.PeerID != n.Host().ID().String() {
-					updatedMap := map[string]interface{}{}
-					updatedMap[serviceID] = types.Service{PeerID: n.Host().ID().String(), Name: serviceID}
-					b.Add(protocol.ServicesLedgerKey, updatedMap)
+				left, _ := b.TTL(protocol.ServicesLedgerKey, serviceID)
+				if found && service.PeerID == n.Host().ID().String() && left > ttl/2 {
+					return
 				}
-			},
-		)
+				// If mismatch, update the blockchain unless it was just done
+				if wait := time.Until(last.Add(announcetime)); wait > 0 {
+					if retry == nil {
+						retry = time.After(wait)
+					}
+					return
+				}
+				last = time.Now()
+				updatedMap := map[string]interface{}{}
+				updatedMap[serviceID] = types.Service{PeerID: n.Host().ID().String(), Name: serviceID}
+				b.AddTTL(protocol.ServicesLedgerKey, updatedMap, ttl)
+			}
+
+			expose()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case _, ok := <-events:
+					if !ok {
+						// Closed once the node stops, or on overflow
+						if ctx.Err() != nil {
+							return
+						}
+						events = b.Watch(ctx, protocol.ServicesLedgerKey, serviceID)
+					}
+					expose()
+				case <-retry:
+					retry = nil
+					expose()
+				case <-renew.C:
+					expose()
+				}
+			}
+		}()
 		return nil
 	}
 }
@@ -109,21 +158,22 @@ func ConnectNetworkService(announcetime time.Duration, serviceID string, srcaddr
 		}
 		//	ll.Info("Binding local port on", srcaddr)
 
-		// Announce ourselves so nodes accepts our connection
+		// Announce ourselves so nodes accepts our connection, until we stop
+		ttl := AdvertisementTTL(announcetime)
 		ledger.Announce(
 			ctx,
 			announcetime,
 			func() {
 				// Retrieve current ID for ip in the blockchain
-				_, found := ledger.GetKey(protocol.UsersLedgerKey, node.Host().ID().String())
-				// If mismatch, update the blockchain
-				if !found {
+				left, found := ledger.TTL(protocol.UsersLedgerKey, node.Host().ID().String())
+				// If missing or about to expire, update the blockchain
+				if !found || left < ttl/2 {
 					updatedMap := map[string]interface{}{}
 					updatedMap[node.Host().ID().String()] = &types.User{
 						PeerID:    node.Host().ID().String(),
 						Timestamp: time.Now().String(),
 					}
-					ledger.Add(protocol.UsersLedgerKey, updatedMap)
+					ledger.AddTTL(protocol.UsersLedgerKey, updatedMap, ttl)
 				}
 			},
 		)
@@ -87,22 +87,42 @@ func (pg *PeerGater) Gate(n *node.Node, p peer.ID) bool {
 }
 
 // UpdaterService is a service responsible to sync back trustDB from the ledger state.
-// It is a network service which retrieves the senders ID listed in the Trusted Zone
-// and fills it in the trustDB used to gate blockchain messages
+// It is a network service which watches the senders ID listed in the Trusted Zone
+// and fills it in the trustDB used to gate blockchain messages.
+// The trustDB follows the changes of the ledger, duration is not used anymore
 func (pg *PeerGater) UpdaterService(duration time.Duration) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
-		b.Announce(ctx, duration, func() {
-			db := []peer.ID{}
-			tz, found := b.CurrentData()[protocol.TrustZoneKey]
-			if found {
-				for k, _ := range tz {
+		events := b.Watch(ctx, protocol.TrustZoneKey)
+		go func() {
+			tz := map[string]bool{}
+			for {
+				e, ok := <-events
+				if !ok {
+					return
+				}
+				switch e.Type {
+				case blockchain.EventPut:
+					tz[e.Key] = true
+				case blockchain.EventDelete:
+					delete(tz, e.Key)
+				case blockchain.EventOverflow:
+					// Watch again, the changes after the copy are sent too
+					events = b.Watch(ctx, protocol.TrustZoneKey)
+					tz = map[string]bool{}
+					for k := range b.CurrentData()[protocol.TrustZoneKey] {
+						tz[k] = true
+					}
+				}
+
+				db := []peer.ID{}
+				for k := range tz {
 					db = append(db, peer.ID(k))
 				}
+				pg.Lock()
+				pg.trustDB = db
+				pg.Unlock()
 			}
-			pg.Lock()
-			pg.trustDB = db
-			pg.Unlock()
-		})
+		}()
 
 		return nil
 	}
@@ -26,5 +26,8 @@ type Machine struct {
 	OS       string
 	Arch     string
 	Address  string
+	Address6 string
 	Version  string
+	MTU      int    `json:",omitempty"`
+	MAC      string `json:",omitempty"`
 }
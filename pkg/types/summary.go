@@ -23,4 +23,10 @@ package types
 type Summary struct {
 	Files, Machines, Users, Services, BlockChain, OnChainNodes, Peers int
 	NodeID                                                            string
+	VPN                                                               VPNSummary
+}
+
+// VPNSummary sums up the traffic handled by the VPN engine
+type VPNSummary struct {
+	PacketsIn, PacketsOut, BytesIn, BytesOut, Dropped uint64
 }
@@ -21,6 +21,7 @@ package utils
 // THE SOFTWARE.
 
 import (
+	"crypto/sha256"
 	"net"
 	"sort"
 
@@ -44,3 +45,20 @@ func NextIP(defaultIP string, ips []string) string {
 
 	return iplib.NextIP(last).String()
 }
+
+// ULA returns an IPv6 Unique Local Address (RFC 4193) in CIDR notation.
+// The 40-bit global ID is derived from the network seed, so all the nodes
+// of a network share the same /64, while the interface ID embeds the IPv4
+// address of the node, which is already unique within the network.
+func ULA(seed string, ip net.IP) string {
+	sum := sha256.Sum256([]byte(seed))
+
+	ula := make(net.IP, net.IPv6len)
+	ula[0] = 0xfd
+	copy(ula[1:6], sum[:5])
+	if v4 := ip.To4(); v4 != nil {
+		copy(ula[12:], v4)
+	}
+
+	return (&net.IPNet{IP: ula, Mask: net.CIDRMask(64, 128)}).String()
+}
@@ -21,6 +21,8 @@ package utils_test
 // THE SOFTWARE.
 
 import (
+	"net"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
@@ -36,4 +38,22 @@ var _ = Describe("IP", func() {
 			Expect(NextIP("10.1.1.0", []string{})).To(Equal("10.1.1.0"))
 		})
 	})
+
+	Context("ULA", func() {
+		It("embeds the IPv4 address in a fd00::/8 prefix", func() {
+			ip, ipnet, err := net.ParseCIDR(ULA("seed", net.ParseIP("10.1.0.11")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip[0]).To(Equal(byte(0xfd)))
+			Expect(ip[12:].String()).To(Equal(net.ParseIP("10.1.0.11").To4().String()))
+			ones, _ := ipnet.Mask.Size()
+			Expect(ones).To(Equal(64))
+		})
+		It("shares the prefix within the same network", func() {
+			_, a, _ := net.ParseCIDR(ULA("seed", net.ParseIP("10.1.0.11")))
+			_, b, _ := net.ParseCIDR(ULA("seed", net.ParseIP("10.1.0.12")))
+			_, c, _ := net.ParseCIDR(ULA("other", net.ParseIP("10.1.0.12")))
+			Expect(a.String()).To(Equal(b.String()))
+			Expect(a.String()).ToNot(Equal(c.String()))
+		})
+	})
 })